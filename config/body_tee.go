@@ -0,0 +1,34 @@
+package config
+
+import (
+	"os"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// BodyTee captures the raw bodies of a sample of the requests for the replay, while they are parsed as usual. The
+// bodies may carry the personal data, it's meant for debugging only and is disabled unless configured.
+type BodyTee struct {
+	// SampleRate is the fraction of the requests with a body that are captured, from 0 (exclusive) to 1 (all).
+	SampleRate float64 `mapstructure:"sample_rate"`
+	// Dir is the directory the built-in sink writes the bodies to, one file per request. The file name is logged at
+	// the info level with the request ID. Defaults to the system temp dir.
+	Dir string `mapstructure:"dir"`
+	// Paths are the path prefixes of the requests to capture, empty means all paths.
+	Paths []string `mapstructure:"paths"`
+}
+
+// InitDefaults validates the sample rate and sets missing values to their default values.
+func (cfg *BodyTee) InitDefaults() error {
+	const op = errors.Op("body_tee_init_defaults")
+
+	if cfg.SampleRate <= 0 || cfg.SampleRate > 1 {
+		return errors.E(op, errors.Errorf("body_tee sample_rate should be greater than 0 and at most 1, got %v", cfg.SampleRate))
+	}
+
+	if cfg.Dir == "" {
+		cfg.Dir = os.TempDir()
+	}
+
+	return nil
+}
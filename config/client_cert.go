@@ -0,0 +1,55 @@
+package config
+
+import (
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	// DefaultClientCertSubject is the default variable of the client certificate subject DN, the Apache mod_ssl name.
+	DefaultClientCertSubject string = "SSL_CLIENT_S_DN"
+	// DefaultClientCertIssuer is the default variable of the client certificate issuer DN.
+	DefaultClientCertIssuer string = "SSL_CLIENT_I_DN"
+	// DefaultClientCertSerial is the default variable of the client certificate serial number.
+	DefaultClientCertSerial string = "SSL_CLIENT_M_SERIAL"
+	// DefaultClientCertFingerprint is the default variable of the client certificate SHA-256 fingerprint.
+	DefaultClientCertFingerprint string = "SSL_CLIENT_FINGERPRINT"
+)
+
+// ClientCert configures the variables the details of the verified client certificate (mTLS) are passed to the worker
+// in. The requests without a verified client certificate have none of them.
+type ClientCert struct {
+	// Subject is the variable of the subject DN (CN=client,O=Example). Default is SSL_CLIENT_S_DN.
+	Subject string `mapstructure:"subject"`
+	// Issuer is the variable of the issuer DN. Default is SSL_CLIENT_I_DN.
+	Issuer string `mapstructure:"issuer"`
+	// Serial is the variable of the serial number in uppercase hex. Default is SSL_CLIENT_M_SERIAL.
+	Serial string `mapstructure:"serial"`
+	// Fingerprint is the variable of the SHA-256 fingerprint of the DER certificate in lowercase hex. Default is
+	// SSL_CLIENT_FINGERPRINT.
+	Fingerprint string `mapstructure:"fingerprint"`
+}
+
+// InitDefaults sets missing values to their default values.
+func (cfg *ClientCert) InitDefaults() error {
+	const op = errors.Op("client_cert_init_defaults")
+
+	if cfg.Subject == "" {
+		cfg.Subject = DefaultClientCertSubject
+	}
+	if cfg.Issuer == "" {
+		cfg.Issuer = DefaultClientCertIssuer
+	}
+	if cfg.Serial == "" {
+		cfg.Serial = DefaultClientCertSerial
+	}
+	if cfg.Fingerprint == "" {
+		cfg.Fingerprint = DefaultClientCertFingerprint
+	}
+
+	names := map[string]struct{}{cfg.Subject: {}, cfg.Issuer: {}, cfg.Serial: {}, cfg.Fingerprint: {}}
+	if len(names) != 4 {
+		return errors.E(op, errors.Str("client_cert variables should have distinct names"))
+	}
+
+	return nil
+}
@@ -25,6 +25,10 @@ type Config struct {
 	Pool *pool.Config `mapstructure:"pool"`
 	// InternalErrorCode used to override default 500 (InternalServerError) http code
 	InternalErrorCode uint64 `mapstructure:"internal_error_code"`
+	// ParseErrorStatus responds to the requests rejected while their bodies are read or parsed with the status of the
+	// error kind (400, 403, 408, 413, 415, 431, 503) documented by the limits and the checks. By default the plain
+	// text error is sent with 500, the ErrorRenderer set by the native middleware chooses the status on its own.
+	ParseErrorStatus bool `mapstructure:"parse_error_status"`
 	// MaxRequestSize specified max size for payload body in megabytes. 0 = 1GB.
 	MaxRequestSize uint64 `mapstructure:"max_request_size"`
 	// SSLConfig defines https server options.
@@ -36,6 +40,30 @@ type Config struct {
 	HTTP3Config *http3.Config `mapstructure:"http3"`
 	// Uploads configures uploads configuration.
 	Uploads *Uploads `mapstructure:"uploads"`
+	// Parse configures request body parsing.
+	Parse *Parse `mapstructure:"parse"`
+	// RequestID configures the correlation ID of the requests, nil means disabled.
+	RequestID *RequestID `mapstructure:"request_id"`
+	// ClientCert passes the details of the verified client certificate to the worker, nil means disabled.
+	ClientCert *ClientCert `mapstructure:"client_cert"`
+	// CookieCodec verifies and decodes the signed cookies before the worker gets them, nil means disabled.
+	CookieCodec *CookieCodec `mapstructure:"cookie_codec"`
+	// CanonicalPath collapses the duplicate slashes and resolves the dot segments of the request path before the
+	// request is handled, the original path is passed to the worker in the Raw-Path attribute.
+	CanonicalPath bool `mapstructure:"canonical_path"`
+	// AllowLengthConflict accepts the requests with both Content-Length and Transfer-Encoding, which are rejected
+	// with 400 by default: the framing the proxy and the server may disagree on is the request smuggling signal.
+	AllowLengthConflict bool `mapstructure:"allow_length_conflict"`
+	// Forwarded derives the client address, scheme and host from the Forwarded or X-Forwarded-* headers set by the
+	// trusted proxies, nil means the headers are passed to the worker as they are.
+	Forwarded *Forwarded `mapstructure:"forwarded"`
+	// HeaderVars pass the request headers injected by the CDN or the proxy to the worker as the server variables.
+	HeaderVars []*HeaderVar `mapstructure:"header_vars"`
+	// ParseRange passes the byte ranges of the Range header of the GET requests to the worker in the Range attribute,
+	// the malformed header is flagged with the Range-Error attribute for the worker to answer with 416.
+	ParseRange bool `mapstructure:"parse_range"`
+	// BodyTee captures the raw bodies of a sample of the requests to the debug sink, nil means disabled.
+	BodyTee *BodyTee `mapstructure:"body_tee"`
 
 	// private
 	UID int
@@ -110,6 +138,64 @@ func (c *Config) InitDefaults() error {
 		return err
 	}
 
+	if c.Parse == nil {
+		c.Parse = &Parse{}
+	}
+
+	err = c.Parse.InitDefaults()
+	if err != nil {
+		return err
+	}
+
+	if c.RequestID != nil {
+		err = c.RequestID.InitDefaults()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.ClientCert != nil {
+		err = c.ClientCert.InitDefaults()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.CookieCodec != nil {
+		err = c.CookieCodec.InitDefaults()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Forwarded != nil {
+		err = c.Forwarded.InitDefaults()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.BodyTee != nil {
+		err = c.BodyTee.InitDefaults()
+		if err != nil {
+			return err
+		}
+	}
+
+	vars := make(map[string]struct{}, len(c.HeaderVars))
+	for _, hv := range c.HeaderVars {
+		err = hv.InitDefaults()
+		if err != nil {
+			return err
+		}
+
+		if _, ok := vars[hv.Var]; ok {
+			return errors.E(errors.Op("header_vars_init_defaults"), errors.Errorf("header_vars variable %s is mapped twice", hv.Var))
+		}
+
+		vars[hv.Var] = struct{}{}
+	}
+
 	return c.Valid()
 }
 
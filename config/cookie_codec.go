@@ -0,0 +1,33 @@
+package config
+
+import (
+	"github.com/roadrunner-server/errors"
+)
+
+// CookieCodec configures the signed or encrypted cookies verified and decoded before the worker gets them. The other
+// cookies are passed as they are.
+type CookieCodec struct {
+	// Cookies are the names of the decoded cookies.
+	Cookies []string `mapstructure:"cookies"`
+	// Key is the HMAC-SHA256 key of the built-in signed cookie codec, the cookie value is the payload followed by a dot
+	// and the unpadded base64url signature of name=payload. Empty means the codec is set with
+	// handler.Handler.SetCookieCodec, the cookies are rejected until it is.
+	Key string `mapstructure:"key"`
+}
+
+// InitDefaults validates the cookie names.
+func (cfg *CookieCodec) InitDefaults() error {
+	const op = errors.Op("cookie_codec_init_defaults")
+
+	if len(cfg.Cookies) == 0 {
+		return errors.E(op, errors.Str("cookie_codec should list at least one cookie"))
+	}
+
+	for _, name := range cfg.Cookies {
+		if name == "" {
+			return errors.E(op, errors.Str("cookie_codec cookie name should not be empty"))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	// ForwardedPrecedenceForwarded uses the Forwarded header (RFC 7239), the X-Forwarded-For, X-Forwarded-Proto and
+	// X-Forwarded-Host headers when it's missing.
+	ForwardedPrecedenceForwarded string = "forwarded"
+	// ForwardedPrecedenceXForwarded uses the X-Forwarded-* headers, the Forwarded header when X-Forwarded-For is
+	// missing. The malformed header of the precedence is never replaced by the other one.
+	ForwardedPrecedenceXForwarded string = "x-forwarded"
+)
+
+// Forwarded configures the client address, scheme and host derived from the forwarding headers set by the trusted
+// proxies. The headers of the requests from the other peers are ignored.
+type Forwarded struct {
+	// TrustedProxies are the addresses or the CIDR ranges of the proxies whose forwarding headers are trusted.
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	// Precedence is the header used when the request has both: forwarded (default) or x-forwarded.
+	Precedence string `mapstructure:"precedence"`
+
+	// internal
+	Prefixes []netip.Prefix `mapstructure:"-"`
+}
+
+// InitDefaults parses the trusted proxies and sets missing values to their default values.
+func (cfg *Forwarded) InitDefaults() error {
+	const op = errors.Op("forwarded_init_defaults")
+
+	if len(cfg.TrustedProxies) == 0 {
+		return errors.E(op, errors.Str("forwarded should list at least one trusted proxy"))
+	}
+
+	cfg.Prefixes = make([]netip.Prefix, 0, len(cfg.TrustedProxies))
+	for _, p := range cfg.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return errors.E(op, errors.Errorf("invalid forwarded trusted proxy %s: %v", p, err))
+			}
+
+			cfg.Prefixes = append(cfg.Prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return errors.E(op, errors.Errorf("invalid forwarded trusted proxy %s: %v", p, err))
+		}
+
+		cfg.Prefixes = append(cfg.Prefixes, prefix.Masked())
+	}
+
+	switch cfg.Precedence {
+	case "":
+		cfg.Precedence = ForwardedPrecedenceForwarded
+	case ForwardedPrecedenceForwarded, ForwardedPrecedenceXForwarded:
+	default:
+		return errors.E(op, errors.Errorf("unknown forwarded precedence option: %s", cfg.Precedence))
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// HeaderVar passes the value of the request header to the worker as the server variable, to surface the metadata
+// the CDN or the proxy injects (CF-IPCountry as GEOIP_COUNTRY_CODE). The header is passed as the client sent it when
+// nothing in front of the server overwrites it, only the headers set by the trusted proxy should be mapped.
+type HeaderVar struct {
+	// Header is the request header name, case-insensitive.
+	Header string `mapstructure:"header"`
+	// Var is the server variable the header values are passed in.
+	Var string `mapstructure:"var"`
+	// Override allows the variable to replace the standard one: the CGI variables (REMOTE_ADDR, HTTPS, the HTTP_*
+	// header variables) and the variables the server sets itself, the client_cert ones for example. Without it the
+	// standard variables are kept.
+	Override bool `mapstructure:"override"`
+}
+
+// InitDefaults validates the mapping.
+func (cfg *HeaderVar) InitDefaults() error {
+	const op = errors.Op("header_var_init_defaults")
+
+	if cfg.Header == "" || cfg.Var == "" {
+		return errors.E(op, errors.Str("header_vars require the header and the var names"))
+	}
+
+	if !cfg.Override && IsStandardVar(cfg.Var) {
+		return errors.E(op, errors.Errorf("header_vars variable %s is a standard variable, set override to replace it", cfg.Var))
+	}
+
+	return nil
+}
+
+// IsStandardVar reports whether the server variable is one of the CGI variables (RFC 3875) the worker builds
+// $_SERVER with, the request headers (HTTP_*) included, or the TLS variables.
+func IsStandardVar(name string) bool {
+	name = strings.ToUpper(name)
+	if strings.HasPrefix(name, "HTTP_") || strings.HasPrefix(name, "SSL_") {
+		return true
+	}
+
+	switch name {
+	case "AUTH_TYPE", "CONTENT_LENGTH", "CONTENT_TYPE", "DOCUMENT_ROOT", "GATEWAY_INTERFACE", "HTTPS", "PATH_INFO",
+		"PATH_TRANSLATED", "PHP_AUTH_PW", "PHP_AUTH_USER", "QUERY_STRING", "REMOTE_ADDR", "REMOTE_HOST", "REMOTE_PORT",
+		"REMOTE_USER", "REQUEST_METHOD", "REQUEST_SCHEME", "REQUEST_TIME", "REQUEST_TIME_FLOAT", "REQUEST_URI",
+		"SCRIPT_FILENAME", "SCRIPT_NAME", "SERVER_ADDR", "SERVER_NAME", "SERVER_PORT", "SERVER_PROTOCOL",
+		"SERVER_SOFTWARE":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,813 @@
+package config
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	// ParserURLEncoded parses the body as application/x-www-form-urlencoded form.
+	ParserURLEncoded string = "urlencoded"
+	// ParserMultipart parses the body as multipart/form-data form.
+	ParserMultipart string = "multipart"
+	// ParserJSON parses the body as a JSON document.
+	ParserJSON string = "json"
+	// ParserRaw sends the body to the worker as is.
+	ParserRaw string = "raw"
+	// ParserNDJSON parses the body as newline-delimited JSON, one record per line.
+	ParserNDJSON string = "ndjson"
+	// ParserRelated parses the body as multipart/related: the root part is sent as the body, the parts it
+	// references as the uploads keyed by their Content-ID.
+	ParserRelated string = "related"
+	// ParserCBOR parses the body as a CBOR document (RFC 8949), the same way the JSON documents are.
+	ParserCBOR string = "cbor"
+)
+
+const (
+	// BodyEncodingJSON encodes the parsed body and the uploads sent to the worker as JSON.
+	BodyEncodingJSON string = "json"
+	// BodyEncodingProtobuf encodes the parsed body and the uploads sent to the worker as google.protobuf.Struct.
+	BodyEncodingProtobuf string = "protobuf"
+)
+
+const (
+	// NDJSONMalformedAbort rejects the NDJSON bodies with a malformed line with 400.
+	NDJSONMalformedAbort string = "abort"
+	// NDJSONMalformedSkip skips and logs the malformed NDJSON lines.
+	NDJSONMalformedSkip string = "skip"
+)
+
+const (
+	// CookieLimitReject rejects the requests exceeding the cookie limits with 431.
+	CookieLimitReject string = "reject"
+	// CookieLimitTruncate drops the cookies over the limits, the request gets the cookies_truncated warning.
+	CookieLimitTruncate string = "truncate"
+)
+
+const (
+	// DuplicateParamsReject rejects the requests having the same top-level parameter in the query and the body with
+	// 400.
+	DuplicateParamsReject string = "reject"
+	// DuplicateParamsFlag passes such requests to the worker with the colliding keys in the Duplicate-Params
+	// attribute.
+	DuplicateParamsFlag string = "flag"
+)
+
+const (
+	// MissingContentTypeRaw sends the bodies without Content-Type to the worker as is.
+	MissingContentTypeRaw string = "raw"
+	// MissingContentTypeURLEncoded parses the bodies without Content-Type as urlencoded forms.
+	MissingContentTypeURLEncoded string = "assume-urlencoded"
+	// MissingContentTypeReject rejects the requests with a body but without Content-Type with 415.
+	MissingContentTypeReject string = "reject"
+)
+
+const (
+	// DuplicatePartHeadersReject rejects the multipart parts with the repeated framing headers with 400.
+	DuplicatePartHeadersReject string = "reject"
+	// DuplicatePartHeadersFirst uses the first occurrence of the repeated framing headers.
+	DuplicatePartHeadersFirst string = "first"
+)
+
+const (
+	// EmptyFilenameValue classifies the multipart parts with the empty filename parameter as the values.
+	EmptyFilenameValue string = "value"
+	// EmptyFilenameFile classifies such parts as the files, reported as not uploaded (UPLOAD_ERR_NO_FILE) the same
+	// way PHP reports the file inputs submitted without a file.
+	EmptyFilenameFile string = "file"
+	// EmptyFilenameReject rejects the forms with such parts with 400.
+	EmptyFilenameReject string = "reject"
+)
+
+const (
+	// MultipartLineEndingsAuto follows the line endings of the first boundary line, the way net/http does: the body
+	// framed with LF only is accepted, the boundaries not ending the same way as the first one are not recognized.
+	MultipartLineEndingsAuto string = "auto"
+	// MultipartLineEndingsLenient rewrites the LF boundary and header lines to CRLF, so the bodies mixing LF and
+	// CRLF framing are split into the parts the client meant.
+	MultipartLineEndingsLenient string = "lenient"
+	// MultipartLineEndingsStrict rejects the multipart bodies with the LF boundary or header lines with 400.
+	MultipartLineEndingsStrict string = "strict"
+)
+
+const (
+	// MultipartTrailingDataIgnore ignores the data after the closing multipart boundary, the way net/http does.
+	MultipartTrailingDataIgnore string = "ignore"
+	// MultipartTrailingDataReject rejects the multipart bodies with anything but the whitespace after the closing
+	// boundary with 400.
+	MultipartTrailingDataReject string = "reject"
+)
+
+const (
+	// NameLengthBytes counts the field name length in bytes.
+	NameLengthBytes string = "bytes"
+	// NameLengthRunes counts the field name length in characters (UTF-8 code points).
+	NameLengthRunes string = "runes"
+)
+
+const (
+	// NamePatternReject rejects the forms with the field names not matching the name pattern with 400.
+	NamePatternReject string = "reject"
+	// NamePatternDrop removes such fields before the form is parsed.
+	NamePatternDrop string = "drop"
+)
+
+// ContentType maps a media type pattern to the body parser.
+type ContentType struct {
+	// Pattern is an exact media type (application/vnd.app+form), a structured syntax suffix (+json) or a type
+	// wildcard (text/*).
+	Pattern string `mapstructure:"pattern"`
+	// Parser is one of: urlencoded, multipart, json, ndjson, related, cbor, raw.
+	Parser string `mapstructure:"parser"`
+}
+
+// CheckboxGroup is the form branch of the checkbox group, filled with the booleans for the expected keys.
+type CheckboxGroup struct {
+	// Prefix is the field name of the group as it's sent in the form: perm, or settings[perm].
+	Prefix string `mapstructure:"prefix"`
+	// Keys are the names of the group checkboxes.
+	Keys []string `mapstructure:"keys"`
+}
+
+// JSONArrayStream configures the streaming decoding of the JSON bodies which are a top-level array: the elements are
+// decoded one at a time while the body is read, instead of buffering the whole body.
+type JSONArrayStream struct {
+	// MaxElements is the maximum number of the array elements, the bodies with more elements are rejected with 413.
+	// 0 means unlimited.
+	MaxElements int `mapstructure:"max_elements"`
+}
+
+// JSONStrings are the form strings the JSON booleans and null are converted to.
+type JSONStrings struct {
+	// True is the string of true, default is 1.
+	True string `mapstructure:"true"`
+	// False is the string of false, default is empty.
+	False string `mapstructure:"false"`
+	// Null is the string of null, default is empty.
+	Null string `mapstructure:"null"`
+}
+
+// BodySizeLimit is the body size limit of the content type.
+type BodySizeLimit struct {
+	// Pattern is the media type pattern, the same syntax as the content_types patterns.
+	Pattern string `mapstructure:"pattern"`
+	// MaxSize is the maximum size of the body in bytes.
+	MaxSize int64 `mapstructure:"max_size"`
+}
+
+// ParseCost are the weights of the parse cost of the request: the sum of the counters of the parsed body multiplied
+// by their weights.
+type ParseCost struct {
+	// Bytes is the weight of a body byte read.
+	Bytes float64 `mapstructure:"bytes"`
+	// Fields is the weight of a parsed field, each list value is a field.
+	Fields float64 `mapstructure:"fields"`
+	// Files is the weight of an uploaded file.
+	Files float64 `mapstructure:"files"`
+	// Depth is the weight of a nesting level of the parsed data tree.
+	Depth float64 `mapstructure:"depth"`
+	// Buckets are the upper bounds of the parse cost histogram buckets.
+	Buckets []float64 `mapstructure:"buckets"`
+}
+
+// Fields restricts the top-level fields of the parsed request bodies (including the uploaded files) and the length of
+// the field names.
+type Fields struct {
+	// Allowed top-level fields, the required fields are always allowed. Empty means any field is allowed.
+	Allowed []string `mapstructure:"allowed"`
+	// Required top-level fields, the requests without them are rejected with 400.
+	Required []string `mapstructure:"required"`
+	// RejectUnknown rejects the requests with the fields not in the allowed list with 400, otherwise such fields are
+	// removed before the request is sent to the worker.
+	RejectUnknown bool `mapstructure:"reject_unknown"`
+	// MaxNameLength is the maximum length of the field names at any nesting level, the requests with longer names
+	// are rejected with 400. 0 means unlimited.
+	MaxNameLength int `mapstructure:"max_name_length"`
+	// NameLength is the unit of MaxNameLength: bytes (default) or runes.
+	NameLength string `mapstructure:"name_length"`
+	// NamePattern is the regular expression (RE2 syntax) every raw field name of the urlencoded and the multipart
+	// forms must match, the whole name before it's split into the indexes (user[name]). Empty means any name.
+	NamePattern string `mapstructure:"name_pattern"`
+	// NamePatternAction is what happens to the fields not matching the name pattern: reject (default) or drop.
+	NamePatternAction string `mapstructure:"name_pattern_action"`
+
+	// internal
+	NameRegexp *regexp.Regexp `mapstructure:"-"`
+}
+
+// CSRF configures the double-submit token check: the token sent in the cookie must match the one in the form field.
+type CSRF struct {
+	// Cookie is the name of the cookie with the token.
+	Cookie string `mapstructure:"cookie"`
+	// Field is the top-level field of the parsed body with the token.
+	Field string `mapstructure:"field"`
+	// Paths are the URL path prefixes the check applies to, empty means all paths. Only the unsafe methods (POST,
+	// PUT, PATCH, DELETE) are checked.
+	Paths []string `mapstructure:"paths"`
+}
+
+// DuplicateParams configures the check of the top-level parameters sent both in the query and in the parsed body.
+type DuplicateParams struct {
+	// Action is reject (default) or flag.
+	Action string `mapstructure:"action"`
+	// Paths are the URL path prefixes the check applies to, empty means all paths.
+	Paths []string `mapstructure:"paths"`
+}
+
+// LazyParse configures the skipped parsing of the request bodies: the buffered raw body is sent to the worker
+// unparsed, with the Lazy-Body attribute naming the parser. The handler has no parsed data of these bodies, the worker
+// parses the raw body itself (on the first access, or never if it doesn't read it).
+type LazyParse struct {
+	// MaxBuffer is the largest body (in bytes, by its Content-Length) which is buffered, the larger bodies and the
+	// bodies of unknown length are parsed eagerly. Default is 1MB.
+	MaxBuffer int64 `mapstructure:"max_buffer"`
+	// Paths are the URL path prefixes the lazy parsing applies to, empty means all paths.
+	Paths []string `mapstructure:"paths"`
+}
+
+// SelectFields configures the partial serialization of the parsed body for the workers which read only some of the
+// fields: only the subtrees of the listed fields are sent, with the Selected-Fields attribute listing them.
+type SelectFields struct {
+	// Fields are the form keys (user[name], avatar) of the body and uploads subtrees sent to the worker.
+	Fields []string `mapstructure:"fields"`
+	// Paths are the URL path prefixes the selection applies to, empty means all paths.
+	Paths []string `mapstructure:"paths"`
+}
+
+// Parse configures how the incoming request bodies are read and parsed before they are sent to the workers.
+type Parse struct {
+	// MaxConcurrency limits the number of requests which are parsing their bodies at the same time. 0 = unlimited.
+	MaxConcurrency int `mapstructure:"max_concurrency"`
+	// QueueTimeout is the time a request waits for a free parse slot when MaxConcurrency is reached. 0 means the
+	// request is rejected immediately with 503.
+	QueueTimeout time.Duration `mapstructure:"queue_timeout"`
+	// BodyReadTimeout is the deadline for reading the body of each request, counted from the start of the parse,
+	// independently of the connection deadlines. The timed out requests get 408. 0 = no deadline.
+	BodyReadTimeout time.Duration `mapstructure:"body_read_timeout"`
+	// ContentTypes maps custom media types to the body parsers. The built-in urlencoded and multipart types are
+	// always recognized, unmatched media types are sent to the worker as raw body.
+	ContentTypes []*ContentType `mapstructure:"content_types"`
+	// UnwrapPath is the dot path (data, data.attributes) of the JSON body element parsed instead of the whole
+	// envelope document. The bodies without the element are rejected with 400.
+	UnwrapPath string `mapstructure:"unwrap_path"`
+	// MaxSiblingsPerNode limits the number of the direct children of any node of the urlencoded and multipart form
+	// trees (key[0] through key[N], or the key[] list values), the forms exceeding it are rejected with 400. It
+	// complements the nesting depth limit by bounding the breadth of each level. 0 means unlimited.
+	MaxSiblingsPerNode int `mapstructure:"max_siblings_per_node"`
+	// FieldInspectStatus is the status code of the requests rejected by the field inspectors (the WAF native
+	// middleware seeing every parsed value). Default is 403.
+	FieldInspectStatus int `mapstructure:"field_inspect_status"`
+	// StrictContentType rejects with 415 the bodies which don't match their declared Content-Type (a JSON document
+	// sent as a form, a multipart body without its boundary, a JSON body with a syntax error) and the malformed
+	// Content-Type headers, instead of matching them the lenient way or reporting them as malformed bodies.
+	StrictContentType bool `mapstructure:"strict_content_type"`
+	// DecodeContentEncoding decodes the request bodies sent with the gzip or deflate Content-Encoding before they are
+	// parsed, the chunked transfer encoding is removed by the server first. The unsupported encodings are rejected
+	// with 415, the malformed encoded data with 400.
+	DecodeContentEncoding bool `mapstructure:"decode_content_encoding"`
+	// MaxBodySizes are the body size limits (in bytes) of the media type patterns, the bodies exceeding the limit of
+	// their Content-Type are rejected with 413. The most specific pattern applies, the same way the content_types
+	// patterns are matched, the other bodies are limited by max_request_size only. The limits are checked against the
+	// declared Content-Length before the body is read, and against the body as it's read. A limit larger than
+	// max_request_size has no effect.
+	MaxBodySizes []*BodySizeLimit `mapstructure:"max_body_sizes"`
+	// MaxDecodedSize limits the size (in bytes) of the decoded body, the larger bodies are rejected with 413. 0 means
+	// max_request_size.
+	MaxDecodedSize int64 `mapstructure:"max_decoded_size"`
+	// MaxDecodeRatio rejects with 413 the decoded bodies expanding more than the ratio times their encoded size (the
+	// decompression bombs), checked while the body is decoded once it's over 64 KB. 0 means unlimited.
+	MaxDecodeRatio int64 `mapstructure:"max_decode_ratio"`
+	// CoerceScalars keeps the numbers and booleans of the JSON (and NDJSON) bodies typed through to the worker,
+	// instead of converting them to the form strings. The urlencoded and multipart values are always strings.
+	CoerceScalars bool `mapstructure:"coerce_scalars"`
+	// JSONStrings overrides the form strings the booleans and null of the JSON (and NDJSON) bodies are converted to,
+	// by default they are converted the way PHP casts them to string (true is 1, false and null are empty). It can't
+	// be combined with coerce_scalars.
+	JSONStrings *JSONStrings `mapstructure:"json_strings"`
+	// JSONArrayStream decodes the JSON bodies which are a top-level array element by element, so only one element
+	// is buffered at a time. It can't be combined with unwrap_path, which needs the whole document.
+	JSONArrayStream *JSONArrayStream `mapstructure:"json_array_stream"`
+	// PHPArrayKeys splits the urlencoded and multipart field names into the array keys the same way PHP does, so
+	// the keys collide exactly when they collide in PHP: the indexes are kept as written, spaces included (a[ 8 ]
+	// and a[8] are distinct keys, as 08 and 8 are), the name dots and spaces become underscores.
+	PHPArrayKeys bool `mapstructure:"php_array_keys"`
+	// LiteralQuotedNames makes the quoted multipart names (name="a[b]") literal keys, only unquoted names
+	// (name=a[b]) are split using the array syntax.
+	LiteralQuotedNames bool `mapstructure:"literal_quoted_names"`
+	// MissingContentType defines what to do with non-empty bodies sent without Content-Type: raw (default),
+	// assume-urlencoded or reject.
+	MissingContentType string `mapstructure:"missing_content_type"`
+	// DuplicatePartHeaders defines what to do with the multipart parts carrying the Content-Disposition,
+	// Content-Type or Content-Transfer-Encoding header more than once: reject (default) or first.
+	DuplicatePartHeaders string `mapstructure:"duplicate_part_headers"`
+	// EmptyFilename defines how the multipart parts with the empty filename parameter (filename="") are classified:
+	// value (default), file or reject. The parts with a non-empty filename are always the files, and the parts
+	// without the filename parameter are always the values, whatever their name or Content-Type.
+	EmptyFilename string `mapstructure:"empty_filename"`
+	// MultipartLineEndings defines how the multipart boundary and header lines ending with LF instead of CRLF are
+	// handled: auto (default), lenient or strict. The line endings inside the part contents are never changed.
+	MultipartLineEndings string `mapstructure:"multipart_line_endings"`
+	// MultipartTrailingData defines how the data after the closing multipart boundary is handled: ignore (default)
+	// or reject. The trailing data is the sign of the request smuggling or a broken client.
+	MultipartTrailingData string `mapstructure:"multipart_trailing_data"`
+	// PartsManifest passes the flat list of the multipart/form-data parts to the worker in the Parts-Manifest
+	// attribute (JSON): the name, the filename, the Content-Type and the size of each part, in the order they were
+	// sent. The list is built while the parts are read, the data and the uploads trees are sent as usual.
+	PartsManifest bool `mapstructure:"parts_manifest"`
+	// MaxPartHeaderSize limits the size (in bytes) of the header block of each multipart part, the Content-Disposition
+	// with a huge filename included. The parts with the larger headers are rejected with 413 while the header is read.
+	// 0 means the net/http limit (10 MB).
+	MaxPartHeaderSize int64 `mapstructure:"max_part_header_size"`
+	// MaxMultipartValueSize limits the size (in bytes) of each multipart value part, the parts without a filename.
+	// The value parts are not files, so the uploads max_file_size doesn't cover them. The form with a larger value is
+	// rejected with 413 naming the field. 0 means only the total limit of the values (the multipart memory + 10 MB).
+	MaxMultipartValueSize int64 `mapstructure:"max_multipart_value_size"`
+	// MaxTotalParsedBytes limits the memory the parsed request retains jointly: the keys and the values of the parsed
+	// data tree, the upload keys and metadata and the upload contents kept in memory. The request sitting just under
+	// each per-dimension limit is rejected with 413 when their sum exceeds it. 0 means unlimited.
+	MaxTotalParsedBytes int64 `mapstructure:"max_total_parsed_bytes"`
+	// StreamSingleUpload sends the multipart forms consisting of a single file to the worker as the raw body with the
+	// file details in the Upload-Field, Upload-Name and Upload-Mime attributes, instead of storing the file in the
+	// uploads dir. The first file part is read into memory straight from the request whatever its size (the body
+	// limits and max_file_size still apply), so the large file is never written to disk. When the form has more parts,
+	// the file is stored as usual.
+	StreamSingleUpload bool `mapstructure:"stream_single_upload"`
+	// ZeroCopyURLEncoded parses the urlencoded bodies with the scanner which doesn't copy the keys and values, the
+	// parsed data is the same as with the default parser. The bodies up to 4KB are always parsed this way.
+	ZeroCopyURLEncoded bool `mapstructure:"zero_copy_urlencoded"`
+	// MethodOverrideField is the body field overriding the method of the POST requests (_method), only PUT, PATCH
+	// and DELETE are accepted. Empty means disabled.
+	MethodOverrideField string `mapstructure:"method_override_field"`
+	// RequestOrder enables the $_REQUEST equivalent: the query (G), the parsed body (P) and the cookies (C) merged
+	// in the order of the letters, the later sources replace the earlier ones, the same way PHP request_order does
+	// (GP, GPC, CGP...). Empty means disabled.
+	RequestOrder string `mapstructure:"request_order"`
+	// TrackSources tags the merged request_order values with their source (G, P or C), sent in the
+	// Request-Params-Sources attribute and reported by the params view to the native middleware. Off by default,
+	// the tags double the size of the merged tree.
+	TrackSources bool `mapstructure:"track_sources"`
+	// MaxCookieCount limits the number of the cookies of the request, 0 means unlimited.
+	MaxCookieCount int `mapstructure:"max_cookie_count"`
+	// MaxCookieBytes limits the summed size (in bytes) of the cookie pairs of the request as sent, 0 means
+	// unlimited. Unlike the header limits, it bounds the cookies which each get the extra processing (unescaping, the
+	// cookie codec, the request_order merge).
+	MaxCookieBytes int64 `mapstructure:"max_cookie_bytes"`
+	// CookieLimitAction defines what happens to the request exceeding the cookie limits: reject (default, 431) or
+	// truncate (the cookies over the limits are dropped).
+	CookieLimitAction string `mapstructure:"cookie_limit_action"`
+	// ParseBodyMethods are the normally bodyless methods (GET, HEAD, OPTIONS, DELETE) whose bodies are parsed when
+	// present. By default the urlencoded bodies of the methods other than POST, PUT and PATCH are ignored the way
+	// net/http ignores them, and the HEAD and OPTIONS bodies are not read at all.
+	ParseBodyMethods []string `mapstructure:"parse_body_methods"`
+	// StructuredHeaders are the request headers with the bracket syntax pairs (X-Meta: user[id]=5; user[role]=admin)
+	// parsed into the trees, passed to the worker as JSON in the Header:<name> attributes.
+	StructuredHeaders []string `mapstructure:"structured_headers"`
+	// BodyEncoding is the encoding of the parsed body and the uploads sent to the worker: json (default) or
+	// protobuf (google.protobuf.Struct, the worker gets the Body-Encoding attribute).
+	BodyEncoding string `mapstructure:"body_encoding"`
+	// ParseDiagnostics passes the details of the parsed bodies to the worker in the Parse-Diagnostics attribute (JSON):
+	// the media type, the parser, the multipart boundary and parts count, the fields and files count, and the limits
+	// the request used at least 80% of.
+	ParseDiagnostics bool `mapstructure:"parse_diagnostics"`
+	// ParseSummaryHeader adds the X-RR-Parse-Summary response header to the parsed requests: the media type, the
+	// parser, the fields and files count and the limits the request used at least 80% of, never the field values. It
+	// exposes the handler internals to the clients, meant for the staging only, never enable it in production.
+	ParseSummaryHeader bool `mapstructure:"parse_summary_header"`
+	// ParseWarnings passes the non-fatal warnings of the parse (a skipped NDJSON line, a duplicate part header, the
+	// rewritten LF multipart framing, an ignored method override) to the worker in the Parse-Warnings attribute
+	// (JSON). The warnings never reject the request, they are always logged at the debug level.
+	ParseWarnings bool `mapstructure:"parse_warnings"`
+	// Deterministic serializes the worker payload with the keys sorted canonically (byte-wise): the request context
+	// maps (headers, cookies, attributes) and the protobuf encoded trees, the JSON trees are always sorted. It's meant
+	// for the tests and debugging (stable golden files), the order doesn't match the PHP runtime order of the fields,
+	// and the sorting has its cost.
+	Deterministic bool `mapstructure:"deterministic"`
+	// MaxParseDuration bounds the time spent building the parsed data from the already read body (urlencoded,
+	// multipart and JSON), separately from the body read timeout. The NDJSON records are decoded while the body is
+	// read, for them it counts from the first record. The requests exceeding it are rejected with 408. 0 means
+	// unlimited.
+	MaxParseDuration time.Duration `mapstructure:"max_parse_duration"`
+	// NDJSONMaxLines is the maximum number of records in the NDJSON bodies, the bodies with more records are
+	// rejected with 413. Default is 10000.
+	NDJSONMaxLines int `mapstructure:"ndjson_max_lines"`
+	// NDJSONMalformedLines defines what to do with the NDJSON lines which are not valid JSON: abort (default)
+	// rejects the body with 400, skip drops and logs the line.
+	NDJSONMalformedLines string `mapstructure:"ndjson_malformed_lines"`
+	// CSRF enables the double-submit token check, the requests failing it are rejected with 403.
+	CSRF *CSRF `mapstructure:"csrf"`
+	// DuplicateParams enables the check of the parameters sent both in the query and in the body, which PHP
+	// silently resolves when it builds $_REQUEST.
+	DuplicateParams *DuplicateParams `mapstructure:"duplicate_params"`
+	// LazyParse skips the parsing of the urlencoded and JSON bodies, the worker gets them raw and parses them itself.
+	// The multipart bodies are always parsed. It can't be combined with the checks and the transformations of the
+	// parsed body (csrf, fields, duplicate_params, method_override_field, select_fields, the body in request_order,
+	// max_total_parsed_bytes, trim_quotes, collapse_lists, checkboxes, nested_form_fields). The field inspectors
+	// still see the fields, the body is parsed for them only.
+	LazyParse *LazyParse `mapstructure:"lazy_parse"`
+	// SelectFields limits the parsed body and uploads sent to the worker to the listed fields, the first entry
+	// matching the URL path applies. The requests matching no entry are sent whole.
+	SelectFields []*SelectFields `mapstructure:"select_fields"`
+	// RedactFields are the field name patterns (path.Match syntax, case-insensitive) whose values are replaced with
+	// [REDACTED] in the diagnostic logs. A pattern matches the leaf name of the field or its full dot path
+	// (user.password). Default: *password*, *secret*, *token*, ssn.
+	RedactFields []string `mapstructure:"redact_fields"`
+	// TrimQuotes are the field name patterns (matched the same way the redact_fields are) whose parsed values have a
+	// single layer of the surrounding double quotes stripped, "value" is sent as value. The unmatched and the embedded
+	// quotes are kept.
+	TrimQuotes []string `mapstructure:"trim_quotes"`
+	// CollapseLists are the field name patterns (matched the same way the redact_fields are) whose single element
+	// lists are sent as the element, the stray a[]=1 is sent as a=1. The longer lists and the indexed fields (a[0]=1)
+	// are kept.
+	CollapseLists []string `mapstructure:"collapse_lists"`
+	// Fields validates the top-level fields of the parsed bodies.
+	Fields *Fields `mapstructure:"fields"`
+	// Checkboxes are the checkbox groups of the urlencoded and multipart forms: the keys of a group are set to true
+	// when they are sent and to false when they are absent (unchecked), after the fields validation.
+	Checkboxes []*CheckboxGroup `mapstructure:"checkboxes"`
+	// NestedFormFields are the names (key[sub] notation) of the urlencoded and multipart form fields whose value is
+	// itself a urlencoded form (a=1&b[c]=2). The value is parsed into the subtree of the field, with the limits of
+	// the body fields, before the fields validation. The malformed nested forms are rejected with 400.
+	NestedFormFields []string `mapstructure:"nested_form_fields"`
+	// ParseCost computes the weighted cost of parsing each request, passed to the worker and set in the request
+	// attributes in the Parse-Cost attribute, and observed by the parse metrics. The weights default to 1 per KB of
+	// the body, 1 per field, 10 per file and 1 per nesting level when none is set.
+	ParseCost *ParseCost `mapstructure:"parse_cost"`
+	// BodySizeBuckets are the upper bounds (in bytes) of the request body size histogram buckets.
+	BodySizeBuckets []float64 `mapstructure:"body_size_buckets"`
+	// FieldCountBuckets are the upper bounds of the parsed fields count histogram buckets.
+	FieldCountBuckets []float64 `mapstructure:"field_count_buckets"`
+}
+
+// InitDefaults sets missing values to their default values.
+func (cfg *Parse) InitDefaults() error {
+	const op = errors.Op("parse_init_defaults")
+
+	if cfg.MaxConcurrency < 0 {
+		return errors.E(op, errors.Str("max_concurrency should be greater than or equal to 0"))
+	}
+
+	if cfg.QueueTimeout < 0 {
+		return errors.E(op, errors.Str("queue_timeout should be greater than or equal to 0"))
+	}
+
+	if cfg.BodyReadTimeout < 0 {
+		return errors.E(op, errors.Str("body_read_timeout should be greater than or equal to 0"))
+	}
+
+	switch cfg.MissingContentType {
+	case "":
+		cfg.MissingContentType = MissingContentTypeRaw
+	case MissingContentTypeRaw, MissingContentTypeURLEncoded, MissingContentTypeReject:
+	default:
+		return errors.E(op, errors.Errorf("unknown missing_content_type option: %s", cfg.MissingContentType))
+	}
+
+	switch cfg.DuplicatePartHeaders {
+	case "":
+		cfg.DuplicatePartHeaders = DuplicatePartHeadersReject
+	case DuplicatePartHeadersReject, DuplicatePartHeadersFirst:
+	default:
+		return errors.E(op, errors.Errorf("unknown duplicate_part_headers option: %s", cfg.DuplicatePartHeaders))
+	}
+
+	switch cfg.EmptyFilename {
+	case "":
+		cfg.EmptyFilename = EmptyFilenameValue
+	case EmptyFilenameValue, EmptyFilenameFile, EmptyFilenameReject:
+	default:
+		return errors.E(op, errors.Errorf("unknown empty_filename option: %s", cfg.EmptyFilename))
+	}
+
+	switch cfg.MultipartLineEndings {
+	case "":
+		cfg.MultipartLineEndings = MultipartLineEndingsAuto
+	case MultipartLineEndingsAuto, MultipartLineEndingsLenient, MultipartLineEndingsStrict:
+	default:
+		return errors.E(op, errors.Errorf("unknown multipart_line_endings option: %s", cfg.MultipartLineEndings))
+	}
+
+	switch cfg.MultipartTrailingData {
+	case "":
+		cfg.MultipartTrailingData = MultipartTrailingDataIgnore
+	case MultipartTrailingDataIgnore, MultipartTrailingDataReject:
+	default:
+		return errors.E(op, errors.Errorf("unknown multipart_trailing_data option: %s", cfg.MultipartTrailingData))
+	}
+
+	if cfg.MaxPartHeaderSize < 0 {
+		return errors.E(op, errors.Str("max_part_header_size should not be negative"))
+	}
+
+	if cfg.MaxMultipartValueSize < 0 {
+		return errors.E(op, errors.Str("max_multipart_value_size should not be negative"))
+	}
+
+	if cfg.MaxTotalParsedBytes < 0 {
+		return errors.E(op, errors.Str("max_total_parsed_bytes should not be negative"))
+	}
+
+	switch cfg.BodyEncoding {
+	case "":
+		cfg.BodyEncoding = BodyEncodingJSON
+	case BodyEncodingJSON, BodyEncodingProtobuf:
+	default:
+		return errors.E(op, errors.Errorf("unknown body_encoding option: %s", cfg.BodyEncoding))
+	}
+
+	if cfg.MaxDecodedSize < 0 {
+		return errors.E(op, errors.Str("max_decoded_size should not be negative"))
+	}
+
+	if cfg.MaxDecodeRatio < 0 {
+		return errors.E(op, errors.Str("max_decode_ratio should not be negative"))
+	}
+
+	if cfg.MaxSiblingsPerNode < 0 {
+		return errors.E(op, errors.Str("max_siblings_per_node should not be negative"))
+	}
+
+	switch {
+	case cfg.FieldInspectStatus == 0:
+		cfg.FieldInspectStatus = http.StatusForbidden
+	case cfg.FieldInspectStatus < 400 || cfg.FieldInspectStatus > 599:
+		return errors.E(op, errors.Errorf("field_inspect_status should be a 4xx or 5xx status code, got %d", cfg.FieldInspectStatus))
+	}
+
+	if cfg.MaxParseDuration < 0 {
+		return errors.E(op, errors.Str("max_parse_duration should be greater than or equal to 0"))
+	}
+
+	if cfg.NDJSONMaxLines < 0 {
+		return errors.E(op, errors.Str("ndjson_max_lines should be greater than or equal to 0"))
+	}
+
+	if cfg.NDJSONMaxLines == 0 {
+		cfg.NDJSONMaxLines = 10000
+	}
+
+	switch cfg.NDJSONMalformedLines {
+	case "":
+		cfg.NDJSONMalformedLines = NDJSONMalformedAbort
+	case NDJSONMalformedAbort, NDJSONMalformedSkip:
+	default:
+		return errors.E(op, errors.Errorf("unknown ndjson_malformed_lines option: %s", cfg.NDJSONMalformedLines))
+	}
+
+	if len(cfg.RedactFields) == 0 {
+		cfg.RedactFields = []string{"*password*", "*secret*", "*token*", "ssn"}
+	}
+
+	for _, p := range cfg.RedactFields {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.E(op, errors.Errorf("invalid redact_fields pattern '%s': %v", p, err))
+		}
+	}
+
+	for _, p := range cfg.TrimQuotes {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.E(op, errors.Errorf("invalid trim_quotes pattern '%s': %v", p, err))
+		}
+	}
+
+	for _, p := range cfg.CollapseLists {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.E(op, errors.Errorf("invalid collapse_lists pattern '%s': %v", p, err))
+		}
+	}
+
+	if len(cfg.BodySizeBuckets) == 0 {
+		// 1KB - 64MB
+		cfg.BodySizeBuckets = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+	}
+
+	if len(cfg.FieldCountBuckets) == 0 {
+		cfg.FieldCountBuckets = []float64{1, 5, 10, 50, 100, 500, 1000}
+	}
+
+	if !increasing(cfg.BodySizeBuckets) {
+		return errors.E(op, errors.Str("body_size_buckets should be in increasing order"))
+	}
+
+	if !increasing(cfg.FieldCountBuckets) {
+		return errors.E(op, errors.Str("field_count_buckets should be in increasing order"))
+	}
+
+	if cfg.Fields != nil {
+		if cfg.Fields.RejectUnknown && len(cfg.Fields.Allowed) == 0 && len(cfg.Fields.Required) == 0 {
+			return errors.E(op, errors.Str("fields reject_unknown requires the allowed or required fields"))
+		}
+
+		if cfg.Fields.MaxNameLength < 0 {
+			return errors.E(op, errors.Str("fields max_name_length should not be negative"))
+		}
+
+		switch cfg.Fields.NameLength {
+		case "":
+			cfg.Fields.NameLength = NameLengthBytes
+		case NameLengthBytes, NameLengthRunes:
+		default:
+			return errors.E(op, errors.Errorf("unknown fields name_length unit: %s", cfg.Fields.NameLength))
+		}
+
+		switch cfg.Fields.NamePatternAction {
+		case "":
+			cfg.Fields.NamePatternAction = NamePatternReject
+		case NamePatternReject, NamePatternDrop:
+		default:
+			return errors.E(op, errors.Errorf("unknown fields name_pattern_action: %s", cfg.Fields.NamePatternAction))
+		}
+
+		if cfg.Fields.NamePattern != "" {
+			re, err := regexp.Compile(cfg.Fields.NamePattern)
+			if err != nil {
+				return errors.E(op, errors.Errorf("invalid fields name_pattern: %v", err))
+			}
+
+			cfg.Fields.NameRegexp = re
+		}
+	}
+
+	if cfg.CSRF != nil && (cfg.CSRF.Cookie == "" || cfg.CSRF.Field == "") {
+		return errors.E(op, errors.Str("csrf requires the cookie and field names"))
+	}
+
+	if cfg.LazyParse != nil {
+		if cfg.LazyParse.MaxBuffer < 0 {
+			return errors.E(op, errors.Str("lazy_parse max_buffer should not be negative"))
+		}
+
+		if cfg.LazyParse.MaxBuffer == 0 {
+			cfg.LazyParse.MaxBuffer = 1 << 20
+		}
+
+		switch {
+		case cfg.CSRF != nil:
+			return errors.E(op, errors.Str("lazy_parse can't be combined with csrf"))
+		case cfg.Fields != nil:
+			return errors.E(op, errors.Str("lazy_parse can't be combined with fields"))
+		case cfg.DuplicateParams != nil:
+			return errors.E(op, errors.Str("lazy_parse can't be combined with duplicate_params"))
+		case cfg.MethodOverrideField != "":
+			return errors.E(op, errors.Str("lazy_parse can't be combined with method_override_field"))
+		case len(cfg.SelectFields) > 0:
+			return errors.E(op, errors.Str("lazy_parse can't be combined with select_fields"))
+		case strings.Contains(cfg.RequestOrder, "P"):
+			return errors.E(op, errors.Str("lazy_parse can't be combined with the body (P) in request_order"))
+		case cfg.MaxTotalParsedBytes > 0:
+			return errors.E(op, errors.Str("lazy_parse can't be combined with max_total_parsed_bytes"))
+		case len(cfg.TrimQuotes) > 0:
+			return errors.E(op, errors.Str("lazy_parse can't be combined with trim_quotes"))
+		case len(cfg.CollapseLists) > 0:
+			return errors.E(op, errors.Str("lazy_parse can't be combined with collapse_lists"))
+		case len(cfg.Checkboxes) > 0:
+			return errors.E(op, errors.Str("lazy_parse can't be combined with checkboxes"))
+		case len(cfg.NestedFormFields) > 0:
+			return errors.E(op, errors.Str("lazy_parse can't be combined with nested_form_fields"))
+		}
+	}
+
+	if cfg.MaxCookieCount < 0 || cfg.MaxCookieBytes < 0 {
+		return errors.E(op, errors.Str("max_cookie_count and max_cookie_bytes should not be negative"))
+	}
+
+	switch cfg.CookieLimitAction {
+	case "":
+		cfg.CookieLimitAction = CookieLimitReject
+	case CookieLimitReject, CookieLimitTruncate:
+	default:
+		return errors.E(op, errors.Errorf("unknown cookie_limit_action option: %s", cfg.CookieLimitAction))
+	}
+
+	if cfg.TrackSources && cfg.RequestOrder == "" {
+		return errors.E(op, errors.Str("track_sources requires request_order"))
+	}
+
+	for i, c := range cfg.RequestOrder {
+		if !strings.ContainsRune("GPC", c) || strings.IndexRune(cfg.RequestOrder, c) != i {
+			return errors.E(op, errors.Errorf("invalid request_order: %s, use each of the G, P and C letters at most once", cfg.RequestOrder))
+		}
+	}
+
+	for i, sf := range cfg.SelectFields {
+		if sf == nil || len(sf.Fields) == 0 {
+			return errors.E(op, errors.Errorf("select_fields entry %d has no fields", i))
+		}
+
+		for _, f := range sf.Fields {
+			if f == "" || strings.Contains(f, "[]") {
+				return errors.E(op, errors.Errorf("select_fields entry %d: invalid field '%s', list appends (key[]) can't be selected", i, f))
+			}
+		}
+	}
+
+	if cfg.DuplicateParams != nil {
+		switch cfg.DuplicateParams.Action {
+		case "":
+			cfg.DuplicateParams.Action = DuplicateParamsReject
+		case DuplicateParamsReject, DuplicateParamsFlag:
+		default:
+			return errors.E(op, errors.Errorf("unknown duplicate_params action: %s", cfg.DuplicateParams.Action))
+		}
+	}
+
+	for _, m := range cfg.ParseBodyMethods {
+		switch strings.ToUpper(m) {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodDelete:
+		default:
+			return errors.E(op, errors.Errorf("unsupported parse_body_methods method: %s", m))
+		}
+	}
+
+	if cfg.JSONStrings != nil {
+		if cfg.CoerceScalars {
+			return errors.E(op, errors.Str("json_strings can't be combined with coerce_scalars"))
+		}
+
+		if cfg.JSONStrings.True == "" {
+			cfg.JSONStrings.True = "1"
+		}
+	}
+
+	if cfg.JSONArrayStream != nil {
+		if cfg.JSONArrayStream.MaxElements < 0 {
+			return errors.E(op, errors.Str("json_array_stream max_elements should not be negative"))
+		}
+
+		if cfg.UnwrapPath != "" {
+			return errors.E(op, errors.Str("json_array_stream can't be combined with unwrap_path"))
+		}
+	}
+
+	for _, l := range cfg.MaxBodySizes {
+		if l == nil || l.Pattern == "" {
+			return errors.E(op, errors.Str("max_body_sizes pattern should not be empty"))
+		}
+
+		if l.MaxSize <= 0 {
+			return errors.E(op, errors.Errorf("max_body_sizes max_size of '%s' should be greater than 0", l.Pattern))
+		}
+	}
+
+	if pc := cfg.ParseCost; pc != nil {
+		if pc.Bytes < 0 || pc.Fields < 0 || pc.Files < 0 || pc.Depth < 0 {
+			return errors.E(op, errors.Str("parse_cost weights should not be negative"))
+		}
+
+		if pc.Bytes == 0 && pc.Fields == 0 && pc.Files == 0 && pc.Depth == 0 {
+			pc.Bytes, pc.Fields, pc.Files, pc.Depth = 1.0/1024, 1, 10, 1
+		}
+
+		if len(pc.Buckets) == 0 {
+			pc.Buckets = []float64{1, 10, 100, 1000, 10000, 100000}
+		}
+
+		if !increasing(pc.Buckets) {
+			return errors.E(op, errors.Str("parse_cost buckets should be in increasing order"))
+		}
+	}
+
+	for _, g := range cfg.Checkboxes {
+		if g == nil || g.Prefix == "" {
+			return errors.E(op, errors.Str("checkboxes prefix should not be empty"))
+		}
+
+		if len(g.Keys) == 0 {
+			return errors.E(op, errors.Errorf("checkboxes group '%s' should have keys", g.Prefix))
+		}
+	}
+
+	for _, f := range cfg.NestedFormFields {
+		if f == "" {
+			return errors.E(op, errors.Str("nested_form_fields name should not be empty"))
+		}
+	}
+
+	for _, ct := range cfg.ContentTypes {
+		if ct == nil || ct.Pattern == "" {
+			return errors.E(op, errors.Str("content_types pattern should not be empty"))
+		}
+
+		switch ct.Parser {
+		case ParserURLEncoded, ParserMultipart, ParserJSON, ParserNDJSON, ParserRelated, ParserCBOR, ParserRaw:
+		default:
+			return errors.E(op, errors.Errorf("unknown parser '%s' for the content type '%s'", ct.Parser, ct.Pattern))
+		}
+	}
+
+	return nil
+}
+
+func increasing(buckets []float64) bool {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return false
+		}
+	}
+
+	return true
+}
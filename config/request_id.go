@@ -0,0 +1,45 @@
+package config
+
+import (
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	// DefaultRequestIDHeader is the default header of the request correlation ID.
+	DefaultRequestIDHeader string = "X-Request-ID"
+
+	// RequestIDGenerateUUID generates the random (version 4) UUID for the requests without the ID.
+	RequestIDGenerateUUID string = "uuid"
+	// RequestIDGenerateUUIDv7 generates the time-ordered (version 7) UUID for the requests without the ID.
+	RequestIDGenerateUUIDv7 string = "uuid7"
+	// RequestIDGenerateNone leaves the requests without the ID as they are.
+	RequestIDGenerateNone string = "none"
+)
+
+// RequestID configures the correlation ID of the requests: it's read from the request header (or generated), passed
+// to the worker, echoed in the response header and attached to the log lines of the request.
+type RequestID struct {
+	// Header is the request and the response header with the ID. Default is X-Request-ID.
+	Header string `mapstructure:"header"`
+	// Generate is what to do with the requests without a valid ID: uuid (default), uuid7 or none.
+	Generate string `mapstructure:"generate"`
+}
+
+// InitDefaults sets missing values to their default values.
+func (cfg *RequestID) InitDefaults() error {
+	const op = errors.Op("request_id_init_defaults")
+
+	if cfg.Header == "" {
+		cfg.Header = DefaultRequestIDHeader
+	}
+
+	switch cfg.Generate {
+	case "":
+		cfg.Generate = RequestIDGenerateUUID
+	case RequestIDGenerateUUID, RequestIDGenerateUUIDv7, RequestIDGenerateNone:
+	default:
+		return errors.E(op, errors.Errorf("unknown request_id generate option: %s", cfg.Generate))
+	}
+
+	return nil
+}
@@ -2,6 +2,22 @@ package config
 
 import (
 	"os"
+	"strings"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// DefaultTempPattern is the default name pattern of the upload temp files.
+const DefaultTempPattern string = "upload-*"
+
+const (
+	// RepeatedFileKeysLast keeps the last of the files sent under the same bare name, the way PHP does.
+	RepeatedFileKeysLast string = "last"
+	// RepeatedFileKeysFirst keeps the first of them.
+	RepeatedFileKeysFirst string = "first"
+	// RepeatedFileKeysArray keeps all of them as the indexed list, the same as if the name ended with [].
+	RepeatedFileKeysArray string = "array"
 )
 
 // Uploads describes file location and controls access to them.
@@ -16,13 +32,151 @@ type Uploads struct {
 	// Allowed files
 	Allow []string `mapstructure:"allow"`
 
+	// AllowMime specifies the list of the declared media types the uploaded files can have, empty means any type.
+	AllowMime []string `mapstructure:"allow_mime"`
+
+	// MaxFileSize is the maximum size of the uploaded file in bytes, 0 means unlimited. The files declaring the
+	// larger part Content-Length are rejected before they are read, the others once they exceed the limit.
+	MaxFileSize int64 `mapstructure:"max_file_size"`
+
+	// FormMaxFileSize honors the MAX_FILE_SIZE field of the multipart forms the way PHP does: the files following
+	// the field and larger than its value are rejected with the UPLOAD_ERR_FORM_SIZE error. max_file_size still
+	// applies, the field can only lower it.
+	FormMaxFileSize bool `mapstructure:"form_max_file_size"`
+
+	// PartialUploads passes the multipart forms ending inside a file part (the client disconnected, the closing
+	// boundary is missing) to the worker the way PHP does: the parts read before are kept and the truncated file
+	// gets the UPLOAD_ERR_PARTIAL error. Disabled, such forms are rejected as malformed.
+	PartialUploads bool `mapstructure:"partial_uploads"`
+
+	// SniffMime detects the media type of the uploaded files from their content (the WHATWG sniffing of
+	// http.DetectContentType), passed to the worker in the upload sniffedMime field next to the declared mime.
+	SniffMime bool `mapstructure:"sniff_mime"`
+
+	// ImageDimensions extracts the format and the pixel dimensions of the uploaded images (gif, jpeg, png), passed
+	// to the worker in the upload image field. Only the image header is decoded.
+	ImageDimensions bool `mapstructure:"image_dimensions"`
+
+	// MaxFileNestingDepth limits the nesting of the file field names (file[a][b] is 3 levels deep: the name and each
+	// index), separately from the form data. The deeper file fields are rejected with 400. 0 means the shared limit.
+	MaxFileNestingDepth int `mapstructure:"max_file_nesting_depth"`
+
+	// RepeatedFileKeys defines which of the files sent under the same name without brackets (two file parts) are
+	// kept: last (default, as PHP), first or array.
+	RepeatedFileKeys string `mapstructure:"repeated_file_keys"`
+
+	// ExpectedFiles lists the upload fields of the multipart forms (avatar, docs[]) reported as not uploaded
+	// (UPLOAD_ERR_NO_FILE) when the form has no file under them, so the worker finds them in $_FILES the way the
+	// empty file inputs are. Empty means the absent uploads stay absent.
+	ExpectedFiles []string `mapstructure:"expected_files"`
+
+	// TempPattern is the name pattern of the upload temp files, the last "*" is replaced by the 128-bit random part
+	// (appended when the pattern has no "*"). Default is upload-*.
+	TempPattern string `mapstructure:"temp_pattern"`
+
+	// TempQuota is the maximum number of bytes held in the upload temp files of all requests at the same time, 0
+	// means unlimited. Both the parts spilled to disk while the body is read and their copies in Dir are counted,
+	// as they are written. The request whose files don't fit is rejected with 503, or waits for TempQuotaTimeout.
+	TempQuota int64 `mapstructure:"temp_quota"`
+
+	// TempQuotaTimeout is the time the request uploads wait for the temp space freed by the other requests when
+	// TempQuota is reached. 0 means the request is rejected immediately.
+	TempQuotaTimeout time.Duration `mapstructure:"temp_quota_timeout"`
+
+	// MaxOpenFiles is the maximum number of the upload temp files written at the same time by all requests, each
+	// holds a file descriptor. 0 means unlimited. The files wait for a free slot up to OpenFilesTimeout, the
+	// requests which don't get one are rejected with 503.
+	MaxOpenFiles int `mapstructure:"max_open_files"`
+
+	// OpenFilesTimeout is the time an upload temp file waits for a free slot when MaxOpenFiles is reached. 0 means
+	// the request is rejected immediately.
+	OpenFilesTimeout time.Duration `mapstructure:"open_files_timeout"`
+
+	// TempTTL is the age (since the last modification) of the upload temp files considered orphaned by a crashed
+	// worker or a missed cleanup, such files named by TempPattern are removed from the uploads dir by the background
+	// sweeper. It should be longer than the longest request. 0 means disabled.
+	TempTTL time.Duration `mapstructure:"temp_ttl"`
+
+	// TempSweepInterval is the time between the sweeps of the orphaned temp files. Default is TempTTL.
+	TempSweepInterval time.Duration `mapstructure:"temp_sweep_interval"`
+
+	// TempFallbackMemory is the memory (in bytes, per request) the multipart parts are kept in when their temp
+	// files can't be created because the temp disk is full or not writable. The requests whose parts don't fit, and
+	// the requests whose uploads can't be stored in the uploads dir, are rejected with 503. 0 means no fallback.
+	TempFallbackMemory int64 `mapstructure:"temp_fallback_memory"`
+
 	// internal
-	Forbidden map[string]struct{} `mapstructure:"-"`
-	Allowed   map[string]struct{} `mapstructure:"-"`
+	Forbidden   map[string]struct{} `mapstructure:"-"`
+	Allowed     map[string]struct{} `mapstructure:"-"`
+	AllowedMime map[string]struct{} `mapstructure:"-"`
 }
 
 // InitDefaults sets missing values to their default values.
 func (cfg *Uploads) InitDefaults() error {
+	const op = errors.Op("uploads_init_defaults")
+
+	if cfg.MaxFileSize < 0 {
+		return errors.E(op, errors.Str("max_file_size should be greater than or equal to 0"))
+	}
+
+	if cfg.MaxFileNestingDepth < 0 {
+		return errors.E(op, errors.Str("max_file_nesting_depth should be greater than or equal to 0"))
+	}
+
+	switch cfg.RepeatedFileKeys {
+	case "":
+		cfg.RepeatedFileKeys = RepeatedFileKeysLast
+	case RepeatedFileKeysLast, RepeatedFileKeysFirst, RepeatedFileKeysArray:
+	default:
+		return errors.E(op, errors.Errorf("unknown repeated_file_keys option: %s", cfg.RepeatedFileKeys))
+	}
+
+	for _, f := range cfg.ExpectedFiles {
+		if f == "" {
+			return errors.E(op, errors.Str("expected_files should not contain empty field names"))
+		}
+	}
+
+	if cfg.TempQuota < 0 {
+		return errors.E(op, errors.Str("temp_quota should be greater than or equal to 0"))
+	}
+
+	if cfg.TempQuotaTimeout < 0 {
+		return errors.E(op, errors.Str("temp_quota_timeout should be greater than or equal to 0"))
+	}
+
+	if cfg.MaxOpenFiles < 0 {
+		return errors.E(op, errors.Str("max_open_files should be greater than or equal to 0"))
+	}
+
+	if cfg.OpenFilesTimeout < 0 {
+		return errors.E(op, errors.Str("open_files_timeout should be greater than or equal to 0"))
+	}
+
+	if cfg.TempTTL < 0 {
+		return errors.E(op, errors.Str("temp_ttl should be greater than or equal to 0"))
+	}
+
+	if cfg.TempSweepInterval < 0 {
+		return errors.E(op, errors.Str("temp_sweep_interval should be greater than or equal to 0"))
+	}
+
+	if cfg.TempSweepInterval == 0 {
+		cfg.TempSweepInterval = cfg.TempTTL
+	}
+
+	if cfg.TempFallbackMemory < 0 {
+		return errors.E(op, errors.Str("temp_fallback_memory should be greater than or equal to 0"))
+	}
+
+	if cfg.TempPattern == "" {
+		cfg.TempPattern = DefaultTempPattern
+	}
+
+	if strings.ContainsRune(cfg.TempPattern, os.PathSeparator) || strings.ContainsRune(cfg.TempPattern, '/') {
+		return errors.E(op, errors.Str("temp_pattern should not contain path separators"))
+	}
+
 	if cfg.Dir == "" {
 		cfg.Dir = os.TempDir()
 	}
@@ -42,8 +196,16 @@ func (cfg *Uploads) InitDefaults() error {
 		delete(cfg.Allowed, k)
 	}
 
+	if len(cfg.AllowMime) > 0 {
+		cfg.AllowedMime = make(map[string]struct{}, len(cfg.AllowMime))
+		for i := range cfg.AllowMime {
+			cfg.AllowedMime[strings.ToLower(strings.TrimSpace(cfg.AllowMime[i]))] = struct{}{}
+		}
+	}
+
 	cfg.Forbid = nil
 	cfg.Allow = nil
+	cfg.AllowMime = nil
 
 	return nil
 }
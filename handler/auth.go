@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// AuthUserAttribute is the attribute the Basic auth user is passed to the worker with.
+	AuthUserAttribute string = "PHP_AUTH_USER"
+	// AuthPasswordAttribute is the attribute the Basic auth password is passed to the worker with.
+	AuthPasswordAttribute string = "PHP_AUTH_PW"
+	// AuthDigestAttribute is the attribute the Digest auth credentials are passed to the worker with.
+	AuthDigestAttribute string = "PHP_AUTH_DIGEST"
+)
+
+const digestScheme string = "digest "
+
+// readAuth passes the Authorization header credentials to the worker the way PHP populates $_SERVER. Malformed
+// credentials are ignored, the header itself is still available to the worker.
+func (r *Request) readAuth(hr *http.Request) {
+	header := hr.Header.Get("Authorization")
+	if header == "" {
+		return
+	}
+
+	if user, password, ok := hr.BasicAuth(); ok {
+		r.setAttribute(AuthUserAttribute, user)
+		r.setAttribute(AuthPasswordAttribute, password)
+		return
+	}
+
+	if len(header) > len(digestScheme) && strings.EqualFold(header[:len(digestScheme)], digestScheme) {
+		r.setAttribute(AuthDigestAttribute, strings.TrimSpace(header[len(digestScheme):]))
+	}
+}
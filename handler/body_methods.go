@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+)
+
+// bodyMethods are the methods the form bodies are parsed for: POST, PUT and PATCH always, and the normally bodyless
+// methods (GET, DELETE...) enabled by parse_body_methods.
+type bodyMethods map[string]struct{}
+
+func newBodyMethods(methods []string) bodyMethods {
+	if len(methods) == 0 {
+		return nil
+	}
+
+	bm := make(bodyMethods, len(methods))
+	for _, m := range methods {
+		bm[strings.ToUpper(m)] = struct{}{}
+	}
+
+	return bm
+}
+
+// form reports whether the form body of the method is parsed, net/http ignores it for the methods other than POST,
+// PUT and PATCH.
+func (bm bodyMethods) form(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return true
+	default:
+		_, ok := bm[method]
+		return ok
+	}
+}
+
+// read reports whether the body of the method is read at all, the HEAD and OPTIONS bodies are not unless enabled.
+func (bm bodyMethods) read(method string) bool {
+	switch method {
+	case http.MethodHead, http.MethodOptions:
+		_, ok := bm[method]
+		return ok
+	default:
+		return true
+	}
+}
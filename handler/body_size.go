@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// bodySizes are the body size limits of the content types, on top of max_request_size.
+type bodySizes struct {
+	patterns mediaPatterns[int64]
+}
+
+// newBodySizes returns nil when no limits are configured.
+func newBodySizes(limits []*config.BodySizeLimit) *bodySizes {
+	if len(limits) == 0 {
+		return nil
+	}
+
+	bs := &bodySizes{patterns: newMediaPatterns[int64]()}
+	for _, l := range limits {
+		bs.patterns.add(l.Pattern, l.MaxSize)
+	}
+
+	return bs
+}
+
+// limit checks the declared body length against the limit of the request content type before the body is read (so
+// the clients waiting for 100 Continue don't send it), and limits the reads of the bodies of unknown length. The
+// requests with the content types without the limit are left to max_request_size.
+func (bs *bodySizes) limit(w http.ResponseWriter, r *http.Request) error {
+	if bs == nil || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+
+	ct := r.Header.Get("Content-Type")
+	limit, ok := bs.patterns.lookup(mediaType(ct))
+	if !ok {
+		return nil
+	}
+
+	if r.ContentLength > limit {
+		return newParseError(ParseErrorBodyTooLarge, errors.Errorf("the %s body of %d bytes exceeds the size limit of %d bytes", mediaType(ct), r.ContentLength, limit)).
+			with(ParseErrorCodeBodyTooLarge, fmt.Sprintf("send the %s bodies of at most %d bytes", mediaType(ct), limit))
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return nil
+}
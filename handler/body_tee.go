@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"io"
+	"math/rand/v2"
+	"net/http"
+
+	"github.com/roadrunner-server/http/v5/config"
+	"go.uber.org/zap"
+)
+
+// bodyTeePattern is the name pattern of the files the built-in sink writes.
+const bodyTeePattern string = "body-*"
+
+// BodySink receives the raw bodies of the sampled requests, see config.BodyTee. Open is called before the body is
+// read, the body is written to the returned writer chunk by chunk while the handler reads it, and the writer is closed
+// once the request is parsed. The sink errors are logged, they never fail the request.
+type BodySink interface {
+	Open(r *http.Request) (io.WriteCloser, error)
+}
+
+// BodySinkFunc is the function adapter of the BodySink.
+type BodySinkFunc func(r *http.Request) (io.WriteCloser, error)
+
+// Open calls f(r).
+func (f BodySinkFunc) Open(r *http.Request) (io.WriteCloser, error) {
+	return f(r)
+}
+
+// NewFileBodySink returns the sink writing each body to its own file in the dir, readable by the owner only. The
+// file name is logged at the info level with the request ID, so the body can be found by the request ID.
+func NewFileBodySink(dir string) BodySink {
+	return BodySinkFunc(func(*http.Request) (io.WriteCloser, error) {
+		return createTempFile(dir, bodyTeePattern)
+	})
+}
+
+// bodyTee samples the requests whose raw bodies are written to the sink.
+type bodyTee struct {
+	rate float64
+	// empty means all paths
+	paths []string
+	// nil disables the capture
+	sink BodySink
+}
+
+// newBodyTee returns nil when the capture is disabled.
+func newBodyTee(cfg *config.BodyTee) *bodyTee {
+	if cfg == nil {
+		return nil
+	}
+
+	return &bodyTee{rate: cfg.SampleRate, paths: cfg.Paths, sink: NewFileBodySink(cfg.Dir)}
+}
+
+// start replaces the body of the sampled request with the one copying what's read to the sink. It's called before
+// the Content-Encoding decoding and the max_body_sizes limits of the handler, so the sink gets the body bytes as they
+// were sent. The max_request_size limit of the server wraps the body before the handler sees it, the body over it is
+// captured up to the limit. Returns nil when the request isn't captured.
+func (bt *bodyTee) start(r *http.Request, log *zap.Logger) *teeBody {
+	if bt == nil || bt.sink == nil || r.Body == nil || r.Body == http.NoBody || !hasPathPrefix(r.URL.Path, bt.paths) {
+		return nil
+	}
+
+	if bt.rate < 1 && rand.Float64() >= bt.rate {
+		return nil
+	}
+
+	w, err := bt.sink.Open(r)
+	if err != nil {
+		log.Warn("request body capture failed", zap.Error(err))
+		return nil
+	}
+
+	if f, ok := w.(interface{ Name() string }); ok {
+		log.Info("request body captured", zap.String("file", f.Name()))
+	}
+
+	tb := &teeBody{ReadCloser: r.Body, w: w}
+	r.Body = tb
+
+	return tb
+}
+
+// teeBody writes the bytes read from the body to the sink. The first write error stops the capture, the body is
+// still read as usual.
+type teeBody struct {
+	io.ReadCloser
+	w   io.WriteCloser
+	err error
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.err == nil {
+		_, b.err = b.w.Write(p[:n])
+	}
+
+	return n, err
+}
+
+// finish closes the sink, the captured body ends where the handler stopped reading it.
+func (b *teeBody) finish(log *zap.Logger) {
+	if b == nil {
+		return
+	}
+
+	err := b.w.Close()
+	if b.err == nil {
+		b.err = err
+	}
+
+	if b.err != nil {
+		log.Warn("request body capture failed", zap.Error(b.err))
+	}
+}
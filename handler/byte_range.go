@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"encoding/json"
+	stderr "errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	// RangeAttribute is the JSON encoded list of the byte ranges of the Range header (ByteRange), see
+	// config.Config.ParseRange.
+	RangeAttribute string = "Range"
+	// RangeErrorAttribute is the code of the Range header the worker should answer with 416, see RangeError.
+	RangeErrorAttribute string = "Range-Error"
+	// maxByteRanges limits the number of the ranges of the Range header, the many small overlapping ranges are the
+	// known denial of service vector of the servers answering them.
+	maxByteRanges = 100
+)
+
+const (
+	// RangeErrorMalformed is the Range header which doesn't follow the RFC 9110 syntax (the last position before the
+	// first one included) or has more than 100 ranges.
+	RangeErrorMalformed string = "malformed"
+	// RangeErrorUnsatisfiable is the Range header with none of its ranges overlapping the representation.
+	RangeErrorUnsatisfiable string = "unsatisfiable"
+)
+
+// ByteRange is the range of the Range header (RFC 9110 14.1.2), bytes=500-999 is {500, 999}, 500- is {500, -1} and
+// the suffix range -500 is {-1, -1, 500}. The positions are inclusive.
+type ByteRange struct {
+	// Start is the first byte position, -1 for the suffix range.
+	Start int64 `json:"start"`
+	// End is the last byte position, -1 for the open ranges and the suffix range.
+	End int64 `json:"end"`
+	// Suffix is the length of the suffix range, 0 for the other ranges.
+	Suffix int64 `json:"suffix,omitempty"`
+}
+
+// RangeError is the Range header the server can't satisfy, the Code is one of the RangeError constants.
+type RangeError struct {
+	Code string
+	Err  error
+}
+
+func (e *RangeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RangeError) Unwrap() error {
+	return e.Err
+}
+
+// ParseRange parses the Range header value. A unit other than bytes is ignored, as the RFC requires, the result is
+// nil then. The positions are not checked against the representation size, see ResolveRanges.
+func ParseRange(header string) ([]ByteRange, error) {
+	unit, set, ok := strings.Cut(header, "=")
+	if !ok {
+		return nil, rangeErr(RangeErrorMalformed, "range unit is missing")
+	}
+
+	if !strings.EqualFold(unit, "bytes") {
+		return nil, nil
+	}
+
+	var ranges []ByteRange
+	for spec := range strings.SplitSeq(set, ",") {
+		// the empty list elements are allowed
+		spec = strings.Trim(spec, " \t")
+		if spec == "" {
+			continue
+		}
+
+		if len(ranges) == maxByteRanges {
+			return nil, rangeErr(RangeErrorMalformed, "more than %d ranges", maxByteRanges)
+		}
+
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, rangeErr(RangeErrorMalformed, "malformed range '%s'", spec)
+		}
+
+		if first == "" {
+			n, ok := rangePos(last)
+			if !ok {
+				return nil, rangeErr(RangeErrorMalformed, "malformed suffix range '%s'", spec)
+			}
+
+			ranges = append(ranges, ByteRange{Start: -1, End: -1, Suffix: n})
+			continue
+		}
+
+		br := ByteRange{End: -1}
+		br.Start, ok = rangePos(first)
+		if ok && last != "" {
+			br.End, ok = rangePos(last)
+			ok = ok && br.End >= br.Start
+		}
+		if !ok {
+			return nil, rangeErr(RangeErrorMalformed, "malformed range '%s'", spec)
+		}
+
+		ranges = append(ranges, br)
+	}
+
+	if len(ranges) == 0 {
+		return nil, rangeErr(RangeErrorMalformed, "no ranges")
+	}
+
+	return ranges, nil
+}
+
+// ResolveRanges validates the ranges against the representation size and returns their absolute positions: the
+// open ranges end with the last byte, the suffix ranges are counted from the end, the ranges past the end are
+// dropped, and the rest are clamped to the size. None of the ranges overlapping the representation is an
+// unsatisfiable RangeError, the 416 response.
+func ResolveRanges(ranges []ByteRange, size int64) ([]ByteRange, error) {
+	out := make([]ByteRange, 0, len(ranges))
+	for _, br := range ranges {
+		switch {
+		case br.Start < 0:
+			if br.Suffix == 0 || size == 0 {
+				continue
+			}
+
+			br.Start, br.End, br.Suffix = max(size-br.Suffix, 0), size-1, 0
+		case br.Start >= size:
+			continue
+		case br.End < 0 || br.End >= size:
+			br.End = size - 1
+		}
+
+		out = append(out, br)
+	}
+
+	if len(out) == 0 {
+		return nil, rangeErr(RangeErrorUnsatisfiable, "no range overlaps the %d bytes", size)
+	}
+
+	return out, nil
+}
+
+// rangePos parses the byte position, the digits only.
+func rangePos(s string) (int64, bool) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+func rangeErr(code, format string, args ...any) *RangeError {
+	return &RangeError{Code: code, Err: errors.Errorf("Range header: "+format, args...)}
+}
+
+// setRange passes the parsed Range header of the GET requests to the worker, the only method the ranges are defined
+// for. The malformed header is flagged with the Range-Error attribute, the request is never rejected.
+func setRange(r *http.Request, req *Request) {
+	values := r.Header.Values("Range")
+	if r.Method != http.MethodGet || len(values) == 0 {
+		return
+	}
+
+	if len(values) > 1 {
+		req.setAttribute(RangeErrorAttribute, RangeErrorMalformed)
+		return
+	}
+
+	ranges, err := ParseRange(values[0])
+	var re *RangeError
+	if stderr.As(err, &re) {
+		req.setAttribute(RangeErrorAttribute, re.Code)
+		return
+	}
+
+	if ranges == nil {
+		return
+	}
+
+	// the ranges always encode
+	data, _ := json.Marshal(ranges)
+	req.setAttribute(RangeAttribute, string(data))
+}
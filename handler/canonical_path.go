@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// RawPathAttribute is the original (escaped) request path, set when the canonical path differs from it.
+const RawPathAttribute string = "Raw-Path"
+
+// canonicalizePath replaces the path of the URL with its canonical form and returns the original escaped path, or
+// empty if the path is already canonical. The escaped path is canonicalized, so the encoded slashes (%2F) stay a part
+// of their segment.
+func canonicalizePath(u *url.URL) string {
+	raw := u.EscapedPath()
+	canonical := canonicalPath(raw)
+	if canonical == raw {
+		return ""
+	}
+
+	p, err := url.PathUnescape(canonical)
+	if err != nil {
+		// EscapedPath is always a valid escaping
+		return ""
+	}
+
+	u.Path, u.RawPath = p, canonical
+
+	return raw
+}
+
+// canonicalPath collapses the duplicate slashes and resolves the dot segments (RFC 3986 5.2.4) of the absolute path,
+// the .. segments never go above the root. The trailing slash is kept, and the path ending with a dot segment ends
+// with the slash (/a/b/.. is /a/). The paths other than the absolute ones (*, empty) are returned as they are.
+func canonicalPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p
+	}
+
+	c := path.Clean(p)
+	if c == "/" {
+		return c
+	}
+
+	last := p[strings.LastIndexByte(p, '/')+1:]
+	if last == "" || last == "." || last == ".." {
+		c += "/"
+	}
+
+	return c
+}
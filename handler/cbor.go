@@ -0,0 +1,321 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// cborBreak is the stop code of the indefinite length items.
+const cborBreak byte = 0xff
+
+// parseCBORBody decodes the CBOR document (RFC 8949) into the data tree the same way the JSON documents are, see
+// parseJSONBody. The CBOR values are mapped to the JSON ones: the integers and the floats are the numbers, the byte
+// strings are the base64 (standard, padded) strings, undefined is null and the tags are skipped, their content is
+// decoded. The integer map keys are the decimal strings, the other keys which are not the text strings, NaN and the
+// infinities, and the simple values other than false, true, null and undefined are rejected.
+func parseCBORBody(r *http.Request, sc jsonScalars, dl *parseDeadline) (dataTree, error) {
+	const op = errors.Op("parse_cbor_body")
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// the document decoding is a part of the parsing
+	dl.start()
+
+	d := &cborDecoder{data: body}
+	doc, err := d.value(0)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	if d.pos != len(body) {
+		return nil, errors.E(op, newParseError(ParseErrorMalformed, errors.Str("unexpected data after the CBOR document")))
+	}
+
+	data, ok, err := documentTree(doc, sc, dl)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	if !ok {
+		return nil, errors.E(op, newParseError(ParseErrorMalformed, errors.Str("CBOR document should be a map or an array")))
+	}
+
+	return data, nil
+}
+
+// cborDecoder decodes the CBOR items into the values encoding/json decodes the JSON documents into (with UseNumber),
+// so the rest of the parse is shared. The lengths are checked against the bytes left before anything is allocated.
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// value decodes the next item, level is the nesting of the arrays, the maps and the tags.
+func (d *cborDecoder) value(level int) (any, error) {
+	if level >= MaxLevel {
+		return nil, newParseError(ParseErrorMalformed, errors.Errorf("CBOR document exceeds the maximum nesting level %d", MaxLevel)).
+			with(ParseErrorCodeLimitExceeded, fmt.Sprintf("nest the CBOR document at most %d levels deep", MaxLevel))
+	}
+
+	start := d.pos
+	major, arg, indefinite, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		return json.Number(strconv.FormatUint(arg, 10)), nil
+	case 1:
+		// -1 - arg, the arguments above MaxInt64 don't fit int64
+		n := new(big.Int).SetUint64(arg)
+		return json.Number(n.Neg(n.Add(n, big.NewInt(1))).String()), nil
+	case 2:
+		b, err := d.bytes(major, arg, indefinite)
+		if err != nil {
+			return nil, err
+		}
+
+		return base64.StdEncoding.EncodeToString(b), nil
+	case 3:
+		b, err := d.bytes(major, arg, indefinite)
+		if err != nil {
+			return nil, err
+		}
+
+		if !utf8.Valid(b) {
+			return nil, d.errorf(start, "text string is not valid UTF-8")
+		}
+
+		return string(b), nil
+	case 4:
+		return d.array(arg, indefinite, level)
+	case 5:
+		return d.object(arg, indefinite, level)
+	case 6:
+		return d.value(level + 1)
+	default:
+		return d.simple(start, arg)
+	}
+}
+
+// head reads the initial byte and the argument of the item. The argument of the indefinite length items is 0.
+func (d *cborDecoder) head() (byte, uint64, bool, error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, false, d.errorf(d.pos, "unexpected end of the document")
+	}
+
+	start := d.pos
+	b := d.data[d.pos]
+	d.pos++
+
+	major, info := b>>5, b&0x1f
+	switch {
+	case info < 24:
+		return major, uint64(info), false, nil
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(d.data)-d.pos < n {
+			return 0, 0, false, d.errorf(d.pos, "unexpected end of the document")
+		}
+
+		var arg uint64
+		for _, c := range d.data[d.pos : d.pos+n] {
+			arg = arg<<8 | uint64(c)
+		}
+
+		d.pos += n
+		return major, arg, false, nil
+	case info == 31 && major >= 2 && major <= 5:
+		return major, 0, true, nil
+	case info == 31 && major == 7:
+		return 0, 0, false, d.errorf(start, "unexpected break")
+	default:
+		return 0, 0, false, d.errorf(start, "reserved additional information %d", info)
+	}
+}
+
+// bytes reads the content of the byte or text string, the chunks of the indefinite length string are concatenated.
+func (d *cborDecoder) bytes(major byte, n uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, d.errorf(d.pos, "string of %d bytes exceeds the document", n)
+		}
+
+		b := d.data[d.pos : d.pos+int(n)]
+		d.pos += int(n)
+		return b, nil
+	}
+
+	var out []byte
+	for {
+		if d.pos < len(d.data) && d.data[d.pos] == cborBreak {
+			d.pos++
+			return out, nil
+		}
+
+		start := d.pos
+		chunkMajor, chunkLen, chunkIndefinite, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+
+		if chunkMajor != major || chunkIndefinite {
+			return nil, d.errorf(start, "indefinite length string chunk of another type")
+		}
+
+		chunk, err := d.bytes(major, chunkLen, false)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, chunk...)
+	}
+}
+
+func (d *cborDecoder) array(n uint64, indefinite bool, level int) ([]any, error) {
+	if !indefinite && n > uint64(len(d.data)-d.pos) {
+		return nil, d.errorf(d.pos, "array of %d items exceeds the document", n)
+	}
+
+	arr := make([]any, 0, int(n)) //nolint:gosec
+	for i := uint64(0); indefinite || i < n; i++ {
+		if indefinite && d.breaks() {
+			break
+		}
+
+		v, err := d.value(level + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		arr = append(arr, v)
+	}
+
+	return arr, nil
+}
+
+func (d *cborDecoder) object(n uint64, indefinite bool, level int) (map[string]any, error) {
+	if !indefinite && n > uint64(len(d.data)-d.pos)/2 {
+		return nil, d.errorf(d.pos, "map of %d pairs exceeds the document", n)
+	}
+
+	obj := make(map[string]any, int(n)) //nolint:gosec
+	for i := uint64(0); indefinite || i < n; i++ {
+		if indefinite && d.breaks() {
+			break
+		}
+
+		k, err := d.key(level)
+		if err != nil {
+			return nil, err
+		}
+
+		// the later duplicate keys override the earlier ones, the same as in JSON
+		obj[k], err = d.value(level + 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return obj, nil
+}
+
+// key decodes the map key, the text strings and the integers only.
+func (d *cborDecoder) key(level int) (string, error) {
+	if d.pos < len(d.data) {
+		switch d.data[d.pos] >> 5 {
+		case 0, 1, 3:
+			v, err := d.value(level + 1)
+			if err != nil {
+				return "", err
+			}
+
+			if n, ok := v.(json.Number); ok {
+				return n.String(), nil
+			}
+
+			return v.(string), nil
+		}
+	}
+
+	return "", d.errorf(d.pos, "map key should be a text string or an integer")
+}
+
+// breaks consumes the stop code of the indefinite length array or map, if it's next.
+func (d *cborDecoder) breaks() bool {
+	if d.pos < len(d.data) && d.data[d.pos] == cborBreak {
+		d.pos++
+		return true
+	}
+
+	return false
+}
+
+// simple decodes the major type 7: the simple values and the floats, the argument holds the float bits.
+func (d *cborDecoder) simple(start int, arg uint64) (any, error) {
+	var f float64
+	switch info := d.data[start] & 0x1f; info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		f = halfFloat(uint16(arg)) //nolint:gosec
+	case 26:
+		f = float64(math.Float32frombits(uint32(arg))) //nolint:gosec
+	case 27:
+		f = math.Float64frombits(arg)
+	default:
+		return nil, d.errorf(start, "unsupported simple value %d", arg)
+	}
+
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, d.errorf(start, "float %v has no JSON number form", f)
+	}
+
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+}
+
+func (d *cborDecoder) errorf(pos int, format string, args ...any) error {
+	return newParseError(ParseErrorMalformed, errors.Errorf("malformed CBOR at byte %d: %s", pos, fmt.Sprintf(format, args...)))
+}
+
+// halfFloat converts the IEEE 754 half precision float bits.
+func halfFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		f = math.Inf(1)
+		if mant != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if h&0x8000 != 0 {
+		f = -f
+	}
+
+	return f
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// checkboxGroup is the form branch of the checkbox group: the browsers send only the checked boxes, so the absent
+// keys are the unchecked ones.
+type checkboxGroup struct {
+	path []string
+	keys []string
+}
+
+// checkboxGroups fills the configured checkbox groups of the parsed forms with booleans.
+type checkboxGroups []checkboxGroup
+
+// newCheckboxGroups returns nil when no group is configured.
+func newCheckboxGroups(cfg []*config.CheckboxGroup, phpKeys bool) checkboxGroups {
+	if len(cfg) == 0 {
+		return nil
+	}
+
+	cg := make(checkboxGroups, 0, len(cfg))
+	for _, g := range cfg {
+		cg = append(cg, checkboxGroup{path: splitKey(g.Prefix, phpKeys), keys: g.Keys})
+	}
+
+	return cg
+}
+
+// apply sets the expected keys of each group to true when they were sent (whatever the value, "on" by default) and
+// to false when they are absent. The group missing from the form is added with all the keys false, the other keys of
+// the group and the groups which are not branches (perm=on) are left as is.
+func (cg checkboxGroups) apply(data dataTree) {
+	for _, g := range cg {
+		node := data
+		for _, k := range g.path {
+			v, ok := node[k]
+			if !ok {
+				v = dataTree{}
+				node[k] = v
+			}
+
+			branch, ok := v.(dataTree)
+			if !ok {
+				node = nil
+				break
+			}
+
+			node = branch
+		}
+
+		if node == nil {
+			continue
+		}
+
+		for _, k := range g.keys {
+			_, checked := node[k]
+			node[k] = checked
+		}
+	}
+}
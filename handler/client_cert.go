@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// clientCert passes the details of the verified client certificate to the worker, see config.ClientCert.
+type clientCert struct {
+	subject     string
+	issuer      string
+	serial      string
+	fingerprint string
+}
+
+// newClientCert returns nil when the client certificate variables are disabled.
+func newClientCert(cfg *config.ClientCert) *clientCert {
+	if cfg == nil {
+		return nil
+	}
+
+	return &clientCert{
+		subject:     cfg.Subject,
+		issuer:      cfg.Issuer,
+		serial:      cfg.Serial,
+		fingerprint: cfg.Fingerprint,
+	}
+}
+
+// set sets the variables of the leaf certificate of the verified chain. The certificates the client sent without them
+// being verified (tls.RequestClientCert) are ignored, the worker can't trust them.
+func (c *clientCert) set(r *http.Request, req *Request) {
+	if c == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	sum := sha256.Sum256(cert.Raw)
+
+	req.setAttribute(c.subject, cert.Subject.String())
+	req.setAttribute(c.issuer, cert.Issuer.String())
+	req.setAttribute(c.serial, fmt.Sprintf("%X", cert.SerialNumber))
+	req.setAttribute(c.fingerprint, hex.EncodeToString(sum[:]))
+}
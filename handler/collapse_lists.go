@@ -0,0 +1,22 @@
+package handler
+
+// collapseLists replaces the single element lists of the fields matched by the patterns with the element (a[]=1 is
+// a=1), see config.Parse.CollapseLists. The longer lists and the indexed fields (a[0]=1) are kept.
+func (fp fieldPatterns) collapseLists(dt dataTree, prefix []string) {
+	if len(fp) == 0 {
+		return
+	}
+
+	for k, v := range dt {
+		keys := append(prefix[:len(prefix):len(prefix)], k)
+
+		switch actual := v.(type) {
+		case dataTree:
+			fp.collapseLists(actual, keys)
+		case []string:
+			if len(actual) == 1 && fp.match(keys...) {
+				dt[k] = actual[0]
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	stderr "errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// decodeBody replaces the body of the request sent with Content-Encoding by the decoded stream. The transfer
+// encoding (chunked) is already removed by the server, the content encodings are removed in the reverse order they
+// were applied (gzip, deflate). The size limit applies to the decoded stream, the decoded bodies have the unknown
+// length. The bodies expanding more than the max_decode_ratio times their encoded size are rejected as the
+// decompression bombs, as soon as the ratio is crossed. The Content-Encoding header is removed, the worker gets the
+// decoded body.
+func (h *Handler) decodeBody(r *http.Request) error {
+	const op = errors.Op("decode_body")
+
+	header := r.Header.Values("Content-Encoding")
+	if !h.decodeContentEncoding || len(header) == 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+
+	var encodings []string
+	for _, v := range header {
+		for enc := range strings.SplitSeq(v, ",") {
+			enc = strings.ToLower(strings.TrimSpace(enc))
+			if enc != "" && enc != "identity" {
+				encodings = append(encodings, enc)
+			}
+		}
+	}
+
+	if len(encodings) == 0 {
+		r.Header.Del("Content-Encoding")
+		return nil
+	}
+
+	encoded := &countingBody{ReadCloser: r.Body}
+	body := io.Reader(encoded)
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err error
+		switch encodings[i] {
+		case "gzip", "x-gzip":
+			body, err = gzip.NewReader(body)
+		case "deflate":
+			body, err = zlib.NewReader(body)
+		default:
+			return errors.E(op, newParseError(ParseErrorUnsupportedMediaType, errors.Errorf("unsupported Content-Encoding: %s", encodings[i])))
+		}
+		if err != nil {
+			return errors.E(op, decodeError(err))
+		}
+	}
+
+	r.Body = &decodedBody{r: body, closer: r.Body, limit: h.maxDecodedSize, encoded: encoded, ratio: h.maxDecodeRatio}
+	r.ContentLength = -1
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+
+	return nil
+}
+
+// decodeRatioGrace is the decoded size the ratio isn't checked under, the small bodies of the repeated values
+// legitimately compress well above any sensible ratio.
+const decodeRatioGrace = 64 << 10
+
+// decodedBody reads the decoded body up to the limit, the malformed encoded data is reported as the client error.
+type decodedBody struct {
+	r      io.Reader
+	closer io.Closer
+	// 0 means unlimited
+	limit int64
+	read  int64
+	// the encoded bytes read so far, and the max decoded to encoded ratio (0 means unlimited)
+	encoded *countingBody
+	ratio   int64
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	// one byte over the limit is enough to tell the body is too large
+	if b.limit > 0 && int64(len(p)) > b.limit-b.read+1 {
+		p = p[:b.limit-b.read+1]
+	}
+
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	if b.limit > 0 && b.read > b.limit {
+		return n - int(b.read-b.limit), newParseError(ParseErrorBodyTooLarge, errors.Errorf("decoded body exceeds the size limit of %d bytes", b.limit))
+	}
+
+	if b.ratio > 0 && b.read > decodeRatioGrace && b.read > b.ratio*b.encoded.n {
+		return 0, newParseError(ParseErrorBodyTooLarge, errors.Errorf("decoded body expands more than %d times its encoded size", b.ratio)).
+			with(ParseErrorCodeDecodeRatioExceeded, "send the body without the Content-Encoding or with a lower compression ratio")
+	}
+
+	if err != nil && !stderr.Is(err, io.EOF) {
+		return n, decodeError(err)
+	}
+
+	return n, err
+}
+
+func (b *decodedBody) Close() error {
+	return b.closer.Close()
+}
+
+// decodeError converts the errors of the malformed encoded data to the client errors, the errors of the underlying
+// body (timeouts, size limits) are kept as they are.
+func decodeError(err error) error {
+	var corrupt flate.CorruptInputError
+	switch {
+	case stderr.Is(err, gzip.ErrHeader), stderr.Is(err, gzip.ErrChecksum), stderr.Is(err, zlib.ErrHeader),
+		stderr.Is(err, zlib.ErrChecksum), stderr.Is(err, zlib.ErrDictionary), stderr.Is(err, io.ErrUnexpectedEOF),
+		stderr.As(err, &corrupt):
+		return newParseError(ParseErrorMalformed, errors.Errorf("malformed encoded body: %v", err)).
+			with(ParseErrorCodeInvalidEncoding, "send the body encoded with the declared Content-Encoding")
+	default:
+		return err
+	}
+}
@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+const (
+	mimeURLEncoded string = "application/x-www-form-urlencoded"
+	mimeMultipart  string = "multipart/form-data"
+)
+
+// contentTypes maps the request media types to the body parsers. Exact matches take precedence over the
+// structured syntax suffixes (+json), which take precedence over the type wildcards (text/*).
+type contentTypes struct {
+	patterns mediaPatterns[int]
+	// parser for the bodies without Content-Type
+	missing int
+	// the malformed headers are rejected instead of being matched the lenient way
+	strict bool
+}
+
+func newContentTypes(cts []*config.ContentType, missing string) (*contentTypes, error) {
+	const op = errors.Op("content_types")
+
+	c := &contentTypes{
+		patterns: newMediaPatterns[int](),
+		missing:  contentStream,
+	}
+
+	c.patterns.add(mimeURLEncoded, contentURLEncoded)
+	c.patterns.add(mimeMultipart, contentMultipart)
+
+	switch missing {
+	case config.MissingContentTypeURLEncoded:
+		c.missing = contentURLEncoded
+	case config.MissingContentTypeReject:
+		c.missing = contentUnsupported
+	case config.MissingContentTypeRaw, "":
+	default:
+		return nil, errors.E(op, errors.Errorf("unknown missing_content_type option: %s", missing))
+	}
+
+	for _, ct := range cts {
+		if ct == nil {
+			continue
+		}
+
+		parser, ok := parserByName(ct.Parser)
+		if !ok {
+			return nil, errors.E(op, errors.Errorf("unknown parser '%s' for the content type '%s'", ct.Parser, ct.Pattern))
+		}
+
+		c.patterns.add(ct.Pattern, parser)
+	}
+
+	return c, nil
+}
+
+// mediaPatterns maps the media type patterns to the values: the exact media types, the structured syntax suffixes
+// (+json) and the type wildcards (text/*), matched in this order.
+type mediaPatterns[V any] struct {
+	exact    map[string]V
+	suffix   map[string]V
+	wildcard map[string]V
+}
+
+func newMediaPatterns[V any]() mediaPatterns[V] {
+	return mediaPatterns[V]{
+		exact:    make(map[string]V),
+		suffix:   make(map[string]V),
+		wildcard: make(map[string]V),
+	}
+}
+
+func (mp mediaPatterns[V]) add(pattern string, v V) {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	switch {
+	case strings.HasPrefix(pattern, "+"):
+		mp.suffix[pattern] = v
+	case strings.HasSuffix(pattern, "/*"):
+		mp.wildcard[strings.TrimSuffix(pattern, "/*")] = v
+	default:
+		mp.exact[pattern] = v
+	}
+}
+
+// lookup returns the value of the most specific pattern matching the lowercased media type.
+func (mp mediaPatterns[V]) lookup(mt string) (V, bool) {
+	if v, ok := mp.exact[mt]; ok {
+		return v, true
+	}
+
+	if i := strings.LastIndexByte(mt, '+'); i != -1 {
+		if v, ok := mp.suffix[mt[i:]]; ok {
+			return v, true
+		}
+	}
+
+	if i := strings.IndexByte(mt, '/'); i != -1 {
+		if v, ok := mp.wildcard[mt[:i]]; ok {
+			return v, true
+		}
+	}
+
+	var zero V
+	return zero, false
+}
+
+func parserByName(name string) (int, bool) {
+	switch name {
+	case config.ParserURLEncoded:
+		return contentURLEncoded, true
+	case config.ParserMultipart:
+		return contentMultipart, true
+	case config.ParserJSON:
+		return contentJSON, true
+	case config.ParserNDJSON:
+		return contentNDJSON, true
+	case config.ParserRaw:
+		return contentStream, true
+	case config.ParserRelated:
+		return contentRelated, true
+	case config.ParserCBOR:
+		return contentCBOR, true
+	default:
+		return 0, false
+	}
+}
+
+// match returns the parser for the Content-Type header value. hasBody tells if the request declares a non-empty body,
+// the empty bodies without Content-Type are always passed as is.
+func (c *contentTypes) match(header string, hasBody bool) int {
+	if header == "" && hasBody {
+		return c.missing
+	}
+
+	if ct, ok := c.patterns.lookup(mediaType(header)); ok {
+		return ct
+	}
+
+	// malformed headers are matched the lenient way
+	if strings.Contains(header, mimeURLEncoded) || strings.Contains(header, mimeMultipart) {
+		if c.strict {
+			return contentMismatch
+		}
+
+		if strings.Contains(header, mimeURLEncoded) {
+			return contentURLEncoded
+		}
+
+		return contentMultipart
+	}
+
+	return contentStream
+}
+
+// mediaType returns the lowercased media type without parameters.
+func mediaType(header string) string {
+	if i := strings.IndexByte(header, ';'); i != -1 {
+		header = header[:i]
+	}
+
+	return strings.ToLower(strings.TrimSpace(header))
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"slices"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/http/v5/config"
+	"go.uber.org/zap"
+)
+
+// CookieErrorsAttribute lists the configured cookies which failed to verify or decode, see config.CookieCodec. The
+// cookies are removed, the worker never gets the tampered values.
+const CookieErrorsAttribute string = "Cookie-Errors"
+
+// CookieCodec verifies and decodes the signed or encrypted cookie value, the error rejects the cookie. The codec must
+// compare the signatures in constant time (hmac.Equal, crypto/subtle).
+type CookieCodec interface {
+	DecodeCookie(name, value string) (string, error)
+}
+
+// CookieCodecFunc is the function adapter of the CookieCodec.
+type CookieCodecFunc func(name, value string) (string, error)
+
+// DecodeCookie calls f(name, value).
+func (f CookieCodecFunc) DecodeCookie(name, value string) (string, error) {
+	return f(name, value)
+}
+
+// NewSignedCookieCodec returns the codec of the cookies signed with HMAC-SHA256: the value is the payload followed by
+// a dot and the unpadded base64url signature of name=payload, the name is signed so the value of one cookie can't be
+// sent as another one. The decoded value is the payload.
+func NewSignedCookieCodec(key []byte) CookieCodec {
+	return &signedCookieCodec{key: key}
+}
+
+type signedCookieCodec struct {
+	key []byte
+}
+
+func (c *signedCookieCodec) DecodeCookie(name, value string) (string, error) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", errors.Str("cookie is not signed")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return "", errors.Str("malformed cookie signature")
+	}
+
+	mac := hmac.New(sha256.New, c.key)
+	_, _ = mac.Write([]byte(name + "=" + value[:i]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", errors.Str("cookie signature mismatch")
+	}
+
+	return value[:i], nil
+}
+
+// cookieDecoding decodes the configured cookies of the requests.
+type cookieDecoding struct {
+	names map[string]struct{}
+	// nil rejects all the configured cookies
+	codec CookieCodec
+}
+
+// newCookieDecoding returns nil when no cookies are decoded.
+func newCookieDecoding(cfg *config.CookieCodec) *cookieDecoding {
+	if cfg == nil || len(cfg.Cookies) == 0 {
+		return nil
+	}
+
+	cd := &cookieDecoding{names: make(map[string]struct{}, len(cfg.Cookies))}
+	for _, name := range cfg.Cookies {
+		cd.names[name] = struct{}{}
+	}
+
+	if cfg.Key != "" {
+		cd.codec = NewSignedCookieCodec([]byte(cfg.Key))
+	}
+
+	return cd
+}
+
+// decode replaces the configured cookies with their decoded values. It fails closed: the cookies the codec rejects,
+// or all of them without a codec, are removed and listed in the Cookie-Errors attribute.
+func (cd *cookieDecoding) decode(req *Request, log *zap.Logger) {
+	if cd == nil {
+		return
+	}
+
+	var failed []string
+	for name, value := range req.Cookies {
+		if _, ok := cd.names[name]; !ok {
+			continue
+		}
+
+		decoded, err := "", errors.Str("no cookie codec is set")
+		if cd.codec != nil {
+			decoded, err = cd.codec.DecodeCookie(name, value)
+		}
+
+		if err != nil {
+			log.Debug("cookie rejected", zap.String("cookie", name), zap.Error(err))
+			delete(req.Cookies, name)
+			failed = append(failed, name)
+			continue
+		}
+
+		req.Cookies[name] = decoded
+	}
+
+	if len(failed) > 0 {
+		slices.Sort(failed)
+		req.setAttribute(CookieErrorsAttribute, failed...)
+	}
+}
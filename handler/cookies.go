@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// cookieLimits caps the cookies of the request, see config.Parse.MaxCookieCount and config.Parse.MaxCookieBytes.
+type cookieLimits struct {
+	// 0 means unlimited
+	count int
+	bytes int64
+	// drop the cookies over the limits instead of rejecting the request
+	truncate bool
+}
+
+// newCookieLimits returns nil when the cookies are unlimited.
+func newCookieLimits(cfg *config.Parse) *cookieLimits {
+	if cfg.MaxCookieCount <= 0 && cfg.MaxCookieBytes <= 0 {
+		return nil
+	}
+
+	return &cookieLimits{
+		count:    cfg.MaxCookieCount,
+		bytes:    cfg.MaxCookieBytes,
+		truncate: cfg.CookieLimitAction == config.CookieLimitTruncate,
+	}
+}
+
+// read sets the unescaped cookies of the request. With the limits, the Cookie headers are split pair by pair and the
+// limits are checked before each pair is parsed, so the flood of cookies is never parsed as a whole. The malformed
+// pairs count against the limits and are skipped, the same way net/http skips them.
+func (cl *cookieLimits) read(r *http.Request, req *Request) error {
+	if cl == nil {
+		for _, c := range r.Cookies() {
+			req.setCookie(c)
+		}
+
+		return nil
+	}
+
+	count, size := 0, int64(0)
+	for _, line := range r.Header.Values("Cookie") {
+		for pair := range strings.SplitSeq(line, ";") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+
+			count++
+			size += int64(len(pair))
+			if (cl.count > 0 && count > cl.count) || (cl.bytes > 0 && size > cl.bytes) {
+				if !cl.truncate {
+					return cl.err()
+				}
+
+				req.warnings.add(ParseWarningCookiesTruncated, "the cookies after the first %d exceed the limits, dropped", count-1)
+				return nil
+			}
+
+			cookies, err := http.ParseCookie(pair)
+			if err != nil {
+				continue
+			}
+
+			for _, c := range cookies {
+				req.setCookie(c)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (cl *cookieLimits) err() error {
+	return newParseError(ParseErrorHeaderTooLarge, errors.Errorf("request cookies exceed the limits of %d cookies and %d bytes", cl.count, cl.bytes)).
+		with(ParseErrorCodeHeaderTooLarge, fmt.Sprintf("send at most %d cookies of at most %d bytes in total (0 means unlimited)", cl.count, cl.bytes))
+}
+
+// setCookie sets the unescaped cookie value, the values which can't be unescaped are skipped.
+func (r *Request) setCookie(c *http.Cookie) {
+	if v, err := url.QueryUnescape(c.Value); err == nil {
+		r.Cookies[c.Name] = v
+	}
+}
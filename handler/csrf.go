@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// csrfCheck compares the double-submit CSRF tokens of the cookie and the parsed body field.
+type csrfCheck struct {
+	cookie string
+	field  string
+	// empty means all paths
+	paths []string
+}
+
+// newCSRFCheck returns nil when the check is disabled.
+func newCSRFCheck(cfg *config.CSRF) *csrfCheck {
+	if cfg == nil || cfg.Cookie == "" || cfg.Field == "" {
+		return nil
+	}
+
+	return &csrfCheck{
+		cookie: cfg.Cookie,
+		field:  cfg.Field,
+		paths:  cfg.Paths,
+	}
+}
+
+// check rejects the unsafe requests to the checked paths with 403 when the tokens are missing or don't match. The
+// token field is left in the parsed data.
+func (c *csrfCheck) check(hr *http.Request, req *Request) error {
+	if c == nil || !c.applies(hr) {
+		return nil
+	}
+
+	cookie := req.Cookies[c.cookie]
+
+	var field string
+	if data, ok := req.body.(dataTree); ok && req.Parsed {
+		field, _ = data[c.field].(string)
+	}
+
+	if cookie == "" || field == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(field)) != 1 {
+		return newParseError(ParseErrorForbidden, errors.Str("CSRF token mismatch"))
+	}
+
+	return nil
+}
+
+func (c *csrfCheck) applies(hr *http.Request) bool {
+	switch hr.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return false
+	}
+
+	return hasPathPrefix(hr.URL.Path, c.paths)
+}
+
+// hasPathPrefix reports whether the path starts with any of the prefixes, empty prefixes list matches all paths.
+func hasPathPrefix(path string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+
+	for _, p := range prefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/roadrunner-server/http/v5/config"
+	"github.com/roadrunner-server/http/v5/handler/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_CSRF(t *testing.T) {
+	csrf := &config.CSRF{Cookie: "XSRF-TOKEN", Field: "_token", Paths: []string{"/admin"}}
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		cookie string
+		form   url.Values
+		status int
+	}{
+		{name: "match", method: http.MethodPost, path: "/admin/users", cookie: "abc", form: url.Values{"_token": {"abc"}}, status: http.StatusInternalServerError},
+		{name: "mismatch", method: http.MethodPost, path: "/admin/users", cookie: "abc", form: url.Values{"_token": {"abd"}}, status: http.StatusForbidden},
+		{name: "missing cookie", method: http.MethodPost, path: "/admin", form: url.Values{"_token": {"abc"}}, status: http.StatusForbidden},
+		{name: "missing field", method: http.MethodPut, path: "/admin", cookie: "abc", form: url.Values{"name": {"n"}}, status: http.StatusForbidden},
+		{name: "nested field", method: http.MethodPost, path: "/admin", cookie: "abc", form: url.Values{"_token[a]": {"abc"}}, status: http.StatusForbidden},
+		{name: "other path", method: http.MethodPost, path: "/public", cookie: "abc", form: url.Values{"_token": {"abd"}}, status: http.StatusInternalServerError},
+		{name: "safe method", method: http.MethodGet, path: "/admin", cookie: "abc", status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{CSRF: csrf}})
+
+			r := handlertest.NewURLEncodedRequest(tt.method, tt.path, tt.form)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "XSRF-TOKEN", Value: tt.cookie})
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.status, w.Code)
+			if tt.status == http.StatusForbidden {
+				assert.Nil(t, p.pld)
+			}
+		})
+	}
+
+	t.Run("token kept with the fields allowlist", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{
+			CSRF:   &config.CSRF{Cookie: "XSRF-TOKEN", Field: "_token"},
+			Fields: &config.Fields{Allowed: []string{"name"}},
+		}})
+
+		r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"_token": {"abc"}, "name": {"n"}, "extra": {"x"}})
+		r.AddCookie(&http.Cookie{Name: "XSRF-TOKEN", Value: "abc"})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		require.NotNil(t, p.pld)
+		assert.JSONEq(t, `{"_token":"abc","name":"n"}`, string(p.pld.Body))
+	})
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type connKey struct{}
+
+// connInfo is the state of the client connection shared by the requests sent over it.
+type connInfo struct {
+	requests atomic.Int64
+}
+
+// ConnContext is the http.Server ConnContext hook which lets the handler count the requests of the keep-alive
+// connections, so the body read failures on the reused connections can be told apart.
+func ConnContext(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, &connInfo{})
+}
+
+// connRequest counts the request and returns its number on the connection, 0 if the connection isn't tracked.
+func connRequest(ctx context.Context) int64 {
+	ci, ok := ctx.Value(connKey{}).(*connInfo)
+	if !ok {
+		return 0
+	}
+
+	return ci.requests.Add(1)
+}
+
+// setBodyDeadline sets the read deadline for the body of this request only. The returned function clears it, the
+// server sets its own deadlines again when it reads the next request from the connection.
+func (h *Handler) setBodyDeadline(w http.ResponseWriter, log *zap.Logger) func() {
+	if h.bodyReadTimeout == 0 {
+		return func() {}
+	}
+
+	rc := http.NewResponseController(w)
+	err := rc.SetReadDeadline(time.Now().Add(h.bodyReadTimeout))
+	if err != nil {
+		log.Debug("body read timeout is not supported by the connection", zap.Error(err))
+		return func() {}
+	}
+
+	return func() {
+		_ = rc.SetReadDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// ParseDiagnosticsAttribute is the attribute with the JSON encoded details of how the body was parsed, passed to the
+// worker when the parse diagnostics are enabled. The attributes never collide with the form fields.
+const ParseDiagnosticsAttribute string = "Parse-Diagnostics"
+
+// ParseSummaryHeader is the response header with the summary of how the request was parsed, see
+// config.Parse.ParseSummaryHeader.
+const ParseSummaryHeader string = "X-RR-Parse-Summary"
+
+// nearLimitRatio is the part of a limit the request should use to have the limit reported as close to tripping.
+const nearLimitRatio = 0.8
+
+// parseDiagnostics are the details of the parsed body, for the worker error handlers to log.
+type parseDiagnostics struct {
+	// media type of the body, without parameters
+	ContentType string `json:"contentType"`
+	Parser      string `json:"parser"`
+	Boundary    string `json:"boundary,omitempty"`
+	Parts       int    `json:"parts,omitempty"`
+	Fields      int    `json:"fields"`
+	Files       int    `json:"files"`
+	// the limits the request used at least 80% of
+	NearLimits []string `json:"nearLimits,omitempty"`
+}
+
+// setDiagnostics attaches the parse diagnostics and the parse summary to the parsed request.
+func (h *Handler) setDiagnostics(r *http.Request, req *Request, ct int, dl *parseDeadline) {
+	if !h.parseDiagnostics && !h.parseSummary {
+		return
+	}
+
+	d := &parseDiagnostics{
+		ContentType: mediaType(r.Header.Get("Content-Type")),
+		Parser:      parserName(ct),
+	}
+
+	if data, ok := req.body.(dataTree); ok {
+		d.Fields = data.count()
+		if ct == contentNDJSON && h.ndjsonMaxLines > 0 && float64(len(data)) >= nearLimitRatio*float64(h.ndjsonMaxLines) {
+			d.NearLimits = append(d.NearLimits, "ndjson_max_lines")
+		}
+	}
+
+	if req.form != nil {
+		d.Boundary = req.form.boundary
+		d.Parts = req.form.parts
+		if float64(d.Parts) >= nearLimitRatio*maxMultipartParts {
+			d.NearLimits = append(d.NearLimits, "multipart_parts")
+		}
+	}
+
+	if req.Uploads != nil {
+		d.Files = len(req.Uploads.list)
+		if limit := h.multipartOpts.maxFileSize; limit > 0 {
+			for _, f := range req.Uploads.list {
+				if float64(uploadSize(f)) >= nearLimitRatio*float64(limit) {
+					d.NearLimits = append(d.NearLimits, "max_file_size")
+					break
+				}
+			}
+		}
+	}
+
+	if dl.used() >= nearLimitRatio {
+		d.NearLimits = append(d.NearLimits, "max_parse_duration")
+	}
+
+	if h.parseSummary {
+		req.parseSummary = d.summary()
+	}
+
+	if !h.parseDiagnostics {
+		return
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+
+	req.setAttribute(ParseDiagnosticsAttribute, string(b))
+}
+
+// summary returns the diagnostics without the multipart details as the structured field dictionary (RFC 8941):
+// type="multipart/form-data", parser=multipart, fields=3, files=1, near-limits=(max_file_size).
+func (d *parseDiagnostics) summary() string {
+	var sb strings.Builder
+	sb.WriteString(`type="`)
+	for _, c := range []byte(d.ContentType) {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			sb.WriteByte(c)
+		}
+	}
+
+	sb.WriteString(`", parser=`)
+	sb.WriteString(d.Parser)
+	sb.WriteString(", fields=")
+	sb.WriteString(strconv.Itoa(d.Fields))
+	sb.WriteString(", files=")
+	sb.WriteString(strconv.Itoa(d.Files))
+	sb.WriteString(", near-limits=(")
+	sb.WriteString(strings.Join(d.NearLimits, " "))
+	sb.WriteByte(')')
+
+	return sb.String()
+}
+
+// uploadSize returns the size of the upload read from the body, before it's moved to the temp file.
+func uploadSize(f *FileUpload) int64 {
+	if fp, ok := f.source.(*filePart); ok {
+		return fp.size
+	}
+
+	return f.Size
+}
+
+func parserName(ct int) string {
+	switch ct {
+	case contentMultipart:
+		return config.ParserMultipart
+	case contentURLEncoded:
+		return config.ParserURLEncoded
+	case contentJSON:
+		return config.ParserJSON
+	case contentNDJSON:
+		return config.ParserNDJSON
+	case contentRelated:
+		return config.ParserRelated
+	case contentCBOR:
+		return config.ParserCBOR
+	case contentEmptyForm:
+		return "empty"
+	default:
+		return config.ParserRaw
+	}
+}
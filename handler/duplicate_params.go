@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/http/v5/config"
+	"go.uber.org/zap"
+)
+
+// DuplicateParamsAttribute lists the top-level parameters found both in the query and in the body, when the
+// duplicate params check is configured to flag them.
+const DuplicateParamsAttribute string = "Duplicate-Params"
+
+// duplicateParamsCheck looks for the top-level keys present both in the query and in the parsed body (the data and
+// the uploads trees). PHP merges both into $_REQUEST and silently picks one, for the endpoints where a parameter
+// must come from exactly one source such a collision is rejected or reported to the worker.
+type duplicateParamsCheck struct {
+	flag    bool
+	phpKeys bool
+	// empty means all paths
+	paths []string
+}
+
+// newDuplicateParamsCheck returns nil when the check is disabled.
+func newDuplicateParamsCheck(cfg *config.DuplicateParams, phpKeys bool) *duplicateParamsCheck {
+	if cfg == nil {
+		return nil
+	}
+
+	return &duplicateParamsCheck{
+		flag:    cfg.Action == config.DuplicateParamsFlag,
+		phpKeys: phpKeys,
+		paths:   cfg.Paths,
+	}
+}
+
+// check rejects the request with 400 or sets the Duplicate-Params attribute when the query and the body share
+// top-level keys. The query keys are split the same way the body keys are.
+func (c *duplicateParamsCheck) check(hr *http.Request, req *Request, log *zap.Logger) error {
+	if c == nil || !req.Parsed || req.RawQuery == "" || !hasPathPrefix(hr.URL.Path, c.paths) {
+		return nil
+	}
+
+	data, _ := req.body.(dataTree)
+	var files fileTree
+	if req.Uploads != nil {
+		files = req.Uploads.tree
+	}
+
+	if len(data) == 0 && len(files) == 0 {
+		return nil
+	}
+
+	query, err := url.ParseQuery(req.RawQuery)
+	if err != nil {
+		// the worker parses the query on its own, the malformed pairs are not a collision
+		log.Debug("query parse error", zap.Error(err))
+	}
+
+	var keys []string
+	for k := range query {
+		path := splitKey(k, c.phpKeys)
+		if len(path) == 0 || path[0] == "" || slices.Contains(keys, path[0]) {
+			continue
+		}
+
+		_, inData := data[path[0]]
+		_, inFiles := files[path[0]]
+		if inData || inFiles {
+			keys = append(keys, path[0])
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	slices.Sort(keys)
+
+	if c.flag {
+		log.Warn("parameters present in both the query and the body", zap.Strings("keys", keys))
+		req.setAttribute(DuplicateParamsAttribute, keys...)
+		return nil
+	}
+
+	return newParseError(ParseErrorInvalidFields, errors.Errorf("parameters present in both the query and the body: %s", strings.Join(keys, ", ")))
+}
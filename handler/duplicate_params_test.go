@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/roadrunner-server/http/v5/config"
+	"github.com/roadrunner-server/http/v5/handler/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_DuplicateParams(t *testing.T) {
+	testCases := []struct {
+		name   string
+		target string
+		form   url.Values
+		status int
+		keys   []string
+	}{
+		{name: "no query", target: "/pay", form: url.Values{"amount": {"1"}}, status: http.StatusInternalServerError},
+		{name: "distinct", target: "/pay?id=5", form: url.Values{"amount": {"1"}}, status: http.StatusInternalServerError},
+		{name: "collision", target: "/pay?amount=100&id=5", form: url.Values{"amount": {"1"}, "id": {"5"}}, status: http.StatusBadRequest, keys: []string{"amount", "id"}},
+		{name: "nested collision", target: "/pay?user[role]=admin", form: url.Values{"user[name]": {"n"}}, status: http.StatusBadRequest, keys: []string{"user"}},
+		{name: "other path", target: "/public?amount=100", form: url.Values{"amount": {"1"}}, status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{
+				DuplicateParams: &config.DuplicateParams{Action: config.DuplicateParamsReject, Paths: []string{"/pay"}},
+			}})
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, handlertest.NewURLEncodedRequest(http.MethodPost, tt.target, tt.form))
+			assert.Equal(t, tt.status, w.Code)
+			if tt.keys != nil {
+				assert.Contains(t, w.Body.String(), "parameters present in both the query and the body: ")
+				for _, k := range tt.keys {
+					assert.Contains(t, w.Body.String(), k)
+				}
+			}
+		})
+	}
+
+	t.Run("flag", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{
+			DuplicateParams: &config.DuplicateParams{Action: config.DuplicateParamsFlag},
+		}})
+
+		r := handlertest.NewMultipart().
+			Field("id", "1").
+			File("doc", "doc.txt", "text/plain", []byte("abc")).
+			Request(http.MethodPost, "/?doc=x&id=2&page=1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+		req := p.request(t)
+		require.Contains(t, req.Attributes, DuplicateParamsAttribute)
+		assert.Equal(t, [][]byte{[]byte("doc"), []byte("id")}, req.Attributes[DuplicateParamsAttribute].Value)
+	})
+}
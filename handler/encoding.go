@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"encoding/json"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// BodyEncodingAttribute tells the worker how the parsed body and the uploads are encoded, it's only set for the
+	// encodings other than JSON.
+	BodyEncodingAttribute string = "Body-Encoding"
+	// BodyEncodingProtobuf is the google.protobuf.Struct encoding of the parsed body and of the uploads tree.
+	BodyEncodingProtobuf string = "protobuf"
+)
+
+// dataTreeStruct converts the data tree to the protobuf Struct: branches are structs, lists are lists of strings.
+func dataTreeStruct(dt dataTree) *structpb.Struct {
+	s := &structpb.Struct{Fields: make(map[string]*structpb.Value, len(dt))}
+	for k, v := range dt {
+		switch actual := v.(type) {
+		case dataTree:
+			s.Fields[k] = structpb.NewStructValue(dataTreeStruct(actual))
+		case []string:
+			list := &structpb.ListValue{Values: make([]*structpb.Value, len(actual))}
+			for i := range actual {
+				list.Values[i] = structpb.NewStringValue(actual[i])
+			}
+
+			s.Fields[k] = structpb.NewListValue(list)
+		case []any:
+			list := &structpb.ListValue{Values: make([]*structpb.Value, len(actual))}
+			for i := range actual {
+				list.Values[i] = scalarValue(actual[i])
+			}
+
+			s.Fields[k] = structpb.NewListValue(list)
+		default:
+			s.Fields[k] = scalarValue(actual)
+		}
+	}
+
+	return s
+}
+
+// scalarValue converts the leaf value, the coerced JSON numbers and booleans keep their types.
+func scalarValue(v any) *structpb.Value {
+	switch actual := v.(type) {
+	case string:
+		return structpb.NewStringValue(actual)
+	case bool:
+		return structpb.NewBoolValue(actual)
+	case json.Number:
+		f, err := actual.Float64()
+		if err != nil {
+			// out of the double range, keep the digits
+			return structpb.NewStringValue(actual.String())
+		}
+
+		return structpb.NewNumberValue(f)
+	default:
+		return structpb.NewNullValue()
+	}
+}
+
+// fileTreeStruct converts the file tree to the protobuf Struct, the uploads are structs with the same fields the
+// JSON encoding has.
+func fileTreeStruct(ft fileTree) *structpb.Struct {
+	s := &structpb.Struct{Fields: make(map[string]*structpb.Value, len(ft))}
+	for k, v := range ft {
+		switch actual := v.(type) {
+		case fileTree:
+			s.Fields[k] = structpb.NewStructValue(fileTreeStruct(actual))
+		case []*FileUpload:
+			list := &structpb.ListValue{Values: make([]*structpb.Value, len(actual))}
+			for i := range actual {
+				list.Values[i] = uploadValue(actual[i])
+			}
+
+			s.Fields[k] = structpb.NewListValue(list)
+		case *FileUpload:
+			s.Fields[k] = uploadValue(actual)
+		default:
+			s.Fields[k] = structpb.NewNullValue()
+		}
+	}
+
+	return s
+}
+
+func uploadValue(f *FileUpload) *structpb.Value {
+	if f == nil {
+		return structpb.NewNullValue()
+	}
+
+	fields := map[string]*structpb.Value{
+		"name":    structpb.NewStringValue(f.Name),
+		"mime":    structpb.NewStringValue(f.Mime),
+		"size":    structpb.NewNumberValue(float64(f.Size)),
+		"error":   structpb.NewNumberValue(float64(f.Error)),
+		"tmpName": structpb.NewStringValue(f.TempFilename),
+	}
+
+	if f.SniffedMime != "" {
+		fields["sniffedMime"] = structpb.NewStringValue(f.SniffedMime)
+	}
+
+	if f.Image != nil {
+		fields["image"] = structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+			"format": structpb.NewStringValue(f.Image.Format),
+			"width":  structpb.NewNumberValue(float64(f.Image.Width)),
+			"height": structpb.NewNumberValue(float64(f.Image.Height)),
+		}})
+	}
+
+	if len(f.Metadata) > 0 {
+		md := make(map[string]*structpb.Value, len(f.Metadata))
+		for k, v := range f.Metadata {
+			md[k] = structpb.NewStringValue(v)
+		}
+
+		fields["metadata"] = structpb.NewStructValue(&structpb.Struct{Fields: md})
+	}
+
+	return structpb.NewStructValue(&structpb.Struct{Fields: fields})
+}
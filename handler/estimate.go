@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"mime"
+	"net/http"
+)
+
+// the average sizes the estimate assumes, the real bodies vary a lot around them
+const (
+	// a=value& of the urlencoded forms
+	estimateURLEncodedPair = 16
+	// "key":"value", of the JSON objects
+	estimateJSONValue = 16
+	// the CRLF--boundary CRLF line and the smallest Content-Disposition header block of a multipart part, without
+	// the boundary itself
+	estimatePartFraming = 48
+	// the average content of a multipart part
+	estimatePartContent = 64
+	// the memory of a tree node: the map entry, the key and the value headers
+	estimateNodeBytes = 80
+)
+
+// ParseEstimate is the rough size of the tree the body would be parsed into, see Handler.EstimateParse.
+type ParseEstimate struct {
+	// the body is going to be parsed into the tree, false for the raw bodies and the unknown lengths
+	Parsed bool
+	// the estimated number of the fields (the parts of the multipart bodies)
+	Fields int64
+	// the estimated memory of the parsed tree, in bytes
+	Bytes int64
+}
+
+// EstimateParse estimates the size of the parsed body from the Content-Length and the Content-Type of the request,
+// without reading the body, for the admission control of the requests likely expensive to parse. The body is
+// matched to its parser the way the handler matches it (content_types, parse_body_methods). The estimate is
+// necessarily approximate: it assumes the average field sizes, so a body of many tiny fields has more fields than
+// estimated and the one of a few large values has less. The multipart parts are capped by the parts limit and their
+// memory by the multipart memory limit, the forms without the boundary are estimated as empty, they are rejected
+// before any part is read. The bodies of unknown length (chunked, encoded) are not estimated.
+func (h *Handler) EstimateParse(r *http.Request) ParseEstimate {
+	if r.ContentLength <= 0 || h.sendRawBody || !h.bodyMethods.read(r.Method) {
+		return ParseEstimate{}
+	}
+
+	n := r.ContentLength
+	header := r.Header.Get("Content-Type")
+
+	switch h.contentTypes.match(header, true) {
+	case contentURLEncoded:
+		if !h.bodyMethods.form(r.Method) {
+			return ParseEstimate{}
+		}
+
+		fields := n/estimateURLEncodedPair + 1
+		return ParseEstimate{Parsed: true, Fields: fields, Bytes: n + fields*estimateNodeBytes}
+	case contentMultipart:
+		_, params, err := mime.ParseMediaType(header)
+		boundary := params["boundary"]
+		if err != nil || boundary == "" {
+			return ParseEstimate{Parsed: true}
+		}
+
+		parts := min(n/int64(len(boundary)+estimatePartFraming+estimatePartContent)+1, maxMultipartParts)
+		// the contents above the memory limit are stored on disk
+		mem := min(n, h.multipartOpts.maxMemory+maxValueExtraBytes)
+		return ParseEstimate{Parsed: true, Fields: parts, Bytes: mem + parts*(estimateNodeBytes+mapEntryOverhead)}
+	case contentJSON, contentNDJSON, contentCBOR:
+		// the decoded document and the tree built from it are both in memory
+		fields := n/estimateJSONValue + 1
+		return ParseEstimate{Parsed: true, Fields: fields, Bytes: 2*n + fields*estimateNodeBytes}
+	default:
+		return ParseEstimate{}
+	}
+}
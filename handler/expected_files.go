@@ -0,0 +1,71 @@
+package handler
+
+// expectedFiles are the upload fields of the multipart forms reported as not uploaded (UPLOAD_ERR_NO_FILE) when the
+// form has no file part under them, the way PHP fills $_FILES for the file inputs submitted empty, see
+// config.Uploads.ExpectedFiles.
+type expectedFiles [][]string
+
+// newExpectedFiles returns nil when no field is configured.
+func newExpectedFiles(fields []string, phpKeys bool) expectedFiles {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	ef := make(expectedFiles, 0, len(fields))
+	for _, f := range fields {
+		if keys := splitKey(f, phpKeys); len(keys) > 0 {
+			ef = append(ef, keys)
+		}
+	}
+
+	return ef
+}
+
+// fill adds the placeholder upload of each expected field missing from the uploads. The field colliding with the
+// uploaded files (avatar expected, avatar[0] sent) is treated as present.
+func (ef expectedFiles) fill(u *Uploads) error {
+	if ef == nil || u == nil {
+		return nil
+	}
+
+	for _, keys := range ef {
+		if u.tree.has(keys) {
+			continue
+		}
+
+		placeholder := []*FileUpload{{Error: UploadErrorNoFile}}
+		err := u.tree.mount(keys, placeholder)
+		if err != nil {
+			return err
+		}
+
+		u.list = append(u.list, placeholder...)
+	}
+
+	return nil
+}
+
+// has reports whether the tree holds a value at the keys, the list key (docs[]) is present when the list is.
+func (ft fileTree) has(keys []string) bool {
+	node := ft
+	for _, k := range keys {
+		if k == "" {
+			return true
+		}
+
+		v, ok := node[k]
+		if !ok {
+			return false
+		}
+
+		next, ok := v.(fileTree)
+		if !ok {
+			// the leaf at the key or one of its parents
+			return true
+		}
+
+		node = next
+	}
+
+	return true
+}
@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// fieldRules is the allowlist of the top-level fields of the parsed bodies and the field names length limit.
+type fieldRules struct {
+	// nil means any field is allowed
+	allowed       map[string]struct{}
+	required      []string
+	rejectUnknown bool
+	// 0 means unlimited
+	maxNameLength int
+	runes         bool
+}
+
+// newFieldRules returns nil when there is nothing to validate.
+func newFieldRules(cfg *config.Fields) *fieldRules {
+	if cfg == nil || (len(cfg.Allowed) == 0 && len(cfg.Required) == 0 && cfg.MaxNameLength == 0) {
+		return nil
+	}
+
+	fr := &fieldRules{
+		required:      cfg.Required,
+		rejectUnknown: cfg.RejectUnknown,
+		maxNameLength: cfg.MaxNameLength,
+		runes:         cfg.NameLength == config.NameLengthRunes,
+	}
+
+	if len(cfg.Allowed) > 0 || cfg.RejectUnknown {
+		fr.allowed = make(map[string]struct{}, len(cfg.Allowed)+len(cfg.Required))
+		for _, k := range cfg.Allowed {
+			fr.allowed[k] = struct{}{}
+		}
+
+		for _, k := range cfg.Required {
+			fr.allowed[k] = struct{}{}
+		}
+	}
+
+	return fr
+}
+
+// validate checks the parsed data and the uploads against the rules. The unknown fields are removed, or rejected
+// in the strict mode.
+func (fr *fieldRules) validate(req *Request) error {
+	if fr == nil {
+		return nil
+	}
+
+	data, _ := req.body.(dataTree)
+
+	var files fileTree
+	if req.Uploads != nil {
+		files = req.Uploads.tree
+	}
+
+	if fr.maxNameLength > 0 {
+		err := fr.checkNames(data)
+		if err != nil {
+			return err
+		}
+
+		err = fr.checkNames(files)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, k := range fr.required {
+		_, inData := data[k]
+		_, inFiles := files[k]
+		if !inData && !inFiles {
+			return newParseError(ParseErrorInvalidFields, errors.Errorf("missing required field: %s", k)).
+				with(ParseErrorCodeInvalidFields, fmt.Sprintf("send the required field '%s'", k))
+		}
+	}
+
+	if fr.allowed == nil {
+		return nil
+	}
+
+	var unknown []string
+	for k := range data {
+		if _, ok := fr.allowed[k]; !ok {
+			unknown = append(unknown, k)
+		}
+	}
+
+	for k := range files {
+		if _, ok := fr.allowed[k]; !ok {
+			unknown = append(unknown, k)
+		}
+	}
+
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	if fr.rejectUnknown {
+		sort.Strings(unknown)
+		return newParseError(ParseErrorInvalidFields, errors.Errorf("unknown fields: %s", strings.Join(unknown, ", "))).
+			with(ParseErrorCodeInvalidFields, fmt.Sprintf("remove the unknown fields: %s", strings.Join(unknown, ", ")))
+	}
+
+	for _, k := range unknown {
+		delete(data, k)
+		delete(files, k)
+	}
+
+	if req.Uploads != nil {
+		// the removed files are not moved to the uploads dir
+		req.Uploads.list = files.uploads(req.Uploads.list[:0])
+	}
+
+	return nil
+}
+
+// checkNames rejects the tree with the field names longer than the limit, at any nesting level.
+func (fr *fieldRules) checkNames(tree map[string]any) error {
+	for k, v := range tree {
+		if fr.nameLength(k) > fr.maxNameLength {
+			unit := config.NameLengthBytes
+			if fr.runes {
+				unit = config.NameLengthRunes
+			}
+
+			return newParseError(ParseErrorInvalidFields, errors.Errorf("field name is longer than %d %s: %s...", fr.maxNameLength, unit, namePrefix(k))).
+				with(ParseErrorCodeLimitExceeded, fmt.Sprintf("send the field names of at most %d %s", fr.maxNameLength, unit))
+		}
+
+		var err error
+		switch branch := v.(type) {
+		case dataTree:
+			err = fr.checkNames(branch)
+		case fileTree:
+			err = fr.checkNames(branch)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fr *fieldRules) nameLength(name string) int {
+	if fr.runes {
+		return utf8.RuneCountInString(name)
+	}
+
+	return len(name)
+}
+
+// namePrefix returns the beginning of the long name for the error message, cut at the character boundary.
+func namePrefix(name string) string {
+	const maxPrefix = 16
+
+	n := 0
+	for i := range name {
+		if n == maxPrefix {
+			return name[:i]
+		}
+
+		n++
+	}
+
+	return name
+}
+
+// namePattern is the regular expression every raw field name of the forms must match, see config.Fields.NamePattern.
+type namePattern struct {
+	re   *regexp.Regexp
+	drop bool
+}
+
+// newNamePattern returns nil when no pattern is configured.
+func newNamePattern(cfg *config.Fields) *namePattern {
+	if cfg == nil || cfg.NameRegexp == nil {
+		return nil
+	}
+
+	return &namePattern{re: cfg.NameRegexp, drop: cfg.NamePatternAction == config.NamePatternDrop}
+}
+
+// keep checks the whole field name before it's split, returns false for the dropped fields. The fields not matching
+// the pattern are rejected with 400 unless they are dropped.
+func (np *namePattern) keep(name string) (bool, error) {
+	if np == nil || np.re.MatchString(name) {
+		return true, nil
+	}
+
+	if np.drop {
+		return false, nil
+	}
+
+	return false, newParseError(ParseErrorInvalidFields, errors.Errorf("field name doesn't match the name pattern: %s", name)).
+		with(ParseErrorCodeInvalidFields, fmt.Sprintf("rename the field '%s' to match %s", name, np.re))
+}
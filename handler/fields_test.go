@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/roadrunner-server/http/v5/config"
+	"github.com/roadrunner-server/http/v5/handler/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequest_Fields(t *testing.T) {
+	fields := &config.Fields{
+		Allowed:  []string{"name", "opts"},
+		Required: []string{"token", "avatar"},
+	}
+
+	form := func() *handlertest.Multipart {
+		return handlertest.NewMultipart().
+			Field("token", "t").
+			Field("name", "n").
+			Field("opts[a]", "1").
+			Field("extra[b]", "2").
+			File("avatar", "a.png", "image/png", []byte("png")).
+			File("junk", "j.txt", "text/plain", []byte("junk"))
+	}
+
+	t.Run("unknown removed", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{Fields: fields}})
+
+		r := form().Request(http.MethodPost, "/")
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		defer req.Close(nil, r)
+
+		assert.Equal(t, dataTree{"token": "t", "name": "n", "opts": dataTree{"a": "1"}}, req.body)
+		assert.NotContains(t, req.Uploads.tree, "junk")
+		require.Len(t, req.Uploads.list, 1)
+		assert.Equal(t, "a.png", req.Uploads.list[0].Name)
+	})
+
+	t.Run("unknown rejected", func(t *testing.T) {
+		strict := *fields
+		strict.RejectUnknown = true
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{Fields: &strict}})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, form().Request(http.MethodPost, "/"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "unknown fields: extra, junk")
+		assert.Nil(t, p.pld)
+	})
+
+	t.Run("missing required", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{Fields: fields}})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"token": {"t"}, "name": {"n"}}))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "missing required field: avatar")
+		assert.Nil(t, p.pld)
+	})
+
+	t.Run("raw body is not validated", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{Fields: fields}})
+
+		r := handlertest.NewRawRequest(http.MethodPost, "/", "text/plain", []byte("anything"))
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+	})
+}
+
+func TestRequest_FieldNameLength(t *testing.T) {
+	// 5 characters, 10 bytes
+	form := url.Values{"ключь": {"v"}, "tags[ключь]": {"1"}}
+
+	t.Run("bytes", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{Fields: &config.Fields{MaxNameLength: 6}}})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewURLEncodedRequest(http.MethodPost, "/", form))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "field name is longer than 6 bytes: ключь")
+		assert.Nil(t, p.pld)
+	})
+
+	t.Run("runes", func(t *testing.T) {
+		fields := &config.Fields{MaxNameLength: 6, NameLength: config.NameLengthRunes}
+		h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{Fields: fields}})
+
+		r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", form)
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Equal(t, dataTree{"ключь": "v", "tags": dataTree{"ключь": "1"}}, req.body)
+
+		// nested names and files are limited as well
+		for _, r := range []*http.Request{
+			handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"tags[ключьключь]": {"1"}}),
+			handlertest.NewMultipart().File("files[ключьключь]", "a.txt", "text/plain", []byte("a")).Request(http.MethodPost, "/"),
+		} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Contains(t, w.Body.String(), "field name is longer than 6 runes: ключьключь")
+		}
+	})
+}
+
+func TestRequest_Checkboxes(t *testing.T) {
+	cts := []*config.ContentType{{Pattern: "application/json", Parser: config.ParserJSON}}
+	groups := []*config.CheckboxGroup{
+		{Prefix: "perm", Keys: []string{"read", "write", "admin"}},
+		{Prefix: "settings[notify]", Keys: []string{"email", "sms"}},
+	}
+
+	newHandler := func(t *testing.T) *Handler {
+		parse := &config.Parse{Checkboxes: groups, ContentTypes: cts}
+		require.NoError(t, parse.InitDefaults())
+		h, _ := newTestHandler(t, &config.Config{Parse: parse})
+		return h
+	}
+
+	testCases := []struct {
+		name   string
+		values url.Values
+		want   dataTree
+	}{
+		{
+			name:   "checked and unchecked",
+			values: url.Values{"perm[read]": {"on"}, "perm[write]": {"yes"}, "settings[notify][sms]": {"on"}},
+			want: dataTree{
+				"perm":     dataTree{"read": true, "write": true, "admin": false},
+				"settings": dataTree{"notify": dataTree{"email": false, "sms": true}},
+			},
+		},
+		{
+			name:   "missing groups",
+			values: url.Values{"name": {"n"}},
+			want: dataTree{
+				"name":     "n",
+				"perm":     dataTree{"read": false, "write": false, "admin": false},
+				"settings": dataTree{"notify": dataTree{"email": false, "sms": false}},
+			},
+		},
+		{
+			name:   "unexpected keys left as is",
+			values: url.Values{"perm[read]": {"on"}, "perm[other]": {"on"}, "settings": {"off"}},
+			want: dataTree{
+				"perm":     dataTree{"read": true, "write": false, "admin": false, "other": "on"},
+				"settings": "off",
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandler(t)
+
+			r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", tt.values)
+			req := newTestRequest(r)
+			require.NoError(t, h.request(r, req))
+			assert.Equal(t, tt.want, req.body)
+		})
+	}
+
+	t.Run("multipart", func(t *testing.T) {
+		h := newHandler(t)
+
+		r := handlertest.NewMultipart().Field("perm[admin]", "on").Request(http.MethodPost, "/")
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		defer req.Close(nil, r)
+		assert.Equal(t, dataTree{"read": false, "write": false, "admin": true}, req.body.(dataTree)["perm"])
+	})
+
+	t.Run("empty form", func(t *testing.T) {
+		h := newHandler(t)
+
+		r := httptest.NewRequest(http.MethodPost, "/", http.NoBody)
+		r.Header.Set("Content-Type", handlertest.ContentURLEncoded)
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Equal(t, dataTree{"read": false, "write": false, "admin": false}, req.body.(dataTree)["perm"])
+	})
+
+	t.Run("json is not a form", func(t *testing.T) {
+		h := newHandler(t)
+
+		r := handlertest.NewJSONRequest(http.MethodPost, "/", `{"perm":{"read":"on"}}`)
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Equal(t, dataTree{"perm": dataTree{"read": "on"}}, req.body)
+	})
+
+	t.Run("config", func(t *testing.T) {
+		assert.Error(t, (&config.Parse{Checkboxes: []*config.CheckboxGroup{{Keys: []string{"a"}}}}).InitDefaults())
+		assert.Error(t, (&config.Parse{Checkboxes: []*config.CheckboxGroup{{Prefix: "perm"}}}).InitDefaults())
+	})
+}
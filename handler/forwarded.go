@@ -0,0 +1,382 @@
+package handler
+
+import (
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/roadrunner-server/http/v5/config"
+	"golang.org/x/net/http/httpguts"
+)
+
+// forwarding derives the client address, scheme and host of the requests from the trusted proxies, see
+// config.Forwarded.
+type forwarding struct {
+	trusted []netip.Prefix
+	// X-Forwarded-For takes precedence over Forwarded
+	preferXForwarded bool
+}
+
+// forwardedHop is what one proxy reports about the request it received: the element of the Forwarded header, or the
+// X-Forwarded-For address.
+type forwardedHop struct {
+	// invalid for the unknown and the obfuscated nodes
+	addr  netip.Addr
+	proto string
+	host  string
+}
+
+// newForwarding returns nil when the forwarding headers are not used.
+func newForwarding(cfg *config.Forwarded) *forwarding {
+	if cfg == nil || len(cfg.Prefixes) == 0 {
+		return nil
+	}
+
+	return &forwarding{trusted: cfg.Prefixes, preferXForwarded: cfg.Precedence == config.ForwardedPrecedenceXForwarded}
+}
+
+// apply replaces the remote address and the URI scheme and host of the request sent by a trusted proxy. The hops are
+// walked from the nearest proxy, the first address which isn't trusted is the client. The unknown or obfuscated
+// client node leaves the remote address of the proxy. The malformed header of the precedence is ignored along with
+// the other one, the client could have sent both.
+func (f *forwarding) apply(r *http.Request, req *Request) {
+	if f == nil {
+		return
+	}
+
+	peer, err := netip.ParseAddr(req.RemoteAddr)
+	if err != nil || !f.isTrusted(peer) {
+		return
+	}
+
+	hops, ok := f.hops(r)
+	if !ok || len(hops) == 0 {
+		return
+	}
+
+	client := hops[0]
+	for i := len(hops) - 1; i >= 0; i-- {
+		client = hops[i]
+		if !client.addr.IsValid() || !f.isTrusted(client.addr) {
+			break
+		}
+	}
+
+	if client.addr.IsValid() {
+		req.RemoteAddr = client.addr.String()
+	}
+
+	if client.proto != "http" && client.proto != "https" {
+		client.proto = ""
+	}
+
+	if client.proto == "" && client.host == "" {
+		return
+	}
+
+	u, err := url.Parse(req.URI)
+	if err != nil {
+		return
+	}
+
+	if client.proto != "" {
+		u.Scheme = client.proto
+	}
+	if client.host != "" {
+		u.Host = client.host
+	}
+
+	req.URI = u.String()
+}
+
+func (f *forwarding) isTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range f.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hops returns the hops of the header of the precedence, or of the other one when it's missing.
+func (f *forwarding) hops(r *http.Request) ([]forwardedHop, bool) {
+	forwarded, xForwarded := r.Header.Values("Forwarded"), r.Header.Values("X-Forwarded-For")
+	if f.preferXForwarded && len(xForwarded) > 0 || len(forwarded) == 0 {
+		if len(xForwarded) == 0 {
+			return nil, false
+		}
+
+		return parseXForwarded(xForwarded, r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-Host"))
+	}
+
+	return parseForwarded(strings.Join(forwarded, ","))
+}
+
+// parseXForwarded parses the X-Forwarded-For addresses, the X-Forwarded-Proto and X-Forwarded-Host apply to all of
+// them, their last values (set by the nearest proxy) are used.
+func parseXForwarded(values []string, proto, host string) ([]forwardedHop, bool) {
+	proto = strings.ToLower(lastListValue(proto))
+	host = lastListValue(host)
+	if host != "" && !httpguts.ValidHostHeader(host) {
+		host = ""
+	}
+
+	var hops []forwardedHop
+	for _, v := range values {
+		for a := range strings.SplitSeq(v, ",") {
+			a = strings.TrimSpace(a)
+			if a == "" {
+				continue
+			}
+
+			addr, err := netip.ParseAddr(strings.Trim(a, "[]"))
+			if err != nil {
+				ap, errP := netip.ParseAddrPort(a)
+				if errP != nil {
+					return nil, false
+				}
+
+				addr = ap.Addr()
+			}
+
+			hops = append(hops, forwardedHop{addr: addr.Unmap(), proto: proto, host: host})
+		}
+	}
+
+	return hops, true
+}
+
+func lastListValue(v string) string {
+	if i := strings.LastIndexByte(v, ','); i >= 0 {
+		v = v[i+1:]
+	}
+
+	return strings.TrimSpace(v)
+}
+
+// parseForwarded parses the Forwarded header (RFC 7239 4), the elements in the order of the proxies. It reports false
+// for the malformed header: the bad syntax, a repeated parameter, the for and by nodes which are neither addresses nor
+// the unknown or obfuscated identifiers, the invalid proto or host. The unknown parameters are skipped.
+func parseForwarded(v string) ([]forwardedHop, bool) {
+	var hops []forwardedHop
+	var hop forwardedHop
+	seen := make(map[string]struct{}, 4)
+
+	for i := 0; ; {
+		i = skipOWS(v, i)
+		if i < len(v) && v[i] != ',' && v[i] != ';' {
+			start := i
+			for i < len(v) && httpguts.IsTokenRune(rune(v[i])) {
+				i++
+			}
+
+			name := strings.ToLower(v[start:i])
+			if name == "" || i >= len(v) || v[i] != '=' {
+				return nil, false
+			}
+
+			value, next, ok := forwardedValue(v, i+1)
+			if !ok {
+				return nil, false
+			}
+
+			if _, dup := seen[name]; dup {
+				return nil, false
+			}
+
+			seen[name] = struct{}{}
+			if !hop.set(name, value) {
+				return nil, false
+			}
+
+			i = skipOWS(v, next)
+		}
+
+		if i < len(v) && v[i] == ';' {
+			i++
+			continue
+		}
+
+		if i < len(v) && v[i] != ',' {
+			return nil, false
+		}
+
+		// the empty list elements are skipped
+		if len(seen) > 0 {
+			hops = append(hops, hop)
+			hop = forwardedHop{}
+			clear(seen)
+		}
+
+		if i >= len(v) {
+			return hops, true
+		}
+
+		i++
+	}
+}
+
+// set sets the known parameter of the element, it reports false for the invalid value.
+func (hop *forwardedHop) set(name, value string) bool {
+	switch name {
+	case "for":
+		addr, ok := parseForwardedNode(value)
+		hop.addr = addr
+		return ok
+	case "by":
+		_, ok := parseForwardedNode(value)
+		return ok
+	case "proto":
+		if !validScheme(value) {
+			return false
+		}
+
+		hop.proto = strings.ToLower(value)
+	case "host":
+		if !httpguts.ValidHostHeader(value) || value == "" {
+			return false
+		}
+
+		hop.host = value
+	}
+
+	return true
+}
+
+// forwardedValue reads the token or the quoted string at i, and returns the position after it.
+func forwardedValue(v string, i int) (string, int, bool) {
+	if i < len(v) && v[i] == '"' {
+		var sb strings.Builder
+		for i++; i < len(v); i++ {
+			c := v[i]
+			switch {
+			case c == '"':
+				return sb.String(), i + 1, true
+			case c == '\\':
+				i++
+				if i >= len(v) || (v[i] < 0x20 && v[i] != '\t') || v[i] == 0x7f {
+					return "", 0, false
+				}
+
+				sb.WriteByte(v[i])
+			case (c < 0x20 && c != '\t') || c == 0x7f:
+				return "", 0, false
+			default:
+				sb.WriteByte(c)
+			}
+		}
+
+		// the unterminated quoted string
+		return "", 0, false
+	}
+
+	start := i
+	for i < len(v) && httpguts.IsTokenRune(rune(v[i])) {
+		i++
+	}
+
+	return v[start:i], i, i > start
+}
+
+// parseForwardedNode parses the node identifier (RFC 7239 6): the IPv4 address, the bracketed IPv6 address, unknown
+// or an obfuscated identifier, with the optional port. The address is invalid for the unknown and obfuscated nodes.
+func parseForwardedNode(node string) (netip.Addr, bool) {
+	if rest, ok := strings.CutPrefix(node, "["); ok {
+		ip, port, ok := strings.Cut(rest, "]")
+		if !ok || (port != "" && (port[0] != ':' || !validNodePort(port[1:]))) {
+			return netip.Addr{}, false
+		}
+
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || !addr.Is6() || addr.Zone() != "" {
+			return netip.Addr{}, false
+		}
+
+		return addr.Unmap(), true
+	}
+
+	name, port, hasPort := strings.Cut(node, ":")
+	if hasPort && !validNodePort(port) {
+		return netip.Addr{}, false
+	}
+
+	if strings.EqualFold(name, "unknown") || obfuscatedNode(name) {
+		return netip.Addr{}, true
+	}
+
+	addr, err := netip.ParseAddr(name)
+	if err != nil || !addr.Is4() {
+		return netip.Addr{}, false
+	}
+
+	return addr, true
+}
+
+// skipOWS returns the position of the first byte at or after i which isn't the optional whitespace.
+func skipOWS(v string, i int) int {
+	for i < len(v) && (v[i] == ' ' || v[i] == '\t') {
+		i++
+	}
+
+	return i
+}
+
+func validNodePort(port string) bool {
+	if obfuscatedNode(port) {
+		return true
+	}
+
+	if port == "" || len(port) > 5 {
+		return false
+	}
+
+	for _, c := range []byte(port) {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// obfuscatedNode reports whether the identifier is the obfuscated node or port, _ followed by the letters, the
+// digits, the dots, the underscores or the dashes.
+func obfuscatedNode(s string) bool {
+	if len(s) < 2 || s[0] != '_' {
+		return false
+	}
+
+	for _, c := range []byte(s[1:]) {
+		if !isAlnum(c) && c != '.' && c != '_' && c != '-' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validScheme reports whether the value is the URI scheme (RFC 3986 3.1).
+func validScheme(s string) bool {
+	if s == "" || !isAlpha(s[0]) {
+		return false
+	}
+
+	for _, c := range []byte(s) {
+		if !isAlnum(c) && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isAlnum(c byte) bool {
+	return isAlpha(c) || (c >= '0' && c <= '9')
+}
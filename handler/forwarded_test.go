@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/roadrunner-server/http/v5/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForwarded(t *testing.T) {
+	addr := netip.MustParseAddr
+
+	testCases := []struct {
+		header string
+		hops   []forwardedHop
+		isErr  bool
+	}{
+		{header: "for=192.0.2.60;proto=http;by=203.0.113.43", hops: []forwardedHop{{addr: addr("192.0.2.60"), proto: "http"}}},
+		{header: `For="[2001:db8:cafe::17]:4711"`, hops: []forwardedHop{{addr: addr("2001:db8:cafe::17")}}},
+		{header: "for=192.0.2.43, for=198.51.100.17", hops: []forwardedHop{{addr: addr("192.0.2.43")}, {addr: addr("198.51.100.17")}}},
+		{header: `for=unknown, for="_gazonk:_port";host="example.com:8443";proto=HTTPS`, hops: []forwardedHop{{}, {proto: "https", host: "example.com:8443"}}},
+		// the quoted pairs, the empty elements and the extensions
+		{header: `for="192.0.2.1";ext="a\"b,c;d" , ,for=10.0.0.1 ;`, hops: []forwardedHop{{addr: addr("192.0.2.1")}, {addr: addr("10.0.0.1")}}},
+		{header: "for=[2001:db8::1]", isErr: true},
+		{header: `for="2001:db8::1"`, isErr: true},
+		{header: "for=192.0.2.1;for=192.0.2.2", isErr: true},
+		{header: `for="192.0.2.1`, isErr: true},
+		{header: "for=192.0.2.1 by=192.0.2.2", isErr: true},
+		{header: "for=", isErr: true},
+		{header: "for=example.com", isErr: true},
+		{header: "for=192.0.2.1:123456", isErr: true},
+		{header: "proto=1http", isErr: true},
+		{header: `host="bad host"`, isErr: true},
+		{header: "=192.0.2.1", isErr: true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.header, func(t *testing.T) {
+			hops, ok := parseForwarded(tt.header)
+			if tt.isErr {
+				assert.False(t, ok)
+				return
+			}
+
+			require.True(t, ok)
+			assert.Equal(t, tt.hops, hops)
+		})
+	}
+}
+
+func TestHandler_Forwarded(t *testing.T) {
+	newHandler := func(t *testing.T, precedence string) (*Handler, *testPool) {
+		cfg := &config.Forwarded{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"}, Precedence: precedence}
+		require.NoError(t, cfg.InitDefaults())
+		return newTestHandler(t, &config.Config{Forwarded: cfg})
+	}
+
+	testCases := []struct {
+		name       string
+		precedence string
+		remote     string
+		headers    map[string]string
+		addr       string
+		uri        string
+	}{
+		{
+			name:    "forwarded",
+			remote:  "10.0.0.5:1234",
+			headers: map[string]string{"Forwarded": `for=198.51.100.7;proto=https;host=example.com, for="192.0.2.1:80"`},
+			addr:    "198.51.100.7",
+			uri:     "https://example.com/path?q=1",
+		},
+		{
+			name:    "the spoofed hops before the client",
+			remote:  "10.0.0.5:1234",
+			headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.7, 10.0.0.9"},
+			addr:    "198.51.100.7",
+			uri:     "http://internal/path?q=1",
+		},
+		{
+			name:    "x-forwarded proto and host",
+			remote:  "10.0.0.5:1234",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.7", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "example.com"},
+			addr:    "198.51.100.7",
+			uri:     "https://example.com/path?q=1",
+		},
+		{
+			name:    "forwarded takes precedence",
+			remote:  "10.0.0.5:1234",
+			headers: map[string]string{"Forwarded": "for=198.51.100.7", "X-Forwarded-For": "198.51.100.8"},
+			addr:    "198.51.100.7",
+			uri:     "http://internal/path?q=1",
+		},
+		{
+			name:       "x-forwarded takes precedence",
+			precedence: config.ForwardedPrecedenceXForwarded,
+			remote:     "10.0.0.5:1234",
+			headers:    map[string]string{"Forwarded": "for=198.51.100.7", "X-Forwarded-For": "198.51.100.8"},
+			addr:       "198.51.100.8",
+			uri:        "http://internal/path?q=1",
+		},
+		{
+			name:    "malformed forwarded is not replaced",
+			remote:  "10.0.0.5:1234",
+			headers: map[string]string{"Forwarded": "for=198.51.100.7;;for=1.1.1.1", "X-Forwarded-For": "198.51.100.8"},
+			addr:    "10.0.0.5",
+			uri:     "http://internal/path?q=1",
+		},
+		{
+			name:    "obfuscated client",
+			remote:  "10.0.0.5:1234",
+			headers: map[string]string{"Forwarded": "for=_hidden;proto=https"},
+			addr:    "10.0.0.5",
+			uri:     "https://internal/path?q=1",
+		},
+		{
+			name:    "untrusted peer",
+			remote:  "198.51.100.1:1234",
+			headers: map[string]string{"Forwarded": "for=198.51.100.7;host=example.com"},
+			addr:    "198.51.100.1",
+			uri:     "http://internal/path?q=1",
+		},
+		{
+			name:    "unsupported proto",
+			remote:  "10.0.0.5:1234",
+			headers: map[string]string{"Forwarded": "for=198.51.100.7;proto=ftp"},
+			addr:    "198.51.100.7",
+			uri:     "http://internal/path?q=1",
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, p := newHandler(t, tt.precedence)
+
+			r := httptest.NewRequest(http.MethodGet, "http://internal/path?q=1", nil)
+			r.URL.Host, r.URL.Scheme = "", ""
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			req := p.request(t)
+			assert.Equal(t, tt.addr, req.GetRemoteAddr())
+			assert.Equal(t, tt.uri, req.GetUri())
+		})
+	}
+
+	assert.Error(t, (&config.Forwarded{}).InitDefaults())
+	assert.Error(t, (&config.Forwarded{TrustedProxies: []string{"10.0.0.0/33"}}).InitDefaults())
+	assert.Error(t, (&config.Forwarded{TrustedProxies: []string{"10.0.0.1"}, Precedence: "x-real-ip"}).InitDefaults())
+}
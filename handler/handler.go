@@ -29,6 +29,10 @@ type uploads struct {
 	dir    string
 	allow  map[string]struct{}
 	forbid map[string]struct{}
+	// the temp space shared by the uploads of all requests, nil means unlimited
+	quota *tempQuota
+	// the temp files open at the same time by all requests, nil means unlimited
+	openFiles *openFiles
 }
 
 // Handler serves http connections to underlying PHP application using PSR-7 protocol. Context will include request headers,
@@ -43,6 +47,139 @@ type Handler struct {
 	sendRawBody      bool
 	debugMode        bool
 
+	// media type to the body parser mapping
+	contentTypes *contentTypes
+	// multipart reader options
+	multipartOpts multipartOptions
+
+	// parse concurrency limiter, nil means unlimited
+	parseSem          chan struct{}
+	parseQueueTimeout time.Duration
+
+	// parse the urlencoded bodies without copying the values
+	zeroCopyURLEncoded bool
+
+	// split the urlencoded and multipart keys the PHP way, see phpIndexes
+	phpArrayKeys bool
+
+	// bounds the trees building time, 0 means unlimited
+	maxParseDuration time.Duration
+
+	// encode the parsed body and the uploads as protobuf
+	protobufTrees bool
+	// serialize the worker payload with the sorted keys
+	deterministic bool
+
+	// NDJSON records limit and the malformed lines policy
+	ndjsonMaxLines      int
+	ndjsonSkipMalformed bool
+
+	// dot path of the JSON body element to be parsed, empty means the whole document
+	unwrapPath string
+	// decode the top-level JSON arrays element by element, nil means the whole body is buffered
+	jsonArrayStream *jsonArrayStream
+	// decode the gzip and deflate request bodies, up to maxDecodedSize bytes (0 = unlimited)
+	decodeContentEncoding bool
+	maxDecodedSize        int64
+	maxDecodeRatio        int64
+	// pass the details of the parsed bodies to the worker
+	parseDiagnostics bool
+	// add the parse summary response header, see config.Parse.ParseSummaryHeader
+	parseSummary bool
+	// how the JSON scalars are converted: kept typed, or the form strings of the booleans and null
+	jsonScalars jsonScalars
+	// weights the parsed requests into the parse cost, nil means disabled
+	parseCost *parseCost
+	// the fields sent to the worker, nil means the whole body
+	fieldSelection fieldSelection
+	// builds the $_REQUEST equivalent, nil means disabled
+	requestOrder *requestOrder
+	// the body size limits of the content types, nil means max_request_size only
+	bodySizes *bodySizes
+	// the children limit of the form tree nodes, 0 means unlimited
+	maxSiblings int
+	// report the bodies not matching their declared Content-Type with 415
+	strictContentType bool
+
+	// hides the sensitive fields in the diagnostic logs
+	redactor *redactor
+	// the fields whose surrounding quotes are stripped
+	trimQuotes fieldPatterns
+	// the fields whose single element lists are sent as the element, nil means none
+	collapseLists fieldPatterns
+
+	// the double-submit CSRF check, nil means disabled
+	csrf *csrfCheck
+	// the deferred parsing of the buffered bodies, nil means the bodies are parsed eagerly
+	lazyParse *lazyParse
+	// native middleware inspecting the parsed body
+	inspectors []BodyInspector
+	// native middleware adding the derived fields to the parsed body
+	mutators []BodyMutator
+	// pass the parse warnings to the worker
+	parseWarnings bool
+	// native middleware inspecting every parsed field value, and the status of the requests they reject
+	fieldInspectors    []FieldInspector
+	fieldInspectStatus int
+	// native middleware inspecting the merged request params
+	paramsInspectors []ParamsInspector
+	// tags the uploads, nil means no metadata
+	uploadMetadata UploadMetadataExtractor
+	// the query and body parameters collision check, nil means disabled
+	duplicateParams *duplicateParamsCheck
+
+	// renders the parse errors, nil means the plain text errors
+	errorRenderer ErrorRenderer
+	// respond to the parse errors with the status of their kind instead of 500, see config.Config.ParseErrorStatus
+	parseErrorStatus bool
+
+	// headers with the bracket syntax pairs, passed to the worker as trees
+	structuredHeaders []string
+
+	// deadline for reading the body of each request, 0 means no deadline
+	bodyReadTimeout time.Duration
+
+	// body field overriding the POST method, empty means disabled
+	methodOverrideField string
+	// the normally bodyless methods the form bodies are parsed for
+	bodyMethods bodyMethods
+
+	// the joint limit of the memory the parsed request retains, 0 means unlimited
+	maxParsedBytes int64
+	// top-level fields allowlist, nil means disabled
+	fieldRules *fieldRules
+	// the pattern of the raw form field names, nil means any name
+	namePattern *namePattern
+	// the correlation ID of the requests, nil means disabled
+	requestID *requestID
+	// canonicalize the request path, see config.Config.CanonicalPath
+	canonicalPath bool
+	// accept both Content-Length and Transfer-Encoding, see config.Config.AllowLengthConflict
+	allowLengthConflict bool
+	// pass the parsed Range header, see config.Config.ParseRange
+	parseRange bool
+	// the client address, scheme and host from the trusted proxies, nil means disabled
+	forwarding *forwarding
+	// the headers passed as the server variables, nil means none
+	headerVars headerVars
+	// the client certificate variables, nil means disabled
+	clientCert *clientCert
+	// the cookies count and size limits, nil means unlimited
+	cookieLimits *cookieLimits
+	// the signed cookies decoded before the worker gets them, nil means none
+	cookieDecoding *cookieDecoding
+	// the checkbox groups filled with booleans, nil means none
+	checkboxes checkboxGroups
+	// the form fields holding the nested urlencoded forms
+	nestedForms nestedForms
+	// the upload fields reported as not uploaded when missing, nil means none
+	expectedFiles expectedFiles
+	// the raw bodies of the sampled requests captured to the sink, nil means disabled
+	bodyTee *bodyTee
+
+	// body size and fields histograms, nil means disabled
+	metrics *Metrics
+
 	// permissions
 	uid int
 	gid int
@@ -57,18 +194,44 @@ type Handler struct {
 
 // NewHandler return 'handler' interface implementation
 func NewHandler(cfg *config.Config, pool common.Pool, log *zap.Logger) (*Handler, error) {
-	return &Handler{
+	h := &Handler{
 		uploads: &uploads{
 			dir:    cfg.Uploads.Dir,
 			allow:  cfg.Uploads.Allowed,
 			forbid: cfg.Uploads.Forbidden,
 		},
-		pool:             pool,
-		debugMode:        checkDebug(cfg),
-		log:              log,
-		internalHTTPCode: cfg.InternalErrorCode,
-		sendRawBody:      cfg.RawBody,
-		internalCtx:      context.Background(),
+		pool:                pool,
+		debugMode:           checkDebug(cfg),
+		requestID:           newRequestID(cfg.RequestID),
+		canonicalPath:       cfg.CanonicalPath,
+		allowLengthConflict: cfg.AllowLengthConflict,
+		parseRange:          cfg.ParseRange,
+		parseErrorStatus:    cfg.ParseErrorStatus,
+		forwarding:          newForwarding(cfg.Forwarded),
+		headerVars:          newHeaderVars(cfg.HeaderVars),
+		clientCert:          newClientCert(cfg.ClientCert),
+		cookieDecoding:      newCookieDecoding(cfg.CookieCodec),
+		bodyTee:             newBodyTee(cfg.BodyTee),
+		log:                 log,
+		internalHTTPCode:    cfg.InternalErrorCode,
+		sendRawBody:         cfg.RawBody,
+		internalCtx:         context.Background(),
+		multipartOpts: multipartOptions{
+			maxMemory:     defaultMaxMemory,
+			forbid:        cfg.Uploads.Forbidden,
+			allow:         cfg.Uploads.Allowed,
+			allowMime:     cfg.Uploads.AllowedMime,
+			maxFileSize:   cfg.Uploads.MaxFileSize,
+			imageInfo:     cfg.Uploads.ImageDimensions,
+			sniffMime:     cfg.Uploads.SniffMime,
+			tempPattern:   cfg.Uploads.TempPattern,
+			maxFileDepth:  cfg.Uploads.MaxFileNestingDepth,
+			repeatedFiles: cfg.Uploads.RepeatedFileKeys,
+
+			fallbackMemory:  cfg.Uploads.TempFallbackMemory,
+			formMaxFileSize: cfg.Uploads.FormMaxFileSize,
+			partialUploads:  cfg.Uploads.PartialUploads,
+		},
 
 		// permissions
 		uid: cfg.UID,
@@ -110,23 +273,296 @@ func NewHandler(cfg *config.Config, pool common.Pool, log *zap.Logger) (*Handler
 				}
 			},
 		},
-	}, nil
+	}
+
+	var cts []*config.ContentType
+	var missingCT string
+	h.redactor = newRedactor(nil)
+	if cfg.Parse != nil {
+		h.redactor = newRedactor(cfg.Parse.RedactFields)
+		h.trimQuotes = newFieldPatterns(cfg.Parse.TrimQuotes)
+		h.collapseLists = newFieldPatterns(cfg.Parse.CollapseLists)
+		cts = cfg.Parse.ContentTypes
+		missingCT = cfg.Parse.MissingContentType
+		if cfg.Parse.MaxConcurrency > 0 {
+			h.parseSem = make(chan struct{}, cfg.Parse.MaxConcurrency)
+		}
+		h.parseQueueTimeout = cfg.Parse.QueueTimeout
+		h.multipartOpts.literalQuotedNames = cfg.Parse.LiteralQuotedNames
+		h.multipartOpts.firstDuplicateHeader = cfg.Parse.DuplicatePartHeaders == config.DuplicatePartHeadersFirst
+		h.multipartOpts.emptyFilename = cfg.Parse.EmptyFilename
+		h.multipartOpts.lineEndings = cfg.Parse.MultipartLineEndings
+		h.multipartOpts.rejectTrailingData = cfg.Parse.MultipartTrailingData == config.MultipartTrailingDataReject
+		h.multipartOpts.maxPartHeaderSize = cfg.Parse.MaxPartHeaderSize
+		h.multipartOpts.maxValueSize = cfg.Parse.MaxMultipartValueSize
+		h.multipartOpts.partsManifest = cfg.Parse.PartsManifest
+		h.maxParsedBytes = cfg.Parse.MaxTotalParsedBytes
+		h.multipartOpts.streamSingleUpload = cfg.Parse.StreamSingleUpload
+		h.fieldRules = newFieldRules(cfg.Parse.Fields)
+		h.namePattern = newNamePattern(cfg.Parse.Fields)
+		h.multipartOpts.namePattern = h.namePattern
+		h.checkboxes = newCheckboxGroups(cfg.Parse.Checkboxes, cfg.Parse.PHPArrayKeys)
+		h.nestedForms = newNestedForms(cfg.Parse.NestedFormFields, cfg.Parse.PHPArrayKeys)
+		h.csrf = newCSRFCheck(cfg.Parse.CSRF)
+		if h.csrf != nil && h.fieldRules != nil && h.fieldRules.allowed != nil {
+			// the token field must survive the fields validation
+			h.fieldRules.allowed[h.csrf.field] = struct{}{}
+		}
+		h.lazyParse = newLazyParse(cfg.Parse.LazyParse)
+		h.duplicateParams = newDuplicateParamsCheck(cfg.Parse.DuplicateParams, cfg.Parse.PHPArrayKeys)
+		h.methodOverrideField = cfg.Parse.MethodOverrideField
+		h.bodyMethods = newBodyMethods(cfg.Parse.ParseBodyMethods)
+		h.bodySizes = newBodySizes(cfg.Parse.MaxBodySizes)
+		h.parseCost = newParseCost(cfg.Parse.ParseCost)
+		h.fieldSelection = newFieldSelection(cfg.Parse.SelectFields, cfg.Parse.PHPArrayKeys)
+		h.cookieLimits = newCookieLimits(cfg.Parse)
+		h.requestOrder = newRequestOrder(cfg.Parse.RequestOrder, cfg.Parse.PHPArrayKeys, cfg.Parse.TrackSources)
+		h.fieldInspectStatus = cfg.Parse.FieldInspectStatus
+		h.zeroCopyURLEncoded = cfg.Parse.ZeroCopyURLEncoded
+		h.phpArrayKeys = cfg.Parse.PHPArrayKeys
+		h.multipartOpts.phpArrayKeys = cfg.Parse.PHPArrayKeys
+		h.bodyReadTimeout = cfg.Parse.BodyReadTimeout
+		h.structuredHeaders = cfg.Parse.StructuredHeaders
+		h.unwrapPath = cfg.Parse.UnwrapPath
+		h.jsonArrayStream = newJSONArrayStream(cfg.Parse.JSONArrayStream)
+		h.maxParseDuration = cfg.Parse.MaxParseDuration
+		h.protobufTrees = cfg.Parse.BodyEncoding == config.BodyEncodingProtobuf
+		h.jsonScalars = jsonScalars{coerce: cfg.Parse.CoerceScalars, strings: cfg.Parse.JSONStrings}
+		h.deterministic = cfg.Parse.Deterministic
+		h.parseDiagnostics = cfg.Parse.ParseDiagnostics
+		h.parseSummary = cfg.Parse.ParseSummaryHeader
+		h.parseWarnings = cfg.Parse.ParseWarnings
+		h.decodeContentEncoding = cfg.Parse.DecodeContentEncoding
+		h.maxDecodedSize = cfg.Parse.MaxDecodedSize
+		h.maxDecodeRatio = cfg.Parse.MaxDecodeRatio
+		if h.maxDecodedSize == 0 {
+			h.maxDecodedSize = int64(cfg.MaxRequestSize) << 20 //nolint:gosec
+		}
+		h.maxSiblings = cfg.Parse.MaxSiblingsPerNode
+		h.strictContentType = cfg.Parse.StrictContentType
+		h.multipartOpts.maxSiblings = cfg.Parse.MaxSiblingsPerNode
+		h.ndjsonMaxLines = cfg.Parse.NDJSONMaxLines
+		h.ndjsonSkipMalformed = cfg.Parse.NDJSONMalformedLines == config.NDJSONMalformedSkip
+	}
+
+	var err error
+	h.contentTypes, err = newContentTypes(cts, missingCT)
+	if err != nil {
+		return nil, err
+	}
+
+	h.contentTypes.strict = h.strictContentType
+	h.expectedFiles = newExpectedFiles(cfg.Uploads.ExpectedFiles, h.phpArrayKeys)
+
+	if cfg.Uploads.TempQuota > 0 {
+		h.uploads.quota = newTempQuota(cfg.Uploads.TempQuota, cfg.Uploads.TempQuotaTimeout)
+	}
+
+	if cfg.Uploads.MaxOpenFiles > 0 {
+		h.uploads.openFiles = newOpenFiles(cfg.Uploads.MaxOpenFiles, cfg.Uploads.OpenFilesTimeout)
+		h.multipartOpts.openFiles = h.uploads.openFiles
+	}
+
+	return h, nil
+}
+
+// SetErrorRenderer sets the renderer of the requests rejected while their bodies were read or parsed, should be
+// called before the handler starts serving requests. nil restores the default plain text errors.
+func (h *Handler) SetErrorRenderer(er ErrorRenderer) {
+	h.errorRenderer = er
+}
+
+// renderParseError writes the response of the request rejected while its body was read or parsed: the configured
+// renderer, or the plain text error with 500 (the status of the error kind with parse_error_status).
+func (h *Handler) renderParseError(w http.ResponseWriter, r *http.Request, pe *ParseError, err error) {
+	if h.errorRenderer != nil {
+		h.errorRenderer.RenderParseError(w, r, pe)
+		return
+	}
+
+	status := http.StatusInternalServerError
+	if h.parseErrorStatus {
+		status = pe.Status
+	}
+
+	http.Error(w, err.Error(), status)
+}
+
+// SetBodyInspectors sets the native middleware inspecting the parsed bodies, in the order they run. Should be called
+// before the handler starts serving requests.
+func (h *Handler) SetBodyInspectors(inspectors ...BodyInspector) {
+	h.inspectors = inspectors
+}
+
+// SetBodyMutators sets the native middleware mutating the parsed bodies, in the order they run. Should be called
+// before the handler starts serving requests.
+func (h *Handler) SetBodyMutators(mutators ...BodyMutator) {
+	h.mutators = mutators
+}
+
+// SetFieldInspectors sets the native middleware inspecting every parsed field value, in the order they run. Should be
+// called before the handler starts serving requests.
+func (h *Handler) SetFieldInspectors(inspectors ...FieldInspector) {
+	h.fieldInspectors = inspectors
+}
+
+// SetParamsInspectors sets the native middleware inspecting the merged request params (request_order), in the order
+// they run. Should be called before the handler starts serving requests.
+func (h *Handler) SetParamsInspectors(inspectors ...ParamsInspector) {
+	h.paramsInspectors = inspectors
+}
+
+// SetUploadMetadataExtractor sets the extractor tagging the uploads with the request metadata, should be called
+// before the handler starts serving requests. nil leaves the uploads without metadata.
+func (h *Handler) SetUploadMetadataExtractor(e UploadMetadataExtractor) {
+	h.uploadMetadata = e
+}
+
+// SetCookieCodec sets the codec of the cookies listed in the cookie_codec config, in place of the built-in signed
+// cookie one. Should be called before the handler starts serving requests, nil rejects the listed cookies.
+func (h *Handler) SetCookieCodec(c CookieCodec) {
+	if h.cookieDecoding != nil {
+		h.cookieDecoding.codec = c
+	}
+}
+
+// SetBodySink sets the sink of the bodies captured by the body_tee config, in place of the built-in file one. Should be
+// called before the handler starts serving requests, nil disables the capture.
+func (h *Handler) SetBodySink(s BodySink) {
+	if h.bodyTee != nil {
+		h.bodyTee.sink = s
+	}
+}
+
+// SetMetrics enables the request body metrics, should be called before the handler starts serving requests.
+func (h *Handler) SetMetrics(m *Metrics) {
+	h.metrics = m
+}
+
+// rejectTempQuota responds with 503 to the request whose spilled parts or uploads don't fit into the temp quota.
+func rejectTempQuota(w http.ResponseWriter, log *zap.Logger, start time.Time, err error) {
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	log.Warn(
+		"request was rejected, the uploads temp quota is reached",
+		zap.Time("start", start),
+		zap.Int64("elapsed", time.Since(start).Milliseconds()),
+		zap.Error(err),
+	)
 }
 
 // ServeHTTP transform the original request to the PSR-7 passed then to the underlying application. Attempts to serve static files first if enabled.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	const op = errors.Op("serve_http")
 	start := time.Now()
+	connReq := connRequest(r.Context())
+
+	rawPath := ""
+	if h.canonicalPath {
+		rawPath = canonicalizePath(r.URL)
+	}
+
+	log := h.log
+	id := h.requestID.resolve(w, r)
+	if id != "" {
+		log = h.log.With(zap.String("request_id", id))
+	}
+
+	if !h.acquireParse(r.Context()) {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		log.Warn(
+			"request was rejected, too many concurrent parses",
+			zap.Time("start", start),
+			zap.Int64("elapsed", time.Since(start).Milliseconds()),
+		)
+		return
+	}
+
+	var body *countingBody
+	if (h.metrics != nil || h.parseCost != nil) && r.Body != nil {
+		body = &countingBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+
+	tee := h.bodyTee.start(r, log)
+
+	// the upgrade handshakes have no body, the read deadline would outlive the handshake on the upgraded connection
+	upgrade := isUpgrade(r)
+	clearDeadline := func() {}
+	if !upgrade {
+		clearDeadline = h.setBodyDeadline(w, log)
+	}
 
 	req := h.getReq(r)
-	err := request(r, req, h.uid, h.gid, h.sendRawBody)
+	req.log = log
+	h.forwarding.apply(r, req)
+	if rawPath != "" {
+		req.setAttribute(RawPathAttribute, rawPath)
+	}
+	h.clientCert.set(r, req)
+	if h.parseRange {
+		setRange(r, req)
+	}
+	if id != "" {
+		req.requestID = id
+		req.setAttribute(RequestIDAttribute, id)
+	}
+	h.headerVars.set(r, req)
+	var err error
+	if !h.allowLengthConflict {
+		err = lengthConflict(r)
+	}
+	if err == nil {
+		err = h.bodySizes.limit(w, r)
+	}
+	if err == nil {
+		err = h.request(r, req)
+	}
+	if err == nil && !upgrade {
+		err = req.readTrailers(r)
+	}
+	if err == nil {
+		h.setWarnings(req)
+	}
+	if err == nil && body != nil {
+		h.parseCost.set(body.n, req)
+	}
+	if err == nil {
+		err = h.csrf.check(r, req)
+	}
+	if err == nil {
+		err = h.duplicateParams.check(r, req, log)
+	}
+	if err == nil {
+		err = h.inspect(r, req)
+	}
+	if err == nil {
+		err = h.mutate(r, req)
+	}
+	if err == nil {
+		err = h.inspectFields(r, req)
+	}
+	if err == nil {
+		err = h.mergeParams(r, req, log)
+	}
+	clearDeadline()
+	tee.finish(log)
+	if req.parseSummary != "" {
+		w.Header().Set(ParseSummaryHeader, req.parseSummary)
+	}
+	if body != nil && h.metrics != nil {
+		h.metrics.observe(body.n, req)
+		if h.parseCost != nil {
+			observeExemplar(h.metrics.parseCost, req.cost, req.requestID)
+		}
+	}
 	if err != nil {
+		h.releaseParse()
 		// if the pipe is broken, there is no sense to write the header
 		// in this case, we just report about error
 		if stderr.Is(err, errEPIPE) {
-			req.Close(h.log, r)
+			req.Close(log, r)
 			h.putReq(req)
-			h.log.Error(
+			log.Error(
 				"write response error",
 				zap.Time("start", start),
 				zap.Int64("elapsed", time.Since(start).Milliseconds()),
@@ -135,10 +571,30 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		req.Close(h.log, r)
+		req.Close(log, r)
 		h.putReq(req)
-		http.Error(w, errors.E(op, err).Error(), 500)
-		h.log.Error(
+		if isTempQuotaErr(err) {
+			rejectTempQuota(w, log, start, err)
+			return
+		}
+		pe := asParseError(err)
+		if pe.Kind == ParseErrorTimeout {
+			// the rest of the body can't be read, the connection can't be reused
+			w.Header().Set("Connection", "close")
+		}
+		h.renderParseError(w, r, pe, errors.E(op, err))
+		if pe.Kind == ParseErrorTimeout {
+			log.Warn(
+				"request body read timeout",
+				zap.Time("start", start),
+				zap.Int64("elapsed", time.Since(start).Milliseconds()),
+				zap.Int64("connection_request", connReq),
+				zap.Bool("reused_connection", connReq > 1),
+				zap.Error(err),
+			)
+			return
+		}
+		log.Error(
 			"request forming error",
 			zap.Time("start", start),
 			zap.Int64("elapsed", time.Since(start).Milliseconds()),
@@ -147,7 +603,28 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	req.Open(h.log, h.uploads.dir, h.uploads.forbid, h.uploads.allow)
+	err = req.open(log, h.uploads.dir, h.uploads.forbid, h.uploads.allow, h.uploads.openFiles)
+	if err != nil {
+		h.releaseParse()
+		req.Close(log, r)
+		h.putReq(req)
+		if isTempQuotaErr(err) {
+			rejectTempQuota(w, log, start, err)
+			return
+		}
+		pe := asParseError(err)
+		h.renderParseError(w, r, pe, errors.E(op, err))
+		log.Warn(
+			"request was rejected, the uploads can't be stored",
+			zap.Time("start", start),
+			zap.Int64("elapsed", time.Since(start).Milliseconds()),
+			zap.Error(err),
+		)
+		return
+	}
+
+	// the body is parsed and files are moved to the uploads dir, let the next request in
+	h.releaseParse()
 	// get payload from the pool
 	pld := h.getPld()
 	// get proto request from the pool
@@ -155,11 +632,11 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err = req.Payload(pld, h.sendRawBody, reqproto)
 	h.putProtoReq(reqproto)
 	if err != nil {
-		req.Close(h.log, r)
+		req.Close(log, r)
 		h.putReq(req)
 		h.putPld(pld)
 		h.handleError(w, err)
-		h.log.Error(
+		log.Error(
 			"payload forming error",
 			zap.Time("start", start),
 			zap.Int64("elapsed", time.Since(start).Milliseconds()),
@@ -171,31 +648,34 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	stopCh := h.getCh()
 	wResp, err := h.pool.Exec(h.internalCtx, pld, stopCh)
 	if err != nil {
-		req.Close(h.log, r)
+		req.Close(log, r)
 		h.putReq(req)
 		h.putPld(pld)
 		h.putCh(stopCh)
 		h.handleError(w, err)
-		h.log.Error("execute", zap.Time("start", start), zap.Int64("elapsed", time.Since(start).Milliseconds()), zap.Error(err))
+		log.Error("execute", zap.Time("start", start), zap.Int64("elapsed", time.Since(start).Milliseconds()), zap.Error(err))
 		return
 	}
 	// return payload to the pool
 	h.putPld(pld)
 
+	st := &responseStream{}
+	stop := stopOnDisconnect(r.Context(), stopCh)
 	for recv := range wResp {
 		if recv.Error() != nil {
-			req.Close(h.log, r)
+			stop()
+			req.Close(log, r)
 			h.putReq(req)
 			h.putCh(stopCh)
 			w.WriteHeader(int(h.internalHTTPCode)) //nolint:gosec
-			h.log.Error("read stream",
+			log.Error("read stream",
 				zap.Time("start", start),
 				zap.Int64("elapsed", time.Since(start).Milliseconds()),
 				zap.Error(recv.Error()))
 			return
 		}
 
-		err = h.Write(recv.Payload(), w)
+		err = h.write(recv.Payload(), w, st)
 		if err != nil {
 			// send a stop signal to the worker pool
 			select {
@@ -204,18 +684,58 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 
 			// we should not exit from the loop here, since after sending close signal, it should be closed from the SDK side
-			h.log.Error("write response (chunk) error",
+			log.Error("write response (chunk) error",
 				zap.Time("start", start),
 				zap.Int64("elapsed", time.Since(start).Milliseconds()),
 				zap.Error(err))
 		}
 	}
 
-	req.Close(h.log, r)
+	stop()
+	req.Close(log, r)
 	h.putReq(req)
 	h.putCh(stopCh)
 }
 
+// acquireParse takes a parse slot if the parse concurrency is limited. When all slots are busy, the request waits up to
+// the queue timeout (or until the client goes away). Returns false if the request should be shed.
+func (h *Handler) acquireParse(ctx context.Context) bool {
+	if h.parseSem == nil {
+		return true
+	}
+
+	select {
+	case h.parseSem <- struct{}{}:
+		return true
+	default:
+	}
+
+	if h.parseQueueTimeout == 0 {
+		return false
+	}
+
+	tm := time.NewTimer(h.parseQueueTimeout)
+	defer tm.Stop()
+
+	select {
+	case h.parseSem <- struct{}{}:
+		return true
+	case <-tm.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseParse returns the parse slot taken by acquireParse.
+func (h *Handler) releaseParse() {
+	if h.parseSem == nil {
+		return
+	}
+
+	<-h.parseSem
+}
+
 // handleError will handle internal RR errors and return 500
 func (h *Handler) handleError(w http.ResponseWriter, err error) {
 	// write an internal server error
@@ -0,0 +1,1685 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	httpV1proto "github.com/roadrunner-server/api/v4/build/http/v1"
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/goridge/v3/pkg/frame"
+	"github.com/roadrunner-server/http/v5/config"
+	"github.com/roadrunner-server/http/v5/handler/handlertest"
+	"github.com/roadrunner-server/pool/payload"
+	staticPool "github.com/roadrunner-server/pool/pool/static_pool"
+	"github.com/roadrunner-server/pool/worker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/protobuf/proto"
+)
+
+// testPool records the payload sent to the worker and fails the execution, which is enough to test the request intake
+type testPool struct {
+	mu  sync.Mutex
+	pld *payload.Payload
+}
+
+func (p *testPool) Workers() []*worker.Process {
+	return nil
+}
+
+func (p *testPool) RemoveWorker(context.Context) error {
+	return nil
+}
+
+func (p *testPool) AddWorker() error {
+	return nil
+}
+
+func (p *testPool) Exec(_ context.Context, pld *payload.Payload, _ chan struct{}) (chan *staticPool.PExec, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pld = &payload.Payload{
+		Body:    append([]byte(nil), pld.Body...),
+		Context: append([]byte(nil), pld.Context...),
+		Codec:   pld.Codec,
+	}
+
+	return nil, errors.Str("test pool")
+}
+
+func (p *testPool) Reset(context.Context) error {
+	return nil
+}
+
+func (p *testPool) Destroy(context.Context) {}
+
+// request returns the worker request context
+func (p *testPool) request(t *testing.T) *httpV1proto.Request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	require.NotNil(t, p.pld)
+
+	req := &httpV1proto.Request{}
+	require.NoError(t, proto.Unmarshal(p.pld.Context, req))
+
+	return req
+}
+
+func newTestHandler(t *testing.T, cfg *config.Config) (*Handler, *testPool) {
+	if cfg.Uploads == nil {
+		cfg.Uploads = &config.Uploads{}
+	}
+	require.NoError(t, cfg.Uploads.InitDefaults())
+	if cfg.InternalErrorCode == 0 {
+		cfg.InternalErrorCode = 500
+	}
+
+	p := &testPool{}
+	h, err := NewHandler(cfg, p, zap.NewNop())
+	require.NoError(t, err)
+
+	return h, p
+}
+
+func TestHandler_ParseConcurrency(t *testing.T) {
+	h, p := newTestHandler(t, &config.Config{
+		Parse: &config.Parse{
+			MaxConcurrency: 1,
+		},
+	})
+
+	// hold the only slot
+	require.True(t, h.acquireParse(context.Background()))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"key": {"value"}}))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Nil(t, p.pld)
+
+	h.releaseParse()
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"key": {"value"}}))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NotNil(t, p.pld)
+	// slot was released after the parse
+	assert.Empty(t, h.parseSem)
+}
+
+func TestHandler_ParseConcurrencyQueue(t *testing.T) {
+	h, p := newTestHandler(t, &config.Config{
+		Parse: &config.Parse{
+			MaxConcurrency: 1,
+			QueueTimeout:   time.Second * 5,
+		},
+	})
+
+	require.True(t, h.acquireParse(context.Background()))
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		h.releaseParse()
+	}()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"key": {"value"}}))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NotNil(t, p.pld)
+}
+
+func TestTempSweeper(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Uploads{Dir: dir, TempTTL: time.Hour}
+	require.NoError(t, cfg.InitDefaults())
+	assert.Equal(t, time.Hour, cfg.TempSweepInterval)
+
+	newFile := func(name string, age time.Duration) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte("data"), 0o600))
+		mtime := time.Now().Add(-age)
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+		return path
+	}
+
+	f, err := createTempFile(dir, cfg.TempPattern)
+	require.NoError(t, err)
+	_, err = f.WriteString("data")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	orphaned := f.Name()
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(orphaned, old, old))
+
+	f, err = createTempFile(dir, cfg.TempPattern)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	inUse := f.Name()
+
+	foreign := newFile("upload-report.txt", 2*time.Hour)
+	otherPattern := newFile("other-0123456789abcdef0123456789abcdef", 2*time.Hour)
+
+	core, logs := observer.New(zap.InfoLevel)
+	s := NewTempSweeper(cfg, zap.New(core))
+	removed, reclaimed := s.sweep(time.Now())
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, int64(4), reclaimed)
+	assert.Equal(t, 1, logs.FilterMessage("orphaned temp files reclaimed").Len())
+
+	assert.NoFileExists(t, orphaned)
+	assert.FileExists(t, inUse)
+	assert.FileExists(t, foreign)
+	assert.FileExists(t, otherPattern)
+
+	t.Run("disabled", func(t *testing.T) {
+		assert.Nil(t, NewTempSweeper(&config.Uploads{Dir: dir}, zap.NewNop()))
+	})
+
+	t.Run("start and stop", func(t *testing.T) {
+		s := NewTempSweeper(&config.Uploads{Dir: dir, TempPattern: cfg.TempPattern, TempTTL: time.Hour, TempSweepInterval: time.Millisecond}, zap.NewNop())
+		s.Start()
+		newFile("upload-"+strings.Repeat("ab", 16), 2*time.Hour)
+		require.Eventually(t, func() bool {
+			_, err := os.Stat(filepath.Join(dir, "upload-"+strings.Repeat("ab", 16)))
+			return os.IsNotExist(err)
+		}, time.Second, time.Millisecond)
+		s.Stop()
+		s.Stop()
+	})
+}
+
+func TestHandler_TempQuota(t *testing.T) {
+	newRequest := func(size int) *http.Request {
+		return handlertest.NewMultipart().
+			Field("key", "value").
+			File("file", "a.txt", "text/plain", bytes.Repeat([]byte("a"), size)).
+			Request(http.MethodPost, "/")
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{Uploads: &config.Uploads{Dir: t.TempDir(), TempQuota: 10}})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(11))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Nil(t, p.pld)
+
+		// hold a part of the quota
+		require.True(t, h.uploads.quota.acquire(context.Background(), 5))
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(6))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Nil(t, p.pld)
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(5))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		require.NotNil(t, p.pld)
+		// the files are removed, the reserved space is released
+		assert.Equal(t, int64(5), h.uploads.quota.used)
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{Uploads: &config.Uploads{Dir: t.TempDir(), TempQuota: 10, TempQuotaTimeout: time.Second * 5}})
+
+		require.True(t, h.uploads.quota.acquire(context.Background(), 10))
+		go func() {
+			time.Sleep(time.Millisecond * 100)
+			h.uploads.quota.release(10)
+		}()
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(10))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.NotNil(t, p.pld)
+		assert.Zero(t, h.uploads.quota.used)
+	})
+
+	t.Run("queue timeout", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{Uploads: &config.Uploads{Dir: t.TempDir(), TempQuota: 10, TempQuotaTimeout: time.Millisecond * 50}})
+
+		require.True(t, h.uploads.quota.acquire(context.Background(), 1))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(10))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Nil(t, p.pld)
+		assert.Equal(t, int64(1), h.uploads.quota.used)
+	})
+
+	t.Run("spill", func(t *testing.T) {
+		tmp := t.TempDir()
+		t.Setenv("TMPDIR", tmp)
+
+		h, p := newTestHandler(t, &config.Config{Uploads: &config.Uploads{Dir: t.TempDir(), TempQuota: 1500}})
+		h.multipartOpts.maxMemory = 10
+
+		// the spilled part and its copy in the uploads dir are both held until the request is done
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(1000))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Nil(t, p.pld)
+		assert.Zero(t, h.uploads.quota.used)
+
+		// the first upload is still being spilled when the second one comes in
+		mp := handlertest.NewMultipart().
+			Field("key", "value").
+			File("file", "a.txt", "text/plain", bytes.Repeat([]byte("a"), 700))
+		body := mp.Bytes()
+		pr, pw := io.Pipe()
+		r := httptest.NewRequest(http.MethodPost, "/", pr)
+		r.Header.Set("Content-Type", mp.ContentType())
+
+		wa := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h.ServeHTTP(wa, r)
+		}()
+
+		_, err := pw.Write(body[:len(body)-100])
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			h.uploads.quota.mu.Lock()
+			defer h.uploads.quota.mu.Unlock()
+			return h.uploads.quota.used >= 550
+		}, time.Second*5, time.Millisecond*10)
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(1000))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		_, err = pw.Write(body[len(body)-100:])
+		require.NoError(t, err)
+		require.NoError(t, pw.Close())
+		<-done
+
+		assert.Equal(t, http.StatusInternalServerError, wa.Code)
+		require.NotNil(t, p.pld)
+		assert.Zero(t, h.uploads.quota.used)
+
+		entries, err := os.ReadDir(tmp)
+		require.NoError(t, err)
+		for _, e := range entries {
+			assert.False(t, isTempName(e.Name(), tmpPartPattern), e.Name())
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		q := newTempQuota(100, time.Second*5)
+
+		var wg sync.WaitGroup
+		for range 50 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.True(t, q.acquire(context.Background(), 30))
+				q.mu.Lock()
+				assert.LessOrEqual(t, q.used, int64(100))
+				q.mu.Unlock()
+				q.release(30)
+			}()
+		}
+
+		wg.Wait()
+		assert.Zero(t, q.used)
+	})
+}
+
+func TestHandler_MaxBodySizes(t *testing.T) {
+	cfg := &config.Parse{
+		ContentTypes: []*config.ContentType{{Pattern: "+json", Parser: config.ParserJSON}},
+		MaxBodySizes: []*config.BodySizeLimit{
+			{Pattern: "+json", MaxSize: 16},
+			{Pattern: "application/vnd.big+json", MaxSize: 1024},
+		},
+	}
+	require.NoError(t, cfg.InitDefaults())
+
+	body := []byte(`{"name":"a long enough value"}`)
+
+	testCases := []struct {
+		name    string
+		ct      string
+		chunked bool
+		status  int
+	}{
+		{name: "declared length", ct: "application/vnd.api+json", status: http.StatusRequestEntityTooLarge},
+		{name: "unknown length", ct: "application/vnd.api+json", chunked: true, status: http.StatusRequestEntityTooLarge},
+		{name: "more specific pattern", ct: "application/vnd.big+json", status: http.StatusInternalServerError},
+		{name: "no limit", ct: handlertest.ContentURLEncoded, status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: cfg})
+
+			r := handlertest.NewRawRequest(http.MethodPost, "/", tt.ct, body)
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.status, w.Code)
+			if tt.status == http.StatusRequestEntityTooLarge {
+				assert.Nil(t, p.pld)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		cfg := &config.Parse{MaxBodySizes: []*config.BodySizeLimit{{Pattern: "application/json"}}}
+		assert.Error(t, cfg.InitDefaults())
+	})
+}
+
+func TestHandler_TempStorageUnavailable(t *testing.T) {
+	form := func(size int) *http.Request {
+		return handlertest.NewMultipart().
+			Field("name", "n").
+			File("doc", "doc.txt", "text/plain", bytes.Repeat([]byte("a"), size)).
+			Request(http.MethodPost, "/")
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	t.Run("spill", func(t *testing.T) {
+		dir := t.TempDir()
+		// the parts over the memory limit are spilled to the system temp dir
+		t.Setenv("TMPDIR", missing)
+
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Uploads: &config.Uploads{Dir: dir}})
+		h.multipartOpts.maxMemory = 10
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, form(100))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.NotContains(t, w.Body.String(), missing)
+		assert.Nil(t, p.pld)
+	})
+
+	t.Run("fallback memory", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("TMPDIR", missing)
+
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Uploads: &config.Uploads{Dir: dir, TempFallbackMemory: 150}})
+		h.multipartOpts.maxMemory = 10
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, form(100))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		require.NotNil(t, p.pld)
+		req := p.request(t)
+		assert.Contains(t, string(req.GetUploads()), `"size":100`)
+		assert.Contains(t, string(req.GetUploads()), `"error":0`)
+
+		// larger than the fallback memory
+		p.pld = nil
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, form(200))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Nil(t, p.pld)
+	})
+
+	t.Run("uploads dir", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Uploads: &config.Uploads{Dir: missing}})
+
+		core, logs := observer.New(zap.WarnLevel)
+		h.log = zap.New(core)
+
+		var pe *ParseError
+		h.SetErrorRenderer(ErrorRendererFunc(func(w http.ResponseWriter, _ *http.Request, err *ParseError) {
+			pe = err
+			w.WriteHeader(err.Status)
+		}))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, form(10))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		require.NotNil(t, pe)
+		assert.Equal(t, ParseErrorCodeStorageUnavailable, pe.Code)
+		assert.Nil(t, p.pld)
+		assert.Equal(t, 1, logs.FilterMessage("request was rejected, the uploads can't be stored").Len())
+	})
+}
+
+func TestHandler_MaxOpenFiles(t *testing.T) {
+	newRequest := func(files, size int) *http.Request {
+		mp := handlertest.NewMultipart()
+		for i := range files {
+			mp.File("file[]", fmt.Sprintf("%d.txt", i), "text/plain", bytes.Repeat([]byte("a"), size))
+		}
+
+		return mp.Request(http.MethodPost, "/")
+	}
+
+	newHandler := func(t *testing.T, timeout time.Duration) (*Handler, *testPool) {
+		return newTestHandler(t, &config.Config{ParseErrorStatus: true, Uploads: &config.Uploads{Dir: t.TempDir(), MaxOpenFiles: 2, OpenFilesTimeout: timeout}})
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		h, p := newHandler(t, 0)
+		require.NoError(t, h.uploads.openFiles.acquire())
+		require.NoError(t, h.uploads.openFiles.acquire())
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(1, 10))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Nil(t, p.pld)
+		assert.Len(t, h.uploads.openFiles.slots, 2)
+
+		// the parts spilled to disk while the body is read
+		h.multipartOpts.maxMemory = 10
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(1, 100))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Nil(t, p.pld)
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		h, p := newHandler(t, time.Second*5)
+		require.NoError(t, h.uploads.openFiles.acquire())
+		require.NoError(t, h.uploads.openFiles.acquire())
+		go func() {
+			time.Sleep(time.Millisecond * 100)
+			h.uploads.openFiles.release()
+		}()
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(20, 10))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		require.NotNil(t, p.pld)
+
+		var uploads map[string][]FileUpload
+		require.NoError(t, json.Unmarshal(p.request(t).Uploads, &uploads))
+		require.Len(t, uploads["file"], 20)
+		for _, f := range uploads["file"] {
+			assert.Equal(t, UploadErrorOK, f.Error)
+			assert.NotEmpty(t, f.TempFilename)
+		}
+
+		// only the slot held by the test is left
+		assert.Len(t, h.uploads.openFiles.slots, 1)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		h, p := newHandler(t, time.Millisecond*50)
+		require.NoError(t, h.uploads.openFiles.acquire())
+		require.NoError(t, h.uploads.openFiles.acquire())
+
+		var pe *ParseError
+		h.SetErrorRenderer(ErrorRendererFunc(func(w http.ResponseWriter, _ *http.Request, err *ParseError) {
+			pe = err
+			w.WriteHeader(err.Status)
+		}))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(3, 10))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Nil(t, p.pld)
+		require.NotNil(t, pe)
+		assert.Equal(t, ParseErrorCodeUnavailable, pe.Code)
+	})
+}
+
+func TestHandler_RequestID(t *testing.T) {
+	newHandler := func(t *testing.T, generate string) (*Handler, *testPool) {
+		cfg := &config.RequestID{Generate: generate}
+		require.NoError(t, cfg.InitDefaults())
+		return newTestHandler(t, &config.Config{ParseErrorStatus: true, RequestID: cfg})
+	}
+
+	workerID := func(t *testing.T, p *testPool) (string, string) {
+		req := p.request(t)
+		header := req.GetHeader()["X-Request-Id"]
+		attr := req.Attributes[RequestIDAttribute]
+		if header == nil || attr == nil {
+			return "", ""
+		}
+
+		require.Len(t, header.Value, 1)
+		return string(header.Value[0]), string(attr.Value[0])
+	}
+
+	testCases := []struct {
+		name     string
+		generate string
+		header   string
+		keep     bool
+		version  uuid.Version
+	}{
+		{name: "client id", header: "abc-123", keep: true},
+		{name: "generated", version: 4},
+		{name: "generated v7", generate: config.RequestIDGenerateUUIDv7, version: 7},
+		{name: "invalid replaced", header: "id with spaces", version: 4},
+		{name: "too long replaced", header: strings.Repeat("a", maxRequestIDLength+1), version: 4},
+		{name: "longest kept", header: strings.Repeat("a", maxRequestIDLength), keep: true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, p := newHandler(t, tt.generate)
+
+			r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"key": {"value"}})
+			if tt.header != "" {
+				r.Header.Set("X-Request-ID", tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			id := w.Header().Get("X-Request-ID")
+			if tt.keep {
+				assert.Equal(t, tt.header, id)
+			} else {
+				u, err := uuid.Parse(id)
+				require.NoError(t, err)
+				assert.Equal(t, tt.version, u.Version())
+			}
+
+			header, attr := workerID(t, p)
+			assert.Equal(t, id, header)
+			assert.Equal(t, id, attr)
+		})
+	}
+
+	t.Run("none", func(t *testing.T) {
+		h, p := newHandler(t, config.RequestIDGenerateNone)
+
+		r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"key": {"value"}})
+		r.Header.Set("X-Request-ID", "bad id")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Empty(t, w.Header().Get("X-Request-ID"))
+
+		header, attr := workerID(t, p)
+		assert.Empty(t, header)
+		assert.Empty(t, attr)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"key": {"value"}}))
+		assert.Empty(t, w.Header().Get("X-Request-ID"))
+		assert.NotContains(t, p.request(t).Attributes, RequestIDAttribute)
+	})
+
+	t.Run("logs and errors", func(t *testing.T) {
+		h, _ := newHandler(t, "")
+		core, logs := observer.New(zap.WarnLevel)
+		h.log = zap.New(core)
+
+		r := handlertest.NewRawRequest(http.MethodPost, "/", handlertest.ContentURLEncoded, []byte("a=%zz"))
+		r.Header.Set("X-Request-ID", "abc-123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "abc-123", w.Header().Get("X-Request-ID"))
+
+		entries := logs.FilterMessage("request forming error").All()
+		require.Len(t, entries, 1)
+		assert.Equal(t, "abc-123", entries[0].ContextMap()["request_id"])
+	})
+
+	t.Run("config", func(t *testing.T) {
+		cfg := &config.RequestID{}
+		require.NoError(t, cfg.InitDefaults())
+		assert.Equal(t, config.DefaultRequestIDHeader, cfg.Header)
+		assert.Equal(t, config.RequestIDGenerateUUID, cfg.Generate)
+		assert.Error(t, (&config.RequestID{Generate: "random"}).InitDefaults())
+	})
+}
+
+func TestHandler_Trailers(t *testing.T) {
+	h, p := newTestHandler(t, &config.Config{})
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	mp := handlertest.NewMultipart().Field("key", "value").Trailer([]byte("\r\nepilogue"))
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL, io.NopCloser(bytes.NewReader(mp.Bytes())))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", mp.ContentType())
+	// unknown length, chunked
+	req.ContentLength = -1
+	req.Trailer = http.Header{"Content-Sha256": {"abc"}}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	wr := p.request(t)
+	require.Contains(t, wr.GetAttributes(), "Trailer:Content-Sha256")
+	assert.Equal(t, [][]byte{[]byte("abc")}, wr.GetAttributes()["Trailer:Content-Sha256"].GetValue())
+	assert.JSONEq(t, `{"key":"value"}`, string(p.pld.Body))
+}
+
+// responseChunk builds the worker response chunk, the headers are sent with the first one only.
+func responseChunk(t *testing.T, headers map[string]string, body string) *payload.Payload {
+	pld := &payload.Payload{Body: []byte(body), Codec: frame.CodecProto}
+	if headers == nil {
+		return pld
+	}
+
+	rsp := &httpV1proto.Response{Status: http.StatusOK, Headers: make(map[string]*httpV1proto.HeaderValue)}
+	for k, v := range headers {
+		rsp.Headers[k] = &httpV1proto.HeaderValue{Value: [][]byte{[]byte(v)}}
+	}
+
+	var err error
+	pld.Context, err = proto.Marshal(rsp)
+	require.NoError(t, err)
+
+	return pld
+}
+
+func TestHandler_StreamFlush(t *testing.T) {
+	h, _ := newTestHandler(t, &config.Config{})
+
+	t.Run("auto", func(t *testing.T) {
+		received := make(chan struct{}, 1)
+
+		// slow worker, the next chunk is produced only after the client got the previous one
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			st := &responseStream{}
+			assert.NoError(t, h.write(responseChunk(t, map[string]string{"Content-Type": "text/csv"}, "a,b\n"), w, st))
+			for _, row := range []string{"1,2\n", "3,4\n"} {
+				select {
+				case <-received:
+				case <-time.After(time.Second * 5):
+					t.Error("chunk was not flushed")
+					return
+				}
+
+				assert.NoError(t, h.write(responseChunk(t, nil, row), w, st))
+			}
+		}))
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL) //nolint:noctx
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+
+		assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+		br := bufio.NewReader(resp.Body)
+		for _, row := range []string{"a,b\n", "1,2\n", "3,4\n"} {
+			line, err := br.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, row, line)
+			received <- struct{}{}
+		}
+	})
+
+	t.Run("manual", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		st := &responseStream{}
+
+		require.NoError(t, h.write(responseChunk(t, map[string]string{StreamFlush: StreamFlushManual}, "a,b\n"), w, st))
+		require.NoError(t, h.write(responseChunk(t, nil, "1,2\n"), w, st))
+		assert.False(t, w.Flushed)
+		assert.Empty(t, w.Header().Get(StreamFlush))
+
+		// flush now
+		require.NoError(t, h.write(responseChunk(t, nil, ""), w, st))
+		assert.True(t, w.Flushed)
+		assert.Equal(t, "a,b\n1,2\n", w.Body.String())
+	})
+
+	t.Run("unknown mode", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		assert.Error(t, h.write(responseChunk(t, map[string]string{StreamFlush: "sometimes"}, "a"), w, &responseStream{}))
+	})
+}
+
+func TestHandler_EventStream(t *testing.T) {
+	h, _ := newTestHandler(t, &config.Config{})
+
+	w := httptest.NewRecorder()
+	st := &responseStream{}
+	// the event streams ignore the manual flush mode
+	headers := map[string]string{"Content-Type": "text/event-stream; charset=utf-8", "Content-Length": "100", StreamFlush: StreamFlushManual}
+	require.NoError(t, h.write(responseChunk(t, headers, "data: 1\n\n"), w, st))
+	assert.True(t, w.Flushed)
+	assert.True(t, st.eventStream)
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "no", w.Header().Get("X-Accel-Buffering"))
+	assert.NotContains(t, w.Header(), "Content-Encoding")
+	assert.Empty(t, w.Header().Get("Content-Length"))
+
+	w.Flushed = false
+	require.NoError(t, h.write(responseChunk(t, nil, "data: 2\n\n"), w, st))
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "data: 1\n\ndata: 2\n\n", w.Body.String())
+
+	// the worker's own cache policy is kept
+	w = httptest.NewRecorder()
+	require.NoError(t, h.write(responseChunk(t, map[string]string{"Content-Type": "text/event-stream", "Cache-Control": "no-store"}, ""), w, &responseStream{}))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+}
+
+func TestStopOnDisconnect(t *testing.T) {
+	t.Run("disconnect", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		stopCh := make(chan struct{}, 1)
+		stop := stopOnDisconnect(ctx, stopCh)
+
+		cancel()
+		select {
+		case <-stopCh:
+		case <-time.After(time.Second * 5):
+			t.Fatal("stop signal was not sent")
+		}
+
+		stop()
+	})
+
+	t.Run("completed", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		stopCh := make(chan struct{}, 1)
+		stop := stopOnDisconnect(ctx, stopCh)
+
+		stop()
+		// the context is canceled when the handler returns
+		cancel()
+		assert.Empty(t, stopCh)
+	})
+}
+
+func TestHandler_MissingContentType(t *testing.T) {
+	t.Run("raw", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewRawRequest(http.MethodPost, "/", "", []byte("a=1")))
+		assert.False(t, p.request(t).GetParsed())
+		assert.Equal(t, "a=1", string(p.pld.Body))
+	})
+
+	t.Run("assume-urlencoded", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{MissingContentType: config.MissingContentTypeURLEncoded}})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewRawRequest(http.MethodPost, "/", "", []byte("a=1&b[c]=2")))
+		assert.True(t, p.request(t).GetParsed())
+		assert.JSONEq(t, `{"a":"1","b":{"c":"2"}}`, string(p.pld.Body))
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{MissingContentType: config.MissingContentTypeReject}})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewRawRequest(http.MethodPost, "/", "", []byte("a=1")))
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+		assert.Nil(t, p.pld)
+
+		// empty body is not rejected
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewRawRequest(http.MethodPost, "/", "", nil))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.NotNil(t, p.pld)
+	})
+
+	t.Run("body size limit", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{MissingContentType: config.MissingContentTypeURLEncoded}})
+
+		w := httptest.NewRecorder()
+		r := handlertest.NewRawRequest(http.MethodPost, "/", "", []byte("a=1234567890"))
+		r.Body = http.MaxBytesReader(w, r.Body, 5)
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Nil(t, p.pld)
+	})
+}
+
+func TestHandler_BodyReadTimeout(t *testing.T) {
+	h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{BodyReadTimeout: time.Millisecond * 200}})
+	core, logs := observer.New(zap.WarnLevel)
+	h.log = zap.New(core)
+
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.ConnContext = ConnContext
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	br := bufio.NewReader(conn)
+	send := func(contentLength int, body string) int {
+		_, errW := fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s", handlertest.ContentURLEncoded, contentLength, body)
+		require.NoError(t, errW)
+
+		resp, errR := http.ReadResponse(br, nil)
+		require.NoError(t, errR)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusInternalServerError, send(3, "a=1"))
+	// the deadline of the first request must not affect the next one on the same connection
+	time.Sleep(time.Millisecond * 300)
+	assert.Equal(t, http.StatusInternalServerError, send(3, "a=1"))
+
+	// the body is never completed
+	assert.Equal(t, http.StatusRequestTimeout, send(10, "a=1"))
+
+	entries := logs.FilterMessage("request body read timeout").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, int64(3), entries[0].ContextMap()["connection_request"])
+	assert.Equal(t, true, entries[0].ContextMap()["reused_connection"])
+}
+
+func TestHandler_ErrorRenderer(t *testing.T) {
+	cfg := func(status bool) *config.Config {
+		return &config.Config{ParseErrorStatus: status, Parse: &config.Parse{
+			StructuredHeaders: []string{"X-Meta"},
+			Fields:            &config.Fields{Required: []string{"name"}},
+		}}
+	}
+
+	tooLarge := func(w http.ResponseWriter) *http.Request {
+		r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"name": {"1234567890"}})
+		r.Body = http.MaxBytesReader(w, r.Body, 5)
+		return r
+	}
+	manyPairs := func(http.ResponseWriter) *http.Request {
+		r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"name": {"value"}})
+		r.Header.Set("X-Meta", strings.Repeat("a[]=1;", maxHeaderPairs+1))
+		return r
+	}
+	malformed := func(http.ResponseWriter) *http.Request {
+		r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"name": {"value"}})
+		r.Header.Set("X-Meta", "a=%zz")
+		return r
+	}
+	missingField := func(http.ResponseWriter) *http.Request {
+		return handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"other": {"value"}})
+	}
+
+	testCases := []struct {
+		name    string
+		request func(w http.ResponseWriter) *http.Request
+		kind    ParseErrorKind
+		status  int
+	}{
+		{name: "body too large", request: tooLarge, kind: ParseErrorBodyTooLarge, status: http.StatusRequestEntityTooLarge},
+		{name: "header too large", request: manyPairs, kind: ParseErrorHeaderTooLarge, status: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "malformed header", request: malformed, kind: ParseErrorMalformed, status: http.StatusBadRequest},
+		{name: "invalid fields", request: missingField, kind: ParseErrorInvalidFields, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			// default plain text error
+			h, p := newTestHandler(t, cfg(false))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, tt.request(w))
+			assert.Equal(t, http.StatusInternalServerError, w.Code)
+			assert.Contains(t, w.Body.String(), "serve_http")
+			assert.Nil(t, p.pld)
+
+			// the status of the error kind
+			h, p = newTestHandler(t, cfg(true))
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, tt.request(w))
+			assert.Equal(t, tt.status, w.Code)
+			assert.Contains(t, w.Body.String(), "serve_http")
+			assert.Nil(t, p.pld)
+
+			h.SetErrorRenderer(ErrorRendererFunc(func(w http.ResponseWriter, _ *http.Request, err *ParseError) {
+				assert.Equal(t, tt.kind, err.Kind)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(err.Status + 1)
+				_, _ = fmt.Fprintf(w, `{"error":{"kind":%d}}`, err.Kind)
+			}))
+
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, tt.request(w))
+			assert.Equal(t, tt.status+1, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.JSONEq(t, fmt.Sprintf(`{"error":{"kind":%d}}`, tt.kind), w.Body.String())
+		})
+	}
+}
+
+func TestHandler_ParseErrorKinds(t *testing.T) {
+	cts := []*config.ContentType{{Pattern: "application/json", Parser: config.ParserJSON}}
+	deep := strings.Repeat(`{"a":`, MaxLevel+1) + "1" + strings.Repeat("}", MaxLevel+1)
+	parts := handlertest.NewMultipart()
+	for i := range maxMultipartParts + 1 {
+		parts.Field("f"+strconv.Itoa(i), "v")
+	}
+
+	testCases := []struct {
+		name    string
+		request *http.Request
+		kind    ParseErrorKind
+		code    ParseErrorCode
+	}{
+		{name: "json syntax", request: handlertest.NewJSONRequest(http.MethodPost, "/", `{"a":`), kind: ParseErrorMalformed, code: ParseErrorCodeMalformedBody},
+		{name: "json trailing data", request: handlertest.NewJSONRequest(http.MethodPost, "/", `{"a":1} {}`), kind: ParseErrorMalformed, code: ParseErrorCodeMalformedBody},
+		{name: "json scalar document", request: handlertest.NewJSONRequest(http.MethodPost, "/", `1`), kind: ParseErrorMalformed, code: ParseErrorCodeMalformedBody},
+		{name: "json nesting", request: handlertest.NewJSONRequest(http.MethodPost, "/", deep), kind: ParseErrorMalformed, code: ParseErrorCodeLimitExceeded},
+		{
+			name:    "multipart without boundary",
+			request: handlertest.NewRawRequest(http.MethodPost, "/", "multipart/form-data", []byte("a")),
+			kind:    ParseErrorMalformed,
+			code:    ParseErrorCodeMalformedMultipart,
+		},
+		{
+			name:    "multipart unclosed",
+			request: handlertest.NewMultipart().Field("a", "1").Unclosed().Request(http.MethodPost, "/"),
+			kind:    ParseErrorMalformed,
+			code:    ParseErrorCodeMalformedMultipart,
+		},
+		{name: "multipart parts", request: parts.Request(http.MethodPost, "/"), kind: ParseErrorBodyTooLarge, code: ParseErrorCodeBodyTooLarge},
+		{
+			name:    "urlencoded escape",
+			request: handlertest.NewRawRequest(http.MethodPost, "/", handlertest.ContentURLEncoded, []byte("a=%zz")),
+			kind:    ParseErrorMalformed,
+			code:    ParseErrorCodeInvalidEncoding,
+		},
+		{
+			name:    "large urlencoded escape",
+			request: handlertest.NewRawRequest(http.MethodPost, "/", handlertest.ContentURLEncoded, []byte("a=%zz&b="+strings.Repeat("b", smallFormSize))),
+			kind:    ParseErrorMalformed,
+			code:    ParseErrorCodeInvalidEncoding,
+		},
+		{
+			name:    "tree collision",
+			request: handlertest.NewRawRequest(http.MethodPost, "/", handlertest.ContentURLEncoded, []byte("a=1&a[b]=2")),
+			kind:    ParseErrorMalformed,
+			code:    ParseErrorCodeFieldCollision,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, p := newTestHandler(t, &config.Config{Parse: &config.Parse{ContentTypes: cts}})
+
+			var kind ParseErrorKind = -1
+			var pe *ParseError
+			h.SetErrorRenderer(ErrorRendererFunc(func(w http.ResponseWriter, _ *http.Request, err *ParseError) {
+				kind = err.Kind
+				pe = err
+				w.WriteHeader(err.Status)
+			}))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, tt.request)
+			assert.Equal(t, tt.kind, kind)
+			assert.Equal(t, tt.kind.Status(), w.Code)
+			require.NotNil(t, pe)
+			assert.Equal(t, tt.code, pe.Code)
+			assert.NotEmpty(t, pe.Hint)
+			assert.Nil(t, p.pld)
+		})
+	}
+}
+
+func TestAsParseError(t *testing.T) {
+	testCases := []struct {
+		name   string
+		err    error
+		kind   ParseErrorKind
+		status int
+	}{
+		{name: "internal", err: errors.Str("worker is gone"), kind: ParseErrorInternal, status: http.StatusInternalServerError},
+		{name: "malformed", err: newParseError(ParseErrorMalformed, errors.Str("bad")), kind: ParseErrorMalformed, status: http.StatusBadRequest},
+		{name: "invalid fields", err: newParseError(ParseErrorInvalidFields, errors.Str("bad")), kind: ParseErrorInvalidFields, status: http.StatusBadRequest},
+		{name: "body too large", err: &http.MaxBytesError{Limit: 1}, kind: ParseErrorBodyTooLarge, status: http.StatusRequestEntityTooLarge},
+		{name: "multipart too large", err: multipart.ErrMessageTooLarge, kind: ParseErrorBodyTooLarge, status: http.StatusRequestEntityTooLarge},
+		{name: "header too large", err: newParseError(ParseErrorHeaderTooLarge, errors.Str("bad")), kind: ParseErrorHeaderTooLarge, status: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "timeout", err: os.ErrDeadlineExceeded, kind: ParseErrorTimeout, status: http.StatusRequestTimeout},
+		{name: "unsupported", err: newParseError(ParseErrorUnsupportedMediaType, errors.Str("bad")), kind: ParseErrorUnsupportedMediaType, status: http.StatusUnsupportedMediaType},
+		{name: "forbidden", err: newParseError(ParseErrorForbidden, errors.Str("bad")), kind: ParseErrorForbidden, status: http.StatusForbidden},
+		{name: "parse timeout", err: newParseError(ParseErrorParseTimeout, errors.Str("bad")), kind: ParseErrorParseTimeout, status: http.StatusRequestTimeout},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			// wrapped the way the request forming returns them
+			pe := asParseError(errors.E(errors.Op("serve_http"), errors.E(errors.Op("request"), tt.err)))
+			assert.Equal(t, tt.kind, pe.Kind)
+			assert.Equal(t, tt.status, pe.Status)
+		})
+	}
+}
+
+func TestParseError_Code(t *testing.T) {
+	pe := asParseError(errors.Str("worker is gone"))
+	assert.Equal(t, ParseErrorCodeInternal, pe.Code)
+	assert.Equal(t, ParseErrorCodeInternal.hint(), pe.Hint)
+
+	pe = asParseError(&http.MaxBytesError{Limit: 1})
+	assert.Equal(t, ParseErrorCodeBodyTooLarge, pe.Code)
+
+	// the specific hint names the field
+	pe = asParseError(invalidMultipleValuesErr("perm"))
+	assert.Equal(t, ParseErrorCodeFieldCollision, pe.Code)
+	assert.Equal(t, "field 'perm' was sent both as a value and as an array, send it only one way", pe.Hint)
+
+	pe = asParseError(siblingsErr([]string{"a", "b"}, 10))
+	assert.Equal(t, ParseErrorCodeLimitExceeded, pe.Code)
+	assert.Equal(t, ParseErrorMalformed, pe.Kind)
+	assert.Contains(t, pe.Hint, "'a[b]'")
+}
+
+func TestHandler_MaxParseDuration(t *testing.T) {
+	form := url.Values{}
+	for i := range parseCheckInterval * 2 {
+		form.Set(fmt.Sprintf("key%d[a][b]", i), "value")
+	}
+
+	mp := handlertest.NewMultipart()
+	for k := range form {
+		mp.Field(k, "value")
+	}
+
+	json := "[" + strings.TrimSuffix(strings.Repeat(`{"a":1},`, parseCheckInterval*2), ",") + "]"
+	ndjson := strings.Repeat(`{"a":{"b":1}}`+"\n", parseCheckInterval*2)
+	cts := []*config.ContentType{
+		{Pattern: "application/json", Parser: config.ParserJSON},
+		{Pattern: "application/x-ndjson", Parser: config.ParserNDJSON},
+	}
+
+	requests := map[string]func() *http.Request{
+		"urlencoded": func() *http.Request {
+			return handlertest.NewURLEncodedRequest(http.MethodPost, "/", form)
+		},
+		"large urlencoded": func() *http.Request {
+			r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", form)
+			// unknown length, the generic path
+			r.ContentLength = -1
+			return r
+		},
+		"multipart": func() *http.Request {
+			return mp.Request(http.MethodPost, "/")
+		},
+		"json": func() *http.Request {
+			return handlertest.NewJSONRequest(http.MethodPost, "/", json)
+		},
+		"ndjson": func() *http.Request {
+			return handlertest.NewRawRequest(http.MethodPost, "/", "application/x-ndjson", []byte(ndjson))
+		},
+	}
+
+	for name, request := range requests {
+		t.Run(name, func(t *testing.T) {
+			h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{ContentTypes: cts, MaxParseDuration: time.Nanosecond}})
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, request())
+			assert.Equal(t, http.StatusRequestTimeout, w.Code)
+			assert.Contains(t, w.Body.String(), "request body parsing exceeded")
+			// the body was read, the connection can be reused
+			assert.Empty(t, w.Header().Get("Connection"))
+			assert.Nil(t, p.pld)
+
+			h, p = newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{ContentTypes: cts, MaxParseDuration: time.Minute}})
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, request())
+			assert.Equal(t, http.StatusInternalServerError, w.Code)
+			assert.NotNil(t, p.pld)
+		})
+	}
+}
+
+func TestHandler_ContentEncoding(t *testing.T) {
+	gzipped := func(t *testing.T, b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	deflated := func(t *testing.T, b []byte) []byte {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		_, err := zw.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	form := []byte("a=1&b[c]=" + strings.Repeat("x", 1024))
+	huge := []byte("a=" + strings.Repeat("x", 64<<10))
+
+	testCases := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+		want     string
+	}{
+		{name: "gzip", encoding: "gzip", body: gzipped(t, form), status: http.StatusInternalServerError, want: string(form)},
+		{name: "deflate", encoding: "deflate", body: deflated(t, form), status: http.StatusInternalServerError, want: string(form)},
+		{name: "layered", encoding: "deflate, gzip", body: gzipped(t, deflated(t, form)), status: http.StatusInternalServerError, want: string(form)},
+		{name: "identity", encoding: "identity", body: form, status: http.StatusInternalServerError, want: string(form)},
+		{name: "too large decoded", encoding: "gzip", body: gzipped(t, huge), status: http.StatusRequestEntityTooLarge},
+		{name: "malformed", encoding: "gzip", body: form, status: http.StatusBadRequest},
+		{name: "truncated", encoding: "gzip", body: gzipped(t, form)[:40], status: http.StatusBadRequest},
+		{name: "unsupported", encoding: "br", body: form, status: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{DecodeContentEncoding: true, MaxDecodedSize: 32 << 10}})
+
+			srv := httptest.NewServer(h)
+			defer srv.Close()
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL, io.NopCloser(bytes.NewReader(tt.body)))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", handlertest.ContentURLEncoded)
+			req.Header.Set("Content-Encoding", tt.encoding)
+			// unknown length, chunked
+			req.ContentLength = -1
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+
+			if tt.want == "" {
+				assert.Nil(t, p.pld)
+				return
+			}
+
+			values, err := url.ParseQuery(tt.want)
+			require.NoError(t, err)
+			want, err := parsePostForm(values, false, 0, nil, nil)
+			require.NoError(t, err)
+			wantJSON, err := json.Marshal(want)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, string(wantJSON), string(p.pld.Body))
+			assert.NotContains(t, p.request(t).GetHeader(), "Content-Encoding")
+		})
+	}
+}
+
+func TestHandler_DecodeRatio(t *testing.T) {
+	gzipped := func(t *testing.T, b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	// the random hex compresses about 2 times
+	random := make([]byte, 64<<10)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		body   []byte
+		status int
+	}{
+		{name: "bomb", body: gzipped(t, []byte("a="+strings.Repeat("x", 1<<20))), status: http.StatusRequestEntityTooLarge},
+		{name: "small", body: gzipped(t, []byte("a="+strings.Repeat("x", 32<<10))), status: http.StatusInternalServerError},
+		{name: "low ratio", body: gzipped(t, []byte("a="+hex.EncodeToString(random))), status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Parse{DecodeContentEncoding: true, MaxDecodedSize: 8 << 20, MaxDecodeRatio: 100}
+			require.NoError(t, cfg.InitDefaults())
+			h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: cfg, MaxRequestSize: 16})
+
+			r := handlertest.NewRawRequest(http.MethodPost, "/", handlertest.ContentURLEncoded, tt.body)
+			r.Header.Set("Content-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.status, w.Code)
+			if tt.status == http.StatusRequestEntityTooLarge {
+				assert.Nil(t, p.pld)
+				return
+			}
+
+			require.NotNil(t, p.pld)
+		})
+	}
+
+	assert.Error(t, (&config.Parse{MaxDecodeRatio: -1}).InitDefaults())
+}
+
+func TestHandler_CanonicalPath(t *testing.T) {
+	testCases := []struct {
+		path string
+		want string
+	}{
+		{path: "/a//b/./c/../d", want: "/a/b/d"},
+		{path: "/../../etc/passwd", want: "/etc/passwd"},
+		{path: "/a/b/..", want: "/a/"},
+		{path: "//", want: "/"},
+		{path: "/a/%2F/./b/", want: "/a/%2F/b/"},
+		{path: "/a/b", want: "/a/b"},
+	}
+
+	h, p := newTestHandler(t, &config.Config{CanonicalPath: true})
+	for _, tt := range testCases {
+		t.Run(tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.URL.RawPath = tt.path
+			r.URL.Path, _ = url.PathUnescape(tt.path)
+			r.URL.RawQuery = "x=1"
+
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			req := p.request(t)
+			assert.Equal(t, "http://example.com"+tt.want+"?x=1", req.Uri)
+			if tt.want == tt.path {
+				assert.NotContains(t, req.Attributes, RawPathAttribute)
+				return
+			}
+
+			require.Contains(t, req.Attributes, RawPathAttribute)
+			assert.Equal(t, [][]byte{[]byte(tt.path)}, req.Attributes[RawPathAttribute].Value)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{})
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/a//b/../c", nil))
+		assert.Equal(t, "http://example.com/a//b/../c", p.request(t).Uri)
+	})
+}
+
+func TestHandler_Range(t *testing.T) {
+	t.Run("parse", func(t *testing.T) {
+		testCases := []struct {
+			header string
+			want   []ByteRange
+			code   string
+		}{
+			{header: "bytes=0-499", want: []ByteRange{{Start: 0, End: 499}}},
+			{header: "bytes=500-", want: []ByteRange{{Start: 500, End: -1}}},
+			{header: "bytes=-500", want: []ByteRange{{Start: -1, End: -1, Suffix: 500}}},
+			{header: "Bytes=0-0 ,, 10-20,\t-1", want: []ByteRange{{Start: 0, End: 0}, {Start: 10, End: 20}, {Start: -1, End: -1, Suffix: 1}}},
+			{header: "items=0-5"},
+			{header: "bytes=5-1", code: RangeErrorMalformed},
+			{header: "bytes=+1-2", code: RangeErrorMalformed},
+			{header: "bytes=1-2-3", code: RangeErrorMalformed},
+			{header: "bytes=-", code: RangeErrorMalformed},
+			{header: "bytes=,", code: RangeErrorMalformed},
+			{header: "bytes 0-5", code: RangeErrorMalformed},
+			{header: "bytes=99999999999999999999-", code: RangeErrorMalformed},
+			{header: "bytes=" + strings.Repeat("0-1,", maxByteRanges+1), code: RangeErrorMalformed},
+		}
+
+		for _, tt := range testCases {
+			ranges, err := ParseRange(tt.header)
+			if tt.code != "" {
+				var re *RangeError
+				require.ErrorAs(t, err, &re, tt.header)
+				assert.Equal(t, tt.code, re.Code, tt.header)
+				continue
+			}
+
+			require.NoError(t, err, tt.header)
+			assert.Equal(t, tt.want, ranges, tt.header)
+		}
+	})
+
+	t.Run("resolve", func(t *testing.T) {
+		ranges := []ByteRange{{Start: 0, End: 9}, {Start: 90, End: -1}, {Start: -1, End: -1, Suffix: 5}, {Start: 95, End: 200}, {Start: 100, End: 120}}
+		resolved, err := ResolveRanges(ranges, 100)
+		require.NoError(t, err)
+		assert.Equal(t, []ByteRange{{Start: 0, End: 9}, {Start: 90, End: 99}, {Start: 95, End: 99}, {Start: 95, End: 99}}, resolved)
+
+		// the suffix longer than the representation is the whole of it
+		resolved, err = ResolveRanges([]ByteRange{{Start: -1, End: -1, Suffix: 500}}, 100)
+		require.NoError(t, err)
+		assert.Equal(t, []ByteRange{{Start: 0, End: 99}}, resolved)
+
+		for _, size := range []int64{0, 100} {
+			_, err = ResolveRanges([]ByteRange{{Start: 100, End: -1}, {Start: -1, End: -1}}, size)
+			var re *RangeError
+			require.ErrorAs(t, err, &re)
+			assert.Equal(t, RangeErrorUnsatisfiable, re.Code)
+		}
+	})
+
+	t.Run("attributes", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseRange: true})
+		serve := func(method string, values ...string) map[string]*httpV1proto.HeaderValue {
+			r := httptest.NewRequest(method, "http://example.com/file", nil)
+			for _, v := range values {
+				r.Header.Add("Range", v)
+			}
+
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			return p.request(t).Attributes
+		}
+
+		attrs := serve(http.MethodGet, "bytes=0-99, -10")
+		assert.Equal(t, [][]byte{[]byte(`[{"start":0,"end":99},{"start":-1,"end":-1,"suffix":10}]`)}, attrs[RangeAttribute].GetValue())
+		assert.NotContains(t, attrs, RangeErrorAttribute)
+
+		attrs = serve(http.MethodGet, "bytes=10-5")
+		assert.Equal(t, [][]byte{[]byte(RangeErrorMalformed)}, attrs[RangeErrorAttribute].GetValue())
+		assert.NotContains(t, attrs, RangeAttribute)
+
+		attrs = serve(http.MethodGet, "bytes=0-1", "bytes=2-3")
+		assert.Equal(t, [][]byte{[]byte(RangeErrorMalformed)}, attrs[RangeErrorAttribute].GetValue())
+
+		// the ranges are defined for GET only
+		attrs = serve(http.MethodHead, "bytes=0-1")
+		assert.NotContains(t, attrs, RangeAttribute)
+		attrs = serve(http.MethodGet, "items=0-1")
+		assert.NotContains(t, attrs, RangeAttribute)
+		assert.NotContains(t, attrs, RangeErrorAttribute)
+
+		h, p = newTestHandler(t, &config.Config{})
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/file", nil)
+		r.Header.Set("Range", "bytes=0-1")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		assert.NotContains(t, p.request(t).Attributes, RangeAttribute)
+	})
+}
+
+func TestHandler_ClientCert(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(0xabcdef),
+		Subject:      pkix.Name{CommonName: "client", Organization: []string{"Example"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	sum := sha256.Sum256(der)
+
+	cfg := &config.ClientCert{Fingerprint: "CLIENT_SHA256"}
+	require.NoError(t, cfg.InitDefaults())
+	h, p := newTestHandler(t, &config.Config{ClientCert: cfg})
+
+	r := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	attrs := p.request(t).Attributes
+	assert.Equal(t, [][]byte{[]byte("CN=client,O=Example")}, attrs[config.DefaultClientCertSubject].GetValue())
+	assert.Equal(t, [][]byte{[]byte("CN=client,O=Example")}, attrs[config.DefaultClientCertIssuer].GetValue())
+	assert.Equal(t, [][]byte{[]byte("ABCDEF")}, attrs[config.DefaultClientCertSerial].GetValue())
+	assert.Equal(t, [][]byte{[]byte(hex.EncodeToString(sum[:]))}, attrs["CLIENT_SHA256"].GetValue())
+	assert.NotContains(t, attrs, config.DefaultClientCertFingerprint)
+
+	// the unverified certificates are ignored
+	r = httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.NotContains(t, p.request(t).Attributes, config.DefaultClientCertSubject)
+
+	assert.Error(t, (&config.ClientCert{Subject: "A", Issuer: "A"}).InitDefaults())
+}
+
+func TestHandler_HeaderVars(t *testing.T) {
+	vars := []*config.HeaderVar{
+		{Header: "cf-ipcountry", Var: "GEOIP_COUNTRY_CODE"},
+		{Header: "X-Edge", Var: "EDGE_LOCATION"},
+		// the variables set by the handler are kept without override
+		{Header: "X-Client-Id", Var: RequestIDAttribute},
+		{Header: "X-Forwarded-Proto-Version", Var: "SSL_PROTOCOL", Override: true},
+	}
+	for _, hv := range vars {
+		require.NoError(t, hv.InitDefaults())
+	}
+
+	h, p := newTestHandler(t, &config.Config{HeaderVars: vars, RequestID: &config.RequestID{Header: config.DefaultRequestIDHeader, Generate: config.RequestIDGenerateNone}})
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("CF-IPCountry", "NL")
+	r.Header.Add("X-Edge", "AMS")
+	r.Header.Add("X-Edge", "FRA")
+	r.Header.Set("X-Client-Id", "spoofed")
+	r.Header.Set(config.DefaultRequestIDHeader, "id-1")
+	r.Header.Set("X-Forwarded-Proto-Version", "TLSv1.3")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	attrs := p.request(t).Attributes
+	assert.Equal(t, [][]byte{[]byte("NL")}, attrs["GEOIP_COUNTRY_CODE"].GetValue())
+	assert.Equal(t, [][]byte{[]byte("AMS"), []byte("FRA")}, attrs["EDGE_LOCATION"].GetValue())
+	assert.Equal(t, [][]byte{[]byte("id-1")}, attrs[RequestIDAttribute].GetValue())
+	assert.Equal(t, [][]byte{[]byte("TLSv1.3")}, attrs["SSL_PROTOCOL"].GetValue())
+
+	// the headers not sent set no variables
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	assert.NotContains(t, p.request(t).Attributes, "GEOIP_COUNTRY_CODE")
+
+	assert.Error(t, (&config.HeaderVar{Header: "X-Real-IP", Var: "REMOTE_ADDR"}).InitDefaults())
+	assert.Error(t, (&config.HeaderVar{Header: "X-Host", Var: "http_host"}).InitDefaults())
+	assert.Error(t, (&config.HeaderVar{Header: "X-Edge"}).InitDefaults())
+	assert.NoError(t, (&config.HeaderVar{Header: "X-Real-IP", Var: "REMOTE_ADDR", Override: true}).InitDefaults())
+}
+
+func TestHandler_LengthConflict(t *testing.T) {
+	request := func(cl, te bool) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("a=1"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ContentLength = -1
+		if cl {
+			r.ContentLength = 3
+			r.Header.Set("Content-Length", "3")
+		}
+		if te {
+			r.TransferEncoding = []string{"chunked"}
+		}
+		return r
+	}
+
+	for _, allow := range []bool{false, true} {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, AllowLengthConflict: allow, Parse: &config.Parse{}})
+
+		for name, r := range map[string]*http.Request{
+			"content length":    request(true, false),
+			"transfer encoding": request(false, true),
+		} {
+			p.pld = nil
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			require.NotNil(t, p.pld, name)
+			assert.JSONEq(t, `{"a": "1"}`, string(p.pld.Body), name)
+		}
+
+		p.pld = nil
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, request(true, true))
+		if allow {
+			assert.NotNil(t, p.pld)
+			continue
+		}
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Nil(t, p.pld)
+	}
+}
+
+func TestHandler_CookieCodec(t *testing.T) {
+	sign := func(name, payload, key string) string {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(name + "=" + payload))
+		return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	cfg := &config.CookieCodec{Cookies: []string{"session", "prefs", "cart", "theme"}, Key: "secret"}
+	require.NoError(t, cfg.InitDefaults())
+	h, p := newTestHandler(t, &config.Config{CookieCodec: cfg})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: sign("session", "user-1", "secret")})
+	// the value of another cookie, a foreign key and a tampered payload
+	r.AddCookie(&http.Cookie{Name: "prefs", Value: sign("session", "user-1", "secret")})
+	r.AddCookie(&http.Cookie{Name: "cart", Value: sign("cart", "42", "other")})
+	r.AddCookie(&http.Cookie{Name: "theme", Value: strings.Replace(sign("theme", "dark", "secret"), "dark", "lite", 1)})
+	r.AddCookie(&http.Cookie{Name: "plain", Value: "as-is"})
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	req := p.request(t)
+	assert.Equal(t, [][]byte{[]byte("user-1")}, req.Cookies["session"].GetValue())
+	assert.Equal(t, [][]byte{[]byte("as-is")}, req.Cookies["plain"].GetValue())
+	assert.NotContains(t, req.Cookies, "prefs")
+	assert.NotContains(t, req.Cookies, "cart")
+	assert.NotContains(t, req.Cookies, "theme")
+	assert.Equal(t, [][]byte{[]byte("cart"), []byte("prefs"), []byte("theme")}, req.Attributes[CookieErrorsAttribute].GetValue())
+
+	// the custom codec replaces the built-in one, none fails closed
+	h.SetCookieCodec(CookieCodecFunc(func(_, value string) (string, error) {
+		return strings.ToUpper(value), nil
+	}))
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, [][]byte{[]byte("ABC")}, p.request(t).Cookies["session"].GetValue())
+
+	h.SetCookieCodec(nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.NotContains(t, p.request(t).Cookies, "session")
+	assert.Equal(t, [][]byte{[]byte("session")}, p.request(t).Attributes[CookieErrorsAttribute].GetValue())
+
+	assert.Error(t, (&config.CookieCodec{}).InitDefaults())
+}
+
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestHandler_BodyTee(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte("a=1&b=22"))
+	require.NoError(t, zw.Close())
+
+	request := func(target string) *http.Request {
+		r := handlertest.NewRawRequest(http.MethodPost, target, handlertest.ContentURLEncoded, gz.Bytes())
+		r.Header.Set("Content-Encoding", "gzip")
+		return r
+	}
+
+	t.Run("file sink", func(t *testing.T) {
+		tee := &config.BodyTee{SampleRate: 1, Dir: t.TempDir(), Paths: []string{"/debug/"}}
+		require.NoError(t, tee.InitDefaults())
+		rid := &config.RequestID{}
+		require.NoError(t, rid.InitDefaults())
+		h, p := newTestHandler(t, &config.Config{BodyTee: tee, RequestID: rid, Parse: &config.Parse{DecodeContentEncoding: true}})
+		core, logs := observer.New(zap.InfoLevel)
+		h.log = zap.New(core)
+
+		h.ServeHTTP(httptest.NewRecorder(), request("/"))
+		require.NotNil(t, p.pld)
+		entries, err := os.ReadDir(tee.Dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+
+		p.pld = nil
+		h.ServeHTTP(httptest.NewRecorder(), request("/debug/form"))
+		require.NotNil(t, p.pld)
+		// the worker gets the parsed body, the sink the body as it was sent
+		assert.JSONEq(t, `{"a": "1", "b": "22"}`, string(p.pld.Body))
+
+		entries, err = os.ReadDir(tee.Dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.True(t, isTempName(entries[0].Name(), bodyTeePattern))
+
+		data, err := os.ReadFile(filepath.Join(tee.Dir, entries[0].Name()))
+		require.NoError(t, err)
+		assert.Equal(t, gz.Bytes(), data)
+
+		// the file is found by the request ID
+		captured := logs.FilterMessage("request body captured").All()
+		require.Len(t, captured, 1)
+		assert.Equal(t, filepath.Join(tee.Dir, entries[0].Name()), captured[0].ContextMap()["file"])
+		assert.NotEmpty(t, captured[0].ContextMap()["request_id"])
+	})
+
+	t.Run("custom sink", func(t *testing.T) {
+		tee := &config.BodyTee{SampleRate: 1}
+		require.NoError(t, tee.InitDefaults())
+		h, p := newTestHandler(t, &config.Config{BodyTee: tee, Parse: &config.Parse{DecodeContentEncoding: true}})
+
+		var sunk []*closeBuffer
+		h.SetBodySink(BodySinkFunc(func(*http.Request) (io.WriteCloser, error) {
+			b := &closeBuffer{}
+			sunk = append(sunk, b)
+			return b, nil
+		}))
+
+		// the requests without a body are never captured
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Empty(t, sunk)
+
+		h.ServeHTTP(httptest.NewRecorder(), request("/"))
+		require.NotNil(t, p.pld)
+		require.Len(t, sunk, 1)
+		assert.True(t, sunk[0].closed)
+		assert.Equal(t, gz.Bytes(), sunk[0].Bytes())
+
+		// the failing sink never fails the request
+		p.pld = nil
+		h.SetBodySink(BodySinkFunc(func(*http.Request) (io.WriteCloser, error) {
+			return nil, errors.Str("sink is down")
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), request("/"))
+		require.NotNil(t, p.pld)
+		assert.JSONEq(t, `{"a": "1", "b": "22"}`, string(p.pld.Body))
+	})
+
+	assert.Error(t, (&config.BodyTee{}).InitDefaults())
+	assert.Error(t, (&config.BodyTee{SampleRate: 1.5}).InitDefaults())
+}
@@ -0,0 +1,183 @@
+// Package handlertest provides helpers to build in-memory requests for the HTTP handler. It is intended for tests
+// (both in this module and downstream) which need to exercise the body parsing without constructing raw bodies by hand.
+package handlertest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+)
+
+const (
+	// ContentURLEncoded is the urlencoded form content type.
+	ContentURLEncoded string = "application/x-www-form-urlencoded"
+	// ContentMultipart is the multipart form content type (without the boundary parameter).
+	ContentMultipart string = "multipart/form-data"
+	// ContentJSON is the JSON content type.
+	ContentJSON string = "application/json"
+
+	defaultBoundary string = "rr-handlertest-boundary"
+	crlf            string = "\r\n"
+)
+
+// NewURLEncodedRequest returns a request with the values encoded as an application/x-www-form-urlencoded body.
+func NewURLEncodedRequest(method, target string, values url.Values) *http.Request {
+	return NewRawRequest(method, target, ContentURLEncoded, []byte(values.Encode()))
+}
+
+// NewJSONRequest returns a request with the provided JSON document as a body.
+func NewJSONRequest(method, target, document string) *http.Request {
+	return NewRawRequest(method, target, ContentJSON, []byte(document))
+}
+
+// NewRawRequest returns a request with an arbitrary body and content type. An empty content type leaves the
+// Content-Type header unset.
+func NewRawRequest(method, target, contentType string, body []byte) *http.Request {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+
+	r := httptest.NewRequest(method, target, rd)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+
+	return r
+}
+
+type part struct {
+	headers []string
+	body    []byte
+}
+
+// Multipart builds a multipart/form-data body part by part. Unlike mime/multipart.Writer it writes exactly what it
+// was told to, so it can also be used to produce malformed bodies for negative tests (duplicate headers, bare LF
+// line endings, missing closing boundary, trailing data after the body, etc.).
+type Multipart struct {
+	boundary string
+	newline  string
+	parts    []part
+	unclosed bool
+	trailer  []byte
+}
+
+// NewMultipart returns an empty multipart body builder.
+func NewMultipart() *Multipart {
+	return &Multipart{
+		boundary: defaultBoundary,
+		newline:  crlf,
+	}
+}
+
+// Boundary overrides the default boundary.
+func (m *Multipart) Boundary(boundary string) *Multipart {
+	m.boundary = boundary
+	return m
+}
+
+// Newline overrides the line ending used for the framing (boundaries and part headers), "\r\n" by default.
+func (m *Multipart) Newline(nl string) *Multipart {
+	m.newline = nl
+	return m
+}
+
+// Field adds a value part.
+func (m *Multipart) Field(name, value string) *Multipart {
+	return m.Part([]string{fmt.Sprintf(`Content-Disposition: form-data; name="%s"`, escapeQuotes(name))}, []byte(value))
+}
+
+// File adds a file part. An empty content type omits the Content-Type header of the part.
+func (m *Multipart) File(name, filename, contentType string, content []byte) *Multipart {
+	headers := []string{
+		fmt.Sprintf(`Content-Disposition: form-data; name="%s"; filename="%s"`, escapeQuotes(name), escapeQuotes(filename)),
+	}
+
+	if contentType != "" {
+		headers = append(headers, "Content-Type: "+contentType)
+	}
+
+	return m.Part(headers, content)
+}
+
+// Part adds a part with raw header lines (e.g. `Content-Disposition: form-data; name="a"`). Header lines are
+// written verbatim and in order, duplicates included.
+func (m *Multipart) Part(headers []string, body []byte) *Multipart {
+	m.parts = append(m.parts, part{
+		headers: headers,
+		body:    body,
+	})
+
+	return m
+}
+
+// Unclosed omits the closing boundary of the body.
+func (m *Multipart) Unclosed() *Multipart {
+	m.unclosed = true
+	return m
+}
+
+// Trailer appends arbitrary bytes after the closing boundary.
+func (m *Multipart) Trailer(data []byte) *Multipart {
+	m.trailer = data
+	return m
+}
+
+// ContentType returns the Content-Type header value including the boundary parameter.
+func (m *Multipart) ContentType() string {
+	return fmt.Sprintf("%s; boundary=%s", ContentMultipart, m.boundary)
+}
+
+// Bytes returns the encoded body.
+func (m *Multipart) Bytes() []byte {
+	var buf bytes.Buffer
+
+	for i := range m.parts {
+		buf.WriteString("--" + m.boundary + m.newline)
+		for _, h := range m.parts[i].headers {
+			buf.WriteString(h + m.newline)
+		}
+		buf.WriteString(m.newline)
+		buf.Write(m.parts[i].body)
+		buf.WriteString(m.newline)
+	}
+
+	if !m.unclosed {
+		buf.WriteString("--" + m.boundary + "--" + m.newline)
+	}
+
+	buf.Write(m.trailer)
+
+	return buf.Bytes()
+}
+
+// Request returns a request carrying the multipart body.
+func (m *Multipart) Request(method, target string) *http.Request {
+	return NewRawRequest(method, target, m.ContentType(), m.Bytes())
+}
+
+// Truncate returns a copy of the request with the body cut after n bytes, to simulate clients which disconnect
+// in the middle of the upload. Content-Length is kept as it was declared.
+func Truncate(r *http.Request, n int) *http.Request {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		panic(err)
+	}
+
+	if n < len(body) {
+		body = body[:n]
+	}
+
+	r2 := r.Clone(r.Context())
+	r2.Body = io.NopCloser(bytes.NewReader(body))
+
+	return r2
+}
+
+func escapeQuotes(s string) string {
+	return strings.NewReplacer("\\", "\\\\", `"`, "\\\"").Replace(s)
+}
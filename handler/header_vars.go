@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// headerVars are the request headers passed to the worker as the server variables, see config.Config.HeaderVars.
+type headerVars []headerVar
+
+type headerVar struct {
+	// the canonical header name
+	header   string
+	name     string
+	override bool
+}
+
+// newHeaderVars returns nil when no header is mapped.
+func newHeaderVars(cfg []*config.HeaderVar) headerVars {
+	if len(cfg) == 0 {
+		return nil
+	}
+
+	hv := make(headerVars, 0, len(cfg))
+	for _, v := range cfg {
+		hv = append(hv, headerVar{header: http.CanonicalHeaderKey(v.Header), name: v.Var, override: v.Override})
+	}
+
+	return hv
+}
+
+// set passes the values of the headers sent with the request. The variables the handler already set (the client
+// certificate, the request ID ones) are kept unless the mapping overrides them.
+func (hv headerVars) set(r *http.Request, req *Request) {
+	for _, v := range hv {
+		values := r.Header[v.header]
+		if len(values) == 0 {
+			continue
+		}
+
+		if _, ok := req.Attributes[v.name]; ok && !v.override {
+			continue
+		}
+
+		req.setAttribute(v.name, values...)
+	}
+}
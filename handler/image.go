@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"bufio"
+	"image"
+	// the formats of the image headers decoding
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ImageInfo is the format and the pixel dimensions of the uploaded image.
+type ImageInfo struct {
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// readImageInfo decodes the header of the image being copied into dst, the bytes consumed by the decoder are written
+// into dst as they are read, so the rest of the file can be copied from src. The info is nil for the files not
+// sniffed as images or with the unsupported formats. Returns the number of bytes written into dst.
+func readImageInfo(src *bufio.Reader, dst io.Writer) (*ImageInfo, int64, error) {
+	head, _ := src.Peek(512)
+	if !strings.HasPrefix(http.DetectContentType(head), "image/") {
+		return nil, 0, nil
+	}
+
+	tw := &teeWriter{w: dst}
+	cfg, format, err := image.DecodeConfig(io.TeeReader(src, tw))
+	if tw.err != nil {
+		return nil, tw.n, tw.err
+	}
+
+	if err != nil {
+		return nil, tw.n, nil
+	}
+
+	return &ImageInfo{Format: format, Width: cfg.Width, Height: cfg.Height}, tw.n, nil
+}
+
+// teeWriter counts the written bytes and remembers the write error.
+type teeWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	t.n += int64(n)
+	if err != nil {
+		t.err = err
+	}
+
+	return n, err
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	stderr "errors"
+	"net/http"
+	"strconv"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// FieldInspector is the native middleware seeing every scalar value of the parsed body (a WAF), after the decoding,
+// the de-nesting and the body mutators, so it checks the same values the application reads. A non-nil error rejects
+// the request with the field_inspect_status (403 by default). The bodies deferred by lazy_parse are parsed for the
+// inspectors too, the worker still gets them raw.
+type FieldInspector interface {
+	// InspectField is called for each value with the full path of its field, the list elements have their index as
+	// the last path segment. The path is reused between the calls, it must be copied to be kept.
+	InspectField(path []string, value string) error
+}
+
+// inspectFields runs the field inspectors on the parsed data tree of the request. The body deferred to the worker
+// (lazy_parse) is parsed for the inspectors only, so the lazy routes are inspected as well.
+func (h *Handler) inspectFields(hr *http.Request, req *Request) error {
+	if len(h.fieldInspectors) == 0 {
+		return nil
+	}
+
+	var data dataTree
+	switch {
+	case req.lazy != 0:
+		var err error
+		data, err = h.lazyTree(hr, req)
+		if err != nil {
+			return err
+		}
+	case req.Parsed:
+		data, _ = req.body.(dataTree)
+	}
+
+	return data.walkScalars(make([]string, 0, 4), func(path []string, value string) error {
+		for _, in := range h.fieldInspectors {
+			err := in.InspectField(path, value)
+			if err != nil {
+				return h.fieldRejectedErr(err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (h *Handler) fieldRejectedErr(err error) error {
+	var pe *ParseError
+	if stderr.As(err, &pe) {
+		return err
+	}
+
+	pe = newParseError(ParseErrorForbidden, errors.E(errors.Op("inspect_field"), err)).with(ParseErrorCodeFieldRejected, "")
+	if h.fieldInspectStatus != 0 {
+		pe.Status = h.fieldInspectStatus
+	}
+
+	return pe
+}
+
+// walkScalars calls fn for each value stored in the tree, in no particular order, until fn returns an error.
+func (dt dataTree) walkScalars(path []string, fn func(path []string, value string) error) error {
+	for k, v := range dt {
+		p := append(path, k)
+
+		var err error
+		switch actual := v.(type) {
+		case dataTree:
+			err = actual.walkScalars(p, fn)
+		case []string:
+			for i := 0; i < len(actual) && err == nil; i++ {
+				err = fn(append(p, strconv.Itoa(i)), actual[i])
+			}
+		case []any:
+			for i := 0; i < len(actual) && err == nil; i++ {
+				err = fn(append(p, strconv.Itoa(i)), typedScalarString(actual[i]))
+			}
+		default:
+			err = fn(p, typedScalarString(actual))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
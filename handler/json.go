@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// parseJSONBody decodes the JSON document into the data tree, the same structure the form data is parsed into.
+// Objects become branches, arrays of scalars become lists and other arrays are indexed by the element position,
+// like the `key[0][name]` form syntax. A non-empty unwrapPath (data.attributes) selects the sub-document to be
+// parsed instead of the whole envelope. The scalars are converted to the form strings, unless the coerce option keeps
+// the numbers and booleans typed, see jsonScalars. The top-level arrays are decoded element by element when the
+// stream is set, see jsonArrayStream.
+func parseJSONBody(r *http.Request, unwrapPath string, stream *jsonArrayStream, sc jsonScalars, dl *parseDeadline) (dataTree, error) {
+	const op = errors.Op("parse_json_body")
+
+	src := io.Reader(r.Body)
+	if stream != nil {
+		br := bufio.NewReader(r.Body)
+		if isJSONArray(br) {
+			return stream.parse(br, sc, dl)
+		}
+
+		src = br
+	}
+
+	body, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	// the document decoding is a part of the parsing
+	dl.start()
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var doc any
+	err = dec.Decode(&doc)
+	if err != nil {
+		return nil, errors.E(op, newParseError(ParseErrorMalformed, err))
+	}
+
+	if dec.More() {
+		return nil, errors.E(op, newParseError(ParseErrorMalformed, errors.Str("unexpected data after the JSON document")))
+	}
+
+	if unwrapPath != "" {
+		doc, err = unwrapJSON(doc, unwrapPath)
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
+	}
+
+	data, ok, err := documentTree(doc, sc, dl)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	if !ok {
+		return nil, errors.E(op, newParseError(ParseErrorMalformed, errors.Str("JSON document should be an object or an array")))
+	}
+
+	return data, nil
+}
+
+// documentTree builds the data tree of the decoded document, the object keys or the array indexes are the top-level
+// keys. It reports false when the document is a scalar, the null document is the empty tree.
+func documentTree(doc any, sc jsonScalars, dl *parseDeadline) (dataTree, bool, error) {
+	data := make(dataTree, 2)
+
+	var err error
+	switch v := doc.(type) {
+	case map[string]any:
+		for k, vv := range v {
+			data[k], err = jsonNode(vv, 1, sc, dl)
+			if err != nil {
+				return nil, true, err
+			}
+		}
+	case []any:
+		for i, vv := range v {
+			data[strconv.Itoa(i)], err = jsonNode(vv, 1, sc, dl)
+			if err != nil {
+				return nil, true, err
+			}
+		}
+	case nil:
+	default:
+		return nil, false, nil
+	}
+
+	return data, true, nil
+}
+
+// unwrapJSON returns the element of the document at the dot path, the path segments of the arrays are the indexes.
+func unwrapJSON(doc any, path string) (any, error) {
+	for _, segment := range strings.Split(path, ".") {
+		var ok bool
+		switch actual := doc.(type) {
+		case map[string]any:
+			doc, ok = actual[segment]
+		case []any:
+			i, err := strconv.Atoi(segment)
+			if err == nil && i >= 0 && i < len(actual) {
+				doc, ok = actual[i], true
+			}
+		}
+
+		if !ok {
+			return nil, newParseError(ParseErrorMalformed, errors.Errorf("JSON document has no element at the path '%s'", path))
+		}
+	}
+
+	return doc, nil
+}
+
+func jsonNode(v any, level int, sc jsonScalars, dl *parseDeadline) (any, error) {
+	if level >= MaxLevel {
+		return nil, newParseError(ParseErrorMalformed, errors.Errorf("JSON document exceeds the maximum nesting level %d", MaxLevel)).
+			with(ParseErrorCodeLimitExceeded, fmt.Sprintf("nest the JSON document at most %d levels deep", MaxLevel))
+	}
+
+	err := dl.check()
+	if err != nil {
+		return nil, err
+	}
+
+	switch actual := v.(type) {
+	case map[string]any:
+		node := make(dataTree, len(actual))
+		for k, vv := range actual {
+			var err error
+			node[k], err = jsonNode(vv, level+1, sc, dl)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return node, nil
+	case []any:
+		if list, ok := sc.list(actual); ok {
+			return list, nil
+		}
+
+		node := make(dataTree, len(actual))
+		for i, vv := range actual {
+			var err error
+			node[strconv.Itoa(i)], err = jsonNode(vv, level+1, sc, dl)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return node, nil
+	default:
+		if sc.coerce {
+			return sc.typed(actual), nil
+		}
+
+		return sc.scalar(actual), nil
+	}
+}
+
+// jsonScalars defines how the JSON scalars are converted to the data tree values.
+type jsonScalars struct {
+	// keep the numbers and booleans typed
+	coerce bool
+	// the form strings of the booleans and null, nil converts them the way PHP casts them to string
+	strings *config.JSONStrings
+}
+
+// list returns the array as a list of strings if it contains only scalars. With coerce, the list having typed
+// scalars is a list of the typed values instead.
+func (sc jsonScalars) list(arr []any) (any, bool) {
+	typed := false
+	for i := range arr {
+		switch arr[i].(type) {
+		case map[string]any, []any:
+			return nil, false
+		case json.Number, bool:
+			typed = sc.coerce
+		}
+	}
+
+	if typed {
+		list := make([]any, len(arr))
+		for i := range arr {
+			list[i] = sc.typed(arr[i])
+		}
+
+		return list, true
+	}
+
+	list := make([]string, len(arr))
+	for i := range arr {
+		list[i] = sc.scalar(arr[i])
+	}
+
+	return list, true
+}
+
+// typed keeps the numbers (as json.Number, so the precision isn't lost) and booleans typed, the strings and null are
+// converted the same way scalar does.
+func (sc jsonScalars) typed(v any) any {
+	switch actual := v.(type) {
+	case json.Number, bool:
+		return actual
+	default:
+		return sc.scalar(actual)
+	}
+}
+
+// scalar converts JSON scalar to the form string.
+func (sc jsonScalars) scalar(v any) string {
+	switch actual := v.(type) {
+	case string:
+		return actual
+	case json.Number:
+		return actual.String()
+	case bool:
+		switch {
+		case sc.strings == nil && actual:
+			return "1"
+		case sc.strings == nil:
+			return ""
+		case actual:
+			return sc.strings.True
+		default:
+			return sc.strings.False
+		}
+	default:
+		if sc.strings == nil {
+			return ""
+		}
+
+		return sc.strings.Null
+	}
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	stderr "errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// jsonArrayStream decodes the JSON bodies which are a top-level array element by element with json.Decoder, so only
+// the current element is buffered instead of the whole body. The elements are indexed by their position, the same
+// way the buffered arrays are.
+type jsonArrayStream struct {
+	// 0 means unlimited
+	maxElements int
+}
+
+// newJSONArrayStream returns nil when the streaming is disabled.
+func newJSONArrayStream(cfg *config.JSONArrayStream) *jsonArrayStream {
+	if cfg == nil {
+		return nil
+	}
+
+	return &jsonArrayStream{maxElements: cfg.MaxElements}
+}
+
+// isJSONArray skips the leading whitespace of the body and reports whether the document is an array.
+func isJSONArray(br *bufio.Reader) bool {
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return false
+		}
+
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+
+		_ = br.UnreadByte()
+		return c == '['
+	}
+}
+
+// parse decodes the array elements while the body is read, the parse deadline counts from the first element. The
+// malformed element is reported with its index.
+func (s *jsonArrayStream) parse(r io.Reader, sc jsonScalars, dl *parseDeadline) (dataTree, error) {
+	const op = errors.Op("parse_json_array_stream")
+
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	// the opening bracket, already peeked
+	_, err := dec.Token()
+	if err != nil {
+		return nil, errors.E(op, jsonStreamErr(err, fmt.Errorf("malformed JSON array: %w", err)))
+	}
+
+	data := make(dataTree, 2)
+	for i := 0; dec.More(); i++ {
+		if s.maxElements > 0 && i >= s.maxElements {
+			return nil, errors.E(op, newParseError(ParseErrorBodyTooLarge, errors.Errorf("JSON array has more than %d elements", s.maxElements)).
+				with(ParseErrorCodeLimitExceeded, fmt.Sprintf("send at most %d array elements", s.maxElements)))
+		}
+
+		var elem any
+		err = dec.Decode(&elem)
+		if err != nil {
+			return nil, errors.E(op, jsonStreamErr(err, fmt.Errorf("malformed JSON array element %d: %w", i, err)))
+		}
+
+		data[strconv.Itoa(i)], err = jsonNode(elem, 1, sc, dl)
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
+	}
+
+	// the closing bracket
+	_, err = dec.Token()
+	if err != nil {
+		return nil, errors.E(op, jsonStreamErr(err, fmt.Errorf("malformed JSON array: %w", err)))
+	}
+
+	_, err = dec.Token()
+	if !stderr.Is(err, io.EOF) {
+		return nil, errors.E(op, newParseError(ParseErrorMalformed, errors.Str("unexpected data after the JSON document")))
+	}
+
+	return data, nil
+}
+
+// jsonStreamErr reports the syntax errors and the truncated bodies as malformed, the read errors (timeouts, the size
+// limits) are returned as they are.
+func jsonStreamErr(err, malformed error) error {
+	var se *json.SyntaxError
+	var ute *json.UnmarshalTypeError
+	if stderr.As(err, &se) || stderr.As(err, &ute) || stderr.Is(err, io.ErrUnexpectedEOF) || stderr.Is(err, io.EOF) {
+		return newParseError(ParseErrorMalformed, malformed)
+	}
+
+	return err
+}
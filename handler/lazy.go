@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// LazyBodyAttribute names the parser (urlencoded, json, ndjson) of the raw body sent to the worker unparsed in the
+// lazy parse mode. The handler doesn't parse the body, the worker parses it itself on the first access to the parsed
+// data, and never if it doesn't read it.
+const LazyBodyAttribute string = "Lazy-Body"
+
+// lazyParse selects the bodies which are buffered and sent to the worker unparsed.
+type lazyParse struct {
+	maxBuffer int64
+	// empty means all paths
+	paths []string
+}
+
+// newLazyParse returns nil when the lazy parsing is disabled.
+func newLazyParse(cfg *config.LazyParse) *lazyParse {
+	if cfg == nil {
+		return nil
+	}
+
+	return &lazyParse{
+		maxBuffer: cfg.MaxBuffer,
+		paths:     cfg.Paths,
+	}
+}
+
+// applies reports whether the body is deferred. Only the bodies buffered in memory as a whole can be deferred: the
+// multipart bodies are streamed to the temp files and the bodies of unknown or too large length would have to be
+// buffered without a bound, they're parsed eagerly.
+func (l *lazyParse) applies(r *http.Request, ct int) bool {
+	if l == nil || r.ContentLength <= 0 || r.ContentLength > l.maxBuffer {
+		return false
+	}
+
+	switch ct {
+	case contentURLEncoded, contentJSON, contentNDJSON:
+		return hasPathPrefix(r.URL.Path, l.paths)
+	default:
+		return false
+	}
+}
+
+// bufferLazyBody reads the raw body and tells the worker which parser it needs.
+func (r *Request) bufferLazyBody(hr *http.Request, ct int) error {
+	var err error
+	r.body, err = io.ReadAll(hr.Body)
+	if err != nil {
+		return err
+	}
+
+	r.lazy = ct
+	switch ct {
+	case contentURLEncoded:
+		r.setAttribute(LazyBodyAttribute, config.ParserURLEncoded)
+	case contentJSON:
+		r.setAttribute(LazyBodyAttribute, config.ParserJSON)
+	case contentNDJSON:
+		r.setAttribute(LazyBodyAttribute, config.ParserNDJSON)
+	}
+
+	return nil
+}
+
+// lazyTree parses the deferred body for the field inspectors, the same way it's parsed eagerly. The tree is only
+// inspected, the worker still gets the raw body. The body which can't be parsed can't be inspected, the error rejects
+// the request.
+func (h *Handler) lazyTree(hr *http.Request, req *Request) (dataTree, error) {
+	raw, _ := req.body.([]byte)
+	r := hr.WithContext(hr.Context())
+	r.Body = io.NopCloser(bytes.NewReader(raw))
+
+	var data dataTree
+	var err error
+	switch req.lazy {
+	case contentURLEncoded:
+		data, err = scanURLEncodedBody(r, h.bodyMethods, h.phpArrayKeys, h.maxSiblings, h.namePattern, nil)
+	case contentJSON:
+		data, err = parseJSONBody(r, h.unwrapPath, h.jsonArrayStream, h.jsonScalars, nil)
+	case contentNDJSON:
+		var warnings parseWarnings
+		data, err = h.parseNDJSONBody(r, h.logger(req), &warnings, nil)
+	}
+	if err != nil {
+		return nil, h.declaredTypeErr(r, err)
+	}
+
+	return data, nil
+}
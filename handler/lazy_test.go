@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/roadrunner-server/http/v5/config"
+	"github.com/roadrunner-server/http/v5/handler/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_LazyParse(t *testing.T) {
+	parse := &config.Parse{
+		ContentTypes: []*config.ContentType{{Pattern: "application/json", Parser: config.ParserJSON}},
+		LazyParse:    &config.LazyParse{MaxBuffer: 64, Paths: []string{"/api"}},
+	}
+	require.NoError(t, parse.InitDefaults())
+
+	testCases := []struct {
+		name   string
+		r      *http.Request
+		parser string
+		body   string
+	}{
+		{
+			name:   "urlencoded",
+			r:      handlertest.NewURLEncodedRequest(http.MethodPost, "/api/health", url.Values{"a[b]": {"1"}}),
+			parser: config.ParserURLEncoded,
+			body:   "a%5Bb%5D=1",
+		},
+		{
+			name:   "json",
+			r:      handlertest.NewRawRequest(http.MethodPost, "/api/health", "application/json", []byte(`{"a":1}`)),
+			parser: config.ParserJSON,
+			body:   `{"a":1}`,
+		},
+		{
+			name: "other path",
+			r:    handlertest.NewRawRequest(http.MethodPost, "/health", "application/json", []byte(`{"a":1}`)),
+			body: `{"a":"1"}`,
+		},
+		{
+			name: "over the buffer",
+			r:    handlertest.NewRawRequest(http.MethodPost, "/api/health", "application/json", []byte(`{"a":"`+strings.Repeat("x", 64)+`"}`)),
+			body: `{"a":"` + strings.Repeat("x", 64) + `"}`,
+		},
+		{
+			name: "multipart",
+			r:    handlertest.NewMultipart().Field("a", "1").Request(http.MethodPost, "/api/health"),
+			body: `{"a":"1"}`,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, p := newTestHandler(t, &config.Config{Parse: parse})
+			h.ServeHTTP(httptest.NewRecorder(), tt.r)
+
+			req := p.request(t)
+			assert.Equal(t, tt.body, string(p.pld.Body))
+			if tt.parser == "" {
+				assert.True(t, req.Parsed)
+				assert.NotContains(t, req.Attributes, LazyBodyAttribute)
+				return
+			}
+
+			assert.False(t, req.Parsed)
+			require.Contains(t, req.Attributes, LazyBodyAttribute)
+			assert.Equal(t, [][]byte{[]byte(tt.parser)}, req.Attributes[LazyBodyAttribute].Value)
+		})
+	}
+
+	t.Run("body checks", func(t *testing.T) {
+		checks := []struct {
+			option string
+			parse  *config.Parse
+		}{
+			{option: "csrf", parse: &config.Parse{CSRF: &config.CSRF{Cookie: "c", Field: "f"}}},
+			{option: "max_total_parsed_bytes", parse: &config.Parse{MaxTotalParsedBytes: 1024}},
+			{option: "trim_quotes", parse: &config.Parse{TrimQuotes: []string{"name"}}},
+			{option: "collapse_lists", parse: &config.Parse{CollapseLists: []string{"tags"}}},
+			{option: "checkboxes", parse: &config.Parse{Checkboxes: []*config.CheckboxGroup{{Prefix: "opts", Keys: []string{"a"}}}}},
+			{option: "nested_form_fields", parse: &config.Parse{NestedFormFields: []string{"payload"}}},
+		}
+
+		for _, c := range checks {
+			c.parse.LazyParse = &config.LazyParse{}
+			assert.ErrorContains(t, c.parse.InitDefaults(), "lazy_parse can't be combined with "+c.option)
+		}
+	})
+}
@@ -0,0 +1,24 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// lengthConflict rejects the request declaring both Content-Length and Transfer-Encoding (RFC 9112 6.3), see
+// config.Config.AllowLengthConflict. The net/http server removes the Content-Length of the chunked requests, so it's
+// the requests of the other transports keeping both headers which are rejected here.
+func lengthConflict(r *http.Request) error {
+	chunked := len(r.TransferEncoding) > 0 || len(r.Header.Values("Transfer-Encoding")) > 0
+	if !chunked {
+		return nil
+	}
+
+	if len(r.Header.Values("Content-Length")) == 0 && r.ContentLength <= 0 {
+		return nil
+	}
+
+	return newParseError(ParseErrorMalformed, errors.Str("the request has both Content-Length and Transfer-Encoding")).
+		with(ParseErrorCodeMalformedBody, "send either Content-Length or Transfer-Encoding, not both")
+}
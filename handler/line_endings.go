@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	stderr "errors"
+	"fmt"
+	"io"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// framing returns the multipart body with the framing lines checked or rewritten to CRLF, see
+// config.Parse.MultipartLineEndings, the part header blocks checked against max_part_header_size and the epilogue
+// checked for the trailing data. The auto mode without the header limit and the trailing data check leaves the body
+// to the multipart reader as it is.
+func (opts *multipartOptions) framing(body io.Reader, boundary string, warnings *parseWarnings) io.Reader {
+	fix := opts.lineEndings == config.MultipartLineEndingsLenient || opts.lineEndings == config.MultipartLineEndingsStrict
+	if !fix && opts.maxPartHeaderSize <= 0 && !opts.rejectTrailingData {
+		return body
+	}
+
+	return &crlfFraming{
+		br:            bufio.NewReader(body),
+		delim:         []byte("--" + boundary),
+		keepEndings:   !fix,
+		strict:        opts.lineEndings == config.MultipartLineEndingsStrict,
+		maxHeaderSize: opts.maxPartHeaderSize,
+		rejectTrailer: opts.rejectTrailingData,
+		warnings:      warnings,
+		lineStart:     true,
+	}
+}
+
+// readEpilogue reads the rest of the body after the closing boundary, so the framing reader checks it for the
+// trailing data. The multipart reader stops at the closing boundary, the epilogue is otherwise never read.
+func (opts *multipartOptions) readEpilogue(body io.Reader) error {
+	if !opts.rejectTrailingData {
+		return nil
+	}
+
+	_, err := io.Copy(io.Discard, body)
+	return err
+}
+
+// crlfFraming reads the multipart body line by line and makes sure the boundary lines, the line endings preceding
+// them and the part header lines end with CRLF. The strict mode rejects the body instead of rewriting it. The line
+// ending before a boundary belongs to the delimiter, so the ending of every content line is held back until the next
+// line shows whether it starts with the boundary. The epilogue after the closing boundary is passed as is. With
+// keepEndings the line endings are passed as they are, only the size of the header blocks is checked.
+type crlfFraming struct {
+	br          *bufio.Reader
+	delim       []byte
+	keepEndings bool
+	strict      bool
+	// the limit of the header block of each part, 0 means unlimited
+	maxHeaderSize int64
+	headerSize    int64
+	// reject anything but the whitespace after the closing boundary
+	rejectTrailer bool
+	// the rewritten LF framing is reported once
+	warnings *parseWarnings
+	warned   bool
+
+	// the held back line ending of the previous line, \n or \r\n
+	pending []byte
+	// the last byte passed before the pending line ending was \r (the line was split by the buffer)
+	cr bool
+	// the next chunk begins a line
+	lineStart bool
+	// the first boundary was read, the line endings of the preamble are not checked
+	started bool
+	// the part header lines are read
+	headers bool
+	// the closing boundary was read
+	done bool
+
+	buf []byte
+	out []byte
+	err error
+}
+
+func (f *crlfFraming) Read(p []byte) (int, error) {
+	for len(f.out) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+
+		f.buf, f.err = f.next(f.buf[:0])
+		f.out = f.buf
+	}
+
+	n := copy(p, f.out)
+	f.out = f.out[n:]
+
+	return n, nil
+}
+
+// next appends the next line (or its part, the lines longer than the buffer are read in chunks) to out.
+func (f *crlfFraming) next(out []byte) ([]byte, error) {
+	chunk, err := f.br.ReadSlice('\n')
+	full := true
+	switch {
+	case err == nil, stderr.Is(err, io.EOF):
+	case stderr.Is(err, bufio.ErrBufferFull):
+		full, err = false, nil
+	default:
+		return out, err
+	}
+
+	boundary, final := false, false
+	if f.lineStart && !f.done && full {
+		boundary, final = f.boundaryLine(chunk)
+	}
+
+	if len(f.pending) > 0 {
+		if boundary && f.started && len(f.pending) == 1 && !f.cr && !f.keepEndings {
+			if f.strict {
+				return out, lfFramingErr()
+			}
+
+			f.warnLF()
+			out = append(out, '\r')
+		}
+
+		out = append(out, f.pending...)
+		f.pending, f.cr = f.pending[:0], false
+	}
+
+	line, ending := cutLineEnding(chunk)
+	f.lineStart = len(ending) > 0
+
+	switch {
+	case f.done:
+		if f.rejectTrailer && len(bytes.TrimLeft(chunk, " \t\r\n")) > 0 {
+			return out, trailingDataErr()
+		}
+
+		return append(out, chunk...), err
+	case boundary || f.headers:
+		if f.headers && !boundary {
+			f.headerSize += int64(len(chunk))
+			if f.maxHeaderSize > 0 && f.headerSize > f.maxHeaderSize {
+				return out, partHeaderTooLargeErr(f.maxHeaderSize)
+			}
+		}
+
+		if len(ending) == 1 && !f.keepEndings {
+			if f.strict {
+				return out, lfFramingErr()
+			}
+
+			f.warnLF()
+			ending = []byte("\r\n")
+		}
+
+		if boundary {
+			f.started = true
+			f.done = final
+			f.headers = !final
+			f.headerSize = 0
+		} else if len(line) == 0 && len(ending) > 0 {
+			// the empty line ends the part headers
+			f.headers = false
+		}
+
+		out = append(out, line...)
+		return append(out, ending...), err
+	default:
+		if len(line) > 0 {
+			f.cr = len(ending) == 0 && line[len(line)-1] == '\r'
+		}
+
+		f.pending = append(f.pending, ending...)
+		return append(out, line...), err
+	}
+}
+
+func (f *crlfFraming) warnLF() {
+	if f.warned {
+		return
+	}
+
+	f.warned = true
+	f.warnings.add(ParseWarningLFFraming, "the multipart body uses LF line endings, rewritten to CRLF")
+}
+
+// boundaryLine reports whether the line is the boundary delimiter line, and whether it's the closing one. Like the
+// multipart reader, it allows the linear whitespace after the boundary.
+func (f *crlfFraming) boundaryLine(line []byte) (bool, bool) {
+	rest, ok := bytes.CutPrefix(line, f.delim)
+	if !ok {
+		return false, false
+	}
+
+	final := false
+	if bytes.HasPrefix(rest, []byte("--")) {
+		rest, final = rest[2:], true
+	}
+
+	rest = bytes.TrimLeft(rest, " \t")
+	switch string(rest) {
+	case "", "\n", "\r\n":
+		return true, final
+	default:
+		return false, false
+	}
+}
+
+// cutLineEnding splits the line into its content and its \n or \r\n ending, if any.
+func cutLineEnding(line []byte) ([]byte, []byte) {
+	switch {
+	case bytes.HasSuffix(line, []byte("\r\n")):
+		return line[:len(line)-2], line[len(line)-2:]
+	case bytes.HasSuffix(line, []byte("\n")):
+		return line[:len(line)-1], line[len(line)-1:]
+	default:
+		return line, nil
+	}
+}
+
+func partHeaderTooLargeErr(limit int64) error {
+	return newParseError(ParseErrorBodyTooLarge, errors.Errorf("multipart part header exceeds the size limit of %d bytes", limit)).
+		with(ParseErrorCodeHeaderTooLarge, fmt.Sprintf("send the part headers (the field names and the filenames) of at most %d bytes", limit))
+}
+
+func trailingDataErr() error {
+	return newParseError(ParseErrorMalformed, errors.Str("unexpected data after the closing multipart boundary")).
+		with(ParseErrorCodeMalformedMultipart, "send nothing but the line ending after the closing multipart boundary")
+}
+
+func lfFramingErr() error {
+	return newParseError(ParseErrorMalformed, errors.Str("the multipart body uses LF line endings, CRLF is required")).
+		with(ParseErrorCodeMalformedMultipart, "end the multipart boundary and header lines with CRLF")
+}
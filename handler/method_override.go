@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// overrideMethod replaces the POST method seen by the worker with the one from the override field of the parsed
+// body (HTML forms can't send PUT, PATCH or DELETE). Other methods and values are ignored.
+func (h *Handler) overrideMethod(req *Request) {
+	if h.methodOverrideField == "" || req.Method != http.MethodPost {
+		return
+	}
+
+	data, ok := req.body.(dataTree)
+	if !ok {
+		return
+	}
+
+	value, ok := data[h.methodOverrideField].(string)
+	if !ok {
+		return
+	}
+
+	switch method := strings.ToUpper(strings.TrimSpace(value)); method {
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+		req.Method = method
+	default:
+		h.logger(req).Debug("method override ignored", zap.String("field", h.methodOverrideField), zap.String("value", h.redactor.value(value, h.methodOverrideField)))
+		req.warnings.add(ParseWarningMethodOverrideIgnored, "method override field %s has an unsupported method", h.methodOverrideField)
+	}
+}
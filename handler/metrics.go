@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+var _ prometheus.Collector = (*Metrics)(nil)
+
+// Metrics collects the request body size, the parsed fields count and the parse cost distributions. The histograms are updated
+// with atomic operations, so observing them on the request path doesn't take locks.
+type Metrics struct {
+	bodySize   prometheus.Histogram
+	fieldCount prometheus.Histogram
+	// observed when the parse cost is enabled
+	parseCost prometheus.Histogram
+}
+
+// NewMetrics creates the parse metrics with the buckets from the parse configuration, nil configuration uses the
+// prometheus default buckets.
+func NewMetrics(cfg *config.Parse) *Metrics {
+	var sizeBuckets, countBuckets, costBuckets []float64
+	if cfg != nil {
+		sizeBuckets = cfg.BodySizeBuckets
+		countBuckets = cfg.FieldCountBuckets
+		if cfg.ParseCost != nil {
+			costBuckets = cfg.ParseCost.Buckets
+		}
+	}
+
+	return &Metrics{
+		bodySize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "rr_http_request_body_size_bytes",
+			Help:    "Size of the request bodies read by the HTTP plugin.",
+			Buckets: sizeBuckets,
+		}),
+		fieldCount: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "rr_http_request_parsed_fields",
+			Help:    "Number of the fields parsed from the request bodies.",
+			Buckets: countBuckets,
+		}),
+		parseCost: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "rr_http_request_parse_cost",
+			Help:    "Weighted cost of parsing the request bodies.",
+			Buckets: costBuckets,
+		}),
+	}
+}
+
+func (m *Metrics) Describe(d chan<- *prometheus.Desc) {
+	m.bodySize.Describe(d)
+	m.fieldCount.Describe(d)
+	m.parseCost.Describe(d)
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.bodySize.Collect(ch)
+	m.fieldCount.Collect(ch)
+	m.parseCost.Collect(ch)
+}
+
+// observe records the request body size, the fields are counted only for the parsed bodies. The request ID is
+// attached to the observations as the exemplar.
+func (m *Metrics) observe(size int64, req *Request) {
+	observeExemplar(m.bodySize, float64(size), req.requestID)
+
+	if dt, ok := req.body.(dataTree); ok {
+		observeExemplar(m.fieldCount, float64(dt.count()), req.requestID)
+	}
+}
+
+func observeExemplar(h prometheus.Histogram, v float64, id string) {
+	if eo, ok := h.(prometheus.ExemplarObserver); ok && id != "" {
+		eo.ObserveWithExemplar(v, prometheus.Labels{"request_id": id})
+		return
+	}
+
+	h.Observe(v)
+}
+
+// countingBody counts the bytes read from the request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
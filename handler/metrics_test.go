@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/roadrunner-server/http/v5/attributes"
+	"github.com/roadrunner-server/http/v5/config"
+	"github.com/roadrunner-server/http/v5/handler/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func histogram(t *testing.T, h prometheus.Histogram) *dto.Histogram {
+	m := &dto.Metric{}
+	require.NoError(t, h.Write(m))
+
+	return m.GetHistogram()
+}
+
+func TestHandler_Metrics(t *testing.T) {
+	cfg := &config.Parse{
+		BodySizeBuckets:   []float64{10, 100},
+		FieldCountBuckets: []float64{2, 5},
+	}
+	require.NoError(t, cfg.InitDefaults())
+
+	h, _ := newTestHandler(t, &config.Config{Parse: cfg})
+	m := NewMetrics(cfg)
+	h.SetMetrics(m)
+
+	form := url.Values{"a": {"1"}, "b[]": {"1", "2"}, "c[d]": {"3"}}
+	h.ServeHTTP(httptest.NewRecorder(), handlertest.NewURLEncodedRequest(http.MethodPost, "/", form))
+	h.ServeHTTP(httptest.NewRecorder(), handlertest.NewRawRequest(http.MethodPost, "/", "text/plain", make([]byte, 200)))
+
+	size := histogram(t, m.bodySize)
+	assert.Equal(t, uint64(2), size.GetSampleCount())
+	assert.Equal(t, float64(len(form.Encode())+200), size.GetSampleSum())
+	assert.Equal(t, uint64(0), size.GetBucket()[0].GetCumulativeCount())
+	assert.Equal(t, uint64(1), size.GetBucket()[1].GetCumulativeCount())
+
+	// raw bodies have no fields
+	fields := histogram(t, m.fieldCount)
+	assert.Equal(t, uint64(1), fields.GetSampleCount())
+	assert.Equal(t, float64(4), fields.GetSampleSum())
+}
+
+func TestHandler_MetricsLargeForm(t *testing.T) {
+	h, p := newTestHandler(t, &config.Config{})
+	h.SetMetrics(NewMetrics(nil))
+
+	// larger than the net/http limit for the bodies not wrapped by http.MaxBytesReader
+	value := strings.Repeat("a", 11<<20)
+	w := httptest.NewRecorder()
+	r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"key": {value}})
+	r.Body = http.MaxBytesReader(w, r.Body, 20<<20)
+	h.ServeHTTP(w, r)
+
+	require.NotNil(t, p.pld)
+	assert.Equal(t, len(value)+len(`{"key":""}`), len(p.pld.Body))
+}
+
+func TestHandler_MetricsRequestID(t *testing.T) {
+	rid := &config.RequestID{}
+	require.NoError(t, rid.InitDefaults())
+
+	h, _ := newTestHandler(t, &config.Config{RequestID: rid})
+	m := NewMetrics(&config.Parse{BodySizeBuckets: []float64{100}})
+	h.SetMetrics(m)
+
+	r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"a": {"1"}})
+	r.Header.Set("X-Request-ID", "abc-123")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	exemplar := histogram(t, m.bodySize).GetBucket()[0].GetExemplar()
+	require.NotNil(t, exemplar)
+	require.Len(t, exemplar.GetLabel(), 1)
+	assert.Equal(t, "request_id", exemplar.GetLabel()[0].GetName())
+	assert.Equal(t, "abc-123", exemplar.GetLabel()[0].GetValue())
+}
+
+func TestHandler_ParseCost(t *testing.T) {
+	cfg := &config.Parse{ParseCost: &config.ParseCost{Bytes: 1, Fields: 2, Files: 10, Depth: 100}}
+	require.NoError(t, cfg.InitDefaults())
+
+	h, p := newTestHandler(t, &config.Config{Parse: cfg, Uploads: &config.Uploads{Dir: t.TempDir()}})
+	m := NewMetrics(cfg)
+	h.SetMetrics(m)
+
+	// the request attributes are shared with the middleware which initialized them
+	body := "a=1&b%5Bc%5D=2"
+	r := attributes.Init(handlertest.NewRawRequest(http.MethodPost, "/", handlertest.ContentURLEncoded, []byte(body)))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	// 14 bytes, 2 fields, 2 levels
+	assert.Equal(t, []string{"218"}, attributes.All(r)[ParseCostAttribute])
+	assert.Equal(t, [][]byte{[]byte("218")}, p.request(t).Attributes[ParseCostAttribute].Value)
+
+	mp := handlertest.NewMultipart().Field("a", "1").File("f", "f.txt", "text/plain", []byte("x"))
+	h.ServeHTTP(httptest.NewRecorder(), mp.Request(http.MethodPost, "/"))
+	want := float64(len(mp.Bytes())) + 2 + 10 + 100
+	assert.Equal(t, [][]byte{[]byte(strconv.FormatFloat(want, 'f', -1, 64))}, p.request(t).Attributes[ParseCostAttribute].Value)
+
+	cost := histogram(t, m.parseCost)
+	assert.Equal(t, uint64(2), cost.GetSampleCount())
+	assert.Equal(t, 218+want, cost.GetSampleSum())
+
+	t.Run("default weights", func(t *testing.T) {
+		cfg := &config.Parse{ParseCost: &config.ParseCost{}}
+		require.NoError(t, cfg.InitDefaults())
+		assert.Equal(t, 1.0/1024, cfg.ParseCost.Bytes)
+		assert.Equal(t, float64(10), cfg.ParseCost.Files)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{})
+		h.ServeHTTP(httptest.NewRecorder(), handlertest.NewRawRequest(http.MethodPost, "/", handlertest.ContentURLEncoded, []byte(body)))
+		assert.NotContains(t, p.request(t).Attributes, ParseCostAttribute)
+	})
+}
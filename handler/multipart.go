@@ -0,0 +1,782 @@
+package handler
+
+import (
+	"bytes"
+	stderr "errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+const (
+	// maxMultipartParts is the same limit net/http applies to the number of parts in the form.
+	maxMultipartParts = 1000
+	// extra memory for the values on top of maxMemory, the same as in net/http
+	maxValueExtraBytes = 10 << 20
+	// the metadata memory accounting and the header entries limit of the form, the same as in net/http
+	mapEntryOverhead = 200
+	fileHeaderSize   = 100
+	maxFormHeaders   = 10000
+	tmpPartPattern   = "multipart-"
+)
+
+// multipartForm is a multipart body read part by part. It's similar to multipart.Form, but keeps the details of the
+// part headers the net/http form parser drops.
+type multipartForm struct {
+	values map[string][]string
+	files  map[string][]*filePart
+	// literal names should be mounted into the tree as is, without splitting them into the indexes
+	literal map[string]struct{}
+	// the only part of the form, read into memory to be sent to the worker as the body
+	single     *filePart
+	singleName string
+	// split the names the PHP way, see phpIndexes
+	phpKeys bool
+	// extract the dimensions of the uploaded images
+	imageInfo bool
+	// sniff the media type of the uploaded files
+	sniffMime bool
+	// temp file name pattern of the uploads
+	tempPattern string
+	// the file keys nesting limit, 0 means MaxLevel
+	maxFileDepth int
+	// the children limit of the tree nodes, 0 means unlimited
+	maxSiblings int
+	// the files kept of the bare names repeated by several parts
+	repeatedFiles string
+	// the boundary and the number of the parts read, for the diagnostics
+	boundary string
+	parts    int
+	// the parts in the order they were read, see config.Parse.PartsManifest
+	manifest []manifestPart
+	// the temp space of the request the spilled parts are reserved in, nil means unlimited
+	space *tempSpace
+	// the warnings of the form read
+	warnings parseWarnings
+}
+
+// filePart is the content of a file part, stored in memory or in a temp file if it doesn't fit into memory.
+type filePart struct {
+	filename string
+	header   textproto.MIMEHeader
+	size     int64
+	content  []byte
+	tmpfile  string
+	// upload error code of the file rejected before its content was read
+	rejected int
+	// kept in memory since its temp file couldn't be created, not accounted in the memory limit
+	fallback bool
+	// the temp space the temp file is reserved in, released when the file is removed
+	space    *tempSpace
+	reserved int64
+}
+
+// multipartOptions controls how the parts are read.
+type multipartOptions struct {
+	maxMemory int64
+	// quoted name parameters are literal keys, unquoted ones use the array syntax
+	literalQuotedNames bool
+	// use the first occurrence of the duplicate framing headers instead of rejecting the part
+	firstDuplicateHeader bool
+	// keep the form consisting of a single file in memory, see multipartForm.single
+	streamSingleUpload bool
+	// the uploads filters which only need the part header
+	forbid    map[string]struct{}
+	allow     map[string]struct{}
+	allowMime map[string]struct{}
+	// split the names the PHP way, see phpIndexes
+	phpArrayKeys bool
+	// the file parts size limit, 0 means unlimited
+	maxFileSize int64
+	// extract the dimensions of the uploaded images, see FileUpload.Image
+	imageInfo bool
+	// sniff the media type of the uploaded files, see FileUpload.SniffedMime
+	sniffMime bool
+	// temp file name pattern of the uploads, see config.Uploads.TempPattern
+	tempPattern string
+	// the file keys nesting limit, see config.Uploads.MaxFileNestingDepth
+	maxFileDepth int
+	// the files kept of the bare names repeated by several parts, see config.Uploads.RepeatedFileKeys
+	repeatedFiles string
+	// the children limit of the tree nodes, see config.Parse.MaxSiblingsPerNode
+	maxSiblings int
+	// the limit of the temp files open at the same time, nil means unlimited
+	openFiles *openFiles
+	// how the parts with the empty filename parameter are classified, see config.Parse.EmptyFilename
+	emptyFilename string
+	// the memory the parts are kept in when their temp files can't be created, see config.Uploads.TempFallbackMemory
+	fallbackMemory int64
+	// how the LF framing lines are handled, see config.Parse.MultipartLineEndings
+	lineEndings string
+	// reject the data after the closing boundary, see config.Parse.MultipartTrailingData
+	rejectTrailingData bool
+	// the size limit of the header block of each part, 0 means unlimited
+	maxPartHeaderSize int64
+	// the size limit of each value part, 0 means only the total limit of the values
+	maxValueSize int64
+	// honor the MAX_FILE_SIZE form field, see config.Uploads.FormMaxFileSize
+	formMaxFileSize bool
+	// keep the forms truncated inside a file part, see config.Uploads.PartialUploads
+	partialUploads bool
+	// the pattern of the part names, nil means any name
+	namePattern *namePattern
+	// list the parts read, see config.Parse.PartsManifest
+	partsManifest bool
+}
+
+// formMaxFileSizeField is the form field limiting the size of the files following it, see
+// config.Uploads.FormMaxFileSize.
+const formMaxFileSizeField string = "MAX_FILE_SIZE"
+
+// formFileSizeLimit parses the MAX_FILE_SIZE value, the invalid and the non-positive values disable the limit.
+func formFileSizeLimit(v string) int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+
+	return n
+}
+
+// rejectFile runs the upload filters which can decide from the part header alone, so the rejected files are never
+// buffered or written to disk. Returns the upload error code, UploadErrorOK if the file passes.
+func (opts *multipartOptions) rejectFile(filename string, header textproto.MIMEHeader) int {
+	if !uploadAllowed(filename, opts.forbid, opts.allow) {
+		return UploadErrorExtension
+	}
+
+	if len(opts.allowMime) > 0 {
+		if _, ok := opts.allowMime[mediaType(partMime(header))]; !ok {
+			return UploadErrorExtension
+		}
+	}
+
+	return UploadErrorOK
+}
+
+// Open opens the part content, satisfies the same contract as multipart.FileHeader.Open.
+func (f *filePart) Open() (multipart.File, error) {
+	if f.tmpfile != "" {
+		return os.Open(f.tmpfile)
+	}
+
+	return sectionReadCloser{io.NewSectionReader(bytes.NewReader(f.content), 0, int64(len(f.content)))}, nil
+}
+
+type sectionReadCloser struct {
+	*io.SectionReader
+}
+
+func (rc sectionReadCloser) Close() error {
+	return nil
+}
+
+// readMultipart reads the multipart body of the request.
+func readMultipart(r *http.Request, opts *multipartOptions, space *tempSpace) (*multipartForm, error) {
+	const op = errors.Op("read_multipart")
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, errors.E(op, multipartErr(err))
+	}
+
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, errors.E(op, multipartErr(http.ErrMissingBoundary))
+	}
+
+	form := &multipartForm{
+		values:        make(map[string][]string),
+		files:         make(map[string][]*filePart),
+		literal:       make(map[string]struct{}),
+		phpKeys:       opts.phpArrayKeys,
+		imageInfo:     opts.imageInfo,
+		sniffMime:     opts.sniffMime,
+		tempPattern:   opts.tempPattern,
+		maxFileDepth:  opts.maxFileDepth,
+		repeatedFiles: opts.repeatedFiles,
+		maxSiblings:   opts.maxSiblings,
+		boundary:      boundary,
+		space:         space,
+	}
+
+	body := opts.framing(r.Body, boundary, &form.warnings)
+	err = form.read(multipart.NewReader(body, boundary), opts)
+	if err == nil {
+		err = opts.readEpilogue(body)
+	}
+	if err != nil {
+		_ = form.removeAll()
+		return nil, errors.E(op, partError(err))
+	}
+
+	return form, nil
+}
+
+func (mf *multipartForm) read(mr *multipart.Reader, opts *multipartOptions) error {
+	maxMemory := opts.maxMemory
+	fallback := opts.fallbackMemory
+	maxValueBytes := maxMemory + maxValueExtraBytes
+	maxHeaders := int64(maxFormHeaders)
+	parts := 0
+	// the MAX_FILE_SIZE field limits the files following it, 0 means no limit
+	formMaxSize := int64(0)
+
+	// the part already taken from the reader while checking for the single upload
+	var pending *multipart.Part
+
+	for {
+		p := pending
+		pending = nil
+
+		if p == nil {
+			var err error
+			p, err = mr.NextPart()
+			if stderr.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		// the header entries of the file parts are kept, net/http limits their total
+		if headerEntries(p.Header) > maxHeaders {
+			return multipart.ErrMessageTooLarge
+		}
+
+		parts++
+		mf.parts = parts
+		if parts > maxMultipartParts {
+			return multipart.ErrMessageTooLarge
+		}
+
+		err := checkPartHeaders(p.Header, opts, &mf.warnings)
+		if err != nil {
+			return err
+		}
+
+		name, filename, literal := partNames(p, opts)
+		if name == "" {
+			continue
+		}
+
+		keep, err := opts.namePattern.keep(name)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			// multipart.Reader skips the unread content of the part
+			continue
+		}
+
+		if literal {
+			mf.literal[name] = struct{}{}
+		}
+
+		maxValueBytes -= int64(len(name)) + mapEntryOverhead
+		if maxValueBytes < 0 {
+			return multipart.ErrMessageTooLarge
+		}
+
+		// the filename parameter makes the part a file, even the empty one unless it's classified as a value
+		emptyFile := false
+		if filename == "" && (opts.emptyFilename == config.EmptyFilenameFile || opts.emptyFilename == config.EmptyFilenameReject) && hasFilenameParam(p.Header) {
+			if opts.emptyFilename == config.EmptyFilenameReject {
+				return multipartErr(errors.Errorf("multipart part '%s' has the empty filename", name))
+			}
+
+			emptyFile = true
+		}
+
+		if filename == "" && !emptyFile {
+			// value, store as string in memory
+			limit, capped := maxValueBytes, opts.maxValueSize > 0 && opts.maxValueSize < maxValueBytes
+			if capped {
+				limit = opts.maxValueSize
+			}
+
+			var buf bytes.Buffer
+			n, errC := io.CopyN(&buf, p, limit+1)
+			if errC != nil && !stderr.Is(errC, io.EOF) {
+				return errC
+			}
+
+			if capped && n > limit {
+				return valueTooLargeErr(name, limit)
+			}
+
+			maxValueBytes -= n
+			if maxValueBytes < 0 {
+				return multipart.ErrMessageTooLarge
+			}
+
+			if opts.formMaxFileSize && name == formMaxFileSizeField {
+				formMaxSize = formFileSizeLimit(buf.String())
+			}
+
+			mf.values[name] = append(mf.values[name], buf.String())
+			mf.record(opts, name, "", p.Header, n)
+			continue
+		}
+
+		maxValueBytes -= mimeHeaderSize(p.Header) + mapEntryOverhead + fileHeaderSize
+		if maxValueBytes < 0 {
+			return multipart.ErrMessageTooLarge
+		}
+
+		maxHeaders -= headerEntries(p.Header)
+
+		fp := &filePart{
+			filename: filename,
+			header:   p.Header,
+			space:    mf.space,
+		}
+
+		declared, err := partContentLength(p.Header)
+		if err != nil {
+			return err
+		}
+
+		fp.rejected = opts.rejectFile(filename, p.Header)
+		if fp.rejected == UploadErrorOK && opts.maxFileSize > 0 && declared > opts.maxFileSize {
+			fp.rejected = UploadErrorIniSize
+		}
+
+		if fp.rejected == UploadErrorOK && formMaxSize > 0 && declared > formMaxSize {
+			fp.rejected = UploadErrorFormSize
+		}
+
+		if emptyFile {
+			// the file input submitted without a file, PHP reports it as no file
+			fp.rejected = UploadErrorNoFile
+		}
+
+		if fp.rejected != UploadErrorOK {
+			// multipart.Reader skips the unread content of the part
+			mf.files[name] = append(mf.files[name], fp)
+			mf.record(opts, name, filename, p.Header, 0)
+			continue
+		}
+
+		// the parts without Content-Length are limited while being read
+		src := io.Reader(p)
+		limit := opts.maxFileSize
+		if formMaxSize > 0 && (limit == 0 || formMaxSize < limit) {
+			limit = formMaxSize
+		}
+		if limit > 0 {
+			// one byte more to detect the oversize files
+			src = io.LimitReader(p, limit+1)
+		}
+
+		// the first file may be the only part, sent to the worker as the body straight from the request
+		first := opts.streamSingleUpload && parts == 1
+		if first {
+			err = fp.readWhole(src, declared, maxMemory, opts.maxFileSize)
+		} else {
+			err = fp.readContent(src, declared, maxMemory, &fallback, opts)
+		}
+		if err != nil {
+			if opts.partialUploads && stderr.Is(err, io.ErrUnexpectedEOF) {
+				// PHP keeps the parts read before the truncated file
+				fp.reject(UploadErrorPartial)
+				mf.files[name] = append(mf.files[name], fp)
+				mf.record(opts, name, filename, p.Header, 0)
+				mf.warnings.add(ParseWarningPartialUpload, "the multipart body ended inside the file part '%s'", name)
+				return nil
+			}
+
+			return err
+		}
+
+		if fp.rejected == UploadErrorOK && formMaxSize > 0 && fp.size > formMaxSize {
+			fp.reject(UploadErrorFormSize)
+		}
+
+		mf.record(opts, name, filename, p.Header, fp.size)
+
+		if first {
+			single, next, errS := mf.checkSingle(mr, fp, name)
+			if errS != nil {
+				return errS
+			}
+
+			if single {
+				return nil
+			}
+
+			// not the only part, store it the same way as any other file
+			err = fp.storeWhole(maxMemory, &fallback, opts)
+			if err != nil {
+				return err
+			}
+
+			pending = next
+		}
+
+		if fp.rejected == UploadErrorOK && fp.tmpfile == "" && !fp.fallback {
+			maxMemory -= fp.size
+			maxValueBytes -= fp.size
+		}
+
+		mf.files[name] = append(mf.files[name], fp)
+	}
+}
+
+// readContent reads the file part into memory, or into the temp file if it doesn't fit into the memory left. The
+// declared size only presizes the buffer up to the memory limit, the files declared larger go to the disk directly.
+// When the temp file can't be created, the part is kept in the fallback memory left for the request, if any.
+func (f *filePart) readContent(src io.Reader, declared, maxMemory int64, fallback *int64, opts *multipartOptions) error {
+	var buf bytes.Buffer
+	var n int64
+	if declared <= maxMemory {
+		if declared > 0 {
+			buf.Grow(int(declared) + bytes.MinRead)
+		}
+
+		var err error
+		n, err = io.CopyN(&buf, src, maxMemory+1)
+		if err != nil && !stderr.Is(err, io.EOF) {
+			return err
+		}
+	}
+
+	if declared > maxMemory || n > maxMemory {
+		// too big, write to disk and flush the buffer
+		err := f.store(&buf, src, fallback, opts)
+		if err != nil {
+			return err
+		}
+	} else {
+		f.content = buf.Bytes()
+		f.size = int64(len(f.content))
+	}
+
+	return f.checkSize(declared, opts.maxFileSize)
+}
+
+// store writes the buffered bytes and the rest of the part into the temp file, or keeps them in the fallback memory
+// when the temp file can't be created. The temp file of the part which failed to be written is removed.
+func (f *filePart) store(buf *bytes.Buffer, rest io.Reader, fallback *int64, opts *multipartOptions) error {
+	size, err := f.spill(buf, rest, opts.openFiles)
+	switch {
+	case err == nil:
+		f.size = size
+		return nil
+	case f.tmpfile == "" && isStorageErr(err):
+		return f.keepInMemory(buf, rest, fallback, err)
+	}
+
+	// the part isn't added to the form, removeAll doesn't see it
+	f.reject(UploadErrorCantWrite)
+	if isStorageErr(err) {
+		return storageErr(err)
+	}
+
+	return err
+}
+
+// readWhole reads the first file part into memory whatever its size, see config.Parse.StreamSingleUpload. The only
+// file of the form goes from the request to the worker without the temp file, the size is still limited by the body
+// limits and max_file_size.
+func (f *filePart) readWhole(src io.Reader, declared, maxMemory, maxFileSize int64) error {
+	var buf bytes.Buffer
+	if declared > 0 && declared <= maxMemory {
+		buf.Grow(int(declared) + bytes.MinRead)
+	}
+
+	_, err := buf.ReadFrom(src)
+	if err != nil {
+		return err
+	}
+
+	f.content = buf.Bytes()
+	f.size = int64(len(f.content))
+
+	return f.checkSize(declared, maxFileSize)
+}
+
+// storeWhole stores the part read by readWhole the way readContent does, when it turns out not to be the only part:
+// it stays in memory if it fits, otherwise it's written to the temp file once.
+func (f *filePart) storeWhole(maxMemory int64, fallback *int64, opts *multipartOptions) error {
+	if f.rejected != UploadErrorOK || f.size <= maxMemory {
+		return nil
+	}
+
+	buf := bytes.NewBuffer(f.content)
+	f.content, f.size = nil, 0
+
+	return f.store(buf, bytes.NewReader(nil), fallback, opts)
+}
+
+// checkSingle checks if the first file part is the only part of the form. Only the accepted files kept in memory are
+// sent to the worker as the body, the rest are stored as any other file. If it's not the only part, the next part is
+// returned to be processed.
+func (mf *multipartForm) checkSingle(mr *multipart.Reader, fp *filePart, name string) (bool, *multipart.Part, error) {
+	next, err := mr.NextPart()
+	if stderr.Is(err, io.EOF) {
+		if fp.rejected == UploadErrorOK && fp.tmpfile == "" {
+			mf.single = fp
+			mf.singleName = name
+			return true, nil, nil
+		}
+
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	return false, next, nil
+}
+
+// storeSingle moves the single upload to the form files.
+func (mf *multipartForm) storeSingle() {
+	mf.files[mf.singleName] = append(mf.files[mf.singleName], mf.single)
+	mf.single = nil
+	mf.singleName = ""
+}
+
+// spill writes the already buffered bytes and the rest of the part into the temp file. Each chunk is reserved in the
+// temp quota before it's written.
+func (f *filePart) spill(buf *bytes.Buffer, rest io.Reader, of *openFiles) (int64, error) {
+	err := of.acquire()
+	if err != nil {
+		return 0, err
+	}
+
+	defer of.release()
+
+	file, err := createTempFile("", tmpPartPattern)
+	if err != nil {
+		return 0, err
+	}
+
+	// remember the file first, so it's removed even if the copy fails
+	f.tmpfile = file.Name()
+
+	var dst io.Writer = file
+	if f.space != nil {
+		qw := &quotaWriter{w: file, space: f.space}
+		defer func() { f.reserved = qw.n }()
+		dst = qw
+	}
+
+	size, err := io.Copy(dst, io.MultiReader(buf, rest))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	return size, err
+}
+
+// mimeHeaderSize is the memory accounted for the part header, the same estimate net/http uses.
+func mimeHeaderSize(header textproto.MIMEHeader) int64 {
+	size := int64(400)
+	for k, vs := range header {
+		size += int64(len(k)) + mapEntryOverhead
+		for _, v := range vs {
+			size += int64(len(v))
+		}
+	}
+
+	return size
+}
+
+// headerEntries returns the number of the header entries, the way net/http counts them towards the form limit.
+func headerEntries(header textproto.MIMEHeader) int64 {
+	n := int64(0)
+	for _, vs := range header {
+		n += int64(len(vs))
+	}
+
+	return n
+}
+
+// partError classifies the error of reading the parts. The body read limits and the temp files errors are left to
+// asParseError, any other error comes from the malformed multipart body.
+func partError(err error) error {
+	var pe *ParseError
+	var mbe *http.MaxBytesError
+	var fe *fs.PathError
+	switch {
+	case stderr.As(err, &pe), stderr.As(err, &mbe), stderr.As(err, &fe), isTempQuotaErr(err):
+		return err
+	case stderr.Is(err, os.ErrDeadlineExceeded), stderr.Is(err, multipart.ErrMessageTooLarge):
+		return err
+	default:
+		return multipartErr(err)
+	}
+}
+
+// multipartErr is the error of the malformed multipart body.
+func multipartErr(err error) *ParseError {
+	return newParseError(ParseErrorMalformed, err).with(ParseErrorCodeMalformedMultipart, "")
+}
+
+func valueTooLargeErr(name string, limit int64) error {
+	return newParseError(ParseErrorBodyTooLarge, errors.Errorf("multipart value '%s' exceeds the size limit of %d bytes", name, limit)).
+		with(ParseErrorCodeValueTooLarge, fmt.Sprintf("send the '%s' field value of at most %d bytes", name, limit))
+}
+
+// partContentLength returns the declared size of the part, -1 if the part has no Content-Length.
+func partContentLength(header textproto.MIMEHeader) (int64, error) {
+	v := header.Get("Content-Length")
+	if v == "" {
+		return -1, nil
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return 0, multipartErr(errors.Errorf("invalid multipart part Content-Length: %q", v))
+	}
+
+	return n, nil
+}
+
+// checkSize rejects the file read over the maximum size, and verifies the declared size of the part against the
+// bytes actually read.
+func (f *filePart) checkSize(declared, maxFileSize int64) error {
+	if maxFileSize > 0 && f.size > maxFileSize {
+		f.reject(UploadErrorIniSize)
+		return nil
+	}
+
+	if declared >= 0 && f.size != declared {
+		return multipartErr(errors.Errorf("multipart part Content-Length %d doesn't match the %d bytes read", declared, f.size))
+	}
+
+	return nil
+}
+
+// reject drops the content of the file already read.
+func (f *filePart) reject(code int) {
+	f.rejected = code
+	f.content = nil
+	f.size = 0
+	if f.tmpfile != "" {
+		_ = os.Remove(f.tmpfile)
+		f.tmpfile = ""
+		f.free()
+	}
+}
+
+// free releases the temp space of the removed temp file.
+func (f *filePart) free() {
+	f.space.free(f.reserved)
+	f.reserved = 0
+}
+
+// removeAll removes the temp files of the form.
+func (mf *multipartForm) removeAll() error {
+	var err error
+	for _, fps := range mf.files {
+		for _, fp := range fps {
+			if fp.tmpfile == "" {
+				continue
+			}
+
+			e := os.Remove(fp.tmpfile)
+			if e != nil && !stderr.Is(e, os.ErrNotExist) && err == nil {
+				err = e
+			}
+			fp.free()
+		}
+	}
+
+	return err
+}
+
+// checkPartHeaders rejects the part with the duplicate framing headers, or keeps only their first occurrence. The
+// framing headers define how the part is interpreted, so a part carrying any of them more than once is ambiguous.
+func checkPartHeaders(header textproto.MIMEHeader, opts *multipartOptions, warnings *parseWarnings) error {
+	for _, k := range [...]string{"Content-Disposition", "Content-Type", "Content-Transfer-Encoding", "Content-Length"} {
+		if len(header[k]) < 2 {
+			continue
+		}
+
+		if !opts.firstDuplicateHeader {
+			return multipartErr(errors.Errorf("duplicate %s header in the multipart part", k))
+		}
+
+		warnings.add(ParseWarningDuplicatePartHeader, "duplicate %s header in the multipart part, the first one is used", k)
+		header[k] = header[k][:1]
+	}
+
+	return nil
+}
+
+// partNames returns the form name and the file name of the part, and whether the form name should be used as
+// a literal key.
+func partNames(p *multipart.Part, opts *multipartOptions) (string, string, bool) {
+	if !opts.literalQuotedNames {
+		return p.FormName(), p.FileName(), false
+	}
+
+	disposition := p.Header.Get("Content-Disposition")
+	name, quoted, ok := dispositionParam(disposition, "name")
+	if !ok {
+		return "", "", false
+	}
+
+	if quoted {
+		// mime parser handles the escaping
+		return p.FormName(), p.FileName(), true
+	}
+
+	// mime parser rejects the whole header because of the brackets in the name, so the filename is taken as is
+	filename, _, _ := dispositionParam(disposition, "filename")
+	if filename != "" {
+		filename = filepath.Base(strings.Trim(filename, `"`))
+	}
+
+	return name, filename, false
+}
+
+// hasFilenameParam reports whether the Content-Disposition of the part has the filename parameter, including the
+// empty one.
+func hasFilenameParam(header textproto.MIMEHeader) bool {
+	disposition := header.Get("Content-Disposition")
+	_, params, err := mime.ParseMediaType(disposition)
+	if err != nil {
+		_, _, ok := dispositionParam(disposition, "filename")
+		return ok
+	}
+
+	_, ok := params["filename"]
+	return ok
+}
+
+// dispositionParam extracts the parameter from the form-data Content-Disposition header and reports whether it was
+// quoted. Unlike mime.ParseMediaType, it accepts the unquoted values with brackets (name=key[a][b]) which are not
+// valid tokens. Quoted values are returned with the quotes and are expected to be taken from the mime parser.
+func dispositionParam(v, name string) (string, bool, bool) {
+	params := strings.Split(v, ";")
+	if !strings.EqualFold(strings.TrimSpace(params[0]), "form-data") {
+		return "", false, false
+	}
+
+	for _, param := range params[1:] {
+		key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found || !strings.EqualFold(strings.TrimSpace(key), name) {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		return value, strings.HasPrefix(value, `"`), value != ""
+	}
+
+	return "", false, false
+}
@@ -0,0 +1,1307 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/roadrunner-server/http/v5/config"
+	"github.com/roadrunner-server/http/v5/handler/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadMultipart_Spill(t *testing.T) {
+	r := handlertest.NewMultipart().
+		Field("name", "value").
+		File("small", "small.txt", "text/plain", []byte("abc")).
+		File("big", "big.txt", "text/plain", []byte("0123456789abcdef")).
+		Request(http.MethodPost, "/")
+
+	form, err := readMultipart(r, &multipartOptions{maxMemory: 10}, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"value"}, form.values["name"])
+	require.Len(t, form.files["small"], 1)
+	require.Len(t, form.files["big"], 1)
+
+	small := form.files["small"][0]
+	assert.Empty(t, small.tmpfile)
+	assert.Equal(t, int64(3), small.size)
+
+	big := form.files["big"][0]
+	require.NotEmpty(t, big.tmpfile)
+	assert.Equal(t, int64(16), big.size)
+
+	f, err := big.Open()
+	require.NoError(t, err)
+	content, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, "0123456789abcdef", string(content))
+
+	require.NoError(t, form.removeAll())
+	_, err = os.Stat(big.tmpfile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// TestReadMultipart_StdlibParity reads the same forms with the net/http parser and with readMultipart, the limits
+// and the memory accounting must give the same results.
+func TestReadMultipart_StdlibParity(t *testing.T) {
+	fill := func(n int) []byte {
+		return bytes.Repeat([]byte("a"), n)
+	}
+
+	fields := func(n int) *handlertest.Multipart {
+		mp := handlertest.NewMultipart()
+		for i := range n {
+			mp.Field("f"+strconv.Itoa(i), "v")
+		}
+
+		return mp
+	}
+
+	for _, tt := range []struct {
+		name      string
+		maxMemory int64
+		form      *handlertest.Multipart
+		// the files expected to be stored on disk
+		disk []string
+	}{
+		{
+			name:      "memory",
+			maxMemory: 10,
+			form: handlertest.NewMultipart().
+				Field("a", "1").
+				Field("b", "2").
+				Field("b", "3").
+				File("small", "small.txt", "text/plain", fill(3)).
+				File("other", "other.txt", "text/plain", fill(5)),
+		},
+		{
+			name:      "spill",
+			maxMemory: 10,
+			form: handlertest.NewMultipart().
+				File("f1", "f1.bin", "application/octet-stream", fill(6)).
+				File("f2", "f2.bin", "application/octet-stream", fill(6)).
+				File("f3", "f3.bin", "application/octet-stream", fill(4)),
+			disk: []string{"f2"},
+		},
+		{name: "parts limit", maxMemory: 10, form: fields(maxMultipartParts)},
+		{name: "parts over the limit", maxMemory: 10, form: fields(maxMultipartParts + 1)},
+		{
+			name: "value over the limit",
+			form: handlertest.NewMultipart().Field("a", string(fill(maxValueExtraBytes+1))),
+		},
+		{
+			name: "value metadata over the limit",
+			form: handlertest.NewMultipart().
+				Field("a", string(fill(maxValueExtraBytes-300))).
+				Field("b", ""),
+		},
+		{
+			name: "file metadata over the limit",
+			form: handlertest.NewMultipart().
+				Field("a", string(fill(maxValueExtraBytes-1000))).
+				File("f", "f.txt", "text/plain", nil),
+		},
+		{
+			name: "file headers over the limit",
+			form: func() *handlertest.Multipart {
+				mp := handlertest.NewMultipart()
+				headers := []string{`Content-Disposition: form-data; name="f"; filename="f.txt"`}
+				for i := range 10 {
+					headers = append(headers, "X-Meta-"+strconv.Itoa(i)+": v")
+				}
+
+				for range maxMultipartParts {
+					mp.Part(headers, []byte("a"))
+				}
+
+				return mp
+			}(),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, params, err := mime.ParseMediaType(tt.form.ContentType())
+			require.NoError(t, err)
+
+			std, stdErr := multipart.NewReader(bytes.NewReader(tt.form.Bytes()), params["boundary"]).ReadForm(tt.maxMemory)
+			form, err := readMultipart(tt.form.Request(http.MethodPost, "/"), &multipartOptions{maxMemory: tt.maxMemory}, nil)
+
+			if stdErr != nil {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), stdErr.Error())
+				return
+			}
+
+			require.NoError(t, err)
+			defer func() {
+				_ = std.RemoveAll()
+				_ = form.removeAll()
+			}()
+
+			assert.Equal(t, std.Value, form.values)
+			require.Len(t, form.files, len(std.File))
+			for name, fhs := range std.File {
+				require.Len(t, form.files[name], len(fhs))
+				for i, fh := range fhs {
+					fp := form.files[name][i]
+					assert.Equal(t, fh.Filename, fp.filename)
+					assert.Equal(t, fh.Size, fp.size)
+					assert.Equal(t, slices.Contains(tt.disk, name), fp.tmpfile != "", name)
+				}
+			}
+		})
+	}
+}
+
+func TestRequest_LiteralQuotedNames(t *testing.T) {
+	mp := handlertest.NewMultipart().
+		Part([]string{`Content-Disposition: form-data; name="weird[literal]"`}, []byte("1")).
+		Part([]string{`Content-Disposition: form-data; name=arr[a][b]`}, []byte("2")).
+		Part([]string{`Content-Disposition: form-data; name=files[x]; filename="f.txt"`}, []byte("3")).
+		Part([]string{`Content-Disposition: form-data; name="file[literal]"; filename="g.txt"`}, []byte("4"))
+
+	t.Run("enabled", func(t *testing.T) {
+		r := mp.Request(http.MethodPost, "/")
+		h, _ := newTestHandler(t, &config.Config{Parse: &config.Parse{LiteralQuotedNames: true}})
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		defer req.Close(nil, r)
+
+		assert.Equal(t, dataTree{
+			"weird[literal]": "1",
+			"arr": dataTree{
+				"a": dataTree{"b": "2"},
+			},
+		}, req.body)
+
+		require.Len(t, req.Uploads.list, 2)
+		assert.Contains(t, req.Uploads.tree, "file[literal]")
+		require.Contains(t, req.Uploads.tree, "files")
+		assert.Equal(t, "f.txt", req.Uploads.tree["files"].(fileTree)["x"].(*FileUpload).Name)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		r := mp.Request(http.MethodPost, "/")
+		h, _ := newTestHandler(t, &config.Config{})
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		defer req.Close(nil, r)
+
+		// unquoted names with the brackets are not valid for the mime parser and are skipped
+		assert.Equal(t, dataTree{
+			"weird": dataTree{"literal": "1"},
+		}, req.body)
+		require.Len(t, req.Uploads.list, 1)
+		assert.Contains(t, req.Uploads.tree, "file")
+	})
+}
+
+func TestRequest_DuplicatePartHeaders(t *testing.T) {
+	mp := handlertest.NewMultipart().
+		Part([]string{
+			`Content-Disposition: form-data; name="first"`,
+			`Content-Disposition: form-data; name="second"`,
+		}, []byte("1")).
+		Part([]string{
+			`Content-Disposition: form-data; name="upload"; filename="a.txt"`,
+			`Content-Type: text/plain`,
+			`Content-Type: application/x-php`,
+		}, []byte("2"))
+
+	t.Run("reject", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, mp.Request(http.MethodPost, "/"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Nil(t, p.pld)
+	})
+
+	t.Run("first", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{DuplicatePartHeaders: config.DuplicatePartHeadersFirst}})
+
+		r := mp.Request(http.MethodPost, "/")
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		defer req.Close(nil, r)
+
+		assert.Equal(t, dataTree{"first": "1"}, req.body)
+		require.Len(t, req.Uploads.list, 1)
+		assert.Equal(t, "text/plain", req.Uploads.list[0].Mime)
+	})
+}
+
+func TestRequest_EmptyFilename(t *testing.T) {
+	mp := handlertest.NewMultipart().
+		Part([]string{`Content-Disposition: form-data; name="avatar"; filename=""`, `Content-Type: application/octet-stream`}, []byte("smuggled")).
+		Part([]string{`Content-Disposition: form-data; name="doc"; filename="a.txt"`}, []byte("file")).
+		Part([]string{`Content-Disposition: form-data; name="note"`, `Content-Type: text/plain`}, []byte("value"))
+
+	testCases := []struct {
+		policy  string
+		body    dataTree
+		uploads []string
+		errors  []int
+	}{
+		{policy: "", body: dataTree{"avatar": "smuggled", "note": "value"}, uploads: []string{"a.txt"}, errors: []int{UploadErrorOK}},
+		{policy: config.EmptyFilenameFile, body: dataTree{"note": "value"}, uploads: []string{"", "a.txt"}, errors: []int{UploadErrorNoFile, UploadErrorOK}},
+	}
+
+	for _, tt := range testCases {
+		t.Run("policy "+tt.policy, func(t *testing.T) {
+			cfg := &config.Parse{EmptyFilename: tt.policy}
+			require.NoError(t, cfg.InitDefaults())
+			h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: cfg, Uploads: &config.Uploads{Dir: t.TempDir()}})
+
+			r := mp.Request(http.MethodPost, "/")
+			req := newTestRequest(r)
+			require.NoError(t, h.request(r, req))
+			defer req.Close(nil, r)
+
+			assert.Equal(t, tt.body, req.body)
+			require.Len(t, req.Uploads.list, len(tt.uploads))
+			for i := range tt.uploads {
+				assert.Equal(t, tt.uploads[i], req.Uploads.list[i].Name)
+				assert.Equal(t, tt.errors[i], req.Uploads.list[i].Error)
+			}
+		})
+	}
+
+	t.Run("policy reject", func(t *testing.T) {
+		cfg := &config.Parse{EmptyFilename: config.EmptyFilenameReject}
+		require.NoError(t, cfg.InitDefaults())
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: cfg})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, mp.Request(http.MethodPost, "/"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Nil(t, p.pld)
+
+		// the forms without the empty filenames are accepted
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewMultipart().Field("note", "value").Request(http.MethodPost, "/"))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+}
+
+func TestRequest_MultipartLineEndings(t *testing.T) {
+	lf := handlertest.NewMultipart().Boundary("B").Newline("\n").
+		Field("a", "1").
+		File("doc", "a.txt", "text/plain", []byte("x\r\ny\n"))
+	// the second boundary ends with LF, the first one with CRLF
+	mixed := "--B\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n1\n--B\nContent-Disposition: form-data; name=\"b\"\n\n2\r\n--B--\r\n"
+
+	testCases := []struct {
+		mode  string
+		body  string
+		want  dataTree
+		file  string
+		isErr bool
+	}{
+		{mode: config.MultipartLineEndingsAuto, body: string(lf.Bytes()), want: dataTree{"a": "1"}, file: "x\r\ny\n"},
+		{mode: config.MultipartLineEndingsLenient, body: string(lf.Bytes()), want: dataTree{"a": "1"}, file: "x\r\ny\n"},
+		{mode: config.MultipartLineEndingsStrict, body: string(lf.Bytes()), isErr: true},
+		// the LF boundary is a part of the first value
+		{mode: config.MultipartLineEndingsAuto, body: mixed, want: dataTree{"a": "1\n--B\nContent-Disposition: form-data; name=\"b\"\n\n2"}},
+		{mode: config.MultipartLineEndingsLenient, body: mixed, want: dataTree{"a": "1", "b": "2"}},
+		{mode: config.MultipartLineEndingsStrict, body: mixed, isErr: true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg := &config.Parse{MultipartLineEndings: tt.mode}
+			require.NoError(t, cfg.InitDefaults())
+			h, _ := newTestHandler(t, &config.Config{Parse: cfg, Uploads: &config.Uploads{Dir: t.TempDir()}})
+
+			r := handlertest.NewRawRequest(http.MethodPost, "/", "multipart/form-data; boundary=B", []byte(tt.body))
+			req := newTestRequest(r)
+			err := h.request(r, req)
+			defer req.Close(nil, r)
+
+			if tt.isErr {
+				pe := asParseError(err)
+				require.NotNil(t, pe, "%v", err)
+				assert.Equal(t, http.StatusBadRequest, pe.Status)
+				assert.Equal(t, ParseErrorCodeMalformedMultipart, pe.Code)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, req.body)
+			if tt.file == "" {
+				return
+			}
+
+			require.Len(t, req.Uploads.list, 1)
+			req.Open(nil, h.uploads.dir, nil, nil)
+			b, err := os.ReadFile(req.Uploads.list[0].TempFilename)
+			require.NoError(t, err)
+			assert.Equal(t, tt.file, string(b))
+		})
+	}
+}
+
+func TestRequest_MultipartTrailingData(t *testing.T) {
+	form := handlertest.NewMultipart().Boundary("B").Field("a", "1").Bytes()
+	junk := append(append([]byte{}, form...), "\r\nPOST /admin HTTP/1.1\r\n"...)
+	blank := append(append([]byte{}, form...), " \r\n\r\n"...)
+
+	for _, mode := range []string{config.MultipartTrailingDataIgnore, config.MultipartTrailingDataReject} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := &config.Parse{MultipartTrailingData: mode}
+			require.NoError(t, cfg.InitDefaults())
+			h, _ := newTestHandler(t, &config.Config{Parse: cfg, Uploads: &config.Uploads{Dir: t.TempDir()}})
+
+			parse := func(body []byte) (*Request, error) {
+				r := handlertest.NewRawRequest(http.MethodPost, "/", "multipart/form-data; boundary=B", body)
+				req := newTestRequest(r)
+				err := h.request(r, req)
+				req.Close(nil, r)
+				return req, err
+			}
+
+			// the whitespace after the closing boundary is always accepted
+			req, err := parse(blank)
+			require.NoError(t, err)
+			assert.Equal(t, dataTree{"a": "1"}, req.body)
+
+			req, err = parse(junk)
+			if mode == config.MultipartTrailingDataIgnore {
+				require.NoError(t, err)
+				assert.Equal(t, dataTree{"a": "1"}, req.body)
+				return
+			}
+
+			pe := asParseError(err)
+			require.NotNil(t, pe, "%v", err)
+			assert.Equal(t, http.StatusBadRequest, pe.Status)
+			assert.Equal(t, ParseErrorCodeMalformedMultipart, pe.Code)
+		})
+	}
+}
+
+func TestRequest_PartsManifest(t *testing.T) {
+	mp := handlertest.NewMultipart().
+		Field("a", "1").
+		File("f[]", "a.txt", "text/plain", []byte("hello")).
+		Field("b", "22").
+		File("f[]", "x.php", "text/plain", []byte("<?php")).
+		Field("a", "333")
+
+	for _, enabled := range []bool{false, true} {
+		t.Run(strconv.FormatBool(enabled), func(t *testing.T) {
+			h, _ := newTestHandler(t, &config.Config{
+				Parse:   &config.Parse{PartsManifest: enabled},
+				Uploads: &config.Uploads{Dir: t.TempDir(), Forbid: []string{".php"}},
+			})
+
+			r := mp.Request(http.MethodPost, "/")
+			req := newTestRequest(r)
+			require.NoError(t, h.request(r, req))
+			defer req.Close(nil, r)
+
+			// the trees group the parts by their names
+			assert.Equal(t, dataTree{"a": "333", "b": "22"}, req.body)
+			if !enabled {
+				assert.NotContains(t, req.Attributes, PartsManifestAttribute)
+				return
+			}
+
+			require.Contains(t, req.Attributes, PartsManifestAttribute)
+			var parts []manifestPart
+			require.NoError(t, json.Unmarshal([]byte(req.Attributes[PartsManifestAttribute][0]), &parts))
+			assert.Equal(t, []manifestPart{
+				{Name: "a", Size: 1},
+				{Name: "f[]", Filename: "a.txt", ContentType: "text/plain", Size: 5},
+				{Name: "b", Size: 2},
+				// the forbidden file is never read
+				{Name: "f[]", Filename: "x.php", ContentType: "text/plain"},
+				{Name: "a", Size: 3},
+			}, parts)
+		})
+	}
+}
+
+func TestRequest_RepeatedFileKeys(t *testing.T) {
+	form := func(n int) *handlertest.Multipart {
+		mp := handlertest.NewMultipart()
+		for i := range n {
+			mp.File("file", strconv.Itoa(i)+".txt", "text/plain", []byte("x"))
+		}
+
+		return mp
+	}
+
+	testCases := []struct {
+		policy string
+		parts  int
+		want   []string
+		list   bool
+	}{
+		{policy: "", parts: 2, want: []string{"1.txt"}},
+		{policy: config.RepeatedFileKeysLast, parts: 3, want: []string{"2.txt"}},
+		{policy: config.RepeatedFileKeysFirst, parts: 2, want: []string{"0.txt"}},
+		{policy: config.RepeatedFileKeysFirst, parts: 3, want: []string{"0.txt"}},
+		{policy: config.RepeatedFileKeysArray, parts: 2, want: []string{"0.txt", "1.txt"}, list: true},
+		{policy: config.RepeatedFileKeysArray, parts: 3, want: []string{"0.txt", "1.txt", "2.txt"}, list: true},
+		// a single part stays a single file
+		{policy: config.RepeatedFileKeysArray, parts: 1, want: []string{"0.txt"}},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.policy+" "+strconv.Itoa(tt.parts), func(t *testing.T) {
+			uploads := &config.Uploads{Dir: t.TempDir(), RepeatedFileKeys: tt.policy}
+			require.NoError(t, uploads.InitDefaults())
+			h, _ := newTestHandler(t, &config.Config{Uploads: uploads})
+
+			r := form(tt.parts).Request(http.MethodPost, "/")
+			req := newTestRequest(r)
+			require.NoError(t, h.request(r, req))
+			defer req.Close(nil, r)
+
+			names := make([]string, 0, len(req.Uploads.list))
+			for _, f := range req.Uploads.list {
+				names = append(names, f.Name)
+			}
+			assert.Equal(t, tt.want, names)
+
+			node := req.Uploads.tree["file"]
+			if tt.list {
+				require.IsType(t, []*FileUpload{}, node)
+				assert.Len(t, node, len(tt.want))
+				return
+			}
+
+			require.IsType(t, &FileUpload{}, node)
+			assert.Equal(t, tt.want[0], node.(*FileUpload).Name)
+		})
+	}
+
+	assert.Error(t, (&config.Uploads{RepeatedFileKeys: "all"}).InitDefaults())
+}
+
+func TestRequest_UploadErrorCodes(t *testing.T) {
+	t.Run("form size", func(t *testing.T) {
+		form := handlertest.NewMultipart().
+			File("before", "a.txt", "text/plain", []byte("12345")).
+			Field("MAX_FILE_SIZE", "3").
+			File("large", "b.txt", "text/plain", []byte("12345")).
+			Part([]string{`Content-Disposition: form-data; name="declared"; filename="c.txt"`, "Content-Length: 4"}, []byte("1234")).
+			File("small", "d.txt", "text/plain", []byte("123"))
+
+		for _, enabled := range []bool{true, false} {
+			uploads := &config.Uploads{Dir: t.TempDir(), FormMaxFileSize: enabled}
+			require.NoError(t, uploads.InitDefaults())
+			h, _ := newTestHandler(t, &config.Config{Uploads: uploads})
+
+			r := form.Request(http.MethodPost, "/")
+			req := newTestRequest(r)
+			require.NoError(t, h.request(r, req))
+
+			want := UploadErrorOK
+			if enabled {
+				want = UploadErrorFormSize
+			}
+
+			assert.Equal(t, UploadErrorOK, req.Uploads.tree["before"].(*FileUpload).Error)
+			assert.Equal(t, want, req.Uploads.tree["large"].(*FileUpload).Error)
+			assert.Equal(t, want, req.Uploads.tree["declared"].(*FileUpload).Error)
+			assert.Equal(t, UploadErrorOK, req.Uploads.tree["small"].(*FileUpload).Error)
+			req.Close(nil, r)
+		}
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		form := handlertest.NewMultipart().
+			Field("a", "1").
+			File("doc", "a.txt", "text/plain", bytes.Repeat([]byte("x"), 100))
+		body := form.Bytes()
+
+		uploads := &config.Uploads{Dir: t.TempDir(), PartialUploads: true}
+		require.NoError(t, uploads.InitDefaults())
+		h, _ := newTestHandler(t, &config.Config{Uploads: uploads})
+
+		r := handlertest.Truncate(form.Request(http.MethodPost, "/"), len(body)-50)
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		defer req.Close(nil, r)
+
+		doc := req.Uploads.tree["doc"].(*FileUpload)
+		assert.Equal(t, UploadErrorPartial, doc.Error)
+		assert.Zero(t, doc.Size)
+		assert.Equal(t, "1", req.body.(dataTree)["a"])
+		require.Len(t, req.form.warnings, 1)
+		assert.Equal(t, ParseWarningPartialUpload, req.form.warnings[0].Code)
+
+		// disabled, the truncated form is rejected
+		h, _ = newTestHandler(t, &config.Config{Uploads: &config.Uploads{Dir: t.TempDir()}})
+		r = handlertest.Truncate(form.Request(http.MethodPost, "/"), len(body)-50)
+		req = newTestRequest(r)
+		assert.Error(t, h.request(r, req))
+		req.Close(nil, r)
+	})
+}
+
+func TestRequest_ExpectedFiles(t *testing.T) {
+	uploads := &config.Uploads{Dir: t.TempDir(), ExpectedFiles: []string{"avatar", "docs[]", "meta[photo]"}}
+	require.NoError(t, uploads.InitDefaults())
+	h, _ := newTestHandler(t, &config.Config{Uploads: uploads})
+
+	r := handlertest.NewMultipart().
+		Field("name", "john").
+		File("docs[]", "a.txt", "text/plain", []byte("x")).
+		Request(http.MethodPost, "/")
+	req := newTestRequest(r)
+	require.NoError(t, h.request(r, req))
+	defer req.Close(nil, r)
+
+	require.IsType(t, &FileUpload{}, req.Uploads.tree["avatar"])
+	avatar := req.Uploads.tree["avatar"].(*FileUpload)
+	assert.Equal(t, UploadErrorNoFile, avatar.Error)
+	assert.Empty(t, avatar.Name)
+	assert.Empty(t, avatar.TempFilename)
+
+	// the uploaded field stays as it is
+	require.IsType(t, []*FileUpload{}, req.Uploads.tree["docs"])
+	docs := req.Uploads.tree["docs"].([]*FileUpload)
+	require.Len(t, docs, 1)
+	assert.Equal(t, UploadErrorOK, docs[0].Error)
+
+	require.IsType(t, fileTree{}, req.Uploads.tree["meta"])
+	assert.Equal(t, UploadErrorNoFile, req.Uploads.tree["meta"].(fileTree)["photo"].(*FileUpload).Error)
+	assert.Len(t, req.Uploads.list, 3)
+
+	// without the config the absent uploads stay absent
+	h, _ = newTestHandler(t, &config.Config{Uploads: &config.Uploads{Dir: t.TempDir()}})
+	r = handlertest.NewMultipart().Field("name", "john").Request(http.MethodPost, "/")
+	req = newTestRequest(r)
+	require.NoError(t, h.request(r, req))
+	defer req.Close(nil, r)
+	assert.Empty(t, req.Uploads.list)
+
+	assert.Error(t, (&config.Uploads{ExpectedFiles: []string{""}}).InitDefaults())
+}
+
+func TestRequest_MaxPartHeaderSize(t *testing.T) {
+	body := func(filename, newline string) []byte {
+		return handlertest.NewMultipart().Boundary("B").Newline(newline).
+			Field("a", "1").
+			File("doc", filename, "text/plain", []byte("x\r\ny\n")).
+			Bytes()
+	}
+
+	testCases := []struct {
+		name  string
+		mode  string
+		body  []byte
+		isErr bool
+	}{
+		// the header lines longer than the read buffer
+		{name: "long filename", body: body(strings.Repeat("a", 6000)+".txt", "\r\n")},
+		{name: "long filename lf", body: body(strings.Repeat("a", 6000)+".txt", "\n")},
+		{name: "lenient", mode: config.MultipartLineEndingsLenient, body: body(strings.Repeat("a", 6000)+".txt", "\n")},
+		{name: "huge filename", body: body(strings.Repeat("a", 10000)+".txt", "\r\n"), isErr: true},
+		{name: "huge filename strict", mode: config.MultipartLineEndingsStrict, body: body(strings.Repeat("a", 10000)+".txt", "\r\n"), isErr: true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Parse{MaxPartHeaderSize: 8 << 10, MultipartLineEndings: tt.mode}
+			require.NoError(t, cfg.InitDefaults())
+			h, _ := newTestHandler(t, &config.Config{Parse: cfg, Uploads: &config.Uploads{Dir: t.TempDir()}})
+
+			r := handlertest.NewRawRequest(http.MethodPost, "/", "multipart/form-data; boundary=B", tt.body)
+			req := newTestRequest(r)
+			err := h.request(r, req)
+			defer req.Close(nil, r)
+
+			if tt.isErr {
+				pe := asParseError(err)
+				require.NotNil(t, pe, "%v", err)
+				assert.Equal(t, http.StatusRequestEntityTooLarge, pe.Status)
+				assert.Equal(t, ParseErrorCodeHeaderTooLarge, pe.Code)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, dataTree{"a": "1"}, req.body)
+			require.Len(t, req.Uploads.list, 1)
+			req.Open(nil, h.uploads.dir, nil, nil)
+			b, err := os.ReadFile(req.Uploads.list[0].TempFilename)
+			require.NoError(t, err)
+			assert.Equal(t, "x\r\ny\n", string(b))
+		})
+	}
+
+	assert.Error(t, (&config.Parse{MaxPartHeaderSize: -1}).InitDefaults())
+}
+
+func TestRequest_StreamSingleUpload(t *testing.T) {
+	uploads := &config.Uploads{Forbid: []string{".php"}}
+	h, p := newTestHandler(t, &config.Config{
+		ParseErrorStatus: true,
+		Uploads:          uploads,
+		Parse:            &config.Parse{StreamSingleUpload: true},
+	})
+	// force the multi part files to be spilled
+	h.multipartOpts.maxMemory = 10
+
+	t.Run("single file", func(t *testing.T) {
+		r := handlertest.NewMultipart().
+			File("upload", "big.bin", "application/octet-stream", []byte("0123456789")).
+			Request(http.MethodPost, "/")
+
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		wr := p.request(t)
+		assert.False(t, wr.GetParsed())
+		assert.Empty(t, wr.GetUploads())
+		assert.Equal(t, "0123456789", string(p.pld.Body))
+		assert.Equal(t, [][]byte{[]byte("upload")}, wr.GetAttributes()[UploadFieldAttribute].GetValue())
+		assert.Equal(t, [][]byte{[]byte("big.bin")}, wr.GetAttributes()[UploadNameAttribute].GetValue())
+		assert.Equal(t, [][]byte{[]byte("application/octet-stream")}, wr.GetAttributes()[UploadMimeAttribute].GetValue())
+	})
+
+	t.Run("single file over the memory limit", func(t *testing.T) {
+		// the multipart reader spills the parts to the temp dir
+		tmp := t.TempDir()
+		t.Setenv("TMPDIR", tmp)
+
+		content := bytes.Repeat([]byte("0123456789"), 100)
+		r := handlertest.NewMultipart().
+			File("upload", "big.bin", "application/octet-stream", content).
+			Request(http.MethodPost, "/")
+
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		defer req.Close(nil, r)
+
+		// no spill file is left to remove after the request
+		entries, err := os.ReadDir(tmp)
+		require.NoError(t, err)
+		for _, e := range entries {
+			assert.False(t, isTempName(e.Name(), tmpPartPattern), e.Name())
+		}
+
+		assert.False(t, req.Parsed)
+		assert.Nil(t, req.Uploads)
+		assert.Equal(t, content, req.body)
+		assert.Equal(t, []string{"big.bin"}, req.Attributes[UploadNameAttribute])
+	})
+
+	t.Run("huge declared length", func(t *testing.T) {
+		r := handlertest.NewMultipart().
+			Part([]string{
+				`Content-Disposition: form-data; name="upload"; filename="big.bin"`,
+				"Content-Length: 9223372036854775000",
+			}, []byte("0123")).
+			Request(http.MethodPost, "/")
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("more parts", func(t *testing.T) {
+		r := handlertest.NewMultipart().
+			File("upload", "big.bin", "application/octet-stream", []byte("0123456789a")).
+			Field("key", "value").
+			Request(http.MethodPost, "/")
+
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		defer req.Close(nil, r)
+
+		assert.True(t, req.Parsed)
+		assert.Equal(t, dataTree{"key": "value"}, req.body)
+		require.Len(t, req.form.files["upload"], 1)
+		assert.NotEmpty(t, req.form.files["upload"][0].tmpfile)
+		assert.Equal(t, int64(11), req.form.files["upload"][0].size)
+	})
+
+	t.Run("forbidden file", func(t *testing.T) {
+		r := handlertest.NewMultipart().
+			File("upload", "index.php", "text/plain", []byte("<?php")).
+			Request(http.MethodPost, "/")
+
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		defer req.Close(nil, r)
+
+		assert.True(t, req.Parsed)
+		require.Len(t, req.Uploads.list, 1)
+		req.Open(nil, os.TempDir(), uploads.Forbidden, uploads.Allowed)
+		assert.Equal(t, UploadErrorExtension, req.Uploads.list[0].Error)
+	})
+}
+
+func TestReadMultipart_HeaderFilters(t *testing.T) {
+	r := handlertest.NewMultipart().
+		File("script", "run.php", "text/plain", []byte("<?php echo 1;")).
+		File("doc", "doc.pdf", "application/pdf", []byte("%PDF-1.7")).
+		File("image", "image.png", "image/png; name=image.png", []byte("png content")).
+		Request(http.MethodPost, "/")
+
+	// any accepted file is spilled to disk
+	form, err := readMultipart(r, &multipartOptions{
+		maxMemory: 1,
+		forbid:    map[string]struct{}{".php": {}},
+		allowMime: map[string]struct{}{"image/png": {}},
+	}, nil)
+	require.NoError(t, err)
+	defer func() {
+		_ = form.removeAll()
+	}()
+
+	for _, name := range []string{"script", "doc"} {
+		require.Len(t, form.files[name], 1)
+		fp := form.files[name][0]
+		assert.Equal(t, UploadErrorExtension, fp.rejected)
+		assert.Empty(t, fp.tmpfile)
+		assert.Nil(t, fp.content)
+	}
+
+	require.Len(t, form.files["image"], 1)
+	assert.Equal(t, UploadErrorOK, form.files["image"][0].rejected)
+	assert.NotEmpty(t, form.files["image"][0].tmpfile)
+
+	uploads, err := parseUploads(form, 0, 0, nil)
+	require.NoError(t, err)
+	uploads.Open(nil, t.TempDir(), nil, nil)
+	defer uploads.Clear(nil)
+
+	for _, f := range uploads.list {
+		if f.Name == "image.png" {
+			assert.Equal(t, UploadErrorOK, f.Error)
+			assert.Equal(t, int64(11), f.Size)
+			continue
+		}
+
+		assert.Equal(t, UploadErrorExtension, f.Error)
+		assert.Empty(t, f.TempFilename)
+	}
+}
+
+func TestReadMultipart_MaxValueSize(t *testing.T) {
+	opts := &multipartOptions{maxMemory: 1 << 20, maxValueSize: 8}
+
+	// the values at the limit and the files above it are accepted
+	form, err := readMultipart(handlertest.NewMultipart().
+		Field("short", "12345678").
+		File("upload", "upload.txt", "text/plain", []byte("0123456789abcdef")).
+		Request(http.MethodPost, "/"), opts, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"12345678"}, form.values["short"])
+	assert.Equal(t, int64(16), form.files["upload"][0].size)
+	_ = form.removeAll()
+
+	_, err = readMultipart(handlertest.NewMultipart().
+		Field("short", "1").
+		Field("comment", "123456789").
+		Request(http.MethodPost, "/"), opts, nil)
+	require.Error(t, err)
+	pe := asParseError(err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, pe.Status)
+	assert.Equal(t, ParseErrorCodeValueTooLarge, pe.Code)
+	assert.Contains(t, pe.Error(), "'comment'")
+	assert.Contains(t, pe.Hint, "'comment'")
+}
+
+func TestReadMultipart_PartContentLength(t *testing.T) {
+	part := func(name, contentLength, content string) ([]string, []byte) {
+		return []string{
+			`Content-Disposition: form-data; name="` + name + `"; filename="` + name + `.bin"`,
+			"Content-Type: application/octet-stream",
+			"Content-Length: " + contentLength,
+		}, []byte(content)
+	}
+
+	t.Run("limits", func(t *testing.T) {
+		r := handlertest.NewMultipart().
+			Part(part("declared_small", "3", "abc")).
+			Part(part("declared_big", "100", "0123456789")).
+			Part(part("declared_spill", "12", "0123456789ab")).
+			File("streamed_big", "streamed_big.bin", "application/octet-stream", []byte("0123456789abcdef")).
+			File("streamed_small", "streamed_small.bin", "application/octet-stream", []byte("abcd")).
+			Request(http.MethodPost, "/")
+
+		form, err := readMultipart(r, &multipartOptions{maxMemory: 10, maxFileSize: 12}, nil)
+		require.NoError(t, err)
+		defer func() {
+			_ = form.removeAll()
+		}()
+
+		small := form.files["declared_small"][0]
+		assert.Equal(t, UploadErrorOK, small.rejected)
+		assert.Equal(t, "abc", string(small.content))
+
+		// rejected before the content is read
+		big := form.files["declared_big"][0]
+		assert.Equal(t, UploadErrorIniSize, big.rejected)
+		assert.Nil(t, big.content)
+		assert.Empty(t, big.tmpfile)
+
+		// declared over the memory limit, written to the disk directly
+		spill := form.files["declared_spill"][0]
+		assert.Equal(t, UploadErrorOK, spill.rejected)
+		assert.Equal(t, int64(12), spill.size)
+		assert.NotEmpty(t, spill.tmpfile)
+
+		// no Content-Length, rejected once the limit is exceeded
+		streamed := form.files["streamed_big"][0]
+		assert.Equal(t, UploadErrorIniSize, streamed.rejected)
+		assert.Nil(t, streamed.content)
+		assert.Empty(t, streamed.tmpfile)
+
+		assert.Equal(t, UploadErrorOK, form.files["streamed_small"][0].rejected)
+		assert.Equal(t, "abcd", string(form.files["streamed_small"][0].content))
+	})
+
+	for _, tt := range []struct {
+		name          string
+		contentLength string
+		content       string
+	}{
+		{name: "shorter", contentLength: "5", content: "abc"},
+		{name: "longer", contentLength: "2", content: "abc"},
+		{name: "invalid", contentLength: "-1", content: "abc"},
+		{name: "spilled shorter", contentLength: "20", content: "0123456789ab"},
+		// the buffer is never presized over the memory limit, max_file_size is not set
+		{name: "absurd", contentLength: "9223372036854775807", content: "abc"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true})
+			h.multipartOpts.maxMemory = 10
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, handlertest.NewMultipart().Part(part("file", tt.contentLength, tt.content)).Request(http.MethodPost, "/"))
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Nil(t, p.pld)
+		})
+	}
+}
+
+func TestRequest_ImageDimensions(t *testing.T) {
+	encode := func(t *testing.T, format string, w, h int) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for i := range img.Pix {
+			// noise, so the encoded image is larger than the read buffers
+			img.Pix[i] = byte(i * 7 % 251)
+		}
+
+		var buf bytes.Buffer
+		switch format {
+		case "png":
+			require.NoError(t, png.Encode(&buf, img))
+		case "jpeg":
+			require.NoError(t, jpeg.Encode(&buf, img, nil))
+		}
+
+		return buf.Bytes()
+	}
+
+	pngContent := encode(t, "png", 300, 200)
+	jpegContent := encode(t, "jpeg", 640, 480)
+
+	h, _ := newTestHandler(t, &config.Config{Uploads: &config.Uploads{Dir: t.TempDir(), ImageDimensions: true}})
+	r := handlertest.NewMultipart().
+		File("png", "a.png", "image/png", pngContent).
+		File("jpeg", "b.jpg", "image/jpeg", jpegContent).
+		File("text", "c.txt", "text/plain", []byte("not an image")).
+		File("broken", "d.png", "image/png", pngContent[:20]).
+		Request(http.MethodPost, "/")
+
+	req := newTestRequest(r)
+	require.NoError(t, h.request(r, req))
+	req.Open(nil, h.uploads.dir, nil, nil)
+	defer req.Close(nil, r)
+
+	uploads := make(map[string]*FileUpload)
+	for _, f := range req.Uploads.list {
+		uploads[f.Name] = f
+	}
+
+	for name, tt := range map[string]struct {
+		content []byte
+		image   *ImageInfo
+	}{
+		"a.png": {content: pngContent, image: &ImageInfo{Format: "png", Width: 300, Height: 200}},
+		"b.jpg": {content: jpegContent, image: &ImageInfo{Format: "jpeg", Width: 640, Height: 480}},
+		"c.txt": {content: []byte("not an image")},
+		"d.png": {content: pngContent[:20]},
+	} {
+		f := uploads[name]
+		require.NotNil(t, f, name)
+		assert.Equal(t, UploadErrorOK, f.Error, name)
+		assert.Equal(t, tt.image, f.Image, name)
+		assert.Equal(t, int64(len(tt.content)), f.Size, name)
+
+		// the whole file is stored
+		stored, err := os.ReadFile(f.TempFilename)
+		require.NoError(t, err)
+		assert.Equal(t, tt.content, stored, name)
+	}
+}
+
+func TestRequest_UploadMime(t *testing.T) {
+	form := handlertest.NewMultipart().
+		File("declared", "a.txt", "Text/Plain; charset=UTF-8", []byte("<html><body>")).
+		Part([]string{`Content-Disposition: form-data; name="absent"; filename="b.bin"`}, []byte("%PDF-1.7")).
+		File("empty", "c.txt", "text/plain", nil)
+
+	for _, sniff := range []bool{false, true} {
+		h, _ := newTestHandler(t, &config.Config{Uploads: &config.Uploads{Dir: t.TempDir(), SniffMime: sniff}})
+		r := form.Request(http.MethodPost, "/")
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		req.Open(nil, h.uploads.dir, nil, nil)
+
+		declared := req.Uploads.tree["declared"].(*FileUpload)
+		absent := req.Uploads.tree["absent"].(*FileUpload)
+		empty := req.Uploads.tree["empty"].(*FileUpload)
+
+		// the declared type is passed verbatim, the missing one is the PHP default
+		assert.Equal(t, "Text/Plain; charset=UTF-8", declared.Mime)
+		assert.Equal(t, "application/octet-stream", absent.Mime)
+
+		if !sniff {
+			assert.Empty(t, declared.SniffedMime)
+			data, err := json.Marshal(req.Uploads)
+			require.NoError(t, err)
+			assert.NotContains(t, string(data), "sniffedMime")
+		} else {
+			assert.Equal(t, "text/html; charset=utf-8", declared.SniffedMime)
+			assert.Equal(t, "application/pdf", absent.SniffedMime)
+			assert.Equal(t, "text/plain; charset=utf-8", empty.SniffedMime)
+		}
+
+		// the content is stored as it is
+		stored, err := os.ReadFile(declared.TempFilename)
+		require.NoError(t, err)
+		assert.Equal(t, "<html><body>", string(stored))
+		req.Close(nil, r)
+	}
+}
+
+func TestRequest_TempFileNames(t *testing.T) {
+	const requests, files = 32, 8
+
+	dir := t.TempDir()
+	h, _ := newTestHandler(t, &config.Config{Uploads: &config.Uploads{Dir: dir, TempPattern: "up-*.tmp"}})
+	name := regexp.MustCompile(`^up-[0-9a-f]{32}\.tmp$`)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := make(map[string]struct{}, requests*files)
+	reqs := make([]*Request, requests)
+	hrs := make([]*http.Request, requests)
+
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			mp := handlertest.NewMultipart()
+			for j := range files {
+				mp.File("f[]", "f"+strconv.Itoa(j)+".txt", "text/plain", []byte("content"))
+			}
+
+			hrs[i] = mp.Request(http.MethodPost, "/")
+			reqs[i] = newTestRequest(hrs[i])
+			if !assert.NoError(t, h.request(hrs[i], reqs[i])) {
+				return
+			}
+			reqs[i].Open(nil, h.uploads.dir, nil, nil)
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, f := range reqs[i].Uploads.list {
+				assert.Equal(t, UploadErrorOK, f.Error)
+				assert.Equal(t, dir, filepath.Dir(f.TempFilename))
+				assert.Regexp(t, name, filepath.Base(f.TempFilename))
+				seen[f.TempFilename] = struct{}{}
+			}
+		}()
+	}
+
+	wg.Wait()
+	// the files are kept until all the requests are done, so any collision would have shown
+	assert.Len(t, seen, requests*files)
+	for i := range reqs {
+		reqs[i].Close(nil, hrs[i])
+	}
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestRequest_MaxFileNestingDepth(t *testing.T) {
+	h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Uploads: &config.Uploads{Dir: t.TempDir(), MaxFileNestingDepth: 2}})
+
+	r := handlertest.NewMultipart().
+		Field("data[a][b][c]", "deep").
+		File("doc", "a.txt", "text/plain", []byte("a")).
+		File("docs[]", "b.txt", "text/plain", []byte("b")).
+		File("files[x]", "c.txt", "text/plain", []byte("c")).
+		Request(http.MethodPost, "/")
+	req := newTestRequest(r)
+	require.NoError(t, h.request(r, req))
+	assert.Len(t, req.Uploads.list, 3)
+	assert.Equal(t, dataTree{"data": dataTree{"a": dataTree{"b": dataTree{"c": "deep"}}}}, req.body)
+	req.Close(nil, r)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, handlertest.NewMultipart().
+		File("files[a][b]", "d.txt", "text/plain", []byte("d")).
+		Request(http.MethodPost, "/"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "file field 'files' exceeds the maximum file nesting depth 2")
+}
+
+func TestRequest_MaxSiblingsPerNode(t *testing.T) {
+	h, _ := newTestHandler(t, &config.Config{
+		ParseErrorStatus: true,
+		Parse:            &config.Parse{MaxSiblingsPerNode: 2},
+		Uploads:          &config.Uploads{Dir: t.TempDir()},
+	})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, handlertest.NewMultipart().
+		Field("a", "1").
+		File("docs[0]", "a.txt", "text/plain", []byte("a")).
+		File("docs[1]", "b.txt", "text/plain", []byte("b")).
+		File("docs[2]", "c.txt", "text/plain", []byte("c")).
+		Request(http.MethodPost, "/"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "field 'docs' has more than 2 children")
+
+	r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"k[0]": {"1"}, "k[1]": {"1"}, "k[2]": {"1"}})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "field 'k' has more than 2 children")
+}
+
+func TestRequest_UploadMetadata(t *testing.T) {
+	h, p := newTestHandler(t, &config.Config{Uploads: &config.Uploads{Dir: t.TempDir()}})
+
+	r := handlertest.NewMultipart().
+		File("avatar", "a.png", "image/png", []byte("png")).
+		File("docs[]", "d.pdf", "application/pdf", []byte("%PDF")).
+		Request(http.MethodPost, "/users/42/files")
+	r.Header.Set("X-User-Id", "42")
+
+	// no extractor, no metadata
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.NotContains(t, string(p.request(t).GetUploads()), "metadata")
+
+	h.SetUploadMetadataExtractor(UploadMetadataFunc(func(r *http.Request) map[string]string {
+		return map[string]string{"user": r.Header.Get("X-User-Id"), "route": r.URL.Path}
+	}))
+
+	r = handlertest.NewMultipart().
+		File("avatar", "a.png", "image/png", []byte("png")).
+		File("docs[]", "d.pdf", "application/pdf", []byte("%PDF")).
+		Request(http.MethodPost, "/users/42/files")
+	r.Header.Set("X-User-Id", "42")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var uploads struct {
+		Avatar FileUpload   `json:"avatar"`
+		Docs   []FileUpload `json:"docs"`
+	}
+	require.NoError(t, json.Unmarshal(p.request(t).GetUploads(), &uploads))
+	want := map[string]string{"user": "42", "route": "/users/42/files"}
+	assert.Equal(t, want, uploads.Avatar.Metadata)
+	require.Len(t, uploads.Docs, 1)
+	assert.Equal(t, want, uploads.Docs[0].Metadata)
+}
+
+func TestRequest_Related(t *testing.T) {
+	cts := []*config.ContentType{{Pattern: "multipart/related", Parser: config.ParserRelated}}
+	envelope := []byte(`<soap:Envelope><xop:Include href="cid:img@x"/></soap:Envelope>`)
+	img := []byte("png image")
+	dicom := []byte("dicom instance")
+
+	body := handlertest.NewMultipart().
+		Boundary("rel").
+		Part([]string{`Content-Type: application/xop+xml; type="text/xml"`, "Content-ID: <root@x>"}, envelope).
+		Part([]string{"Content-Type: image/png", "Content-ID: <img@x>"}, img).
+		Part([]string{"Content-Type: application/dicom"}, dicom).
+		Bytes()
+
+	newRequest := func(params string, body []byte) *http.Request {
+		return handlertest.NewRawRequest(http.MethodPost, "/", "multipart/related; boundary=rel"+params, body)
+	}
+
+	partContent := func(t *testing.T, req *Request, key string) (string, []byte) {
+		f, ok := req.Uploads.tree[key].(*FileUpload)
+		require.True(t, ok, key)
+		require.Equal(t, UploadErrorOK, f.Error)
+
+		content, err := os.ReadFile(f.TempFilename)
+		require.NoError(t, err)
+		return f.Mime, content
+	}
+
+	newHandler := func(t *testing.T) *Handler {
+		h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Uploads: &config.Uploads{Dir: t.TempDir()}, Parse: &config.Parse{ContentTypes: cts}})
+		return h
+	}
+
+	t.Run("root is the first part", func(t *testing.T) {
+		h := newHandler(t)
+
+		r := newRequest(`; type="application/xop+xml"`, body)
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		req.Open(nil, h.uploads.dir, nil, nil)
+		defer req.Close(nil, r)
+
+		assert.False(t, req.Parsed)
+		assert.Equal(t, envelope, req.body)
+		assert.Equal(t, []string{"root@x"}, req.Attributes[RelatedRootAttribute])
+		assert.Equal(t, []string{`application/xop+xml; type="text/xml"`}, req.Attributes[RelatedTypeAttribute])
+		assert.Len(t, req.Uploads.tree, 2)
+
+		mimeType, content := partContent(t, req, "img@x")
+		assert.Equal(t, "image/png", mimeType)
+		assert.Equal(t, img, content)
+
+		// the parts without Content-ID are keyed by their position
+		mimeType, content = partContent(t, req, "2")
+		assert.Equal(t, "application/dicom", mimeType)
+		assert.Equal(t, dicom, content)
+	})
+
+	t.Run("start parameter", func(t *testing.T) {
+		h := newHandler(t)
+
+		r := newRequest(`; start="<img@x>"; type="image/png"`, body)
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		req.Open(nil, h.uploads.dir, nil, nil)
+		defer req.Close(nil, r)
+
+		assert.Equal(t, img, req.body)
+		assert.Equal(t, []string{"img@x"}, req.Attributes[RelatedRootAttribute])
+
+		_, content := partContent(t, req, "root@x")
+		assert.Equal(t, envelope, content)
+		assert.NotContains(t, req.Uploads.tree, "img@x")
+	})
+
+	t.Run("root over the memory limit", func(t *testing.T) {
+		h := newHandler(t)
+		h.multipartOpts.maxMemory = 10
+
+		r := newRequest("", body)
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		req.Open(nil, h.uploads.dir, nil, nil)
+		defer req.Close(nil, r)
+
+		assert.Nil(t, req.body)
+		assert.Equal(t, []string{"root@x"}, req.Attributes[RelatedRootAttribute])
+
+		_, content := partContent(t, req, "root@x")
+		assert.Equal(t, envelope, content)
+	})
+
+	t.Run("worker payload", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Uploads: &config.Uploads{Dir: t.TempDir()}, Parse: &config.Parse{ContentTypes: cts}})
+
+		h.ServeHTTP(httptest.NewRecorder(), newRequest("", body))
+		require.NotNil(t, p.pld)
+		assert.Equal(t, envelope, p.pld.Body)
+		assert.False(t, p.request(t).Parsed)
+		assert.Contains(t, string(p.request(t).Uploads), `"img@x":{"name":"","mime":"image/png","size":9`)
+	})
+
+	testCases := []struct {
+		name   string
+		params string
+		body   []byte
+	}{
+		{name: "missing start part", params: `; start="<none@x>"`, body: body},
+		{name: "no parts", body: []byte("--rel--\r\n")},
+		{
+			name: "duplicate content id",
+			body: handlertest.NewMultipart().Boundary("rel").
+				Part([]string{"Content-ID: <a>"}, []byte("1")).
+				Part([]string{"Content-ID: <a>"}, []byte("2")).
+				Bytes(),
+		},
+		{name: "unclosed", body: handlertest.NewMultipart().Boundary("rel").Part([]string{"Content-ID: <a>"}, []byte("1")).Unclosed().Bytes()},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Uploads: &config.Uploads{Dir: t.TempDir()}, Parse: &config.Parse{ContentTypes: cts}})
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newRequest(tt.params, tt.body))
+			assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+			assert.Nil(t, p.pld)
+		})
+	}
+
+	t.Run("opaque without the parser", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true})
+
+		r := newRequest("", body)
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Equal(t, body, req.body)
+		assert.Nil(t, req.Uploads)
+	})
+}
+
+func TestRequest_OutOfOrderFileIndexes(t *testing.T) {
+	r := handlertest.NewMultipart().
+		File("docs[2]", "c.txt", "text/plain", []byte("c")).
+		File("docs[0]", "a.txt", "text/plain", []byte("a")).
+		File("docs[1][scan]", "b.png", "image/png", []byte("b")).
+		Request(http.MethodPost, "/")
+
+	h, _ := newTestHandler(t, &config.Config{Uploads: &config.Uploads{Dir: t.TempDir()}})
+	req := newTestRequest(r)
+	require.NoError(t, h.request(r, req))
+	defer req.Close(nil, r)
+
+	docs, ok := req.Uploads.tree["docs"].(fileTree)
+	require.True(t, ok)
+	require.Len(t, docs, 3)
+	assert.Equal(t, "a.txt", docs["0"].(*FileUpload).Name)
+	assert.Equal(t, "b.png", docs["1"].(fileTree)["scan"].(*FileUpload).Name)
+	assert.Equal(t, "c.txt", docs["2"].(*FileUpload).Name)
+
+	// the worker gets the elements keyed by their explicit index, whatever the order of the parts was
+	data, err := json.Marshal(req.Uploads)
+	require.NoError(t, err)
+	var tree map[string]map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(data, &tree))
+	assert.Contains(t, string(tree["docs"]["0"]), `"name":"a.txt"`)
+	assert.Contains(t, string(tree["docs"]["1"]), `"name":"b.png"`)
+	assert.Contains(t, string(tree["docs"]["2"]), `"name":"c.txt"`)
+}
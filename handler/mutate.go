@@ -0,0 +1,65 @@
+package handler
+
+import (
+	stderr "errors"
+	"net/http"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// BodyMutator is the native middleware adding the derived fields (a resolved tenant ID...) to the parsed body, or
+// removing the fields, before it's sent to the worker. The mutators run after the body inspectors accepted the body,
+// in the order they are set. A non-nil error rejects the request the same way the inspector errors do.
+type BodyMutator interface {
+	MutateBody(r *http.Request, data DataEditor) error
+}
+
+// DataEditor is the writable access to the parsed data tree of the request.
+type DataEditor struct {
+	tree dataTree
+}
+
+// Set places the value (a string or a list of strings) at the path of the already split key (a[b][] is
+// {"a", "b", ""}), creating the intermediate branches. The collisions are resolved the same way the parsed fields
+// collide: the value replaces a leaf, and a non-empty leaf colliding with a branch is an error.
+func (e DataEditor) Set(path []string, value any) error {
+	return e.tree.SetAtPath(path, value)
+}
+
+// Delete removes the field or the whole branch at the path, returns false if the path doesn't exist.
+func (e DataEditor) Delete(path []string) bool {
+	return e.tree.Delete(path)
+}
+
+// View returns the read-only view of the tree, it reflects the later changes.
+func (e DataEditor) View() DataView {
+	return DataView{tree: e.tree}
+}
+
+// mutate runs the body mutators on the parsed request, the bodies which are not parsed into the data tree are left
+// as is.
+func (h *Handler) mutate(hr *http.Request, req *Request) error {
+	if len(h.mutators) == 0 || !req.Parsed {
+		return nil
+	}
+
+	data, ok := req.body.(dataTree)
+	if !ok {
+		data = make(dataTree)
+		req.body = data
+	}
+
+	for _, m := range h.mutators {
+		err := m.MutateBody(hr, DataEditor{tree: data})
+		if err != nil {
+			var pe *ParseError
+			if stderr.As(err, &pe) {
+				return err
+			}
+
+			return newParseError(ParseErrorInvalidFields, errors.E(errors.Op("mutate_body"), err))
+		}
+	}
+
+	return nil
+}
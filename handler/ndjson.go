@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	stderr "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// parseNDJSONBody reads the newline-delimited JSON body line by line and decodes each record into the data tree
+// node, the same way the JSON documents are. The records are indexed by their position, like the JSON array
+// elements; the empty lines are not records. Only the current line is buffered, not the whole body. The malformed
+// lines abort the parsing with 400 or are skipped and logged, depending on the configuration. The records are
+// decoded while the body is read, so the parse deadline counts from the first record.
+func (h *Handler) parseNDJSONBody(r *http.Request, log *zap.Logger, warnings *parseWarnings, dl *parseDeadline) (dataTree, error) {
+	const op = errors.Op("parse_ndjson_body")
+
+	data := make(dataTree, 2)
+	br := bufio.NewReader(r.Body)
+	// the skipped lines count towards the limit as well
+	records := 0
+
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		eof := stderr.Is(err, io.EOF)
+		if err != nil && !eof {
+			return nil, err
+		}
+
+		b = bytes.TrimSpace(b)
+		if len(b) > 0 {
+			records++
+			if h.ndjsonMaxLines > 0 && records > h.ndjsonMaxLines {
+				return nil, errors.E(op, newParseError(ParseErrorBodyTooLarge, errors.Errorf("NDJSON body has more than %d records", h.ndjsonMaxLines)).
+					with(ParseErrorCodeLimitExceeded, fmt.Sprintf("send at most %d records", h.ndjsonMaxLines)))
+			}
+
+			node, errN := ndjsonRecord(b, h.jsonScalars, dl)
+			var pe *ParseError
+			switch {
+			case errN == nil:
+				data[strconv.Itoa(len(data))] = node
+			case stderr.As(errN, &pe) && pe.Kind == ParseErrorParseTimeout:
+				return nil, errors.E(op, errN)
+			case h.ndjsonSkipMalformed:
+				log.Warn("malformed NDJSON line was skipped", zap.Int("line", line), zap.Error(errN))
+				warnings.add(ParseWarningNDJSONLineSkipped, "malformed NDJSON line %d was skipped: %v", line, errN)
+			default:
+				return nil, errors.E(op, newParseError(ParseErrorMalformed, errors.Errorf("malformed NDJSON line %d: %v", line, errN)))
+			}
+		}
+
+		if eof {
+			return data, nil
+		}
+	}
+}
+
+// ndjsonRecord decodes a single NDJSON line into the data tree node.
+func ndjsonRecord(b []byte, sc jsonScalars, dl *parseDeadline) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var doc any
+	err := dec.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if dec.More() {
+		return nil, errors.Str("unexpected data after the JSON record")
+	}
+
+	return jsonNode(doc, 1, sc, dl)
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// nestedForms are the form fields whose value is itself a urlencoded form (a=1&b[c]=2), the way some clients pack
+// their state into a single field, see config.Parse.NestedFormFields.
+type nestedForms []nestedForm
+
+type nestedForm struct {
+	// the configured field name, for the errors
+	name string
+	keys []string
+}
+
+// newNestedForms returns nil when no field is configured.
+func newNestedForms(fields []string, phpKeys bool) nestedForms {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	nf := make(nestedForms, 0, len(fields))
+	for _, f := range fields {
+		if keys := splitKey(f, phpKeys); len(keys) > 0 {
+			nf = append(nf, nestedForm{name: f, keys: keys})
+		}
+	}
+
+	return nf
+}
+
+// decode replaces the value of each configured field with the tree parsed from it. The nested keys are pushed under
+// the field with the limits of the body keys: the nesting level, the siblings of each node and the parse deadline,
+// the collisions are rejected the same way. Only the single string values are decoded, the decoded values aren't.
+func (nf nestedForms) decode(data dataTree, phpKeys bool, maxSiblings int, dl *parseDeadline) error {
+	const op = errors.Op("decode_nested_form")
+
+	for _, f := range nf {
+		keys := f.keys
+		node, ok := lookupNode(data, keys)
+		if !ok {
+			continue
+		}
+
+		blob, ok := node.(string)
+		if !ok {
+			continue
+		}
+
+		values, err := url.ParseQuery(blob)
+		if err != nil {
+			return errors.E(op, newParseError(ParseErrorMalformed, fmt.Errorf("malformed nested form in the field '%s': %w", f.name, err)).
+				with(ParseErrorCodeInvalidEncoding, fmt.Sprintf("urlencode the nested form in the field '%s'", f.name)))
+		}
+
+		data.Delete(keys)
+		for k, v := range values {
+			err = dl.check()
+			if err != nil {
+				return err
+			}
+
+			nested := splitKey(k, phpKeys)
+			if len(nested) == 0 {
+				continue
+			}
+
+			err = data.pushIndexes(append(keys[:len(keys):len(keys)], nested...), v, maxSiblings)
+			if err != nil {
+				return errors.E(op, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// openFiles caps the number of the upload temp files being written at the same time by all requests, each one holds
+// a file descriptor (two while the spilled part is copied to the uploads dir).
+type openFiles struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newOpenFiles(limit int, timeout time.Duration) *openFiles {
+	return &openFiles{
+		slots:   make(chan struct{}, limit),
+		timeout: timeout,
+	}
+}
+
+// acquire takes a slot for the temp file, nil limit means unlimited. When all slots are busy, it waits for a free one
+// up to the timeout, the request is then rejected with 503.
+func (o *openFiles) acquire() error {
+	if o == nil {
+		return nil
+	}
+
+	select {
+	case o.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if o.timeout > 0 {
+		tm := time.NewTimer(o.timeout)
+		defer tm.Stop()
+
+		select {
+		case o.slots <- struct{}{}:
+			return nil
+		case <-tm.C:
+		}
+	}
+
+	return newParseError(ParseErrorUnavailable, errors.Errorf("more than %d upload temp files are open", cap(o.slots)))
+}
+
+// release returns the slot taken by acquire.
+func (o *openFiles) release() {
+	if o == nil {
+		return
+	}
+
+	<-o.slots
+}
@@ -1,8 +1,19 @@
 package handler
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"maps"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/http/v5/config"
 )
 
 // MaxLevel defines maximum tree depth for incoming request data and files.
@@ -11,16 +22,70 @@ const MaxLevel = 127
 type dataTree map[string]any
 type fileTree map[string]any
 
-// parsePostForm parses incoming request body into data tree.
-func parsePostForm(r *http.Request) (dataTree, error) {
+// readURLEncoded reads the urlencoded body the same way http.Request.ParseForm does, but without the net/http 10MB
+// limit for the bodies which are not wrapped by http.MaxBytesReader directly, only max_request_size applies.
+func readURLEncoded(r *http.Request, bm bodyMethods) (url.Values, error) {
+	b, err := readURLEncodedBody(r, bm)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := url.ParseQuery(string(b))
+	if err != nil {
+		return nil, newParseError(ParseErrorMalformed, err).with(ParseErrorCodeInvalidEncoding, "")
+	}
+
+	return values, nil
+}
+
+// isSimpleKey reports whether the key is a single index in both the default and the PHP syntax.
+func isSimpleKey(k string) bool {
+	return k != "" && strings.IndexAny(k, "[] .") == -1
+}
+
+// readURLEncodedBody reads the form body, the body is nil for the methods net/http ignores the form body for, unless
+// they are enabled in bm.
+func readURLEncodedBody(r *http.Request, bm bodyMethods) ([]byte, error) {
+	if !bm.form(r.Method) {
+		return nil, nil
+	}
+
+	if r.Body == nil {
+		return nil, errors.Str("missing form body")
+	}
+
+	if isSmallForm(r) {
+		// the same as io.ReadAll, but with the single allocation, the declared size is not trusted
+		buf := bytes.NewBuffer(make([]byte, 0, r.ContentLength+bytes.MinRead))
+		_, err := buf.ReadFrom(r.Body)
+		return buf.Bytes(), err
+	}
+
+	return io.ReadAll(r.Body)
+}
+
+// parsePostForm parses incoming request body into data tree, phpKeys selects the PHP array keys syntax. maxSiblings
+// limits the children of each node, 0 means unlimited. The names not matching np are dropped or rejected.
+func parsePostForm(values url.Values, phpKeys bool, maxSiblings int, np *namePattern, dl *parseDeadline) (dataTree, error) {
 	data := make(dataTree, 2)
 
-	if r.PostForm != nil {
-		for k, v := range r.PostForm {
-			err := data.push(k, v)
-			if err != nil {
-				return nil, err
-			}
+	for k, v := range values {
+		err := dl.check()
+		if err != nil {
+			return nil, err
+		}
+
+		keep, err := np.keep(k)
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			continue
+		}
+
+		err = data.pushIndexes(splitKey(k, phpKeys), v, maxSiblings)
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -28,15 +93,31 @@ func parsePostForm(r *http.Request) (dataTree, error) {
 }
 
 // parseMultipartData parses incoming request body into data tree.
-func parseMultipartData(r *http.Request) (dataTree, error) {
+func parseMultipartData(form *multipartForm, dl *parseDeadline) (dataTree, error) {
 	data := make(dataTree, 2)
 
-	if r.MultipartForm != nil {
-		for k, v := range r.MultipartForm.Value {
-			err := data.push(k, v)
+	for k, v := range form.values {
+		err := dl.check()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := form.literal[k]; ok {
+			err = checkSiblings(data, []string{k}, len(v), form.maxSiblings)
+			if err != nil {
+				return nil, err
+			}
+
+			err = data.mount([]string{k}, v)
 			if err != nil {
 				return nil, err
 			}
+			continue
+		}
+
+		err = data.pushIndexes(splitKey(k, form.phpKeys), v, form.maxSiblings)
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -45,20 +126,83 @@ func parseMultipartData(r *http.Request) (dataTree, error) {
 
 // pushes value into data tree.
 func (dt dataTree) push(k string, v []string) error {
-	keys := make([]string, 1)
-	fetchIndexes(k, &keys)
+	return dt.pushIndexes(splitKey(k, false), v, 0)
+}
+
+// pushIndexes pushes value into data tree using the already split key. The key adding a child to the node which
+// already has maxSiblings children is rejected, 0 means unlimited.
+func (dt dataTree) pushIndexes(keys, v []string, maxSiblings int) error {
 	if len(keys) <= MaxLevel {
+		err := checkSiblings(dt, keys, len(v), maxSiblings)
+		if err != nil {
+			return err
+		}
+
 		return dt.mount(keys, v)
 	}
 
 	return nil
 }
 
+// checkSiblings walks the existing nodes along the key and rejects it when it adds a child to the node which already
+// has maxSiblings children, or a list longer than maxSiblings (key[]). The error names the parent node.
+func checkSiblings[T dataTree | fileTree](tree T, keys []string, values, maxSiblings int) error {
+	if maxSiblings <= 0 {
+		return nil
+	}
+
+	last := len(keys) - 1
+	if last > 0 && keys[last] == "" && values > maxSiblings {
+		return siblingsErr(keys[:last], maxSiblings)
+	}
+
+	node := tree
+	for j, k := range keys {
+		if k == "" && j == last {
+			return nil
+		}
+
+		child, ok := node[k]
+		if !ok {
+			if len(node) >= maxSiblings {
+				return siblingsErr(keys[:j], maxSiblings)
+			}
+
+			// the rest of the nodes are new
+			return nil
+		}
+
+		branch, ok := child.(T)
+		if !ok {
+			return nil
+		}
+
+		node = branch
+	}
+
+	return nil
+}
+
+func siblingsErr(parent []string, maxSiblings int) error {
+	if len(parent) == 0 {
+		return newParseError(ParseErrorMalformed, errors.Errorf("form has more than %d top-level fields", maxSiblings)).
+			with(ParseErrorCodeLimitExceeded, fmt.Sprintf("send at most %d top-level fields", maxSiblings))
+	}
+
+	name := parent[0]
+	for _, k := range parent[1:] {
+		name += "[" + k + "]"
+	}
+
+	return newParseError(ParseErrorMalformed, errors.Errorf("field '%s' has more than %d children", name, maxSiblings)).
+		with(ParseErrorCodeLimitExceeded, fmt.Sprintf("send at most %d values or keys in the field '%s'", maxSiblings, name))
+}
+
 func invalidMultipleValuesErr(key string) error {
-	return fmt.Errorf(
+	return newParseError(ParseErrorMalformed, fmt.Errorf(
 		"invalid multiple values to key '%+v' in tree",
 		key,
-	)
+	)).with(ParseErrorCodeFieldCollision, fmt.Sprintf("field '%s' was sent both as a value and as an array, send it only one way", key))
 }
 
 // mount mounts data tree recursively.
@@ -117,12 +261,53 @@ func (dt dataTree) mount(keys, v []string) error {
 		}
 	}
 
+	// items[][name]: every value goes into a new element, the same way PHP appends to the array
+	if len(keys) > 2 && keys[1] == "" {
+		if len(v) == 0 {
+			return res.mount(autoIndex(res, keys[1:]), v)
+		}
+
+		for j := range v {
+			err = res.mount(autoIndex(res, keys[1:]), v[j:j+1])
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
 	return res.mount(keys[1:], v)
 }
 
+// autoIndex replaces the empty first key by the next free index of the node, the largest integer key plus one (0
+// for the node without the integer keys), as PHP does for the key[] in the middle of the path.
+func autoIndex[T dataTree | fileTree](node T, keys []string) []string {
+	next := 0
+	for k := range node {
+		n, err := strconv.Atoi(k)
+		if err != nil || strconv.Itoa(n) != k {
+			continue
+		}
+
+		if n >= next {
+			next = n + 1
+		}
+	}
+
+	res := make([]string, len(keys))
+	res[0] = strconv.Itoa(next)
+	copy(res[1:], keys[1:])
+
+	return res
+}
+
 func prepareTreeNode[T dataTree | fileTree, V []string | []*FileUpload](tree T, i []string, v V) (bool, error) {
 	if _, ok := tree[i[0]]; !ok {
-		tree[i[0]] = make(T)
+		// the leaves are set by the caller, only the branches need the node
+		if len(i) > 2 || (len(i) == 2 && i[1] != "") {
+			tree[i[0]] = make(T)
+		}
 		return false, nil
 	}
 
@@ -180,20 +365,47 @@ func isDataEmpty(v any) bool {
 }
 
 // parse incoming dataTree request into JSON (including contentMultipart form dataTree)
-func parseUploads(r *http.Request, uid, gid int) (*Uploads, error) {
+func parseUploads(form *multipartForm, uid, gid int, dl *parseDeadline) (*Uploads, error) {
 	u := &Uploads{
 		tree: make(fileTree),
 		list: make([]*FileUpload, 0),
 	}
 
-	for k, v := range r.MultipartForm.File {
+	// the sorted keys keep the order of the uploads list stable
+	for _, k := range slices.Sorted(maps.Keys(form.files)) {
+		v := form.files[k]
 		files := make([]*FileUpload, 0, len(v))
 		for _, f := range v {
-			files = append(files, NewUpload(f, uid, gid))
+			fu := newPartUpload(f, uid, gid)
+			fu.imageInfo = form.imageInfo
+			fu.sniffMime = form.sniffMime
+			fu.tempPattern = form.tempPattern
+			files = append(files, fu)
+		}
+
+		err := dl.check()
+		if err != nil {
+			return nil, err
+		}
+
+		_, literal := form.literal[k]
+		keys := []string{k}
+		if !literal {
+			keys = splitKey(k, form.phpKeys)
 		}
 
+		// the dropped repeated files are not stored, their parts are removed with the form
+		keys, files = repeatedFileKey(keys, files, form.repeatedFiles)
 		u.list = append(u.list, files...)
-		err := u.tree.push(k, files)
+
+		if literal {
+			err = checkSiblings(u.tree, keys, len(files), form.maxSiblings)
+			if err == nil {
+				err = u.tree.mount(keys, files)
+			}
+		} else {
+			err = u.tree.pushIndexes(keys, files, form.maxFileDepth, form.maxSiblings)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -202,11 +414,46 @@ func parseUploads(r *http.Request, uid, gid int) (*Uploads, error) {
 	return u, nil
 }
 
-// pushes new file upload into it's proper place.
+// pushes new file upload into it's proper place, the files repeated under a bare name are resolved the PHP way.
 func (ft fileTree) push(k string, v []*FileUpload) error {
-	keys := make([]string, 1)
-	fetchIndexes(k, &keys)
+	keys, v := repeatedFileKey(splitKey(k, false), v, config.RepeatedFileKeysLast)
+	return ft.pushIndexes(keys, v, 0, 0)
+}
+
+// repeatedFileKey applies the policy to the files sent under the same name without brackets (file, not file[]),
+// see config.Uploads.RepeatedFileKeys: one of them is kept, or the name gets the list index (file[]).
+func repeatedFileKey(keys []string, v []*FileUpload, policy string) ([]string, []*FileUpload) {
+	if len(keys) != 1 || len(v) < 2 {
+		return keys, v
+	}
+
+	switch policy {
+	case config.RepeatedFileKeysFirst:
+		return keys, v[:1]
+	case config.RepeatedFileKeysArray:
+		return []string{keys[0], ""}, v
+	default:
+		return keys, v[len(v)-1:]
+	}
+}
+
+// pushIndexes pushes new file upload using the already split key. The depth is the number of the keys, the name
+// and each index. The keys deeper than the maxDepth are rejected, 0 means the shared MaxLevel limit, the keys
+// exceeding it are dropped the same way the data tree drops them. maxSiblings limits the children of each node, see
+// dataTree.pushIndexes. The explicit indexes (docs[2]) are the keys of the node, so the uploads land at their index
+// whatever order the parts arrive in.
+func (ft fileTree) pushIndexes(keys []string, v []*FileUpload, maxDepth, maxSiblings int) error {
+	if maxDepth > 0 && len(keys) > maxDepth {
+		return newParseError(ParseErrorMalformed, errors.Errorf("file field '%s' exceeds the maximum file nesting depth %d", keys[0], maxDepth)).
+			with(ParseErrorCodeLimitExceeded, fmt.Sprintf("nest the file fields at most %d levels deep", maxDepth))
+	}
+
 	if len(keys) <= MaxLevel {
+		err := checkSiblings(ft, keys, len(v), maxSiblings)
+		if err != nil {
+			return err
+		}
+
 		return ft.mount(keys, v)
 	}
 	return nil
@@ -239,11 +486,157 @@ func (ft fileTree) mount(i []string, v []*FileUpload) error {
 		return nil
 	}
 
-	return ft[i[0]].(fileTree).mount(i[1:], v)
+	res := ft[i[0]].(fileTree)
+	if len(i) > 2 && i[1] == "" {
+		if len(v) == 0 {
+			return res.mount(autoIndex(res, i[1:]), v)
+		}
+
+		for j := range v {
+			err = res.mount(autoIndex(res, i[1:]), v[j:j+1])
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return res.mount(i[1:], v)
+}
+
+// splitKey splits the input name into the tree indexes, see phpIndexes for the phpKeys syntax.
+func splitKey(k string, phpKeys bool) []string {
+	if phpKeys {
+		return phpIndexes(k)
+	}
+
+	// presized for the bracketed indexes
+	keys := make([]string, 1, 1+strings.Count(k, "["))
+	fetchIndexes(k, &keys)
+
+	return keys
+}
+
+// phpIndexes splits the input name the same way PHP does when it registers the request variables, so the keys
+// collide exactly when they collide in PHP. PHP converts only the canonical decimal strings which fit an int
+// (8, -5, but not 08, +8, -0 or " 8 ") into the integer keys, so keeping the indexes as they are written, spaces
+// included, is enough to match its collisions. The name prefix loses its leading spaces and has the spaces and dots
+// replaced by underscores, an unterminated first bracket is a part of the name (a[b becomes a_b), anything after
+// the last closed bracket is ignored. An empty name is dropped (nil is returned).
+func phpIndexes(s string) []string {
+	s = strings.TrimLeft(s, " ")
+
+	i := strings.IndexByte(s, '[')
+	if i == -1 || strings.IndexByte(s[i:], ']') == -1 {
+		name := phpName(s)
+		if name == "" {
+			return nil
+		}
+
+		return []string{name}
+	}
+
+	name := phpName(s[:i])
+	if name == "" {
+		return nil
+	}
+
+	keys := []string{name}
+	for s = s[i:]; len(s) > 0 && s[0] == '['; {
+		end := strings.IndexByte(s, ']')
+		if end == -1 {
+			// the unterminated nested index is dropped
+			break
+		}
+
+		keys = append(keys, s[1:end])
+		s = s[end+1:]
+	}
+
+	return keys
 }
 
-// fetchIndexes parses input name and splits it into separate indexes list.
+// phpName replaces the characters PHP doesn't allow in the variable names with underscores.
+func phpName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '.', '[':
+			return '_'
+		default:
+			return r
+		}
+	}, s)
+}
+
+// fetchIndexes parses input name and splits it into separate indexes list. The spaces are ignored, the keys are the
+// substrings of the name unless they contain spaces, so splitting the name doesn't allocate a string per character.
+// The brackets and the spaces are ASCII, they never appear inside the multibyte characters, so the valid UTF-8 name
+// is scanned byte by byte. The invalid names take the rune path, which replaces the invalid bytes with U+FFFD.
 func fetchIndexes(s string, keys *[]string) {
+	if !utf8.ValidString(s) {
+		fetchRuneIndexes(s, keys)
+		return
+	}
+
+	var (
+		pos int
+		// the bytes of the last key: from the first to the last character, and whether spaces are between them
+		from, to = -1, -1
+		spaces   bool
+	)
+
+	flush := func() {
+		if from == -1 {
+			return
+		}
+
+		key := s[from:to]
+		if spaces {
+			key = strings.ReplaceAll(key, " ", "")
+		}
+
+		(*keys)[len(*keys)-1] += key
+		from, spaces = -1, false
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case ' ':
+			// ignore all spaces
+			continue
+		case '[':
+			pos = 1
+			continue
+		case ']':
+			if pos == 1 {
+				flush()
+				*keys = append(*keys, "")
+			}
+			pos = 2
+		default:
+			if pos == 1 || pos == 2 {
+				flush()
+				*keys = append(*keys, "")
+			}
+
+			switch {
+			case from == -1:
+				from = i
+			case to != i:
+				spaces = true
+			}
+
+			to = i + 1
+			pos = 0
+		}
+	}
+
+	flush()
+}
+
+// fetchRuneIndexes is fetchIndexes of the names with the invalid UTF-8, the key characters are appended rune by rune.
+func fetchRuneIndexes(s string, keys *[]string) {
 	const empty = ""
 	var (
 		pos int
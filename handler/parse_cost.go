@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"strconv"
+
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// ParseCostAttribute is the weighted cost of parsing the request body, passed to the worker and set in the request
+// attributes, so the native middleware which initialized the attributes can read it once the request is served.
+const ParseCostAttribute string = "Parse-Cost"
+
+// parseCost weights the counters of the parsed request into a single cost.
+type parseCost struct {
+	bytes  float64
+	fields float64
+	files  float64
+	depth  float64
+}
+
+// newParseCost returns nil when the parse cost is disabled.
+func newParseCost(cfg *config.ParseCost) *parseCost {
+	if cfg == nil {
+		return nil
+	}
+
+	return &parseCost{
+		bytes:  cfg.Bytes,
+		fields: cfg.Fields,
+		files:  cfg.Files,
+		depth:  cfg.Depth,
+	}
+}
+
+// of returns the cost of the request with the body of the size n: the body bytes, the parsed fields, the uploaded
+// files and the nesting depth of the parsed trees.
+func (pc *parseCost) of(n int64, req *Request) float64 {
+	cost := pc.bytes * float64(n)
+
+	if dt, ok := req.body.(dataTree); ok {
+		cost += pc.fields*float64(dt.count()) + pc.depth*float64(treeDepth(dt))
+	}
+
+	if req.Uploads != nil {
+		cost += pc.files * float64(len(req.Uploads.list))
+	}
+
+	return cost
+}
+
+// set computes the cost of the parsed request and attaches it to the request, it's observed by the metrics along
+// with the body size.
+func (pc *parseCost) set(n int64, req *Request) {
+	if pc == nil {
+		return
+	}
+
+	req.cost = pc.of(n, req)
+	req.setAttribute(ParseCostAttribute, strconv.FormatFloat(req.cost, 'f', -1, 64))
+}
+
+// treeDepth returns the number of the levels of the tree, the leaves included.
+func treeDepth[T dataTree | fileTree](tree T) int {
+	depth := 0
+	for _, v := range tree {
+		d := 1
+		if branch, ok := v.(T); ok {
+			d += treeDepth(branch)
+		}
+
+		depth = max(depth, d)
+	}
+
+	return depth
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// parseCheckInterval is the number of the tree operations between the clock checks.
+const parseCheckInterval = 64
+
+// parseDeadline bounds the time spent building the trees from the already read bodies, separately from the body
+// read timeout. nil means unlimited.
+type parseDeadline struct {
+	limit time.Duration
+	at    time.Time
+	ops   int
+}
+
+func newParseDeadline(limit time.Duration) *parseDeadline {
+	if limit <= 0 {
+		return nil
+	}
+
+	return &parseDeadline{limit: limit}
+}
+
+// start starts the deadline, the deadline not started explicitly starts with the first tree operation.
+func (d *parseDeadline) start() {
+	if d == nil {
+		return
+	}
+
+	d.at = time.Now().Add(d.limit)
+	d.ops = 0
+}
+
+// used returns the part of the limit spent since the deadline started, 0 when it's not started or unlimited.
+func (d *parseDeadline) used() float64 {
+	if d == nil || d.at.IsZero() {
+		return 0
+	}
+
+	return float64(time.Since(d.at.Add(-d.limit))) / float64(d.limit)
+}
+
+// check is called on every tree operation, the clock is checked periodically.
+func (d *parseDeadline) check() error {
+	if d == nil {
+		return nil
+	}
+
+	if d.at.IsZero() {
+		d.start()
+	}
+
+	d.ops++
+	if d.ops%parseCheckInterval != 0 || time.Now().Before(d.at) {
+		return nil
+	}
+
+	return newParseError(ParseErrorParseTimeout, errors.Errorf("request body parsing exceeded %s", d.limit))
+}
@@ -0,0 +1,262 @@
+package handler
+
+import (
+	stderr "errors"
+	"mime/multipart"
+	"net/http"
+	"os"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// ParseErrorKind tells why the request was rejected, the renderers use it to choose the response.
+type ParseErrorKind int
+
+const (
+	// ParseErrorInternal is any error which is not caused by the client, 500.
+	ParseErrorInternal ParseErrorKind = iota
+	// ParseErrorMalformed is the body or header which can't be parsed, 400.
+	ParseErrorMalformed
+	// ParseErrorInvalidFields is the parsed body missing the required fields or having the unknown ones, 400.
+	ParseErrorInvalidFields
+	// ParseErrorBodyTooLarge is the body exceeding the size limits, 413.
+	ParseErrorBodyTooLarge
+	// ParseErrorHeaderTooLarge is the header exceeding the limits, 431.
+	ParseErrorHeaderTooLarge
+	// ParseErrorTimeout is the body not read in time, 408.
+	ParseErrorTimeout
+	// ParseErrorUnsupportedMediaType is the body with missing or rejected Content-Type, 415.
+	ParseErrorUnsupportedMediaType
+	// ParseErrorForbidden is the request failing the CSRF check, 403.
+	ParseErrorForbidden
+	// ParseErrorParseTimeout is the read body not parsed in time, 408.
+	ParseErrorParseTimeout
+	// ParseErrorContentTypeMismatch is the body not matching its declared Content-Type in the strict mode, 415.
+	ParseErrorContentTypeMismatch
+	// ParseErrorUnavailable is the request the server has no resources to parse at the moment, 503.
+	ParseErrorUnavailable
+)
+
+// Status returns the HTTP status code of the error kind.
+func (k ParseErrorKind) Status() int {
+	switch k {
+	case ParseErrorMalformed, ParseErrorInvalidFields:
+		return http.StatusBadRequest
+	case ParseErrorBodyTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ParseErrorHeaderTooLarge:
+		return http.StatusRequestHeaderFieldsTooLarge
+	case ParseErrorTimeout, ParseErrorParseTimeout:
+		return http.StatusRequestTimeout
+	case ParseErrorUnsupportedMediaType, ParseErrorContentTypeMismatch:
+		return http.StatusUnsupportedMediaType
+	case ParseErrorForbidden:
+		return http.StatusForbidden
+	case ParseErrorUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// code returns the code of the errors of the kind without a more specific one.
+func (k ParseErrorKind) code() ParseErrorCode {
+	switch k {
+	case ParseErrorMalformed:
+		return ParseErrorCodeMalformedBody
+	case ParseErrorInvalidFields:
+		return ParseErrorCodeInvalidFields
+	case ParseErrorBodyTooLarge:
+		return ParseErrorCodeBodyTooLarge
+	case ParseErrorHeaderTooLarge:
+		return ParseErrorCodeHeaderTooLarge
+	case ParseErrorTimeout, ParseErrorParseTimeout:
+		return ParseErrorCodeTimeout
+	case ParseErrorUnsupportedMediaType:
+		return ParseErrorCodeUnsupportedMediaType
+	case ParseErrorContentTypeMismatch:
+		return ParseErrorCodeContentTypeMismatch
+	case ParseErrorForbidden:
+		return ParseErrorCodeForbidden
+	case ParseErrorUnavailable:
+		return ParseErrorCodeUnavailable
+	default:
+		return ParseErrorCodeInternal
+	}
+}
+
+// ParseErrorCode is the stable machine-readable code of the parse error, meant to be returned to the clients. The
+// codes are a part of the API: they are never renamed or reused, new codes may be added.
+type ParseErrorCode string
+
+const (
+	// ParseErrorCodeInternal is the error not caused by the client.
+	ParseErrorCodeInternal ParseErrorCode = "internal"
+	// ParseErrorCodeMalformedBody is the body which can't be parsed under its Content-Type.
+	ParseErrorCodeMalformedBody ParseErrorCode = "malformed_body"
+	// ParseErrorCodeMalformedMultipart is the broken multipart body: missing boundary, malformed part headers,
+	// part Content-Length not matching the content.
+	ParseErrorCodeMalformedMultipart ParseErrorCode = "malformed_multipart"
+	// ParseErrorCodeInvalidEncoding is the invalid percent-encoding of the urlencoded form or the malformed
+	// Content-Encoding data.
+	ParseErrorCodeInvalidEncoding ParseErrorCode = "invalid_encoding"
+	// ParseErrorCodeFieldCollision is the field sent both as a value and as an array or a branch.
+	ParseErrorCodeFieldCollision ParseErrorCode = "field_collision"
+	// ParseErrorCodeLimitExceeded is the form exceeding the fields limits: children per field, nesting depth,
+	// field name length, records or header pairs count.
+	ParseErrorCodeLimitExceeded ParseErrorCode = "limit_exceeded"
+	// ParseErrorCodeInvalidFields is the form missing the required fields, having the unknown ones or the names not
+	// matching the name pattern.
+	ParseErrorCodeInvalidFields ParseErrorCode = "invalid_fields"
+	// ParseErrorCodeBodyTooLarge is the body exceeding the size limits.
+	ParseErrorCodeBodyTooLarge ParseErrorCode = "body_too_large"
+	// ParseErrorCodeHeaderTooLarge is the header exceeding the limits.
+	ParseErrorCodeHeaderTooLarge ParseErrorCode = "header_too_large"
+	// ParseErrorCodeTimeout is the body not read or parsed in time.
+	ParseErrorCodeTimeout ParseErrorCode = "timeout"
+	// ParseErrorCodeUnsupportedMediaType is the body with missing or rejected Content-Type or Content-Encoding.
+	ParseErrorCodeUnsupportedMediaType ParseErrorCode = "unsupported_media_type"
+	// ParseErrorCodeContentTypeMismatch is the body not matching its declared Content-Type.
+	ParseErrorCodeContentTypeMismatch ParseErrorCode = "content_type_mismatch"
+	// ParseErrorCodeForbidden is the request failing the CSRF check.
+	ParseErrorCodeForbidden ParseErrorCode = "forbidden"
+	// ParseErrorCodeUnavailable is the request the server has no resources to parse at the moment.
+	ParseErrorCodeUnavailable ParseErrorCode = "unavailable"
+	// ParseErrorCodeStorageUnavailable is the request whose uploads can't be stored, the temp disk is full or not
+	// writable.
+	ParseErrorCodeStorageUnavailable ParseErrorCode = "storage_unavailable"
+	// ParseErrorCodeFieldRejected is the request with a field value rejected by the field inspectors.
+	ParseErrorCodeFieldRejected ParseErrorCode = "field_rejected"
+	// ParseErrorCodeDecodeRatioExceeded is the Content-Encoding body expanding above the max_decode_ratio, a
+	// decompression bomb.
+	ParseErrorCodeDecodeRatioExceeded ParseErrorCode = "decode_ratio_exceeded"
+	// ParseErrorCodeValueTooLarge is the multipart value part exceeding the max_multipart_value_size.
+	ParseErrorCodeValueTooLarge ParseErrorCode = "value_too_large"
+)
+
+// hint returns the remediation of the errors with the code, used when the error has no more specific one.
+func (c ParseErrorCode) hint() string {
+	switch c {
+	case ParseErrorCodeMalformedBody:
+		return "send a body which is valid for its Content-Type"
+	case ParseErrorCodeMalformedMultipart:
+		return "send a well-formed multipart/form-data body using the boundary declared in the Content-Type"
+	case ParseErrorCodeInvalidEncoding:
+		return "percent-encode the form field names and values, or send the body encoded with its Content-Encoding"
+	case ParseErrorCodeFieldCollision:
+		return "send each field either as a single value or as an array, not both"
+	case ParseErrorCodeLimitExceeded:
+		return "send fewer, shorter or less nested fields"
+	case ParseErrorCodeInvalidFields:
+		return "send all the required fields and only the known ones"
+	case ParseErrorCodeBodyTooLarge:
+		return "send a smaller body"
+	case ParseErrorCodeHeaderTooLarge:
+		return "send fewer or smaller headers"
+	case ParseErrorCodeTimeout:
+		return "send a smaller body, or send it faster"
+	case ParseErrorCodeUnsupportedMediaType:
+		return "send the body with a supported Content-Type and Content-Encoding"
+	case ParseErrorCodeContentTypeMismatch:
+		return "send the Content-Type matching the body"
+	case ParseErrorCodeForbidden:
+		return "send the same CSRF token in the cookie and in the form"
+	case ParseErrorCodeStorageUnavailable:
+		return "retry the request later, the server can't store the uploaded files at the moment"
+	case ParseErrorCodeFieldRejected:
+		return "remove the rejected content from the form fields"
+	case ParseErrorCodeValueTooLarge:
+		return "send shorter form field values"
+	default:
+		return "retry the request later"
+	}
+}
+
+// ParseError is returned when the request body is rejected while being read or parsed. Status is the HTTP status
+// code the client receives by default. Code and Hint are meant for the clients: the stable error code and the human
+// readable remediation, Err is the detailed error for the logs.
+type ParseError struct {
+	Kind   ParseErrorKind
+	Status int
+	Code   ParseErrorCode
+	Hint   string
+	Err    error
+}
+
+func newParseError(kind ParseErrorKind, err error) *ParseError {
+	code := kind.code()
+	return &ParseError{
+		Kind:   kind,
+		Status: kind.Status(),
+		Code:   code,
+		Hint:   code.hint(),
+		Err:    err,
+	}
+}
+
+// with sets the more specific code of the error, and the hint (the default hint of the code if empty).
+func (e *ParseError) with(code ParseErrorCode, hint string) *ParseError {
+	if hint == "" {
+		hint = code.hint()
+	}
+
+	e.Code = code
+	e.Hint = hint
+	return e
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// asParseError converts the request forming error to the ParseError, known client errors get 4xx status codes,
+// any other error is an internal error.
+func asParseError(err error) *ParseError {
+	cause := errorCause(err)
+
+	var pe *ParseError
+	if stderr.As(cause, &pe) {
+		return pe
+	}
+
+	if stderr.Is(cause, os.ErrDeadlineExceeded) {
+		return newParseError(ParseErrorTimeout, err)
+	}
+
+	var mbe *http.MaxBytesError
+	if stderr.As(cause, &mbe) || stderr.Is(cause, multipart.ErrMessageTooLarge) {
+		return newParseError(ParseErrorBodyTooLarge, err)
+	}
+
+	return newParseError(ParseErrorInternal, err)
+}
+
+// errorCause returns the error wrapped by the roadrunner errors, they don't implement Unwrap.
+func errorCause(err error) error {
+	for {
+		e, ok := err.(*errors.Error)
+		if !ok || e.Err == nil {
+			return err
+		}
+
+		err = e.Err
+	}
+}
+
+// ErrorRenderer writes the response of the request rejected while its body was read or parsed, instead of the plain
+// text error. The renderer must write the status code, the error Kind tells why the request was rejected.
+type ErrorRenderer interface {
+	RenderParseError(w http.ResponseWriter, r *http.Request, err *ParseError)
+}
+
+// ErrorRendererFunc is the function adapter of the ErrorRenderer.
+type ErrorRendererFunc func(w http.ResponseWriter, r *http.Request, err *ParseError)
+
+// RenderParseError calls f(w, r, err).
+func (f ErrorRendererFunc) RenderParseError(w http.ResponseWriter, r *http.Request, err *ParseError) {
+	f(w, r, err)
+}
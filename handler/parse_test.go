@@ -2,6 +2,8 @@ package handler
 
 import (
 	"errors"
+	"fmt"
+	"net/url"
 	"strings"
 	"testing"
 
@@ -22,6 +24,7 @@ var samples = []struct { //nolint:gochecknoglobals
 	{"key [ subkey ] [ value ] [ ]", []string{"key", "subkey", "value", ""}},
 	{"ключь [ subkey ] [ value ] [ ]", []string{"ключь", "subkey", "value", ""}}, // test non 1-byte symbols
 	{"options[0][name]", []string{"options", "0", "name"}},
+	{"a b[ c d ]x y", []string{"ab", "cd", "xy"}},
 }
 
 func Test_FetchIndexes(t *testing.T) {
@@ -34,10 +37,227 @@ func Test_FetchIndexes(t *testing.T) {
 	}
 }
 
+func Test_FetchIndexesRunes(t *testing.T) {
+	testCases := []struct {
+		in  string
+		out []string
+	}{
+		{in: "", out: []string{""}},
+		{in: " ", out: []string{""}},
+		{in: "[", out: []string{""}},
+		{in: "]", out: []string{""}},
+		{in: "[]", out: []string{"", ""}},
+		{in: "[ ]", out: []string{"", ""}},
+		{in: "]a[", out: []string{"", "a"}},
+		{in: "a]]b", out: []string{"a", "b"}},
+		{in: "a[[b]]", out: []string{"a", "b"}},
+		{in: "a[b]]c[", out: []string{"a", "b", "c"}},
+		{in: "a [b] c", out: []string{"a", "b", "c"}},
+		{in: "a  b [ c  d ]", out: []string{"ab", "cd"}},
+		{in: "a\t[b]", out: []string{"a\t", "b"}},
+		{in: "日本[語]", out: []string{"日本", "語"}},
+		// the invalid UTF-8 is replaced with U+FFFD
+		{in: "a\xff[b]", out: []string{"a\uFFFD", "b"}},
+		{in: "k[\xc3]", out: []string{"k", "\uFFFD"}},
+		{in: "\xe6\x97[ x\xff y ]", out: []string{"\uFFFD\uFFFD", "x\uFFFDy"}},
+		{in: "ключь\xd0[\x80]", out: []string{"ключь\uFFFD", "\uFFFD"}},
+	}
+
+	for _, tt := range testCases {
+		keys := make([]string, 1)
+		fetchIndexes(tt.in, &keys)
+		if !same(keys, tt.out) {
+			t.Errorf("%q: got %q, want %q", tt.in, keys, tt.out)
+		}
+
+		// the byte scanner splits the names the same way the rune by rune implementation does
+		runeKeys := make([]string, 1)
+		fetchRuneIndexes(tt.in, &runeKeys)
+		if !same(keys, runeKeys) {
+			t.Errorf("%q: got %q, the rune path got %q", tt.in, keys, runeKeys)
+		}
+	}
+
+	for _, tt := range samples {
+		keys, runeKeys := make([]string, 1), make([]string, 1)
+		fetchIndexes(tt.in, &keys)
+		fetchRuneIndexes(tt.in, &runeKeys)
+		if !same(keys, runeKeys) {
+			t.Errorf("%q: got %q, the rune path got %q", tt.in, keys, runeKeys)
+		}
+	}
+}
+
+func Test_PHPIndexes(t *testing.T) {
+	testCases := []struct {
+		in  string
+		out []string
+	}{
+		{"key", []string{"key"}},
+		{"key[subkey][value][]", []string{"key", "subkey", "value", ""}},
+		{"  key[ subkey ][ ]", []string{"key", " subkey ", " "}},
+		{"a b.c[d]", []string{"a_b_c", "d"}},
+		{"key[a]tail[b]", []string{"key", "a"}},
+		{"key[a", []string{"key_a"}},
+		{"key[a.b c", []string{"key_a_b_c"}},
+		{"key[a][b", []string{"key", "a"}},
+		{"key[a[b]", []string{"key", "a[b"}},
+		{"[a]", nil},
+		{"  ", nil},
+		{"ключь[ключь]", []string{"ключь", "ключь"}},
+	}
+
+	for _, tt := range testCases {
+		keys := phpIndexes(tt.in)
+		if !same(keys, tt.out) {
+			t.Errorf("%q: got %q, want %q", tt.in, keys, tt.out)
+		}
+	}
+}
+
+func TestParsePostForm_MaxSiblings(t *testing.T) {
+	testCases := []struct {
+		name    string
+		values  url.Values
+		wantErr string
+	}{
+		{
+			name:   "within the limit",
+			values: url.Values{"a": {"1"}, "b[0]": {"1"}, "b[1]": {"2"}, "b[2]": {"3"}, "c[]": {"1", "2", "3"}},
+		},
+		{
+			name:    "top-level fields",
+			values:  url.Values{"a": {"1"}, "b": {"1"}, "c": {"1"}, "d": {"1"}},
+			wantErr: "form has more than 3 top-level fields",
+		},
+		{
+			name:    "indexed children",
+			values:  url.Values{"key[x][0]": {"1"}, "key[x][1]": {"1"}, "key[x][2]": {"1"}, "key[x][3]": {"1"}},
+			wantErr: "field 'key[x]' has more than 3 children",
+		},
+		{
+			name:    "list values",
+			values:  url.Values{"key[]": {"1", "2", "3", "4"}},
+			wantErr: "field 'key' has more than 3 children",
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePostForm(tt.values, false, 3, nil, nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("want no err but got err %+v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("want err %s but got %+v", tt.wantErr, err)
+			}
+
+			var pe *ParseError
+			if !errors.As(err, &pe) || pe.Kind != ParseErrorMalformed {
+				t.Fatalf("want malformed parse error but got %+v", err)
+			}
+		})
+	}
+}
+
+func TestParsePostForm_PHPArrayKeys(t *testing.T) {
+	testCases := []struct {
+		name string
+		key  string
+		// the PHP tree, the keys which are not canonical integers never collide with a[8]
+		want    any
+		wantErr bool
+		// the default mode trims the spaces inside the brackets
+		wantDefault any
+		defaultErr  bool
+	}{
+		{
+			name:        "canonical integer",
+			key:         "a[8]",
+			want:        dataTree{"8": "y"},
+			wantDefault: dataTree{"8": "y"},
+		},
+		{
+			name:        "leading zero",
+			key:         "a[08]",
+			want:        dataTree{"8": "x", "08": "y"},
+			wantDefault: dataTree{"8": "x", "08": "y"},
+		},
+		{
+			name:        "plus sign",
+			key:         "a[+8]",
+			want:        dataTree{"8": "x", "+8": "y"},
+			wantDefault: dataTree{"8": "x", "+8": "y"},
+		},
+		{
+			name:        "spaces",
+			key:         "a[ 8 ]",
+			want:        dataTree{"8": "x", " 8 ": "y"},
+			wantDefault: dataTree{"8": "y"},
+		},
+		{
+			name:        "negative zero",
+			key:         "a[-0]",
+			want:        dataTree{"8": "x", "-0": "y"},
+			wantDefault: dataTree{"8": "x", "-0": "y"},
+		},
+		{
+			name:        "larger than int64",
+			key:         "a[9223372036854775808]",
+			want:        dataTree{"8": "x", "9223372036854775808": "y"},
+			wantDefault: dataTree{"8": "x", "9223372036854775808": "y"},
+		},
+		{
+			name:        "empty index with space",
+			key:         "a[ ]",
+			want:        dataTree{"8": "x", " ": "y"},
+			defaultErr:  true,
+			wantDefault: nil,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, phpKeys := range []bool{true, false} {
+				data := make(dataTree)
+				var err error
+				for _, kv := range [][2]string{{"a[8]", "x"}, {tt.key, "y"}} {
+					err = data.pushIndexes(splitKey(kv[0], phpKeys), []string{kv[1]}, 0)
+					if err != nil {
+						break
+					}
+				}
+
+				want, wantErr := tt.want, tt.wantErr
+				if !phpKeys {
+					want, wantErr = tt.wantDefault, tt.defaultErr
+				}
+
+				if wantErr {
+					if err == nil {
+						t.Fatalf("php keys %v: want err but got nil", phpKeys)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("php keys %v: want no err but got err %+v", phpKeys, err)
+				}
+				if diff := cmp.Diff(data["a"], want); len(diff) > 0 {
+					t.Fatalf("php keys %v: diff should be empty: %+v", phpKeys, diff)
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkConfig_FetchIndexes(b *testing.B) {
 	b.ReportAllocs()
-	for _, tt := range samples {
-		for b.Loop() {
+	for b.Loop() {
+		for _, tt := range samples {
 			keys := make([]string, 1)
 			fetchIndexes(tt.in, &keys)
 			if !same(keys, tt.out) {
@@ -47,6 +267,27 @@ func BenchmarkConfig_FetchIndexes(b *testing.B) {
 	}
 }
 
+func BenchmarkDataTree_PushDeep(b *testing.B) {
+	keys := make([]string, 0, 100)
+	for i := range 10 {
+		for j := range 10 {
+			keys = append(keys, fmt.Sprintf("key[questions][%d][answers][%d][clue]", i, j))
+		}
+	}
+	value := []string{"value"}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		d := make(dataTree)
+		for _, k := range keys {
+			err := d.push(k, value)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
 func same(in, out []string) bool {
 	if len(in) != len(out) {
 		return false
@@ -280,6 +521,52 @@ func TestDataTreePush(t *testing.T) {
 			},
 			wantErr: errors.New("invalid multiple values to key 'key' in tree"),
 		},
+		{
+			name: "empty index in the middle of the path appends an element per value",
+			values: orderedData{
+				{
+					key:   "key[][name]",
+					value: []string{"a", "b"},
+				},
+				{
+					key:   "key[][name]",
+					value: []string{"c"},
+				},
+			},
+			wantVal: dataTree{
+				"0": dataTree{"name": "a"},
+				"1": dataTree{"name": "b"},
+				"2": dataTree{"name": "c"},
+			},
+		},
+		{
+			name: "empty index follows the largest integer index",
+			values: orderedData{
+				{
+					key:   "key[5][name]",
+					value: []string{"a"},
+				},
+				{
+					key:   "key[x][name]",
+					value: []string{"b"},
+				},
+				{
+					key:   "key[][name]",
+					value: []string{"c"},
+				},
+				{
+					key:   "key[][tags][]",
+					value: []string{"d", "e"},
+				},
+			},
+			wantVal: dataTree{
+				"5": dataTree{"name": "a"},
+				"x": dataTree{"name": "b"},
+				"6": dataTree{"name": "c"},
+				"7": dataTree{"tags": []string{"d"}},
+				"8": dataTree{"tags": []string{"e"}},
+			},
+		},
 	}
 
 	for _, tt := range testCases {
@@ -348,6 +635,16 @@ func TestFileTreePush(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "repeated bare key keeps the last file",
+			values: orderedData{
+				{
+					key:   "key",
+					value: []*FileUpload{{Name: "value1"}, {Name: "value2"}, {Name: "value3"}},
+				},
+			},
+			wantVal: &FileUpload{Name: "value3"},
+		},
 		{
 			name: "old value should get overwritten by not empty value",
 			values: orderedData{
@@ -492,6 +789,24 @@ func TestFileTreePush(t *testing.T) {
 			},
 			wantErr: errors.New("invalid multiple values to key 'key' in tree"),
 		},
+		{
+			name: "empty index in the middle of the path appends an element per upload",
+			values: orderedData{
+				{
+					key:   "key[][doc]",
+					value: []*FileUpload{{Name: "a"}, {Name: "b"}},
+				},
+				{
+					key:   "key[][doc]",
+					value: []*FileUpload{{Name: "c"}},
+				},
+			},
+			wantVal: fileTree{
+				"0": fileTree{"doc": &FileUpload{Name: "a"}},
+				"1": fileTree{"doc": &FileUpload{Name: "b"}},
+				"2": fileTree{"doc": &FileUpload{Name: "c"}},
+			},
+		},
 	}
 
 	for _, tt := range testCases {
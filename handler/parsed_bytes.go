@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// checkParsedBytes rejects the parsed request retaining more than max_total_parsed_bytes with 413, see
+// config.Parse.MaxTotalParsedBytes. The per-dimension limits each bound a single tree, the joint one bounds their sum.
+func (h *Handler) checkParsedBytes(req *Request) error {
+	if h.maxParsedBytes <= 0 {
+		return nil
+	}
+
+	n := req.parsedBytes()
+	if n <= h.maxParsedBytes {
+		return nil
+	}
+
+	return newParseError(ParseErrorBodyTooLarge, errors.Errorf("parsed request retains %d bytes, exceeds the limit of %d bytes", n, h.maxParsedBytes)).
+		with(ParseErrorCodeLimitExceeded, fmt.Sprintf("send at most %d bytes of the form fields and the in-memory files", h.maxParsedBytes))
+}
+
+// parsedBytes returns the memory the parsed request retains: the keys and the scalars of the data tree, the keys of
+// the file tree, the names and the media types of the uploads and the contents of the uploads kept in memory (not
+// stored in the temp files yet).
+func (r *Request) parsedBytes() int64 {
+	n := int64(0)
+	if data, ok := r.body.(dataTree); ok && r.Parsed {
+		n += data.bytes()
+	}
+
+	if r.Uploads == nil {
+		return n
+	}
+
+	n += r.Uploads.tree.keyBytes()
+	for _, f := range r.Uploads.list {
+		n += int64(len(f.Name) + len(f.Mime))
+		if fp, ok := f.source.(*filePart); ok && fp.tmpfile == "" {
+			n += int64(len(fp.content))
+		}
+	}
+
+	return n
+}
+
+// bytes returns the summed length of the keys and the scalars of the tree, the typed scalars count as their string
+// form.
+func (dt dataTree) bytes() int64 {
+	n := int64(0)
+	for k, v := range dt {
+		n += int64(len(k))
+		switch actual := v.(type) {
+		case dataTree:
+			n += actual.bytes()
+		case []string:
+			for _, s := range actual {
+				n += int64(len(s))
+			}
+		case []any:
+			for _, s := range actual {
+				n += int64(len(typedScalarString(s)))
+			}
+		default:
+			n += int64(len(typedScalarString(actual)))
+		}
+	}
+
+	return n
+}
+
+// keyBytes returns the summed length of the keys of the tree.
+func (ft fileTree) keyBytes() int64 {
+	n := int64(0)
+	for k, v := range ft {
+		n += int64(len(k))
+		if branch, ok := v.(fileTree); ok {
+			n += branch.keyBytes()
+		}
+	}
+
+	return n
+}
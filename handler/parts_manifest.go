@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/textproto"
+)
+
+// PartsManifestAttribute carries the JSON encoded list of the multipart/form-data parts in the order they were sent,
+// see config.Parse.PartsManifest.
+const PartsManifestAttribute string = "Parts-Manifest"
+
+// manifestPart is the entry of the parts manifest. The size is the number of the content bytes kept, 0 for the
+// rejected files.
+type manifestPart struct {
+	Name        string `json:"name"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size"`
+}
+
+// record appends the part to the manifest of the form, when the manifest is enabled.
+func (mf *multipartForm) record(opts *multipartOptions, name, filename string, header textproto.MIMEHeader, size int64) {
+	if !opts.partsManifest {
+		return
+	}
+
+	mf.manifest = append(mf.manifest, manifestPart{
+		Name:        name,
+		Filename:    filename,
+		ContentType: header.Get("Content-Type"),
+		Size:        size,
+	})
+}
+
+// setManifest sets the Parts-Manifest attribute of the request, the empty form gets the empty list.
+func (mf *multipartForm) setManifest(req *Request, opts *multipartOptions) error {
+	if !opts.partsManifest {
+		return nil
+	}
+
+	parts := mf.manifest
+	if parts == nil {
+		parts = []manifestPart{}
+	}
+
+	b, err := json.Marshal(parts)
+	if err != nil {
+		return err
+	}
+
+	req.setAttribute(PartsManifestAttribute, string(b))
+
+	return nil
+}
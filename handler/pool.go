@@ -60,6 +60,14 @@ func (h *Handler) getReq(r *http.Request) *Request {
 
 	req.Parsed = false
 	req.body = nil
+	req.form = nil
+	req.protobufTrees = h.protobufTrees
+	req.deterministic = h.deterministic
+	req.space = h.uploads.quota.space(r.Context())
+	if req.protobufTrees {
+		req.setAttribute(BodyEncodingAttribute, BodyEncodingProtobuf)
+	}
+
 	return req
 }
 
@@ -75,6 +83,17 @@ func (h *Handler) putReq(req *Request) {
 	req.Uploads = nil
 	req.Attributes = nil
 	req.body = nil
+	req.form = nil
+	req.lazy = 0
+	req.protobufTrees = false
+	req.deterministic = false
+	req.space = nil
+	req.requestID = ""
+	req.cost = 0
+	req.parseSummary = ""
+	req.selected = nil
+	req.warnings = nil
+	req.log = nil
 
 	h.reqPool.Put(req)
 }
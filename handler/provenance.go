@@ -0,0 +1,73 @@
+package handler
+
+// RequestParamsSourcesAttribute carries the JSON encoded sources of the Request-Params values, the tree of the same
+// shape with the source letter (G, P or C) of each leaf, see config.Parse.TrackSources.
+const RequestParamsSourcesAttribute string = "Request-Params-Sources"
+
+// Source is where a merged request value came from, the letters of config.Parse.RequestOrder.
+type Source byte
+
+const (
+	// SourceQuery is the URL query.
+	SourceQuery Source = 'G'
+	// SourceBody is the parsed body.
+	SourceBody Source = 'P'
+	// SourceCookie is the Cookie header.
+	SourceCookie Source = 'C'
+)
+
+// String returns the letter of the source.
+func (s Source) String() string {
+	return string(s)
+}
+
+// MarshalText encodes the source as its letter.
+func (s Source) MarshalText() ([]byte, error) {
+	return []byte{byte(s)}, nil
+}
+
+// sourceTags tags the nodes merged into the tree with their source. The tags tree mirrors the branches of the merged
+// tree, its leaves are the Source of the merged leaves. The tags are only kept when they are tracked, a nil
+// *sourceTags ignores the calls.
+type sourceTags struct {
+	tree   dataTree
+	source Source
+}
+
+// set tags the node merged at the key, every leaf of a merged branch gets the source.
+func (st *sourceTags) set(k string, node any) {
+	if st == nil {
+		return
+	}
+
+	st.tree[k] = st.tag(node)
+}
+
+func (st *sourceTags) tag(node any) any {
+	branch, ok := node.(dataTree)
+	if !ok {
+		return st.source
+	}
+
+	tags := make(dataTree, len(branch))
+	for k, v := range branch {
+		tags[k] = st.tag(v)
+	}
+
+	return tags
+}
+
+// child returns the tags of the branch at the key, merged into the existing branch.
+func (st *sourceTags) child(k string) *sourceTags {
+	if st == nil {
+		return nil
+	}
+
+	tags, ok := st.tree[k].(dataTree)
+	if !ok {
+		tags = make(dataTree)
+		st.tree[k] = tags
+	}
+
+	return &sourceTags{tree: tags, source: st.source}
+}
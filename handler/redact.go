@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"path"
+	"strings"
+)
+
+// redacted replaces the values of the sensitive fields in the log output.
+const redacted = "[REDACTED]"
+
+// fieldPatterns match the fields by their leaf name or their full dot path (user.password), the patterns use the
+// path.Match syntax and are case-insensitive.
+type fieldPatterns []string
+
+func newFieldPatterns(patterns []string) fieldPatterns {
+	fp := make(fieldPatterns, 0, len(patterns))
+	for _, p := range patterns {
+		fp = append(fp, strings.ToLower(p))
+	}
+
+	return fp
+}
+
+// match reports whether the field at the path matches any of the patterns.
+func (fp fieldPatterns) match(keys ...string) bool {
+	if len(keys) == 0 || len(fp) == 0 {
+		return false
+	}
+
+	leaf := strings.ToLower(keys[len(keys)-1])
+	full := strings.ToLower(strings.Join(keys, "."))
+	for _, p := range fp {
+		if ok, _ := path.Match(p, leaf); ok {
+			return true
+		}
+
+		if ok, _ := path.Match(p, full); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redactor hides the values of the sensitive fields in the diagnostic logs, the fields are matched by the patterns.
+type redactor struct {
+	patterns fieldPatterns
+}
+
+func newRedactor(patterns []string) *redactor {
+	return &redactor{patterns: newFieldPatterns(patterns)}
+}
+
+// match reports whether the field at the path is sensitive.
+func (rd *redactor) match(keys ...string) bool {
+	return rd.patterns.match(keys...)
+}
+
+// value returns the value to be logged for the field at the path.
+func (rd *redactor) value(v string, keys ...string) string {
+	if rd.match(keys...) {
+		return redacted
+	}
+
+	return v
+}
+
+// tree returns the copy of the data tree to be logged, the sensitive values (whole branches included) are replaced.
+func (rd *redactor) tree(dt dataTree) map[string]any {
+	return rd.node(dt, nil)
+}
+
+func (rd *redactor) node(dt dataTree, prefix []string) map[string]any {
+	out := make(map[string]any, len(dt))
+	for k, v := range dt {
+		keys := append(prefix[:len(prefix):len(prefix)], k)
+		if rd.match(keys...) {
+			out[k] = redacted
+			continue
+		}
+
+		switch actual := v.(type) {
+		case dataTree:
+			out[k] = rd.node(actual, keys)
+		case []string:
+			out[k] = append([]string(nil), actual...)
+		default:
+			out[k] = v
+		}
+	}
+
+	return out
+}
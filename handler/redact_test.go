@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/roadrunner-server/http/v5/config"
+	"github.com/roadrunner-server/http/v5/handler/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedactor(t *testing.T) {
+	rd := newRedactor([]string{"*password*", "token", "user.ssn"})
+
+	assert.True(t, rd.match("password"))
+	assert.True(t, rd.match("user", "new_Password"))
+	assert.True(t, rd.match("auth", "token"))
+	assert.True(t, rd.match("user", "ssn"))
+	assert.False(t, rd.match("admin", "ssn"))
+	assert.False(t, rd.match("tokens"))
+	assert.False(t, rd.match())
+
+	dt := dataTree{
+		"name":     "n",
+		"password": "secret",
+		"user": dataTree{
+			"ssn":  "123",
+			"tags": []string{"a"},
+		},
+		"admin": dataTree{"ssn": "456"},
+		"token": dataTree{"value": "t"},
+	}
+
+	assert.Equal(t, map[string]any{
+		"name":     "n",
+		"password": redacted,
+		"user":     map[string]any{"ssn": redacted, "tags": []string{"a"}},
+		"admin":    map[string]any{"ssn": "456"},
+		"token":    redacted,
+	}, rd.tree(dt))
+	// the tree itself is not modified
+	assert.Equal(t, "secret", dt["password"])
+}
+
+func TestHandler_RedactedDebugLog(t *testing.T) {
+	parse := &config.Parse{MethodOverrideField: "_password"}
+	require.NoError(t, parse.InitDefaults())
+	h, _ := newTestHandler(t, &config.Config{Parse: parse})
+
+	core, logs := observer.New(zap.DebugLevel)
+	h.log = zap.New(core)
+
+	r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{
+		"login":          {"user"},
+		"password":       {"hunter2"},
+		"_password":      {"hunter2"},
+		"profile[ssn]":   {"123"},
+		"api[csrfToken]": {"t"},
+	})
+	require.NoError(t, h.request(r, newTestRequest(r)))
+
+	entries := logs.FilterMessage("request body parsed").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, map[string]any{
+		"login":     "user",
+		"password":  redacted,
+		"_password": redacted,
+		"profile":   map[string]any{"ssn": redacted},
+		"api":       map[string]any{"csrfToken": redacted},
+	}, entries[0].ContextMap()["fields"])
+
+	entries = logs.FilterMessage("method override ignored").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, redacted, entries[0].ContextMap()["value"])
+}
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	stderr "errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// relatedBody is the multipart/related body (RFC 2387): the root part and the parts it references by Content-ID.
+type relatedBody struct {
+	// the related parts keyed by their Content-ID, or by their position when they have none
+	form *multipartForm
+	// the root part kept in memory, nil if it's stored with the other parts
+	root    *filePart
+	rootKey string
+	// the Content-Type of the root part, the type parameter if the part has none
+	rootType string
+}
+
+// readRelated reads the multipart/related body of the request. The root part is the one referenced by the start
+// parameter, the first part by default.
+func readRelated(r *http.Request, opts *multipartOptions, space *tempSpace) (*relatedBody, error) {
+	const op = errors.Op("read_related")
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, errors.E(op, multipartErr(err))
+	}
+
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, errors.E(op, multipartErr(http.ErrMissingBoundary))
+	}
+
+	rb := &relatedBody{
+		form: &multipartForm{
+			values:      make(map[string][]string),
+			files:       make(map[string][]*filePart),
+			literal:     make(map[string]struct{}),
+			tempPattern: opts.tempPattern,
+			boundary:    boundary,
+			space:       space,
+		},
+		rootType: params["type"],
+	}
+
+	body := opts.framing(r.Body, boundary, &rb.form.warnings)
+	err = rb.read(multipart.NewReader(body, boundary), opts, contentID(params["start"]))
+	if err == nil {
+		err = opts.readEpilogue(body)
+	}
+	if err != nil {
+		_ = rb.form.removeAll()
+		return nil, errors.E(op, partError(err))
+	}
+
+	return rb, nil
+}
+
+func (rb *relatedBody) read(mr *multipart.Reader, opts *multipartOptions, start string) error {
+	maxMemory := opts.maxMemory
+	fallback := opts.fallbackMemory
+	maxHeaders := int64(maxFormHeaders)
+	parts := 0
+
+	for {
+		p, err := mr.NextPart()
+		if stderr.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// all the part headers are kept
+		if headerEntries(p.Header) > maxHeaders {
+			return multipart.ErrMessageTooLarge
+		}
+
+		maxHeaders -= headerEntries(p.Header)
+
+		parts++
+		rb.form.parts = parts
+		if parts > maxMultipartParts {
+			return multipart.ErrMessageTooLarge
+		}
+
+		err = checkPartHeaders(p.Header, opts, &rb.form.warnings)
+		if err != nil {
+			return err
+		}
+
+		key := contentID(p.Header.Get("Content-ID"))
+		if key == "" {
+			key = strconv.Itoa(parts - 1)
+		}
+
+		if _, ok := rb.form.files[key]; ok || (rb.root != nil && rb.rootKey == key) {
+			return multipartErr(errors.Errorf("duplicate multipart/related part Content-ID: %s", key))
+		}
+
+		fp := &filePart{header: p.Header, space: rb.form.space}
+
+		declared, err := partContentLength(p.Header)
+		if err != nil {
+			return err
+		}
+
+		src := io.Reader(p)
+		if opts.maxFileSize > 0 {
+			// one byte more to detect the oversize parts
+			src = io.LimitReader(p, opts.maxFileSize+1)
+		}
+
+		err = fp.readContent(src, declared, maxMemory, &fallback, opts)
+		if err != nil {
+			return err
+		}
+
+		if fp.rejected == UploadErrorOK && fp.tmpfile == "" && !fp.fallback {
+			maxMemory -= fp.size
+		}
+
+		if (start == "" && parts == 1) || (start != "" && key == start) {
+			rb.rootKey = key
+			if ct := fp.header.Get("Content-Type"); ct != "" {
+				rb.rootType = ct
+			}
+
+			if fp.rejected == UploadErrorOK && fp.tmpfile == "" {
+				rb.root = fp
+				continue
+			}
+		}
+
+		rb.form.files[key] = []*filePart{fp}
+		rb.form.literal[key] = struct{}{}
+	}
+
+	switch {
+	case parts == 0:
+		return multipartErr(errors.Str("multipart/related body has no parts"))
+	case rb.rootKey == "":
+		return multipartErr(errors.Errorf("multipart/related start part not found: %s", start))
+	default:
+		return nil
+	}
+}
+
+// contentID returns the Content-ID header value (or the start parameter) without the angle brackets.
+func contentID(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) >= 2 && v[0] == '<' && v[len(v)-1] == '>' {
+		v = v[1 : len(v)-1]
+	}
+
+	return v
+}
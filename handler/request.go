@@ -6,7 +6,6 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"strings"
 
 	httpV1proto "github.com/roadrunner-server/api/v4/build/http/v1"
@@ -16,12 +15,34 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+const (
+	// TrailerAttributePrefix is the prefix of the attributes the request trailers are passed to the worker with.
+	TrailerAttributePrefix string = "Trailer:"
+	// UploadFieldAttribute is the form field name of the single upload sent to the worker as the body.
+	UploadFieldAttribute string = "Upload-Field"
+	// UploadNameAttribute is the client filename of the single upload sent to the worker as the body.
+	UploadNameAttribute string = "Upload-Name"
+	// UploadMimeAttribute is the client content type of the single upload sent to the worker as the body.
+	UploadMimeAttribute string = "Upload-Mime"
+	// RelatedRootAttribute is the uploads key (Content-ID) of the multipart/related root part.
+	RelatedRootAttribute string = "Related-Root"
+	// RelatedTypeAttribute is the Content-Type of the multipart/related root part.
+	RelatedTypeAttribute string = "Related-Type"
+)
+
 const (
 	defaultMaxMemory = 32 << 20 // 32 MB
 	contentNone      = iota + 900
 	contentStream
 	contentMultipart
 	contentURLEncoded
+	contentJSON
+	contentNDJSON
+	contentUnsupported
+	contentEmptyForm
+	contentMismatch
+	contentRelated
+	contentCBOR
 )
 
 // Request maps net/http requests to PSR7 compatible structure and managed state of temporary uploaded files.
@@ -48,6 +69,27 @@ type Request struct {
 	Attributes map[string][]string `json:"attributes"`
 	// request body can be parsedData or []byte
 	body any
+	// multipart form the uploads are read from
+	form *multipartForm
+	// the content type of the raw body deferred to the worker, 0 if the body isn't deferred, see config.Parse.LazyParse
+	lazy int
+	// the parsed body and the uploads are encoded as protobuf instead of JSON
+	protobufTrees bool
+	// the protobuf messages are serialized with the sorted map keys
+	deterministic bool
+	// the temp space reserved for the spilled parts and the uploads, released when the files are removed
+	space *tempSpace
+	// the weighted parse cost, 0 if disabled
+	cost float64
+	// the X-RR-Parse-Summary header value, empty when disabled
+	parseSummary string
+	// the keys of the subtrees sent to the worker, nil means the whole body, see config.Parse.SelectFields
+	selected [][]string
+	// the non-fatal warnings of the parse
+	warnings parseWarnings
+	// the correlation ID and the logger of the request, nil logger means the handler one
+	requestID string
+	log       *zap.Logger
 }
 
 func FetchIP(pair string, log *zap.Logger) string {
@@ -69,17 +111,66 @@ func FetchIP(pair string, log *zap.Logger) string {
 	return ip.String()
 }
 
-func request(r *http.Request, req *Request, uid, gid int, sendRawBody bool) error {
-	for _, c := range r.Cookies() {
-		if v, err := url.QueryUnescape(c.Value); err == nil {
-			req.Cookies[c.Name] = v
+func (h *Handler) request(r *http.Request, req *Request) error {
+	err := h.cookieLimits.read(r, req)
+	if err != nil {
+		return err
+	}
+
+	h.cookieDecoding.decode(req, h.logger(req))
+
+	req.readAuth(r)
+
+	err = req.readStructuredHeaders(r, h.structuredHeaders)
+	if err != nil {
+		return err
+	}
+
+	// nothing to parse, the body is never read, so no parse work or temp files happen for the handshake
+	if isUpgrade(r) {
+		return nil
+	}
+
+	err = h.decodeBody(r)
+	if err != nil {
+		return err
+	}
+
+	// starts with the first tree operation, once the body is read
+	dl := newParseDeadline(h.maxParseDuration)
+
+	ct := req.contentType(h.contentTypes, r.ContentLength, h.bodyMethods)
+	if h.strictContentType && !h.sendRawBody {
+		err = checkDeclaredType(r, ct)
+		if err != nil {
+			return err
 		}
 	}
 
-	switch req.contentType() {
+	if h.lazyParse.applies(r, ct) && !h.sendRawBody {
+		return req.bufferLazyBody(r, ct)
+	}
+
+	// the checkbox groups are filled in the forms only, the empty ones included
+	form := ct == contentURLEncoded || ct == contentMultipart
+	if !h.sendRawBody && isEmptyForm(r, ct, h.bodyMethods) {
+		ct = contentEmptyForm
+	}
+
+	switch ct {
 	case contentNone:
 		return nil
 
+	case contentEmptyForm:
+		// the form is present, but empty, the parsers are not run on the empty body
+		req.body = make(dataTree)
+
+	case contentUnsupported:
+		return newParseError(ParseErrorUnsupportedMediaType, errors.Str("request body without Content-Type header"))
+
+	case contentMismatch:
+		return mismatchErr(r, errors.Str("malformed Content-Type header"))
+
 	case contentStream:
 		var err error
 		req.body, err = io.ReadAll(r.Body)
@@ -89,8 +180,21 @@ func request(r *http.Request, req *Request, uid, gid int, sendRawBody bool) erro
 
 		return nil
 
+	case contentRelated:
+		if h.sendRawBody {
+			var err error
+			req.body, err = io.ReadAll(r.Body)
+			if err != nil {
+				return err
+			}
+
+			return nil
+		}
+
+		return h.parseRelated(r, req, dl)
+
 	case contentMultipart:
-		if sendRawBody {
+		if h.sendRawBody {
 			var err error
 			req.body, err = io.ReadAll(r.Body)
 			if err != nil {
@@ -100,24 +204,47 @@ func request(r *http.Request, req *Request, uid, gid int, sendRawBody bool) erro
 			return nil
 		}
 
-		err := r.ParseMultipartForm(defaultMaxMemory)
+		var err error
+		req.form, err = readMultipart(r, &h.multipartOpts, req.space)
+		if err != nil {
+			return h.declaredTypeErr(r, err)
+		}
+
+		err = req.form.setManifest(req, &h.multipartOpts)
 		if err != nil {
 			return err
 		}
 
-		req.Uploads, err = parseUploads(r, uid, gid)
+		if f := req.form.single; f != nil {
+			// the fields validation and the expected files need the parsed form
+			if h.fieldRules == nil && h.expectedFiles == nil {
+				req.streamUpload(req.form.singleName, f)
+				return nil
+			}
+
+			req.form.storeSingle()
+		}
+
+		req.Uploads, err = parseUploads(req.form, h.uid, h.gid, dl)
+		if err != nil {
+			return err
+		}
+
+		err = h.expectedFiles.fill(req.Uploads)
 		if err != nil {
 			return err
 		}
 
-		req.body, err = parseMultipartData(r)
+		h.tagUploads(r, req.Uploads)
+
+		req.body, err = parseMultipartData(req.form, dl)
 		if err != nil {
 			return err
 		}
 
 		req.Parsed = true
 	case contentURLEncoded:
-		if sendRawBody {
+		if h.sendRawBody {
 			var err error
 			req.body, err = io.ReadAll(r.Body)
 			if err != nil {
@@ -127,12 +254,71 @@ func request(r *http.Request, req *Request, uid, gid int, sendRawBody bool) erro
 			return nil
 		}
 
-		err := r.ParseForm()
+		// the small forms always take the scanner fast path
+		if h.zeroCopyURLEncoded || isSmallForm(r) {
+			var err error
+			req.body, err = scanURLEncodedBody(r, h.bodyMethods, h.phpArrayKeys, h.maxSiblings, h.namePattern, dl)
+			if err != nil {
+				return h.declaredTypeErr(r, err)
+			}
+
+			break
+		}
+
+		values, err := readURLEncoded(r, h.bodyMethods)
+		if err != nil {
+			return h.declaredTypeErr(r, err)
+		}
+
+		req.body, err = parsePostForm(values, h.phpArrayKeys, h.maxSiblings, h.namePattern, dl)
 		if err != nil {
 			return err
 		}
+	case contentJSON:
+		if h.sendRawBody {
+			var err error
+			req.body, err = io.ReadAll(r.Body)
+			if err != nil {
+				return err
+			}
 
-		req.body, err = parsePostForm(r)
+			return nil
+		}
+
+		var err error
+		req.body, err = parseJSONBody(r, h.unwrapPath, h.jsonArrayStream, h.jsonScalars, dl)
+		if err != nil {
+			return h.declaredTypeErr(r, err)
+		}
+	case contentCBOR:
+		if h.sendRawBody {
+			var err error
+			req.body, err = io.ReadAll(r.Body)
+			if err != nil {
+				return err
+			}
+
+			return nil
+		}
+
+		var err error
+		req.body, err = parseCBORBody(r, h.jsonScalars, dl)
+		if err != nil {
+			return h.declaredTypeErr(r, err)
+		}
+	case contentNDJSON:
+		if h.sendRawBody {
+			var err error
+			req.body, err = io.ReadAll(r.Body)
+			if err != nil {
+				return err
+			}
+
+			return nil
+		}
+
+		var err error
+		req.body, err = h.parseNDJSONBody(r, h.logger(req), &req.warnings, dl)
 		if err != nil {
 			return err
 		}
@@ -140,9 +326,114 @@ func request(r *http.Request, req *Request, uid, gid int, sendRawBody bool) erro
 	}
 
 	req.Parsed = true
+	if data, ok := req.body.(dataTree); ok && form {
+		err = h.nestedForms.decode(data, h.phpArrayKeys, h.maxSiblings, dl)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = h.fieldRules.validate(req)
+	if err != nil {
+		return err
+	}
+
+	if data, ok := req.body.(dataTree); ok && form {
+		h.checkboxes.apply(data)
+	}
+
+	if data, ok := req.body.(dataTree); ok {
+		h.trimQuotes.trimQuotes(data, nil)
+		h.collapseLists.collapseLists(data, nil)
+	}
+
+	err = h.checkParsedBytes(req)
+	if err != nil {
+		return err
+	}
+
+	h.setDiagnostics(r, req, ct, dl)
+
+	if data, ok := req.body.(dataTree); ok && h.log.Core().Enabled(zap.DebugLevel) {
+		h.logger(req).Debug("request body parsed", zap.String("method", req.Method), zap.String("uri", req.URI), zap.Any("fields", h.redactor.tree(data)))
+	}
+
+	h.overrideMethod(req)
+	h.fieldSelection.apply(r, req)
+	return nil
+}
+
+// parseRelated sends the root part of the multipart/related body to the worker as the raw body, and the parts it
+// references as the uploads keyed by their Content-ID. The root part which doesn't fit into memory is stored as the
+// other parts, the Related-Root attribute names it.
+func (h *Handler) parseRelated(r *http.Request, req *Request, dl *parseDeadline) error {
+	rb, err := readRelated(r, &h.multipartOpts, req.space)
+	if err != nil {
+		return h.declaredTypeErr(r, err)
+	}
+
+	req.form = rb.form
+	req.Uploads, err = parseUploads(rb.form, h.uid, h.gid, dl)
+	if err != nil {
+		return err
+	}
+
+	h.tagUploads(r, req.Uploads)
+
+	req.setAttribute(RelatedRootAttribute, rb.rootKey)
+	if rb.rootType != "" {
+		req.setAttribute(RelatedTypeAttribute, rb.rootType)
+	}
+
+	if rb.root != nil {
+		req.body = rb.root.content
+	}
+
+	return nil
+}
+
+// streamUpload sends the content of the single uploaded file to the worker as the raw body, without storing it in
+// the temp file. The file details are passed as attributes.
+func (r *Request) streamUpload(name string, f *filePart) {
+	r.body = f.content
+	r.setAttribute(UploadFieldAttribute, name)
+	r.setAttribute(UploadNameAttribute, f.filename)
+	r.setAttribute(UploadMimeAttribute, partMime(f.header))
+}
+
+// readTrailers drains the rest of the body, so the trailers declared by the client are received, and passes them to
+// the worker as attributes prefixed with "Trailer:".
+func (r *Request) readTrailers(hr *http.Request) error {
+	if len(hr.Trailer) == 0 || hr.Body == nil {
+		return nil
+	}
+
+	// trailers are populated only when the body is read till the end
+	_, err := io.Copy(io.Discard, hr.Body)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range hr.Trailer {
+		if len(v) == 0 {
+			continue
+		}
+
+		r.setAttribute(TrailerAttributePrefix+k, v...)
+	}
+
 	return nil
 }
 
+// setAttribute sets the attribute passed to the worker, replacing the existing values.
+func (r *Request) setAttribute(key string, values ...string) {
+	if r.Attributes == nil {
+		r.Attributes = make(map[string][]string, 1)
+	}
+
+	r.Attributes[key] = values
+}
+
 // Open moves all uploaded files to temporary directory so it can be given to php later.
 func (r *Request) Open(log *zap.Logger, dir string, forbid, allow map[string]struct{}) {
 	if r.Uploads == nil {
@@ -152,16 +443,34 @@ func (r *Request) Open(log *zap.Logger, dir string, forbid, allow map[string]str
 	r.Uploads.Open(log, dir, forbid, allow)
 }
 
+// open is Open with the open files limit.
+func (r *Request) open(log *zap.Logger, dir string, forbid, allow map[string]struct{}, of *openFiles) error {
+	if r.Uploads == nil {
+		return nil
+	}
+
+	return r.Uploads.open(log, dir, forbid, allow, of, r.space)
+}
+
 // Close clears all temp file uploads
 func (r *Request) Close(log *zap.Logger, hr *http.Request) {
-	if r.Uploads == nil {
-		return
+	if r.form != nil {
+		err := r.form.removeAll()
+		if err != nil && log != nil {
+			log.Error("error removing the multipart files", zap.Error(err))
+		}
+		r.form = nil
 	}
 
-	r.Uploads.Clear(log)
-	if hr.MultipartForm != nil {
-		_ = hr.MultipartForm.RemoveAll()
+	if r.Uploads != nil {
+		r.Uploads.Clear(log)
+		if hr.MultipartForm != nil {
+			_ = hr.MultipartForm.RemoveAll()
+		}
 	}
+
+	r.space.freeAll()
+	r.space = nil
 }
 
 // Payload request marshaled RoadRunner payload based on PSR7 data. values encode method is JSON. Make sure to open
@@ -170,7 +479,16 @@ func (r *Request) Payload(p *payload.Payload, sendRawBody bool, req *httpV1proto
 	const op = errors.Op("marshal_payload")
 
 	if r.Uploads != nil {
-		data, err := json.Marshal(r.Uploads)
+		var data []byte
+		var err error
+		switch {
+		case r.protobufTrees:
+			data, err = r.protoMarshal(fileTreeStruct(r.uploadsTree()))
+		case r.selected != nil:
+			data, err = json.Marshal(r.uploadsTree())
+		default:
+			data, err = json.Marshal(r.Uploads)
+		}
 		if err != nil {
 			return errors.E(op, err)
 		}
@@ -179,7 +497,7 @@ func (r *Request) Payload(p *payload.Payload, sendRawBody bool, req *httpV1proto
 	}
 
 	var err error
-	p.Context, err = proto.Marshal(req)
+	p.Context, err = r.protoMarshal(req)
 	if err != nil {
 		return errors.E(op, err)
 	}
@@ -211,7 +529,7 @@ func (r *Request) Payload(p *payload.Payload, sendRawBody bool, req *httpV1proto
 
 			return nil
 		case dataTree:
-			err = packDataTree(bdy, p)
+			err = r.packDataTree(r.dataTree(bdy), p)
 			if err != nil {
 				return errors.E(op, err)
 			}
@@ -228,7 +546,7 @@ func (r *Request) Payload(p *payload.Payload, sendRawBody bool, req *httpV1proto
 		case []byte:
 			p.Body = t
 		case dataTree:
-			err = packDataTree(t, p)
+			err = r.packDataTree(r.dataTree(t), p)
 			if err != nil {
 				return errors.E(op, err)
 			}
@@ -242,22 +560,50 @@ func (r *Request) Payload(p *payload.Payload, sendRawBody bool, req *httpV1proto
 	return nil
 }
 
-// contentType returns the payload content type.
-func (r *Request) contentType() int {
-	if r.Method == "HEAD" || r.Method == "OPTIONS" {
-		return contentNone
+// dataTree returns the part of the body tree sent to the worker.
+func (r *Request) dataTree(t dataTree) dataTree {
+	if r.selected == nil {
+		return t
+	}
+
+	return selectTree(t, r.selected)
+}
+
+// uploadsTree returns the part of the uploads tree sent to the worker.
+func (r *Request) uploadsTree() fileTree {
+	if r.selected == nil {
+		return r.Uploads.tree
 	}
 
-	ct := r.Header.Get("Content-Type")
-	if strings.Contains(ct, "application/x-www-form-urlencoded") {
-		return contentURLEncoded
+	return selectTree(r.Uploads.tree, r.selected)
+}
+
+// contentType returns the payload content type. contentLength is the declared body length, -1 if unknown.
+func (r *Request) contentType(cts *contentTypes, contentLength int64, bm bodyMethods) int {
+	if !bm.read(r.Method) {
+		return contentNone
 	}
 
-	if strings.Contains(ct, "multipart/form-data") {
-		return contentMultipart
+	return cts.match(r.Header.Get("Content-Type"), contentLength != 0)
+}
+
+// isEmptyForm reports whether the request is a form submission with the empty body (Content-Length: 0), so the
+// worker gets the empty, but parsed form, unlike the GET requests which have no form at all. The bodies of unknown
+// length (chunked) are parsed as usual.
+func isEmptyForm(r *http.Request, ct int, bm bodyMethods) bool {
+	if r.ContentLength != 0 || !bm.form(r.Method) {
+		return false
 	}
 
-	return contentStream
+	switch ct {
+	case contentURLEncoded, contentMultipart, contentJSON, contentNDJSON, contentCBOR:
+		return true
+	case contentStream:
+		// no Content-Type, the form would have been sent without one
+		return r.Header.Get("Content-Type") == ""
+	default:
+		return false
+	}
 }
 
 // URI fetches full uri from request in a form of string (including https scheme if TLS connection is enabled).
@@ -278,13 +624,23 @@ func URI(r *http.Request) string {
 	return fmt.Sprintf("http://%s%s", r.Host, uri)
 }
 
-func packDataTree(t dataTree, p *payload.Payload) error {
+// protoMarshal serializes the message, in the deterministic mode the map entries are sorted by their keys.
+func (r *Request) protoMarshal(m proto.Message) ([]byte, error) {
+	return proto.MarshalOptions{Deterministic: r.deterministic}.Marshal(m)
+}
+
+// packDataTree encodes the parsed body, the JSON objects always have the sorted keys.
+func (r *Request) packDataTree(t dataTree, p *payload.Payload) error {
 	if len(t) == 0 {
 		return nil
 	}
 
 	var err error
-	p.Body, err = json.Marshal(t)
+	if r.protobufTrees {
+		p.Body, err = r.protoMarshal(dataTreeStruct(t))
+	} else {
+		p.Body, err = json.Marshal(t)
+	}
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/roadrunner-server/http/v5/config"
+	"go.uber.org/zap"
+)
+
+// RequestIDAttribute is the attribute the request correlation ID is passed to the worker with.
+const RequestIDAttribute string = "REQUEST_ID"
+
+// maxRequestIDLength is the longest request ID accepted from the client.
+const maxRequestIDLength = 128
+
+// requestID reads the correlation ID of the request, or generates one.
+type requestID struct {
+	header string
+	// nil means the requests without the ID are left as they are
+	generate func() (uuid.UUID, error)
+}
+
+// newRequestID returns nil when the request ID is disabled.
+func newRequestID(cfg *config.RequestID) *requestID {
+	if cfg == nil {
+		return nil
+	}
+
+	ri := &requestID{header: http.CanonicalHeaderKey(cfg.Header)}
+	switch cfg.Generate {
+	case config.RequestIDGenerateUUIDv7:
+		ri.generate = uuid.NewV7
+	case config.RequestIDGenerateNone:
+	default:
+		ri.generate = uuid.NewRandom
+	}
+
+	return ri
+}
+
+// resolve returns the ID of the request: the client one, or the generated one when the client ID is missing or
+// invalid. The generated ID replaces the request header, so the worker sees the same ID in the headers, and the ID is
+// echoed in the response header. Empty means the request has no ID.
+func (ri *requestID) resolve(w http.ResponseWriter, r *http.Request) string {
+	if ri == nil {
+		return ""
+	}
+
+	id := r.Header.Get(ri.header)
+	if !validRequestID(id) {
+		id = ""
+		if ri.generate != nil {
+			u, err := ri.generate()
+			if err == nil {
+				id = u.String()
+			}
+		}
+
+		r.Header.Del(ri.header)
+		if id != "" {
+			r.Header.Set(ri.header, id)
+		}
+	}
+
+	if id != "" {
+		w.Header().Set(ri.header, id)
+	}
+
+	return id
+}
+
+// logger returns the logger of the request, with the request ID attached.
+func (h *Handler) logger(req *Request) *zap.Logger {
+	if req.log != nil {
+		return req.log
+	}
+
+	return h.log
+}
+
+// validRequestID accepts the IDs of the visible ASCII characters, so the ID can't break the log lines or the headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
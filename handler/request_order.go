@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"encoding/json"
+	stderr "errors"
+	"net/http"
+	"net/url"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// RequestParamsAttribute carries the JSON encoded $_REQUEST equivalent, the query, body and cookie parameters
+// merged in the configured order, see config.Parse.RequestOrder.
+const RequestParamsAttribute string = "Request-Params"
+
+// ParamsInspector is the native middleware inspecting the merged request parameters (config.Parse.RequestOrder),
+// with track_sources the view reports the source of each value (DataView.Source), so the inspector can require a
+// field to come from the body and not from the query. A non-nil error rejects the request the same way the
+// BodyInspector errors do.
+type ParamsInspector interface {
+	InspectParams(r *http.Request, params DataView) error
+}
+
+// requestOrder merges the request parameters the way PHP builds $_REQUEST: the sources are merged in the order of
+// the letters (G query, P body, C cookies) and the later ones override the earlier keys.
+type requestOrder struct {
+	order   string
+	phpKeys bool
+	// tag the merged values with their source
+	trackSources bool
+}
+
+// newRequestOrder returns nil when the merge is disabled.
+func newRequestOrder(order string, phpKeys, trackSources bool) *requestOrder {
+	if order == "" {
+		return nil
+	}
+
+	return &requestOrder{order: order, phpKeys: phpKeys, trackSources: trackSources}
+}
+
+// mergeParams merges the request parameters and runs the params inspectors on the merged view.
+func (h *Handler) mergeParams(hr *http.Request, req *Request, log *zap.Logger) error {
+	params, err := h.requestOrder.merge(req, log)
+	if err != nil || params.tree == nil {
+		return err
+	}
+
+	for _, in := range h.paramsInspectors {
+		err = in.InspectParams(hr, params)
+		if err != nil {
+			var pe *ParseError
+			if stderr.As(err, &pe) {
+				return err
+			}
+
+			return newParseError(ParseErrorInvalidFields, errors.E(errors.Op("inspect_params"), err))
+		}
+	}
+
+	return nil
+}
+
+// merge sets the Request-Params attribute of the request, and the Request-Params-Sources one when the sources are
+// tracked. The query and the cookie names are split the same way the body keys are, the uploads are not a part of
+// $_REQUEST.
+func (ro *requestOrder) merge(req *Request, log *zap.Logger) (DataView, error) {
+	if ro == nil {
+		return DataView{}, nil
+	}
+
+	merged := make(dataTree)
+	var sources dataTree
+	if ro.trackSources {
+		sources = make(dataTree)
+	}
+
+	for _, source := range ro.order {
+		var tree dataTree
+		switch source {
+		case 'G':
+			query, err := url.ParseQuery(req.RawQuery)
+			if err != nil {
+				// the worker parses the query on its own, only the well-formed pairs are merged
+				log.Debug("query parse error", zap.Error(err))
+			}
+
+			tree = ro.tree(query)
+		case 'P':
+			tree, _ = req.body.(dataTree)
+		case 'C':
+			cookies := make(url.Values, len(req.Cookies))
+			for k, v := range req.Cookies {
+				cookies[k] = []string{v}
+			}
+
+			tree = ro.tree(cookies)
+		}
+
+		var tags *sourceTags
+		if sources != nil {
+			tags = &sourceTags{tree: sources, source: Source(source)}
+		}
+
+		err := mergeTree(merged, tree, MergeOverride, tags)
+		if err != nil {
+			return DataView{}, err
+		}
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return DataView{}, err
+	}
+
+	req.setAttribute(RequestParamsAttribute, string(data))
+
+	if sources != nil {
+		data, err = json.Marshal(sources)
+		if err != nil {
+			return DataView{}, err
+		}
+
+		req.setAttribute(RequestParamsSourcesAttribute, string(data))
+	}
+
+	return DataView{tree: merged, sources: sources}, nil
+}
+
+// tree builds the tree of the query or cookie values. Unlike the body, the query and the cookies aren't rejected,
+// the key colliding as a value and as an array is skipped.
+func (ro *requestOrder) tree(values url.Values) dataTree {
+	tree := make(dataTree, len(values))
+	for k, v := range values {
+		_ = tree.pushIndexes(splitKey(k, ro.phpKeys), v, 0)
+	}
+
+	return tree
+}
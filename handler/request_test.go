@@ -0,0 +1,1516 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roadrunner-server/http/v5/config"
+	"github.com/roadrunner-server/http/v5/handler/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func newTestRequest(r *http.Request) *Request {
+	return &Request{
+		Method:     r.Method,
+		Header:     r.Header,
+		Cookies:    make(map[string]string),
+		Attributes: make(map[string][]string),
+	}
+}
+
+func TestRequest_URLEncoded(t *testing.T) {
+	r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{
+		"key":             {"value"},
+		"arr[]":           {"a", "b"},
+		"nested[k][name]": {"n"},
+	})
+
+	h, _ := newTestHandler(t, &config.Config{})
+	req := newTestRequest(r)
+	require.NoError(t, h.request(r, req))
+
+	assert.True(t, req.Parsed)
+	assert.Equal(t, dataTree{
+		"key": "value",
+		"arr": []string{"a", "b"},
+		"nested": dataTree{
+			"k": dataTree{
+				"name": "n",
+			},
+		},
+	}, req.body)
+}
+
+func TestRequest_Multipart(t *testing.T) {
+	r := handlertest.NewMultipart().
+		Field("name", "value").
+		Field("arr[a]", "1").
+		File("upload", "file.txt", "text/plain", []byte("hello")).
+		Request(http.MethodPost, "/")
+
+	h, _ := newTestHandler(t, &config.Config{})
+	req := newTestRequest(r)
+	require.NoError(t, h.request(r, req))
+	defer req.Close(nil, r)
+
+	assert.True(t, req.Parsed)
+	assert.Equal(t, dataTree{
+		"name": "value",
+		"arr":  dataTree{"a": "1"},
+	}, req.body)
+
+	require.NotNil(t, req.Uploads)
+	require.Len(t, req.Uploads.list, 1)
+	assert.Equal(t, "file.txt", req.Uploads.list[0].Name)
+	assert.Equal(t, "text/plain", req.Uploads.list[0].Mime)
+}
+
+func TestRequest_MultipartTruncated(t *testing.T) {
+	r := handlertest.NewMultipart().
+		Field("name", "value").
+		File("upload", "file.txt", "text/plain", []byte("hello world")).
+		Request(http.MethodPost, "/")
+
+	r = handlertest.Truncate(r, 100)
+
+	h, _ := newTestHandler(t, &config.Config{})
+	req := newTestRequest(r)
+	assert.Error(t, h.request(r, req))
+	req.Close(nil, r)
+}
+
+func TestRequest_Raw(t *testing.T) {
+	r := handlertest.NewJSONRequest(http.MethodPost, "/", `{"key":"value"}`)
+
+	h, _ := newTestHandler(t, &config.Config{})
+	req := newTestRequest(r)
+	require.NoError(t, h.request(r, req))
+
+	assert.Equal(t, []byte(`{"key":"value"}`), req.body)
+}
+
+func TestRequest_ContentTypes(t *testing.T) {
+	h, _ := newTestHandler(t, &config.Config{
+		Parse: &config.Parse{
+			ContentTypes: []*config.ContentType{
+				{Pattern: "application/vnd.myapp+form", Parser: config.ParserURLEncoded},
+				{Pattern: "+json", Parser: config.ParserJSON},
+				{Pattern: "text/*", Parser: config.ParserRaw},
+				{Pattern: "application/vnd.myapp.upload", Parser: config.ParserMultipart},
+			},
+		},
+	})
+
+	t.Run("exact", func(t *testing.T) {
+		r := handlertest.NewRawRequest(http.MethodPost, "/", "application/vnd.myapp+form; charset=utf-8", []byte("a=1&b[c]=2"))
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+
+		assert.True(t, req.Parsed)
+		assert.Equal(t, dataTree{"a": "1", "b": dataTree{"c": "2"}}, req.body)
+	})
+
+	t.Run("suffix", func(t *testing.T) {
+		r := handlertest.NewRawRequest(http.MethodPost, "/", "application/vnd.api+json",
+			[]byte(`{"a":1,"b":{"c":true,"d":null},"e":["x","y"],"f":[{"g":"h"}]}`))
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+
+		assert.True(t, req.Parsed)
+		assert.Equal(t, dataTree{
+			"a": "1",
+			"b": dataTree{"c": "1", "d": ""},
+			"e": []string{"x", "y"},
+			"f": dataTree{"0": dataTree{"g": "h"}},
+		}, req.body)
+	})
+
+	t.Run("wildcard", func(t *testing.T) {
+		r := handlertest.NewRawRequest(http.MethodPost, "/", "text/plain", []byte("a=1"))
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+
+		assert.Equal(t, []byte("a=1"), req.body)
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		mp := handlertest.NewMultipart().Field("a", "1")
+		r := handlertest.NewRawRequest(http.MethodPost, "/", "application/vnd.myapp.upload; boundary=rr-handlertest-boundary", mp.Bytes())
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		defer req.Close(nil, r)
+
+		assert.Equal(t, dataTree{"a": "1"}, req.body)
+	})
+
+	t.Run("unmatched", func(t *testing.T) {
+		r := handlertest.NewJSONRequest(http.MethodPost, "/", `{"a":1}`)
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+
+		assert.False(t, req.Parsed)
+		assert.Equal(t, []byte(`{"a":1}`), req.body)
+	})
+
+	t.Run("malformed json", func(t *testing.T) {
+		r := handlertest.NewRawRequest(http.MethodPost, "/", "application/problem+json", []byte(`{"a":`))
+		req := newTestRequest(r)
+		assert.Error(t, h.request(r, req))
+	})
+}
+
+func TestRequest_Auth(t *testing.T) {
+	h, _ := newTestHandler(t, &config.Config{})
+
+	testCases := []struct {
+		name   string
+		header string
+		want   map[string][]string
+	}{
+		{
+			name:   "basic",
+			header: "Basic " + base64.StdEncoding.EncodeToString([]byte("user:p:ss")),
+			want: map[string][]string{
+				AuthUserAttribute:     {"user"},
+				AuthPasswordAttribute: {"p:ss"},
+			},
+		},
+		{
+			name:   "basic malformed base64",
+			header: "Basic not-base64!",
+			want:   map[string][]string{},
+		},
+		{
+			name:   "basic without password separator",
+			header: "Basic " + base64.StdEncoding.EncodeToString([]byte("user")),
+			want:   map[string][]string{},
+		},
+		{
+			name:   "digest",
+			header: `Digest username="user", realm="rr", nonce="abc"`,
+			want: map[string][]string{
+				AuthDigestAttribute: {`username="user", realm="rr", nonce="abc"`},
+			},
+		},
+		{
+			name:   "bearer",
+			header: "Bearer token",
+			want:   map[string][]string{},
+		},
+		{
+			name: "absent",
+			want: map[string][]string{},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := handlertest.NewRawRequest(http.MethodGet, "/", "", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+
+			req := newTestRequest(r)
+			require.NoError(t, h.request(r, req))
+			assert.Equal(t, tt.want, req.Attributes)
+		})
+	}
+}
+
+func TestRequest_MethodOverride(t *testing.T) {
+	h, _ := newTestHandler(t, &config.Config{Parse: &config.Parse{MethodOverrideField: "_method"}})
+
+	testCases := []struct {
+		name   string
+		method string
+		value  string
+		want   string
+	}{
+		{name: "put", method: http.MethodPost, value: "PUT", want: http.MethodPut},
+		{name: "lowercase delete", method: http.MethodPost, value: "delete", want: http.MethodDelete},
+		{name: "patch", method: http.MethodPost, value: " PATCH ", want: http.MethodPatch},
+		{name: "unsafe target", method: http.MethodPost, value: "CONNECT", want: http.MethodPost},
+		{name: "get target", method: http.MethodPost, value: "GET", want: http.MethodPost},
+		{name: "not a post", method: http.MethodPut, value: "DELETE", want: http.MethodPut},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := handlertest.NewURLEncodedRequest(tt.method, "/", url.Values{"_method": {tt.value}})
+			req := newTestRequest(r)
+			require.NoError(t, h.request(r, req))
+			assert.Equal(t, tt.want, req.Method)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{})
+		r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"_method": {"PUT"}})
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Equal(t, http.MethodPost, req.Method)
+	})
+
+	t.Run("nested field", func(t *testing.T) {
+		r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"_method[]": {"PUT"}})
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Equal(t, http.MethodPost, req.Method)
+	})
+}
+
+func TestRequest_StructuredHeaders(t *testing.T) {
+	h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{StructuredHeaders: []string{"x-meta"}}})
+
+	t.Run("parsed", func(t *testing.T) {
+		r := handlertest.NewRawRequest(http.MethodGet, "/", "", nil)
+		r.Header.Add("X-Meta", "user[id]=5; user[role]=admin")
+		r.Header.Add("X-Meta", "tags[]=a%3Bb;tags[]=c")
+		r.Header.Set("X-Other", "user[id]=5")
+
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		require.Contains(t, req.Attributes, StructuredHeaderAttributePrefix+"X-Meta")
+		assert.JSONEq(t, `{"user":{"id":"5","role":"admin"},"tags":["a;b","c"]}`, req.Attributes[StructuredHeaderAttributePrefix+"X-Meta"][0])
+		assert.NotContains(t, req.Attributes, StructuredHeaderAttributePrefix+"X-Other")
+	})
+
+	for _, value := range []string{"user[id]", "=5", "user=%zz", "a[b]=1; a=2"} {
+		t.Run("malformed "+value, func(t *testing.T) {
+			h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{StructuredHeaders: []string{"X-Meta"}}})
+			r := handlertest.NewRawRequest(http.MethodGet, "/", "", nil)
+			r.Header.Set("X-Meta", value)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Nil(t, p.pld)
+		})
+	}
+}
+
+func TestRequest_JSONUnwrapPath(t *testing.T) {
+	cts := []*config.ContentType{{Pattern: "application/json", Parser: config.ParserJSON}}
+
+	testCases := []struct {
+		name    string
+		path    string
+		body    string
+		want    dataTree
+		wantErr bool
+	}{
+		{
+			name: "object",
+			path: "data",
+			body: `{"data":{"name":"n","tags":["a","b"]},"meta":{"page":1}}`,
+			want: dataTree{"name": "n", "tags": []string{"a", "b"}},
+		},
+		{
+			name: "nested with index",
+			path: "data.items.1",
+			body: `{"data":{"items":[{"id":1},{"id":2}]}}`,
+			want: dataTree{"id": "2"},
+		},
+		{
+			name: "array",
+			path: "data",
+			body: `{"data":[{"id":1}]}`,
+			want: dataTree{"0": dataTree{"id": "1"}},
+		},
+		{
+			name:    "missing",
+			path:    "data.attributes",
+			body:    `{"data":{"id":1}}`,
+			wantErr: true,
+		},
+		{
+			name:    "scalar",
+			path:    "data",
+			body:    `{"data":"value"}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{ContentTypes: cts, UnwrapPath: tt.path}})
+			r := handlertest.NewJSONRequest(http.MethodPost, "/", tt.body)
+			req := newTestRequest(r)
+			err := h.request(r, req)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, req.body)
+		})
+	}
+
+	t.Run("missing path status", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{ContentTypes: cts, UnwrapPath: "data"}})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewJSONRequest(http.MethodPost, "/", `{"meta":{}}`))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "no element at the path 'data'")
+	})
+}
+
+func TestRequest_NDJSON(t *testing.T) {
+	cts := []*config.ContentType{{Pattern: "application/x-ndjson", Parser: config.ParserNDJSON}}
+	body := "{\"id\":1,\"tags\":[\"a\"]}\n\n  [1,2]\r\n{broken\n\"scalar\""
+
+	newHandler := func(t *testing.T, parse *config.Parse) *Handler {
+		parse.ContentTypes = cts
+		require.NoError(t, parse.InitDefaults())
+		h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: parse})
+		return h
+	}
+
+	t.Run("records", func(t *testing.T) {
+		h := newHandler(t, &config.Parse{})
+		r := handlertest.NewRawRequest(http.MethodPost, "/", "application/x-ndjson", []byte("{\"id\":1}\n\n[1,2]\r\n\"scalar\"\n"))
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.True(t, req.Parsed)
+		assert.Equal(t, dataTree{"0": dataTree{"id": "1"}, "1": []string{"1", "2"}, "2": "scalar"}, req.body)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		h := newHandler(t, &config.Parse{})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewRawRequest(http.MethodPost, "/", "application/x-ndjson", []byte(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "malformed NDJSON line 4")
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		h := newHandler(t, &config.Parse{NDJSONMalformedLines: config.NDJSONMalformedSkip})
+		core, logs := observer.New(zap.WarnLevel)
+		h.log = zap.New(core)
+
+		r := handlertest.NewRawRequest(http.MethodPost, "/", "application/x-ndjson", []byte(body))
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Equal(t, dataTree{"0": dataTree{"id": "1", "tags": []string{"a"}}, "1": []string{"1", "2"}, "2": "scalar"}, req.body)
+
+		entries := logs.FilterMessage("malformed NDJSON line was skipped").All()
+		require.Len(t, entries, 1)
+		assert.Equal(t, int64(4), entries[0].ContextMap()["line"])
+	})
+
+	t.Run("max lines", func(t *testing.T) {
+		h := newHandler(t, &config.Parse{NDJSONMaxLines: 2, NDJSONMalformedLines: config.NDJSONMalformedSkip})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewRawRequest(http.MethodPost, "/", "application/x-ndjson", []byte(body)))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Contains(t, w.Body.String(), "more than 2 records")
+	})
+
+	t.Run("parse timeout is not skipped", func(t *testing.T) {
+		h := newHandler(t, &config.Parse{MaxParseDuration: time.Nanosecond, NDJSONMalformedLines: config.NDJSONMalformedSkip})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewRawRequest(http.MethodPost, "/", "application/x-ndjson", []byte(strings.Repeat(`{"a":1}`+"\n", parseCheckInterval*2))))
+		assert.Equal(t, http.StatusRequestTimeout, w.Code)
+		assert.Contains(t, w.Body.String(), "request body parsing exceeded")
+	})
+}
+
+func TestRequest_ProtobufBody(t *testing.T) {
+	parse := &config.Parse{BodyEncoding: config.BodyEncodingProtobuf}
+	require.NoError(t, parse.InitDefaults())
+	h, p := newTestHandler(t, &config.Config{Parse: parse, Uploads: &config.Uploads{Dir: t.TempDir()}})
+
+	r := handlertest.NewMultipart().
+		Field("name", "value").
+		Field("arr[]", "a").
+		Field("arr[]", "b").
+		Field("user[role]", "admin").
+		File("doc", "doc.txt", "text/plain", []byte("abc")).
+		Request(http.MethodPost, "/")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	req := p.request(t)
+	require.Contains(t, req.Attributes, BodyEncodingAttribute)
+	assert.Equal(t, [][]byte{[]byte(BodyEncodingProtobuf)}, req.Attributes[BodyEncodingAttribute].Value)
+
+	body := &structpb.Struct{}
+	require.NoError(t, proto.Unmarshal(p.pld.Body, body))
+	assert.Equal(t, map[string]any{
+		"name": "value",
+		"arr":  []any{"a", "b"},
+		"user": map[string]any{"role": "admin"},
+	}, body.AsMap())
+
+	uploads := &structpb.Struct{}
+	require.NoError(t, proto.Unmarshal(req.Uploads, uploads))
+	doc := uploads.AsMap()["doc"].(map[string]any)
+	assert.Equal(t, "doc.txt", doc["name"])
+	assert.Equal(t, "text/plain", doc["mime"])
+	assert.Equal(t, float64(3), doc["size"])
+	assert.Equal(t, float64(UploadErrorOK), doc["error"])
+	assert.NotEmpty(t, doc["tmpName"])
+}
+
+// unreadBody fails the test if the request body is read
+type unreadBody struct {
+	t *testing.T
+}
+
+func (b unreadBody) Read([]byte) (int, error) {
+	b.t.Error("the body of the upgrade request must not be read")
+	return 0, io.EOF
+}
+
+func (b unreadBody) Close() error {
+	return nil
+}
+
+func TestRequest_Upgrade(t *testing.T) {
+	testCases := []struct {
+		name       string
+		connection string
+		upgrade    string
+		want       bool
+	}{
+		{name: "websocket", connection: "Upgrade", upgrade: "websocket", want: true},
+		{name: "token list", connection: "keep-alive, upgrade", upgrade: "websocket", want: true},
+		{name: "no upgrade header", connection: "Upgrade"},
+		{name: "no connection token", connection: "keep-alive", upgrade: "websocket"},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := handlertest.NewMultipart().File("f", "f.txt", "text/plain", []byte("abc")).Request(http.MethodGet, "/ws")
+			r.Header.Set("Connection", tt.connection)
+			if tt.upgrade != "" {
+				r.Header.Set("Upgrade", tt.upgrade)
+			}
+			assert.Equal(t, tt.want, isUpgrade(r))
+		})
+	}
+
+	h, p := newTestHandler(t, &config.Config{})
+	r := handlertest.NewMultipart().File("f", "f.txt", "text/plain", []byte("abc")).Request(http.MethodGet, "/ws")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Body = unreadBody{t: t}
+	r.AddCookie(&http.Cookie{Name: "session", Value: "s"})
+
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	req := p.request(t)
+	assert.False(t, req.Parsed)
+	assert.Empty(t, req.Uploads)
+	assert.Empty(t, p.pld.Body)
+	assert.Equal(t, [][]byte{[]byte("s")}, req.Cookies["session"].Value)
+}
+
+func TestRequest_CookieLimits(t *testing.T) {
+	request := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		// 3, 8, 6 and 5 bytes as sent, the malformed pair counts and is skipped
+		r.Header.Add("Cookie", "a=1; b=%32%32")
+		r.Header.Add("Cookie", "bad\x01=1; c=333")
+		return r
+	}
+
+	testCases := []struct {
+		name    string
+		parse   *config.Parse
+		cookies map[string]string
+		isErr   bool
+	}{
+		{name: "unlimited", parse: &config.Parse{}, cookies: map[string]string{"a": "1", "b": "22", "c": "333"}},
+		{name: "count at the limit", parse: &config.Parse{MaxCookieCount: 4}, cookies: map[string]string{"a": "1", "b": "22", "c": "333"}},
+		{name: "count over the limit", parse: &config.Parse{MaxCookieCount: 3}, isErr: true},
+		{name: "bytes at the limit", parse: &config.Parse{MaxCookieBytes: 22}, cookies: map[string]string{"a": "1", "b": "22", "c": "333"}},
+		{name: "bytes over the limit", parse: &config.Parse{MaxCookieBytes: 21}, isErr: true},
+		{
+			name:    "count truncated",
+			parse:   &config.Parse{MaxCookieCount: 2, CookieLimitAction: config.CookieLimitTruncate},
+			cookies: map[string]string{"a": "1", "b": "22"},
+		},
+		{
+			name:    "bytes truncated",
+			parse:   &config.Parse{MaxCookieBytes: 5, CookieLimitAction: config.CookieLimitTruncate},
+			cookies: map[string]string{"a": "1"},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.parse.InitDefaults())
+			h, _ := newTestHandler(t, &config.Config{Parse: tt.parse})
+
+			r := request()
+			req := newTestRequest(r)
+			err := h.request(r, req)
+			if tt.isErr {
+				pe := asParseError(err)
+				assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, pe.Status)
+				assert.Equal(t, ParseErrorCodeHeaderTooLarge, pe.Code)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.cookies, req.Cookies)
+			if tt.parse.CookieLimitAction == config.CookieLimitTruncate {
+				require.Len(t, req.warnings, 1)
+				assert.Equal(t, ParseWarningCookiesTruncated, req.warnings[0].Code)
+			}
+		})
+	}
+
+	assert.Error(t, (&config.Parse{CookieLimitAction: "drop"}).InitDefaults())
+}
+
+func TestRequest_JSONCoerceScalars(t *testing.T) {
+	cts := []*config.ContentType{{Pattern: "application/json", Parser: config.ParserJSON}}
+	body := []byte(`{"n":1.5,"big":12345678901234567890,"b":true,"s":"x","z":null,"arr":[1,"a",false],"strs":["a","b"],"obj":{"i":10}}`)
+
+	t.Run("typed", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{Parse: &config.Parse{ContentTypes: cts, CoerceScalars: true}})
+
+		r := handlertest.NewRawRequest(http.MethodPost, "/", "application/json", body)
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Equal(t, dataTree{
+			"n":    json.Number("1.5"),
+			"big":  json.Number("12345678901234567890"),
+			"b":    true,
+			"s":    "x",
+			"z":    "",
+			"arr":  []any{json.Number("1"), "a", false},
+			"strs": []string{"a", "b"},
+			"obj":  dataTree{"i": json.Number("10")},
+		}, req.body)
+
+		h.ServeHTTP(httptest.NewRecorder(), handlertest.NewRawRequest(http.MethodPost, "/", "application/json", body))
+		assert.JSONEq(t, `{"n":1.5,"big":12345678901234567890,"b":true,"s":"x","z":"","arr":[1,"a",false],"strs":["a","b"],"obj":{"i":10}}`, string(p.pld.Body))
+	})
+
+	t.Run("strings", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{Parse: &config.Parse{ContentTypes: cts}})
+
+		h.ServeHTTP(httptest.NewRecorder(), handlertest.NewRawRequest(http.MethodPost, "/", "application/json", body))
+		assert.JSONEq(t, `{"n":"1.5","big":"12345678901234567890","b":"1","s":"x","z":"","arr":["1","a",""],"strs":["a","b"],"obj":{"i":"10"}}`, string(p.pld.Body))
+	})
+
+	t.Run("urlencoded", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{Parse: &config.Parse{CoerceScalars: true}})
+
+		r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"n": {"1"}, "b": {"true"}})
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Equal(t, dataTree{"n": "1", "b": "true"}, req.body)
+	})
+}
+
+func TestRequest_JSONStrings(t *testing.T) {
+	cts := []*config.ContentType{
+		{Pattern: "application/json", Parser: config.ParserJSON},
+		{Pattern: "application/x-ndjson", Parser: config.ParserNDJSON},
+	}
+
+	t.Run("json", func(t *testing.T) {
+		cfg := &config.Parse{ContentTypes: cts, JSONStrings: &config.JSONStrings{True: "true", False: "false", Null: "null"}}
+		require.NoError(t, cfg.InitDefaults())
+		h, _ := newTestHandler(t, &config.Config{Parse: cfg})
+
+		r := handlertest.NewRawRequest(http.MethodPost, "/", "application/json", []byte(`{"t":true,"f":false,"z":null,"n":1,"arr":[true,null],"obj":{"f":false}}`))
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Equal(t, dataTree{
+			"t":   "true",
+			"f":   "false",
+			"z":   "null",
+			"n":   "1",
+			"arr": []string{"true", "null"},
+			"obj": dataTree{"f": "false"},
+		}, req.body)
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		cfg := &config.Parse{ContentTypes: cts, JSONStrings: &config.JSONStrings{False: "0"}}
+		require.NoError(t, cfg.InitDefaults())
+		h, _ := newTestHandler(t, &config.Config{Parse: cfg})
+
+		r := handlertest.NewRawRequest(http.MethodPost, "/", "application/x-ndjson", []byte("{\"a\":true,\"b\":false,\"c\":null}\n"))
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Equal(t, dataTree{"0": dataTree{"a": "1", "b": "0", "c": ""}}, req.body)
+	})
+
+	t.Run("exclusive with coerce_scalars", func(t *testing.T) {
+		cfg := &config.Parse{CoerceScalars: true, JSONStrings: &config.JSONStrings{}}
+		assert.Error(t, cfg.InitDefaults())
+	})
+}
+
+func TestRequest_EmptyBodyForm(t *testing.T) {
+	cts := []*config.ContentType{{Pattern: "application/json", Parser: config.ParserJSON}}
+
+	testCases := []struct {
+		name   string
+		method string
+		ct     string
+		parsed bool
+	}{
+		{name: "urlencoded", method: http.MethodPost, ct: handlertest.ContentURLEncoded, parsed: true},
+		{name: "multipart", method: http.MethodPost, ct: "multipart/form-data; boundary=x", parsed: true},
+		{name: "json", method: http.MethodPut, ct: "application/json", parsed: true},
+		{name: "no content type", method: http.MethodPatch, parsed: true},
+		{name: "raw", method: http.MethodPost, ct: "application/octet-stream"},
+		{name: "get", method: http.MethodGet},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{ContentTypes: cts}})
+
+			newRequest := func() *http.Request {
+				r := httptest.NewRequest(tt.method, "/", http.NoBody)
+				if tt.ct != "" {
+					r.Header.Set("Content-Type", tt.ct)
+				}
+				return r
+			}
+
+			r := newRequest()
+			require.Equal(t, int64(0), r.ContentLength)
+
+			req := newTestRequest(r)
+			require.NoError(t, h.request(r, req))
+			assert.Equal(t, tt.parsed, req.Parsed)
+			if tt.parsed {
+				assert.Equal(t, dataTree{}, req.body)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newRequest())
+			assert.Equal(t, http.StatusInternalServerError, w.Code)
+			assert.Empty(t, p.pld.Body)
+			assert.Equal(t, tt.parsed, p.request(t).Parsed)
+		})
+	}
+
+	t.Run("required fields", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{Fields: &config.Fields{Required: []string{"name"}}}})
+
+		r := httptest.NewRequest(http.MethodPost, "/", http.NoBody)
+		r.Header.Set("Content-Type", handlertest.ContentURLEncoded)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestRequest_ParseBodyMethods(t *testing.T) {
+	form := url.Values{"a": {"1"}}
+
+	testCases := []struct {
+		name    string
+		methods []string
+		method  string
+		want    dataTree
+	}{
+		{name: "get ignored by default", method: http.MethodGet, want: dataTree{}},
+		{name: "delete ignored by default", method: http.MethodDelete, want: dataTree{}},
+		{name: "get", methods: []string{"get"}, method: http.MethodGet, want: dataTree{"a": "1"}},
+		{name: "other method ignored", methods: []string{"GET"}, method: http.MethodDelete, want: dataTree{}},
+		{name: "options", methods: []string{"OPTIONS"}, method: http.MethodOptions, want: dataTree{"a": "1"}},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, zeroCopy := range []bool{false, true} {
+				cfg := &config.Parse{ParseBodyMethods: tt.methods, ZeroCopyURLEncoded: zeroCopy}
+				require.NoError(t, cfg.InitDefaults())
+				h, _ := newTestHandler(t, &config.Config{Parse: cfg})
+
+				r := handlertest.NewURLEncodedRequest(tt.method, "/", form)
+				req := newTestRequest(r)
+				require.NoError(t, h.request(r, req))
+				assert.Equal(t, tt.want, req.body)
+			}
+		})
+	}
+
+	t.Run("head and options bodies are not read by default", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{})
+
+		r := handlertest.NewURLEncodedRequest(http.MethodHead, "/", form)
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Nil(t, req.body)
+		assert.False(t, req.Parsed)
+	})
+
+	t.Run("unsupported method", func(t *testing.T) {
+		cfg := &config.Parse{ParseBodyMethods: []string{"TRACE"}}
+		assert.Error(t, cfg.InitDefaults())
+	})
+}
+
+func TestRequest_DeterministicPayload(t *testing.T) {
+	for _, encoding := range []string{config.BodyEncodingJSON, config.BodyEncodingProtobuf} {
+		t.Run(encoding, func(t *testing.T) {
+			h, p := newTestHandler(t, &config.Config{Parse: &config.Parse{Deterministic: true, BodyEncoding: encoding}})
+
+			var context, body []byte
+			for i := range 20 {
+				form := url.Values{}
+				for _, k := range []string{"b", "a", "d[x]", "d[y]", "c"} {
+					form.Set(k, "v")
+				}
+
+				r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", form)
+				for _, k := range []string{"X-B", "X-A", "X-D", "X-C"} {
+					r.Header.Set(k, k)
+				}
+				r.AddCookie(&http.Cookie{Name: "z", Value: "1"})
+				r.AddCookie(&http.Cookie{Name: "y", Value: "2"})
+
+				h.ServeHTTP(httptest.NewRecorder(), r)
+				if i == 0 {
+					context, body = p.pld.Context, p.pld.Body
+					continue
+				}
+
+				require.Equal(t, context, p.pld.Context)
+				require.Equal(t, body, p.pld.Body)
+			}
+		})
+	}
+}
+
+func TestRequest_ParseDiagnostics(t *testing.T) {
+	diagnostics := func(t *testing.T, req *Request) map[string]any {
+		require.Contains(t, req.Attributes, ParseDiagnosticsAttribute)
+		d := make(map[string]any)
+		require.NoError(t, json.Unmarshal([]byte(req.Attributes[ParseDiagnosticsAttribute][0]), &d))
+		return d
+	}
+
+	t.Run("multipart", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{
+			Parse:   &config.Parse{ParseDiagnostics: true},
+			Uploads: &config.Uploads{Dir: t.TempDir(), MaxFileSize: 10},
+		})
+
+		r := handlertest.NewMultipart().
+			Boundary("diag-boundary").
+			Field("a", "1").
+			Field("b[]", "1").
+			Field("b[]", "2").
+			File("doc", "doc.txt", "text/plain", []byte("123456789")).
+			Request(http.MethodPost, "/")
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		defer req.Close(nil, r)
+
+		assert.Equal(t, map[string]any{
+			"contentType": "multipart/form-data",
+			"parser":      "multipart",
+			"boundary":    "diag-boundary",
+			"parts":       float64(4),
+			"fields":      float64(3),
+			"files":       float64(1),
+			"nearLimits":  []any{"max_file_size"},
+		}, diagnostics(t, req))
+	})
+
+	t.Run("urlencoded", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{Parse: &config.Parse{ParseDiagnostics: true}})
+
+		r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"a": {"1"}, "b[c]": {"2"}})
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Equal(t, map[string]any{
+			"contentType": handlertest.ContentURLEncoded,
+			"parser":      "urlencoded",
+			"fields":      float64(2),
+			"files":       float64(0),
+		}, diagnostics(t, req))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{})
+
+		r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"a": {"1"}})
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.NotContains(t, req.Attributes, ParseDiagnosticsAttribute)
+	})
+}
+
+func TestHandler_ParseSummaryHeader(t *testing.T) {
+	h, p := newTestHandler(t, &config.Config{
+		Parse:   &config.Parse{ParseSummaryHeader: true},
+		Uploads: &config.Uploads{Dir: t.TempDir(), MaxFileSize: 10},
+	})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, handlertest.NewMultipart().
+		Field("password", "secret-value").
+		File("doc", "doc.txt", "text/plain", []byte("123456789")).
+		Request(http.MethodPost, "/"))
+	require.NotNil(t, p.pld)
+	summary := w.Header().Get(ParseSummaryHeader)
+	assert.Equal(t, `type="multipart/form-data", parser=multipart, fields=1, files=1, near-limits=(max_file_size)`, summary)
+	assert.NotContains(t, summary, "secret-value")
+	// the summary is not passed to the worker
+	assert.NotContains(t, p.request(t).Attributes, ParseDiagnosticsAttribute)
+
+	w = httptest.NewRecorder()
+	r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"a": {"1"}})
+	r.Header.Set("Content-Type", `application/x-www-form-urlencoded"\`)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, `type="application/x-www-form-urlencoded\"\\", parser=urlencoded, fields=1, files=0, near-limits=()`, w.Header().Get(ParseSummaryHeader))
+
+	h, _ = newTestHandler(t, &config.Config{Parse: &config.Parse{}})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"a": {"1"}}))
+	assert.Empty(t, w.Header().Values(ParseSummaryHeader))
+}
+
+func TestRequest_StrictContentType(t *testing.T) {
+	cts := []*config.ContentType{{Pattern: "application/json", Parser: config.ParserJSON}}
+
+	testCases := []struct {
+		name   string
+		ct     string
+		body   string
+		strict int
+		lax    int
+	}{
+		{name: "json sent as form", ct: handlertest.ContentURLEncoded, body: `{"key":"value"}`, strict: http.StatusUnsupportedMediaType, lax: http.StatusInternalServerError},
+		{name: "form sent as json", ct: "application/json", body: "key=value", strict: http.StatusUnsupportedMediaType, lax: http.StatusBadRequest},
+		{name: "json syntax error", ct: "application/json", body: `{"key":`, strict: http.StatusUnsupportedMediaType, lax: http.StatusBadRequest},
+		{name: "form escape error", ct: handlertest.ContentURLEncoded, body: "key=%zz", strict: http.StatusUnsupportedMediaType, lax: http.StatusBadRequest},
+		{name: "multipart without boundary", ct: "multipart/form-data", body: "--x\r\n", strict: http.StatusUnsupportedMediaType, lax: http.StatusBadRequest},
+		{name: "multipart with another boundary", ct: "multipart/form-data; boundary=y", body: "--x\r\n\r\n--x--\r\n", strict: http.StatusUnsupportedMediaType, lax: http.StatusInternalServerError},
+		{name: "malformed header", ct: "text/plain, application/x-www-form-urlencoded", body: "key=value", strict: http.StatusUnsupportedMediaType, lax: http.StatusInternalServerError},
+		{name: "valid form", ct: handlertest.ContentURLEncoded, body: "key=value", strict: http.StatusInternalServerError, lax: http.StatusInternalServerError},
+		{name: "valid json", ct: "application/json", body: ` {"key":"value"}`, strict: http.StatusInternalServerError, lax: http.StatusInternalServerError},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, strict := range []bool{true, false} {
+				h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{ContentTypes: cts, StrictContentType: strict}})
+
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, handlertest.NewRawRequest(http.MethodPost, "/", tt.ct, []byte(tt.body)))
+				if strict {
+					assert.Equal(t, tt.strict, w.Code, w.Body.String())
+				} else {
+					assert.Equal(t, tt.lax, w.Code, w.Body.String())
+				}
+
+				// the 500 is the test pool, the body reached the worker
+				if w.Code == http.StatusInternalServerError {
+					require.NotNil(t, p.pld)
+				}
+			}
+		})
+	}
+
+	t.Run("valid body is parsed", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: &config.Parse{StrictContentType: true}})
+
+		r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"key": {"value"}})
+		req := newTestRequest(r)
+		require.NoError(t, h.request(r, req))
+		assert.Equal(t, dataTree{"key": "value"}, req.body)
+	})
+}
+
+func TestRequest_SelectFields(t *testing.T) {
+	cfg := &config.Parse{SelectFields: []*config.SelectFields{
+		{Paths: []string{"/profile"}, Fields: []string{"user[name]", "user", "avatar", "missing[key]"}},
+		{Paths: []string{"/search"}, Fields: []string{"q"}},
+	}}
+	require.NoError(t, cfg.InitDefaults())
+	h, p := newTestHandler(t, &config.Config{Parse: cfg, Uploads: &config.Uploads{Dir: t.TempDir()}})
+
+	mp := handlertest.NewMultipart().
+		Field("user[name]", "n").
+		Field("user[roles][]", "admin").
+		Field("comment", "long text").
+		File("avatar", "a.png", "image/png", []byte("png")).
+		File("attachment", "b.txt", "text/plain", []byte("txt"))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, mp.Request(http.MethodPost, "/profile/1"))
+	require.NotNil(t, p.pld)
+	assert.JSONEq(t, `{"user":{"name":"n","roles":["admin"]}}`, string(p.pld.Body))
+
+	var uploads map[string]any
+	require.NoError(t, json.Unmarshal(p.request(t).GetUploads(), &uploads))
+	assert.Contains(t, uploads, "avatar")
+	assert.NotContains(t, uploads, "attachment")
+	assert.Equal(t, [][]byte{[]byte("user[name]"), []byte("user"), []byte("avatar"), []byte("missing[key]")}, p.request(t).Attributes[SelectedFieldsAttribute].Value)
+
+	// the subtree of a nested field keeps its parents
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, handlertest.NewURLEncodedRequest(http.MethodPost, "/search", url.Values{"q": {"go"}, "page[size]": {"10"}}))
+	assert.JSONEq(t, `{"q":"go"}`, string(p.pld.Body))
+
+	// the requests matching no entry are sent whole
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, handlertest.NewURLEncodedRequest(http.MethodPost, "/other", url.Values{"q": {"go"}, "page[size]": {"10"}}))
+	assert.JSONEq(t, `{"q":"go","page":{"size":"10"}}`, string(p.pld.Body))
+	assert.NotContains(t, p.request(t).Attributes, SelectedFieldsAttribute)
+}
+
+func TestSelectTree(t *testing.T) {
+	tree := dataTree{
+		"user":  dataTree{"name": "n", "address": dataTree{"city": "c", "zip": "z"}},
+		"other": "o",
+	}
+
+	keys := dropCoveredKeys([][]string{{"user", "address", "city"}, {"other"}, {"user", "address"}, {"other"}})
+	assert.Equal(t, [][]string{{"other"}, {"user", "address"}}, keys)
+
+	assert.Equal(t, dataTree{
+		"user":  dataTree{"address": dataTree{"city": "c", "zip": "z"}},
+		"other": "o",
+	}, selectTree(tree, keys))
+
+	assert.Equal(t, dataTree{"user": dataTree{"name": "n"}}, selectTree(tree, [][]string{{"user", "name"}, {"user", "missing"}, {"name"}}))
+	// the source tree is untouched
+	assert.Len(t, tree["user"], 2)
+}
+
+func TestRequest_RequestOrder(t *testing.T) {
+	newRequest := func() *http.Request {
+		r := handlertest.NewURLEncodedRequest(http.MethodPost, "/?id=query&q=go&list[a]=1", url.Values{"id": {"body"}, "list[b]": {"2"}})
+		r.AddCookie(&http.Cookie{Name: "id", Value: "cookie"})
+		r.AddCookie(&http.Cookie{Name: "session", Value: "s"})
+		return r
+	}
+
+	testCases := []struct {
+		order string
+		want  string
+	}{
+		{order: "GP", want: `{"id":"body","q":"go","list":{"a":"1","b":"2"}}`},
+		{order: "PG", want: `{"id":"query","q":"go","list":{"a":"1","b":"2"}}`},
+		{order: "GPC", want: `{"id":"cookie","q":"go","list":{"a":"1","b":"2"},"session":"s"}`},
+		{order: "C", want: `{"id":"cookie","session":"s"}`},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.order, func(t *testing.T) {
+			cfg := &config.Parse{RequestOrder: tt.order}
+			require.NoError(t, cfg.InitDefaults())
+			h, p := newTestHandler(t, &config.Config{Parse: cfg})
+
+			h.ServeHTTP(httptest.NewRecorder(), newRequest())
+			require.NotNil(t, p.pld)
+			attr := p.request(t).Attributes[RequestParamsAttribute]
+			require.NotNil(t, attr)
+			assert.JSONEq(t, tt.want, string(attr.Value[0]))
+			// the body is sent as it is
+			assert.JSONEq(t, `{"id":"body","list":{"b":"2"}}`, string(p.pld.Body))
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{})
+		h.ServeHTTP(httptest.NewRecorder(), newRequest())
+		assert.NotContains(t, p.request(t).Attributes, RequestParamsAttribute)
+	})
+
+	t.Run("track sources", func(t *testing.T) {
+		cfg := &config.Parse{RequestOrder: "GPC", TrackSources: true}
+		require.NoError(t, cfg.InitDefaults())
+		h, p := newTestHandler(t, &config.Config{Parse: cfg})
+
+		h.ServeHTTP(httptest.NewRecorder(), newRequest())
+		attr := p.request(t).Attributes[RequestParamsSourcesAttribute]
+		require.NotNil(t, attr)
+		assert.JSONEq(t, `{"id":"C","q":"G","list":{"a":"G","b":"P"},"session":"C"}`, string(attr.Value[0]))
+
+		// the sources are off by default
+		cfg = &config.Parse{RequestOrder: "GPC"}
+		require.NoError(t, cfg.InitDefaults())
+		h, p = newTestHandler(t, &config.Config{Parse: cfg})
+		h.ServeHTTP(httptest.NewRecorder(), newRequest())
+		assert.NotContains(t, p.request(t).Attributes, RequestParamsSourcesAttribute)
+
+		assert.Error(t, (&config.Parse{TrackSources: true}).InitDefaults())
+	})
+
+	t.Run("invalid order", func(t *testing.T) {
+		for _, order := range []string{"GG", "GX", "gp"} {
+			assert.Error(t, (&config.Parse{RequestOrder: order}).InitDefaults(), order)
+		}
+	})
+}
+
+func TestRequest_JSONArrayStream(t *testing.T) {
+	cts := []*config.ContentType{{Pattern: "application/json", Parser: config.ParserJSON}}
+	newHandler := func(t *testing.T, stream *config.JSONArrayStream) *Handler {
+		cfg := &config.Parse{ContentTypes: cts, JSONArrayStream: stream}
+		require.NoError(t, cfg.InitDefaults())
+		h, _ := newTestHandler(t, &config.Config{Parse: cfg})
+		return h
+	}
+
+	parse := func(h *Handler, body string) (any, error) {
+		r := handlertest.NewJSONRequest(http.MethodPost, "/", body)
+		req := newTestRequest(r)
+		err := h.request(r, req)
+		return req.body, err
+	}
+
+	t.Run("same tree as the buffered parse", func(t *testing.T) {
+		buffered := newHandler(t, nil)
+		for _, body := range []string{
+			` [{"id":1,"tags":["a","b"]},{"id":2,"user":{"name":"n"}},"x",true,null] `,
+			`[]`,
+			`{"key":[1,2]}`,
+		} {
+			want, err := parse(buffered, body)
+			require.NoError(t, err)
+
+			got, err := parse(newHandler(t, &config.JSONArrayStream{}), body)
+			require.NoError(t, err, body)
+			assert.IsType(t, dataTree{}, got)
+			assert.Equal(t, want, got, body)
+		}
+	})
+
+	t.Run("max elements", func(t *testing.T) {
+		h := newHandler(t, &config.JSONArrayStream{MaxElements: 2})
+		_, err := parse(h, `[1,2]`)
+		require.NoError(t, err)
+
+		_, err = parse(h, `[1,2,3]`)
+		pe := asParseError(err)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, pe.Status)
+		assert.Equal(t, ParseErrorCodeLimitExceeded, pe.Code)
+	})
+
+	t.Run("malformed element", func(t *testing.T) {
+		h := newHandler(t, &config.JSONArrayStream{})
+		for body, msg := range map[string]string{
+			`[{"id":1},{"id":}]`: "malformed JSON array element 1",
+			`[1,2`:               "malformed JSON array",
+			`[1] [2]`:            "unexpected data after the JSON document",
+		} {
+			_, err := parse(h, body)
+			pe := asParseError(err)
+			assert.Equal(t, http.StatusBadRequest, pe.Status, body)
+			assert.Contains(t, err.Error(), msg, body)
+		}
+	})
+
+	assert.Error(t, (&config.Parse{JSONArrayStream: &config.JSONArrayStream{}, UnwrapPath: "data"}).InitDefaults())
+}
+
+func TestRequest_TrimQuotes(t *testing.T) {
+	cfg := &config.Parse{TrimQuotes: []string{"name", "tags", "user.id"}}
+	require.NoError(t, cfg.InitDefaults())
+	h, p := newTestHandler(t, &config.Config{Parse: cfg})
+
+	h.ServeHTTP(httptest.NewRecorder(), handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{
+		"name":     {`""quoted""`},
+		"tags[]":   {`"a"`, `"b`, `"`, `""`},
+		"user[id]": {`"42"`},
+		"other":    {`"kept"`},
+		"comment":  {`say "hi"`},
+	}))
+	require.NotNil(t, p.pld)
+	assert.JSONEq(t, `{
+		"name": "\"quoted\"",
+		"tags": ["a", "\"b", "\"", ""],
+		"user": {"id": "42"},
+		"other": "\"kept\"",
+		"comment": "say \"hi\""
+	}`, string(p.pld.Body))
+
+	assert.Error(t, (&config.Parse{TrimQuotes: []string{"["}}).InitDefaults())
+}
+
+func TestRequest_CollapseLists(t *testing.T) {
+	cfg := &config.Parse{CollapseLists: []string{"tag", "multi", "idx", "user.roles"}}
+	require.NoError(t, cfg.InitDefaults())
+	h, p := newTestHandler(t, &config.Config{Parse: cfg})
+
+	h.ServeHTTP(httptest.NewRecorder(), handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{
+		"tag[]":         {"a"},
+		"multi[]":       {"a", "b"},
+		"idx[0]":        {"a"},
+		"user[roles][]": {"admin"},
+		"other[]":       {"a"},
+	}))
+	require.NotNil(t, p.pld)
+	assert.JSONEq(t, `{
+		"tag": "a",
+		"multi": ["a", "b"],
+		"idx": {"0": "a"},
+		"user": {"roles": "admin"},
+		"other": ["a"]
+	}`, string(p.pld.Body))
+
+	// the multipart values are collapsed the same way
+	p.pld = nil
+	h.ServeHTTP(httptest.NewRecorder(), handlertest.NewMultipart().Field("tag[]", "a").Field("multi[]", "a").Field("multi[]", "b").Request(http.MethodPost, "/"))
+	require.NotNil(t, p.pld)
+	assert.JSONEq(t, `{"tag": "a", "multi": ["a", "b"]}`, string(p.pld.Body))
+
+	assert.Error(t, (&config.Parse{CollapseLists: []string{"["}}).InitDefaults())
+}
+
+func TestRequest_NestedFormFields(t *testing.T) {
+	testCases := []struct {
+		name   string
+		body   url.Values
+		want   string
+		status int
+	}{
+		{
+			name: "nested",
+			body: url.Values{"state": {"page=2&filter[tag][]=a&filter[tag][]=b"}, "app[state]": {"x=1"}, "other": {"a=1"}},
+			want: `{"state":{"page":"2","filter":{"tag":["a","b"]}},"app":{"state":{"x":"1"}},"other":"a=1"}`,
+		},
+		{name: "empty", body: url.Values{"state": {""}, "a": {"1"}}, want: `{"a":"1"}`},
+		{name: "malformed", body: url.Values{"state": {"a=%zz"}}, status: http.StatusBadRequest},
+		{name: "too many children", body: url.Values{"state": {"a=1&b=2&c=3&d=4"}}, status: http.StatusBadRequest},
+		{name: "collision", body: url.Values{"state": {"a=1&a[b]=2"}}, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Parse{NestedFormFields: []string{"state", "app[state]"}, MaxSiblingsPerNode: 3}
+			require.NoError(t, cfg.InitDefaults())
+			h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: cfg})
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, handlertest.NewURLEncodedRequest(http.MethodPost, "/", tt.body))
+			if tt.status != 0 {
+				assert.Equal(t, tt.status, w.Code)
+				assert.Nil(t, p.pld)
+				return
+			}
+
+			require.NotNil(t, p.pld)
+			assert.JSONEq(t, tt.want, string(p.pld.Body))
+		})
+	}
+
+	assert.Error(t, (&config.Parse{NestedFormFields: []string{""}}).InitDefaults())
+}
+
+func TestRequest_NamePattern(t *testing.T) {
+	pad := strings.Repeat("x", 5000)
+	requests := map[string]func() *http.Request{
+		"small form": func() *http.Request {
+			return handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"user[name]": {"john"}, "Bad-Key[x]": {"1"}})
+		},
+		"large form": func() *http.Request {
+			return handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"user[name]": {"john"}, "Bad-Key[x]": {"1"}, "pad": {pad}})
+		},
+		"multipart": func() *http.Request {
+			return handlertest.NewMultipart().
+				Field("user[name]", "john").
+				Field("Bad-Key[x]", "1").
+				File("Bad-Key[file]", "a.txt", "text/plain", []byte("x")).
+				File("doc", "b.txt", "text/plain", []byte("y")).
+				Request(http.MethodPost, "/")
+		},
+	}
+
+	for name, request := range requests {
+		t.Run(name, func(t *testing.T) {
+			cfg := &config.Parse{Fields: &config.Fields{NamePattern: `^[a-z0-9_]+(\[[a-z0-9_]*\])*$`}}
+			require.NoError(t, cfg.InitDefaults())
+			h, _ := newTestHandler(t, &config.Config{Parse: cfg})
+
+			r := request()
+			req := newTestRequest(r)
+			err := h.request(r, req)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "Bad-Key[")
+			pe := asParseError(err)
+			require.NotNil(t, pe)
+			assert.Equal(t, ParseErrorInvalidFields, pe.Kind)
+			req.Close(nil, r)
+
+			cfg = &config.Parse{Fields: &config.Fields{NamePattern: `^[a-z0-9_]+(\[[a-z0-9_]*\])*$`, NamePatternAction: config.NamePatternDrop}}
+			require.NoError(t, cfg.InitDefaults())
+			h, _ = newTestHandler(t, &config.Config{Parse: cfg})
+
+			r = request()
+			req = newTestRequest(r)
+			require.NoError(t, h.request(r, req))
+			defer req.Close(nil, r)
+
+			data := req.body.(dataTree)
+			assert.Equal(t, dataTree{"name": "john"}, data["user"])
+			assert.NotContains(t, data, "Bad-Key")
+			if req.Uploads != nil {
+				assert.NotContains(t, req.Uploads.tree, "Bad-Key")
+				assert.Contains(t, req.Uploads.tree, "doc")
+				assert.Len(t, req.Uploads.list, 1)
+			}
+		})
+	}
+
+	assert.Error(t, (&config.Parse{Fields: &config.Fields{NamePattern: "("}}).InitDefaults())
+	assert.Error(t, (&config.Parse{Fields: &config.Fields{NamePatternAction: "skip"}}).InitDefaults())
+}
+
+func TestRequest_CBOR(t *testing.T) {
+	cfg := &config.Parse{ContentTypes: []*config.ContentType{{Pattern: "application/cbor", Parser: config.ParserCBOR}}}
+	require.NoError(t, cfg.InitDefaults())
+	h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: cfg})
+
+	send := func(body []byte) *httptest.ResponseRecorder {
+		p.pld = nil
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewRawRequest(http.MethodPost, "/", "application/cbor", body))
+		return w
+	}
+
+	// {"a": 1, "b": -500, "c": h'0102', "d": [true, null], "e": 1.5, "f": 100000.0, 7: "x"}
+	send([]byte{
+		0xa7,
+		0x61, 'a', 0x01,
+		0x61, 'b', 0x39, 0x01, 0xf3,
+		0x61, 'c', 0x42, 0x01, 0x02,
+		0x61, 'd', 0x82, 0xf5, 0xf6,
+		0x61, 'e', 0xf9, 0x3e, 0x00,
+		0x61, 'f', 0xfa, 0x47, 0xc3, 0x50, 0x00,
+		0x07, 0x61, 'x',
+	})
+	require.NotNil(t, p.pld)
+	assert.JSONEq(t, `{"a": "1", "b": "-500", "c": "AQI=", "d": ["1", ""], "e": "1.5", "f": "100000", "7": "x"}`, string(p.pld.Body))
+
+	// the indefinite lengths and the tags: tag 1 [_ "ab" (_ "c" "d"), 18446744073709551615, -18446744073709551616]
+	send([]byte{
+		0xc1, 0x9f,
+		0x62, 'a', 'b',
+		0x7f, 0x61, 'c', 0x61, 'd', 0xff,
+		0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff,
+	})
+	require.NotNil(t, p.pld)
+	assert.JSONEq(t, `{"0": "ab", "1": "cd", "2": "18446744073709551615", "3": "-18446744073709551616"}`, string(p.pld.Body))
+
+	deep := append(bytes.Repeat([]byte{0x81}, MaxLevel+1), 0x01)
+
+	for name, body := range map[string][]byte{
+		"truncated":        {0xa1, 0x61, 'a'},
+		"trailing data":    {0xa0, 0x00},
+		"scalar document":  {0x01},
+		"array key":        {0xa1, 0x80, 0x01},
+		"invalid utf-8":    {0xa1, 0x61, 0xff, 0x01},
+		"nan":              {0xa1, 0x61, 'a', 0xf9, 0x7e, 0x00},
+		"simple value":     {0xa1, 0x61, 'a', 0xe0},
+		"reserved info":    {0xa1, 0x61, 'a', 0x1c},
+		"unexpected break": {0x81, 0xff},
+		"chunk type":       {0x81, 0x7f, 0x41, 'a', 0xff},
+		"huge length":      {0x9b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"too deep":         deep,
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := send(body)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Nil(t, p.pld)
+		})
+	}
+}
+
+func TestRequest_MaxTotalParsedBytes(t *testing.T) {
+	// the field key and value (8 bytes), the file key, name and mime (18 bytes) and its in-memory content (10 bytes)
+	form := func() *http.Request {
+		return handlertest.NewMultipart().
+			Field("name", "abcd").
+			File("doc", "a.txt", "text/plain", []byte("0123456789")).
+			Request(http.MethodPost, "/")
+	}
+
+	for limit, ok := range map[int64]bool{36: true, 35: false} {
+		cfg := &config.Parse{MaxTotalParsedBytes: limit}
+		require.NoError(t, cfg.InitDefaults())
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: cfg, Uploads: &config.Uploads{Dir: t.TempDir()}})
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, form())
+		if ok {
+			require.NotNil(t, p.pld)
+			assert.JSONEq(t, `{"name": "abcd"}`, string(p.pld.Body))
+			continue
+		}
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Nil(t, p.pld)
+	}
+
+	// the urlencoded forms count only the data tree
+	cfg := &config.Parse{MaxTotalParsedBytes: 8}
+	require.NoError(t, cfg.InitDefaults())
+	h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: cfg})
+	h.ServeHTTP(httptest.NewRecorder(), handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"name": {"abcd"}}))
+	require.NotNil(t, p.pld)
+
+	p.pld = nil
+	h.ServeHTTP(httptest.NewRecorder(), handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"name": {"abcde"}}))
+	assert.Nil(t, p.pld)
+
+	assert.Error(t, (&config.Parse{MaxTotalParsedBytes: -1}).InitDefaults())
+}
+
+func TestRequest_ParseWarnings(t *testing.T) {
+	dupHeader := handlertest.NewMultipart().Boundary("B").
+		Part([]string{`Content-Disposition: form-data; name="a"`, `Content-Disposition: form-data; name="b"`}, []byte("1"))
+	lf := handlertest.NewMultipart().Boundary("B").Newline("\n").Field("a", "1")
+
+	testCases := []struct {
+		name  string
+		parse *config.Parse
+		r     *http.Request
+		codes []ParseWarningCode
+	}{
+		{
+			name:  "duplicate part header",
+			parse: &config.Parse{DuplicatePartHeaders: config.DuplicatePartHeadersFirst},
+			r:     handlertest.NewRawRequest(http.MethodPost, "/", "multipart/form-data; boundary=B", dupHeader.Bytes()),
+			codes: []ParseWarningCode{ParseWarningDuplicatePartHeader},
+		},
+		{
+			name:  "lf framing",
+			parse: &config.Parse{MultipartLineEndings: config.MultipartLineEndingsLenient},
+			r:     handlertest.NewRawRequest(http.MethodPost, "/", "multipart/form-data; boundary=B", lf.Bytes()),
+			codes: []ParseWarningCode{ParseWarningLFFraming},
+		},
+		{
+			name: "ndjson line skipped",
+			parse: &config.Parse{
+				NDJSONMalformedLines: config.NDJSONMalformedSkip,
+				ContentTypes:         []*config.ContentType{{Pattern: "application/x-ndjson", Parser: config.ParserNDJSON}},
+			},
+			r:     handlertest.NewRawRequest(http.MethodPost, "/", "application/x-ndjson", []byte("{\"id\":1}\n{broken\n{also broken\n")),
+			codes: []ParseWarningCode{ParseWarningNDJSONLineSkipped, ParseWarningNDJSONLineSkipped},
+		},
+		{
+			name:  "method override ignored",
+			parse: &config.Parse{MethodOverrideField: "_method"},
+			r:     handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"_method": {"TRACE"}}),
+			codes: []ParseWarningCode{ParseWarningMethodOverrideIgnored},
+		},
+		{
+			name:  "none",
+			parse: &config.Parse{},
+			r:     handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"a": {"1"}}),
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.parse.ParseWarnings = true
+			require.NoError(t, tt.parse.InitDefaults())
+			h, p := newTestHandler(t, &config.Config{Parse: tt.parse, Uploads: &config.Uploads{Dir: t.TempDir()}})
+
+			var seen []ParseWarning
+			h.SetBodyInspectors(inspectorFunc(func(_ *http.Request, data DataView, _ FileView) error {
+				seen = data.Warnings()
+				return nil
+			}))
+
+			h.ServeHTTP(httptest.NewRecorder(), tt.r)
+			require.NotNil(t, p.pld)
+
+			codes := make([]ParseWarningCode, 0, len(seen))
+			for _, w := range seen {
+				codes = append(codes, w.Code)
+			}
+			assert.Equal(t, len(tt.codes), len(codes))
+			assert.ElementsMatch(t, tt.codes, codes)
+
+			attr := p.request(t).Attributes[ParseWarningsAttribute]
+			if len(tt.codes) == 0 {
+				assert.Nil(t, attr)
+				return
+			}
+
+			require.NotNil(t, attr)
+			var sent []ParseWarning
+			require.NoError(t, json.Unmarshal(attr.Value[0], &sent))
+			assert.Equal(t, seen, sent)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg := &config.Parse{MethodOverrideField: "_method"}
+		require.NoError(t, cfg.InitDefaults())
+		h, p := newTestHandler(t, &config.Config{Parse: cfg})
+		h.ServeHTTP(httptest.NewRecorder(), handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"_method": {"TRACE"}}))
+		assert.NotContains(t, p.request(t).Attributes, ParseWarningsAttribute)
+	})
+}
+
+func TestHandler_EstimateParse(t *testing.T) {
+	cfg := &config.Parse{ContentTypes: []*config.ContentType{{Pattern: "application/json", Parser: config.ParserJSON}}}
+	require.NoError(t, cfg.InitDefaults())
+	h, _ := newTestHandler(t, &config.Config{Parse: cfg})
+
+	request := func(method, ct string, n int) *http.Request {
+		r := httptest.NewRequest(method, "/", nil)
+		r.Header.Set("Content-Type", ct)
+		r.ContentLength = int64(n)
+		return r
+	}
+
+	testCases := []struct {
+		name   string
+		r      *http.Request
+		parsed bool
+		fields int64
+	}{
+		{name: "urlencoded", r: request(http.MethodPost, handlertest.ContentURLEncoded, 1600), parsed: true, fields: 101},
+		{name: "multipart", r: request(http.MethodPost, "multipart/form-data; boundary=B", 1130), parsed: true, fields: 11},
+		{name: "multipart parts limit", r: request(http.MethodPost, "multipart/form-data; boundary=B", 1<<30), parsed: true, fields: maxMultipartParts},
+		{name: "multipart without boundary", r: request(http.MethodPost, "multipart/form-data", 1<<20), parsed: true},
+		{name: "json", r: request(http.MethodPost, "application/json", 160), parsed: true, fields: 11},
+		// not mapped to the JSON parser
+		{name: "ndjson", r: request(http.MethodPost, "application/x-ndjson", 160)},
+		{name: "raw", r: request(http.MethodPost, "application/octet-stream", 1<<20)},
+		{name: "unknown length", r: request(http.MethodPost, handlertest.ContentURLEncoded, -1)},
+		{name: "get", r: request(http.MethodGet, handlertest.ContentURLEncoded, 1600)},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			est := h.EstimateParse(tt.r)
+			assert.Equal(t, tt.parsed, est.Parsed)
+			assert.Equal(t, tt.fields, est.Fields)
+			if tt.fields > 0 {
+				assert.Positive(t, est.Bytes)
+			}
+		})
+	}
+
+	// the multipart memory is capped by the memory limit
+	est := h.EstimateParse(request(http.MethodPost, "multipart/form-data; boundary=B", 1<<30))
+	assert.Less(t, est.Bytes, int64(1<<30))
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	stderr "errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -15,8 +16,25 @@ import (
 const (
 	Trailer   string = "Trailer"
 	HTTP2Push string = "Http2-Push"
+	// StreamFlush is the response header the worker uses to choose how the streamed response chunks are flushed to the
+	// client, it's not sent to the client.
+	StreamFlush string = "Stream-Flush"
 )
 
+const (
+	// StreamFlushAuto flushes every body chunk as soon as it's written, the default.
+	StreamFlushAuto string = "auto"
+	// StreamFlushManual buffers the body chunks until the worker sends an empty chunk, the "flush now" signal.
+	StreamFlushManual string = "manual"
+)
+
+// responseStream is the state of the response written from the several worker chunks.
+type responseStream struct {
+	manualFlush bool
+	// the Server-Sent Events stream, every event is flushed as soon as it's written
+	eventStream bool
+}
+
 // Response handles PSR7 response logic.
 type Response struct {
 	// Status contains response status.
@@ -27,9 +45,14 @@ type Response struct {
 
 // Write writes response headers, status and body into ResponseWriter.
 func (h *Handler) Write(pld *payload.Payload, w http.ResponseWriter) error {
+	return h.write(pld, w, &responseStream{})
+}
+
+// write writes the response chunk, the stream state is shared by all the chunks of the response.
+func (h *Handler) write(pld *payload.Payload, w http.ResponseWriter, st *responseStream) error {
 	switch pld.Codec {
 	case frame.CodecProto:
-		return h.handlePROTOresponse(pld, w)
+		return h.handlePROTOresponse(pld, w, st)
 	case frame.CodecJSON:
 		return errors.Str("JSON codec is not supported")
 	default:
@@ -37,7 +60,7 @@ func (h *Handler) Write(pld *payload.Payload, w http.ResponseWriter) error {
 	}
 }
 
-func (h *Handler) handlePROTOresponse(pld *payload.Payload, w http.ResponseWriter) error {
+func (h *Handler) handlePROTOresponse(pld *payload.Payload, w http.ResponseWriter, st *responseStream) error {
 	rsp := h.getProtoRsp()
 	defer h.putProtoRsp(rsp)
 
@@ -62,6 +85,15 @@ func (h *Handler) handlePROTOresponse(pld *payload.Payload, w http.ResponseWrite
 			}
 		}
 
+		if rsp.GetHeaders() != nil && rsp.GetHeaders()[StreamFlush] != nil {
+			err = st.flushMode(rsp.GetHeaders()[StreamFlush].GetValue())
+			if err != nil {
+				return err
+			}
+
+			delete(rsp.GetHeaders(), StreamFlush)
+		}
+
 		if rsp.GetHeaders() != nil && rsp.GetHeaders()[Trailer] != nil {
 			handleProtoTrailers(rsp.GetHeaders())
 		}
@@ -73,6 +105,14 @@ func (h *Handler) handlePROTOresponse(pld *payload.Payload, w http.ResponseWrite
 			}
 		}
 
+		if isEventStream(w.Header()) {
+			st.eventStream = true
+			err = prepareEventStream(w)
+			if err != nil {
+				return err
+			}
+		}
+
 		// The provided code must be a valid HTTP 1xx-5xx status code.
 		if rsp.Status < 100 || rsp.Status >= 600 {
 			http.Error(w, fmt.Sprintf("unknown status code from worker: %d", rsp.Status), 500)
@@ -82,8 +122,12 @@ func (h *Handler) handlePROTOresponse(pld *payload.Payload, w http.ResponseWrite
 		w.WriteHeader(int(rsp.Status))
 	}
 
-	// do not write body if it is empty
+	// do not write body if it is empty, in the manual mode the empty chunk without headers asks to flush
 	if len(pld.Body) == 0 {
+		if st.manualFlush && len(pld.Context) == 0 {
+			return flush(w)
+		}
+
 		return nil
 	}
 
@@ -92,8 +136,36 @@ func (h *Handler) handlePROTOresponse(pld *payload.Payload, w http.ResponseWrite
 		return err
 	}
 
-	if fl, ok := w.(http.Flusher); ok {
-		fl.Flush()
+	if st.manualFlush && !st.eventStream {
+		return nil
+	}
+
+	return flush(w)
+}
+
+func (st *responseStream) flushMode(values [][]byte) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	switch mode := strings.ToLower(strings.TrimSpace(string(values[0]))); mode {
+	case StreamFlushManual:
+		st.manualFlush = true
+	case StreamFlushAuto, "":
+		st.manualFlush = false
+	default:
+		return errors.Errorf("unknown %s mode from worker: %s", StreamFlush, mode)
+	}
+
+	return nil
+}
+
+// flush sends the buffered response data to the client. The response controller is used to reach the flusher of the
+// wrapped writers (middlewares), the writers without one are left as is.
+func flush(w http.ResponseWriter) error {
+	err := http.NewResponseController(w).Flush()
+	if err != nil && !stderr.Is(err, http.ErrNotSupported) {
+		return err
 	}
 
 	return nil
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/roadrunner-server/http/v5/config"
+)
+
+// SelectedFieldsAttribute lists the fields of the partially serialized body, see config.Parse.SelectFields. The
+// worker gets only these subtrees of the parsed body and uploads.
+const SelectedFieldsAttribute string = "Selected-Fields"
+
+// fieldSelection is the list of the selected fields of each route, the first matching route applies.
+type fieldSelection []*selectRoute
+
+type selectRoute struct {
+	// empty means all paths
+	paths []string
+	// the configured field names, for the attribute
+	names []string
+	// the split keys, none is the prefix of another one
+	keys [][]string
+}
+
+// newFieldSelection returns nil when no fields are selected.
+func newFieldSelection(cfg []*config.SelectFields, phpKeys bool) fieldSelection {
+	if len(cfg) == 0 {
+		return nil
+	}
+
+	fs := make(fieldSelection, 0, len(cfg))
+	for _, sf := range cfg {
+		route := &selectRoute{paths: sf.Paths, names: sf.Fields}
+		for _, f := range sf.Fields {
+			if keys := splitKey(f, phpKeys); len(keys) > 0 {
+				route.keys = append(route.keys, keys)
+			}
+		}
+
+		route.keys = dropCoveredKeys(route.keys)
+		fs = append(fs, route)
+	}
+
+	return fs
+}
+
+// dropCoveredKeys removes the keys already selected by a shorter (or the same) key, user[name] is a part of user.
+func dropCoveredKeys(keys [][]string) [][]string {
+	out := keys[:0:0]
+	for i, k := range keys {
+		covered := false
+		for j, other := range keys {
+			if j == i || len(other) > len(k) || (len(other) == len(k) && j > i) {
+				continue
+			}
+
+			if slices.Equal(other, k[:len(other)]) {
+				covered = true
+				break
+			}
+		}
+
+		if !covered {
+			out = append(out, k)
+		}
+	}
+
+	return out
+}
+
+// apply marks the parsed tree of the request for the partial serialization when the route selects the fields.
+func (fs fieldSelection) apply(hr *http.Request, req *Request) {
+	if fs == nil || !req.Parsed {
+		return
+	}
+
+	if _, ok := req.body.(dataTree); !ok && req.Uploads == nil {
+		return
+	}
+
+	for _, route := range fs {
+		if hasPathPrefix(hr.URL.Path, route.paths) {
+			req.selected = route.keys
+			req.setAttribute(SelectedFieldsAttribute, route.names...)
+			return
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	stderr "errors"
+	"net/http"
+	"time"
+)
+
+const mimeEventStream string = "text/event-stream"
+
+// isEventStream reports whether the worker response is a Server-Sent Events stream.
+func isEventStream(header http.Header) bool {
+	return mediaType(header.Get("Content-Type")) == mimeEventStream
+}
+
+// prepareEventStream sets the headers of the event stream response before they are written: the events must not be
+// cached, buffered by the proxies or compressed, since the compressing writers hold the events until their buffer is
+// full. The stream is sent without Content-Encoding (identity is not a valid response coding), the compressing
+// middlewares skip the text/event-stream responses. The write deadline of the server is lifted, the stream is open
+// until the worker or the client ends it.
+func prepareEventStream(w http.ResponseWriter) error {
+	header := w.Header()
+	if header.Get("Cache-Control") == "" {
+		header.Set("Cache-Control", "no-cache")
+	}
+
+	header.Set("X-Accel-Buffering", "no")
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !stderr.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	return nil
+}
+
+// stopOnDisconnect sends the stop signal to the worker stream when the request context is canceled (the client went
+// away), so the worker stops producing the response nobody reads. The returned function must be called once the
+// response is done, before the stop channel is reused.
+func stopOnDisconnect(ctx context.Context, stopCh chan struct{}) func() {
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(fired)
+
+		select {
+		case stopCh <- struct{}{}:
+		default:
+		}
+	})
+
+	return func() {
+		if !stop() {
+			// wait for the signal to be sent, so it's not left for the next request
+			<-fired
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	stderr "errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// sniffSize is the number of the body bytes checked against the declared content type.
+const sniffSize = 512
+
+// checkDeclaredType peeks at the beginning of the body and rejects the bodies which clearly belong to another content
+// type than the declared one: a JSON document sent as a form, a form sent as JSON, a multipart body without its
+// boundary. The peeked bytes are put back, the parsers read the whole body.
+func checkDeclaredType(r *http.Request, ct int) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+
+	br := bufio.NewReaderSize(r.Body, sniffSize)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, r.Body}
+
+	head, err := br.Peek(sniffSize)
+	if err != nil && !stderr.Is(err, io.EOF) && !stderr.Is(err, bufio.ErrBufferFull) {
+		return err
+	}
+
+	if ct == contentCBOR {
+		// the CBOR document is binary, the major type of its first item is an array, a map or a tag
+		if len(head) > 0 && head[0]>>5 != 4 && head[0]>>5 != 5 && head[0]>>5 != 6 {
+			return mismatchErr(r, errors.Str("the body is not a CBOR document"))
+		}
+
+		return nil
+	}
+
+	head = bytes.TrimLeft(head, " \t\r\n")
+	if len(head) == 0 {
+		return nil
+	}
+
+	switch ct {
+	case contentJSON:
+		if head[0] != '{' && head[0] != '[' {
+			return mismatchErr(r, errors.Str("the body is not a JSON document"))
+		}
+	case contentNDJSON:
+		if !strings.ContainsRune(`{["-0123456789tfn`, rune(head[0])) {
+			return mismatchErr(r, errors.Str("the body is not a JSON record"))
+		}
+	case contentURLEncoded:
+		if head[0] == '{' || head[0] == '[' || bytes.HasPrefix(head, []byte("--")) {
+			return mismatchErr(r, errors.Str("the body is not a urlencoded form"))
+		}
+	case contentMultipart:
+		_, params, errM := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if errM != nil || params["boundary"] == "" {
+			return mismatchErr(r, http.ErrMissingBoundary)
+		}
+
+		if !bytes.HasPrefix(head, []byte("--"+params["boundary"])) {
+			return mismatchErr(r, errors.Str("the body doesn't start with the multipart boundary"))
+		}
+	}
+
+	return nil
+}
+
+// declaredTypeErr reports the syntax errors of the body parsed under the declared content type as the content type
+// mismatch in the strict mode, the other errors are returned as is.
+func (h *Handler) declaredTypeErr(r *http.Request, err error) error {
+	if !h.strictContentType || err == nil {
+		return err
+	}
+
+	cause := errorCause(err)
+
+	var se *json.SyntaxError
+	var ee url.EscapeError
+	if stderr.As(cause, &se) || stderr.As(cause, &ee) || stderr.Is(cause, io.ErrUnexpectedEOF) || stderr.Is(cause, http.ErrMissingBoundary) {
+		return mismatchErr(r, err)
+	}
+
+	return err
+}
+
+func mismatchErr(r *http.Request, err error) error {
+	return newParseError(ParseErrorContentTypeMismatch, errors.Errorf("the body doesn't match the declared content type '%s': %v", mediaType(r.Header.Get("Content-Type")), err))
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"encoding/json"
+	stderr "errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	// StructuredHeaderAttributePrefix is the prefix of the attributes the parsed structured headers are passed to
+	// the worker with, the value is the JSON encoded tree.
+	StructuredHeaderAttributePrefix string = "Header:"
+	// maxHeaderPairs limits the number of pairs in all lines of a structured header.
+	maxHeaderPairs = 100
+)
+
+// readStructuredHeaders parses the headers with the bracket syntax pairs (user[id]=5; user[role]=admin) into the
+// trees. Values can be percent-encoded. Malformed headers are rejected with 400, the headers with too many pairs
+// with 431.
+func (r *Request) readStructuredHeaders(hr *http.Request, names []string) error {
+	for _, name := range names {
+		lines := hr.Header.Values(name)
+		if len(lines) == 0 {
+			continue
+		}
+
+		tree, err := parseStructuredHeader(lines)
+		if err != nil {
+			kind := ParseErrorMalformed
+			var pe *ParseError
+			if stderr.As(err, &pe) {
+				kind = pe.Kind
+			}
+
+			return newParseError(kind, errors.Errorf("malformed %s header: %v", name, err))
+		}
+
+		data, err := json.Marshal(tree)
+		if err != nil {
+			return err
+		}
+
+		r.setAttribute(StructuredHeaderAttributePrefix+http.CanonicalHeaderKey(name), string(data))
+	}
+
+	return nil
+}
+
+// parseStructuredHeader groups the values of the same keys, the same way the form values are, and pushes them into
+// the tree in the order the keys first appear.
+func parseStructuredHeader(lines []string) (dataTree, error) {
+	values := make(url.Values)
+	var keys []string
+	pairs := 0
+
+	for _, line := range lines {
+		for _, pair := range strings.Split(line, ";") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+
+			pairs++
+			if pairs > maxHeaderPairs {
+				return nil, newParseError(ParseErrorHeaderTooLarge, errors.Errorf("more than %d pairs", maxHeaderPairs)).
+					with(ParseErrorCodeLimitExceeded, fmt.Sprintf("send at most %d pairs in the header", maxHeaderPairs))
+			}
+
+			key, value, found := strings.Cut(pair, "=")
+			key = strings.TrimSpace(key)
+			if !found || key == "" {
+				return nil, errors.Errorf("invalid pair: %q", pair)
+			}
+
+			value, err := url.QueryUnescape(strings.TrimSpace(value))
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := values[key]; !ok {
+				keys = append(keys, key)
+			}
+			values[key] = append(values[key], value)
+		}
+	}
+
+	tree := make(dataTree, len(keys))
+	for _, k := range keys {
+		err := tree.push(k, values[k])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tree, nil
+}
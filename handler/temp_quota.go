@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"context"
+	stderr "errors"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tempQuota accounts the bytes held in the upload temp files of all requests served at the same time: the parts
+// spilled by the multipart reader and the files copied into the uploads dir. The bytes are reserved chunk by chunk
+// before they are written, and released once the files are removed.
+type tempQuota struct {
+	limit   int64
+	timeout time.Duration
+
+	mu   sync.Mutex
+	used int64
+	// closed and replaced on every release, wakes up the waiting requests
+	freed chan struct{}
+}
+
+func newTempQuota(limit int64, timeout time.Duration) *tempQuota {
+	return &tempQuota{
+		limit:   limit,
+		timeout: timeout,
+		freed:   make(chan struct{}),
+	}
+}
+
+// acquire reserves n bytes. When the quota is reached, the request waits for the other requests to free their temp
+// files up to the timeout (or until the client goes away). Returns false if the uploads should be rejected.
+func (q *tempQuota) acquire(ctx context.Context, n int64) bool {
+	if q == nil || n == 0 {
+		return true
+	}
+
+	// would never fit
+	if n > q.limit {
+		return false
+	}
+
+	var tm *time.Timer
+	for {
+		q.mu.Lock()
+		if q.used+n <= q.limit {
+			q.used += n
+			q.mu.Unlock()
+			return true
+		}
+		freed := q.freed
+		q.mu.Unlock()
+
+		if q.timeout == 0 {
+			return false
+		}
+
+		if tm == nil {
+			tm = time.NewTimer(q.timeout)
+			defer tm.Stop()
+		}
+
+		select {
+		case <-freed:
+		case <-tm.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// release returns n bytes reserved by acquire.
+func (q *tempQuota) release(n int64) {
+	if q == nil || n == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	q.used -= n
+	close(q.freed)
+	q.freed = make(chan struct{})
+	q.mu.Unlock()
+}
+
+// space returns the part of the quota reserved by the request, nil quota means unlimited.
+func (q *tempQuota) space(ctx context.Context) *tempSpace {
+	if q == nil {
+		return nil
+	}
+
+	return &tempSpace{ctx: ctx, quota: q}
+}
+
+// tempSpace is the temp space reserved by the request. The uploads are copied into the uploads dir concurrently, the
+// reserved bytes are counted atomically.
+type tempSpace struct {
+	// the request context, the waiting for the quota ends when the client goes away
+	ctx   context.Context
+	quota *tempQuota
+	n     atomic.Int64
+}
+
+// reserve reserves n bytes before they are written, the nil space is unlimited.
+func (s *tempSpace) reserve(n int64) error {
+	if s == nil || n == 0 {
+		return nil
+	}
+
+	if !s.quota.acquire(s.ctx, n) {
+		return &tempQuotaError{limit: s.quota.limit}
+	}
+
+	s.n.Add(n)
+	return nil
+}
+
+// free releases n bytes of the removed file.
+func (s *tempSpace) free(n int64) {
+	if s == nil || n == 0 {
+		return
+	}
+
+	s.n.Add(-n)
+	s.quota.release(n)
+}
+
+// freeAll releases the bytes of all the request files, once they are removed.
+func (s *tempSpace) freeAll() {
+	if s == nil {
+		return
+	}
+
+	s.quota.release(s.n.Swap(0))
+}
+
+// quotaWriter reserves the bytes in the quota before writing them to the temp file, and counts the bytes reserved for
+// the file.
+type quotaWriter struct {
+	w     io.Writer
+	space *tempSpace
+	n     int64
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	err := w.space.reserve(int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+
+	w.n += int64(len(p))
+	return w.w.Write(p)
+}
+
+// tempQuotaError is the temp file write rejected by the quota, the request is rejected with 503.
+type tempQuotaError struct {
+	limit int64
+}
+
+func (e *tempQuotaError) Error() string {
+	return "the uploads temp quota of " + strconv.FormatInt(e.limit, 10) + " bytes is reached"
+}
+
+// isTempQuotaErr reports whether the temp file write was rejected by the quota.
+func isTempQuotaErr(err error) bool {
+	var qe *tempQuotaError
+	return stderr.As(errorCause(err), &qe)
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"bytes"
+	stderr "errors"
+	"io"
+	"io/fs"
+	"syscall"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// isStorageErr reports whether the error is the failure of the disk the temp files are written to: full, read-only,
+// out of quota, not accessible or failing.
+func isStorageErr(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var pe *fs.PathError
+	if !stderr.As(err, &pe) {
+		return false
+	}
+
+	for _, errno := range []syscall.Errno{syscall.ENOSPC, syscall.EROFS, syscall.EDQUOT, syscall.EACCES, syscall.EPERM, syscall.EIO, syscall.ENOENT} {
+		if stderr.Is(err, errno) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// storageErr reports the temp storage failure as the temporary unavailability of the server (503), not as the
+// internal error with the filesystem details: the temp file path is left out.
+func storageErr(err error) error {
+	var pe *fs.PathError
+	if stderr.As(err, &pe) {
+		err = pe.Err
+	}
+
+	return newParseError(ParseErrorUnavailable, errors.Errorf("upload storage is unavailable: %v", err)).
+		with(ParseErrorCodeStorageUnavailable, "")
+}
+
+// keepInMemory reads the rest of the part the temp file couldn't be created for into memory, the parts exceeding the
+// fallback memory left for the request are rejected with the storage error.
+func (f *filePart) keepInMemory(buf *bytes.Buffer, rest io.Reader, fallback *int64, cause error) error {
+	limit := *fallback - int64(buf.Len())
+	if limit < 0 {
+		return storageErr(cause)
+	}
+
+	// one byte more to detect the parts which don't fit
+	_, err := io.CopyN(buf, rest, limit+1)
+	if err != nil && !stderr.Is(err, io.EOF) {
+		return err
+	}
+
+	if int64(buf.Len()) > *fallback {
+		return storageErr(cause)
+	}
+
+	*fallback -= int64(buf.Len())
+	f.content = buf.Bytes()
+	f.size = int64(len(f.content))
+	f.fallback = true
+	return nil
+}
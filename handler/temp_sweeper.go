@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/roadrunner-server/http/v5/config"
+	"go.uber.org/zap"
+)
+
+// TempSweeper periodically removes the upload temp files left in the uploads dir by a crashed worker or a missed
+// cleanup. Only the files named by the temp pattern and not modified for the TTL are removed, the files of the
+// requests in progress are written or read within the TTL.
+type TempSweeper struct {
+	dir     string
+	pattern string
+	ttl     time.Duration
+	// the time between the sweeps
+	interval time.Duration
+	log      *zap.Logger
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewTempSweeper returns nil when the temp files TTL is not configured.
+func NewTempSweeper(cfg *config.Uploads, log *zap.Logger) *TempSweeper {
+	if cfg == nil || cfg.TempTTL == 0 {
+		return nil
+	}
+
+	return &TempSweeper{
+		dir:      cfg.Dir,
+		pattern:  cfg.TempPattern,
+		ttl:      cfg.TempTTL,
+		interval: cfg.TempSweepInterval,
+		log:      log,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs the sweeps in the background until Stop is called.
+func (s *TempSweeper) Start() {
+	if s == nil {
+		return
+	}
+
+	go func() {
+		defer close(s.done)
+
+		tm := time.NewTicker(s.interval)
+		defer tm.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case now := <-tm.C:
+				s.sweep(now)
+			}
+		}
+	}()
+}
+
+// Stop stops the sweeps and waits for the running one to finish.
+func (s *TempSweeper) Stop() {
+	if s == nil {
+		return
+	}
+
+	s.once.Do(func() {
+		close(s.stop)
+		<-s.done
+	})
+}
+
+// sweep removes the temp files not modified since now minus the TTL, returns the number of the removed files and
+// their total size.
+func (s *TempSweeper) sweep(now time.Time) (int, int64) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		s.log.Warn("temp files sweep failed", zap.String("dir", s.dir), zap.Error(err))
+		return 0, 0
+	}
+
+	var removed int
+	var reclaimed int64
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !isTempName(e.Name(), s.pattern) {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil || now.Sub(info.ModTime()) < s.ttl {
+			// removed in the meantime or still in use
+			continue
+		}
+
+		name := filepath.Join(s.dir, e.Name())
+		err = os.Remove(name)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				s.log.Warn("orphaned temp file removal failed", zap.String("file", name), zap.Error(err))
+			}
+			continue
+		}
+
+		removed++
+		reclaimed += info.Size()
+		s.log.Debug("orphaned temp file removed", zap.String("file", name), zap.Int64("size", info.Size()), zap.Time("modified", info.ModTime()))
+	}
+
+	if removed > 0 {
+		s.log.Info("orphaned temp files reclaimed", zap.String("dir", s.dir), zap.Int("files", removed), zap.Int64("bytes", reclaimed))
+	}
+
+	return removed, reclaimed
+}
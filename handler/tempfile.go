@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	stderr "errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempNameRetries is the number of the names tried when the generated name already exists, with 128 random bits a
+// single retry is already unlikely.
+const tempNameRetries = 4
+
+// createTempFile creates a new file in the dir, the same way os.CreateTemp does, but the random part of the name is
+// 128 bits from crypto/rand, so the names are unpredictable and don't collide across the concurrent requests. The
+// last "*" in the pattern is replaced by the random part, the pattern without "*" gets it appended.
+func createTempFile(dir, pattern string) (*os.File, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndexByte(pattern, '*'); i != -1 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+
+	var rnd [16]byte
+	for try := 0; ; try++ {
+		_, err := rand.Read(rnd[:])
+		if err != nil {
+			return nil, err
+		}
+
+		name := filepath.Join(dir, prefix+hex.EncodeToString(rnd[:])+suffix)
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			return f, nil
+		}
+
+		if !stderr.Is(err, os.ErrExist) || try == tempNameRetries {
+			return nil, err
+		}
+	}
+}
+
+// isTempName reports whether the file name was generated by createTempFile for the pattern.
+func isTempName(name, pattern string) bool {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndexByte(pattern, '*'); i != -1 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+
+	if len(name) != len(prefix)+hex.EncodedLen(16)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return false
+	}
+
+	_, err := hex.DecodeString(name[len(prefix) : len(name)-len(suffix)])
+	return err == nil
+}
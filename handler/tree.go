@@ -0,0 +1,350 @@
+package handler
+
+import (
+	"encoding/json"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// MergePolicy defines how Merge resolves the keys present in both trees. In all policies an empty value never
+// replaces a non-empty one, and an empty leaf is replaced by a branch, the same way push treats them.
+type MergePolicy int
+
+const (
+	// MergeStrict follows the push semantics: the incoming leaf replaces the existing leaf, and a non-empty leaf
+	// colliding with a branch is an error.
+	MergeStrict MergePolicy = iota
+	// MergeKeep keeps the existing values on any collision, only the missing keys are added.
+	MergeKeep
+	// MergeOverride replaces the existing values with the incoming ones on any collision.
+	MergeOverride
+)
+
+// Merge deep-merges the other tree into the data tree. The other tree is copied, it's safe to modify it afterward.
+func (dt dataTree) Merge(other dataTree, policy MergePolicy) error {
+	return mergeTree(dt, other, policy, nil)
+}
+
+// Merge deep-merges the other tree into the file tree. The other tree is copied, but the uploads are shared.
+func (ft fileTree) Merge(other fileTree, policy MergePolicy) error {
+	return mergeTree(ft, other, policy, nil)
+}
+
+// mergeTree merges src into dst, the tags (nil when the sources aren't tracked) follow every replaced node.
+func mergeTree[T dataTree | fileTree](dst, src T, policy MergePolicy, tags *sourceTags) error {
+	for k, incoming := range src {
+		existing, ok := dst[k]
+		if !ok {
+			dst[k] = cloneNode[T](incoming)
+			tags.set(k, incoming)
+			continue
+		}
+
+		dstBranch, dstIsBranch := existing.(T)
+		srcBranch, srcIsBranch := incoming.(T)
+
+		switch {
+		case dstIsBranch && srcIsBranch:
+			err := mergeTree(dstBranch, srcBranch, policy, tags.child(k))
+			if err != nil {
+				return err
+			}
+		case dstIsBranch || srcIsBranch:
+			// leaf collides with a branch, empty leaf always gives the place to the branch
+			leaf := incoming
+			if srcIsBranch {
+				leaf = existing
+			}
+
+			if isDataEmpty(leaf) {
+				if srcIsBranch {
+					dst[k] = cloneNode[T](incoming)
+					tags.set(k, incoming)
+				}
+				continue
+			}
+
+			switch policy {
+			case MergeKeep:
+			case MergeOverride:
+				dst[k] = cloneNode[T](incoming)
+				tags.set(k, incoming)
+			default:
+				return invalidMultipleValuesErr(k)
+			}
+		default:
+			if isDataEmpty(incoming) {
+				continue
+			}
+
+			if policy == MergeKeep && !isDataEmpty(existing) {
+				continue
+			}
+
+			dst[k] = cloneNode[T](incoming)
+			tags.set(k, incoming)
+		}
+	}
+
+	return nil
+}
+
+// SetAtPath places the value at the path of the already split key (a[b][] is {"a", "b", ""}), creating the
+// intermediate nodes. The collisions are resolved the same way push resolves them. The value is a string or a
+// list of strings.
+func (dt dataTree) SetAtPath(path []string, value any) error {
+	err := checkTreePath(path)
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case string:
+		return dt.mount(path, []string{v})
+	case []string:
+		return dt.mount(path, v)
+	default:
+		return errors.Errorf("unsupported data tree value type %T", value)
+	}
+}
+
+// SetAtPath places the upload reference at the path of the already split key, see dataTree.SetAtPath. The value
+// is a *FileUpload or a list of them.
+func (ft fileTree) SetAtPath(path []string, value any) error {
+	err := checkTreePath(path)
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case *FileUpload:
+		return ft.mount(path, []*FileUpload{v})
+	case []*FileUpload:
+		return ft.mount(path, v)
+	default:
+		return errors.Errorf("unsupported file tree value type %T", value)
+	}
+}
+
+// Delete removes the node (a leaf or a whole branch) at the path of the already split key, the emptied parent
+// branches are kept. Returns false if the path doesn't exist.
+func (dt dataTree) Delete(path []string) bool {
+	if len(path) == 0 {
+		return false
+	}
+
+	node := dt
+	for _, k := range path[:len(path)-1] {
+		branch, ok := node[k].(dataTree)
+		if !ok {
+			return false
+		}
+
+		node = branch
+	}
+
+	if _, ok := node[path[len(path)-1]]; !ok {
+		return false
+	}
+
+	delete(node, path[len(path)-1])
+	return true
+}
+
+func checkTreePath(path []string) error {
+	if len(path) == 0 || path[0] == "" {
+		return errors.Str("empty tree path")
+	}
+
+	if len(path) > MaxLevel {
+		return errors.Errorf("tree path exceeds the maximum nesting level %d", MaxLevel)
+	}
+
+	return nil
+}
+
+// cloneNode returns a deep copy of the tree node, the file uploads are shared.
+func cloneNode[T dataTree | fileTree](v any) any {
+	switch actual := v.(type) {
+	case T:
+		node := make(T, len(actual))
+		for k := range actual {
+			node[k] = cloneNode[T](actual[k])
+		}
+
+		return node
+	case []string:
+		return append([]string(nil), actual...)
+	case []*FileUpload:
+		return append([]*FileUpload(nil), actual...)
+	case []any:
+		return append([]any(nil), actual...)
+	default:
+		return v
+	}
+}
+
+// lookupNode returns the node at the path of the already split key, the empty path is the tree itself.
+func lookupNode[T dataTree | fileTree](tree T, path []string) (any, bool) {
+	var node any = tree
+	for _, k := range path {
+		branch, ok := node.(T)
+		if !ok {
+			return nil, false
+		}
+
+		node, ok = branch[k]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return node, true
+}
+
+// selectTree returns the tree holding only the nodes at the paths and the branches leading to them, the selected
+// nodes are shared with the tree. The missing paths are skipped. None of the paths may be the prefix of another one,
+// the selected branch would be modified otherwise.
+func selectTree[T dataTree | fileTree](tree T, paths [][]string) T {
+	out := make(T, len(paths))
+	for _, path := range paths {
+		node, ok := lookupNode(tree, path)
+		if !ok || len(path) == 0 {
+			continue
+		}
+
+		dst := out
+		for _, k := range path[:len(path)-1] {
+			next, ok := dst[k].(T)
+			if !ok {
+				next = make(T, 1)
+				dst[k] = next
+			}
+
+			dst = next
+		}
+
+		dst[path[len(path)-1]] = node
+	}
+
+	return out
+}
+
+// Flatten converts the data tree back to the bracket notation keys (key[a][b]=v), the inverse of push. Lists are
+// written with the empty index (key[]=v1&key[]=v2). Note that the keys containing brackets or spaces can't be
+// represented in this notation and will be parsed differently by push.
+func (dt dataTree) Flatten() url.Values {
+	values := make(url.Values, len(dt))
+	dt.flatten("", values)
+
+	return values
+}
+
+func (dt dataTree) flatten(prefix string, values url.Values) {
+	for k, v := range dt {
+		key := k
+		if prefix != "" {
+			key = prefix + "[" + k + "]"
+		}
+
+		switch actual := v.(type) {
+		case dataTree:
+			if len(actual) == 0 {
+				values[key] = []string{""}
+				continue
+			}
+
+			actual.flatten(key, values)
+		case []string:
+			values[key+"[]"] = append(values[key+"[]"], actual...)
+		case []any:
+			for i := range actual {
+				values[key+"[]"] = append(values[key+"[]"], typedScalarString(actual[i]))
+			}
+		case string:
+			values[key] = []string{actual}
+		case json.Number, bool:
+			values[key] = []string{typedScalarString(actual)}
+		}
+	}
+}
+
+// typedScalarString converts the coerced JSON scalar back to the form string.
+func typedScalarString(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	return jsonScalars{}.scalar(v)
+}
+
+// count returns the number of the values stored in the tree, each list element is counted separately.
+func (dt dataTree) count() int {
+	n := 0
+	for _, v := range dt {
+		switch actual := v.(type) {
+		case dataTree:
+			n += actual.count()
+		case []string:
+			n += len(actual)
+		case []any:
+			n += len(actual)
+		default:
+			n++
+		}
+	}
+
+	return n
+}
+
+// Walk calls fn for each upload stored in the tree with its full path, the list elements have their index as the last
+// path segment (files[1] is {"files", "1"}). The keys are walked in the sorted order, until fn returns false. The
+// path is reused between the calls, fn must copy it to keep it.
+func (ft fileTree) Walk(fn func(path []string, f *FileUpload) bool) {
+	ft.walk(make([]string, 0, 4), fn)
+}
+
+func (ft fileTree) walk(path []string, fn func(path []string, f *FileUpload) bool) bool {
+	for _, k := range slices.Sorted(maps.Keys(ft)) {
+		p := append(path, k)
+
+		switch actual := ft[k].(type) {
+		case fileTree:
+			if !actual.walk(p, fn) {
+				return false
+			}
+		case []*FileUpload:
+			for i := range actual {
+				if !fn(append(p, strconv.Itoa(i)), actual[i]) {
+					return false
+				}
+			}
+		case *FileUpload:
+			if !fn(p, actual) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// uploads appends all the uploads stored in the tree to the list.
+func (ft fileTree) uploads(list []*FileUpload) []*FileUpload {
+	for _, v := range ft {
+		switch actual := v.(type) {
+		case fileTree:
+			list = actual.uploads(list)
+		case []*FileUpload:
+			list = append(list, actual...)
+		case *FileUpload:
+			list = append(list, actual)
+		}
+	}
+
+	return list
+}
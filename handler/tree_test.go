@@ -0,0 +1,297 @@
+package handler
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataTreeMerge(t *testing.T) {
+	base := func() dataTree {
+		return dataTree{
+			"name":  "default",
+			"empty": "",
+			"opts": dataTree{
+				"color": "red",
+				"size":  "m",
+			},
+			"tags": []string{"a"},
+		}
+	}
+
+	testCases := []struct {
+		name    string
+		policy  MergePolicy
+		other   dataTree
+		want    dataTree
+		wantErr bool
+	}{
+		{
+			name:   "strict incoming leaves win",
+			policy: MergeStrict,
+			other: dataTree{
+				"name":  "user",
+				"empty": "filled",
+				"opts":  dataTree{"size": "xl", "weight": "1"},
+				"tags":  []string{"b", "c"},
+			},
+			want: dataTree{
+				"name":  "user",
+				"empty": "filled",
+				"opts":  dataTree{"color": "red", "size": "xl", "weight": "1"},
+				"tags":  []string{"b", "c"},
+			},
+		},
+		{
+			name:   "strict empty value does not override",
+			policy: MergeStrict,
+			other:  dataTree{"name": "", "opts": ""},
+			want:   base(),
+		},
+		{
+			name:   "strict empty leaf is replaced by a branch",
+			policy: MergeStrict,
+			other:  dataTree{"empty": dataTree{"k": "v"}},
+			want: dataTree{
+				"name":  "default",
+				"empty": dataTree{"k": "v"},
+				"opts":  dataTree{"color": "red", "size": "m"},
+				"tags":  []string{"a"},
+			},
+		},
+		{
+			name:    "strict scalar over branch",
+			policy:  MergeStrict,
+			other:   dataTree{"opts": "scalar"},
+			wantErr: true,
+		},
+		{
+			name:    "strict branch over scalar",
+			policy:  MergeStrict,
+			other:   dataTree{"name": dataTree{"k": "v"}},
+			wantErr: true,
+		},
+		{
+			name:   "keep",
+			policy: MergeKeep,
+			other: dataTree{
+				"name":  "user",
+				"empty": "filled",
+				"opts":  "scalar",
+				"new":   "value",
+			},
+			want: dataTree{
+				"name":  "default",
+				"empty": "filled",
+				"opts":  dataTree{"color": "red", "size": "m"},
+				"tags":  []string{"a"},
+				"new":   "value",
+			},
+		},
+		{
+			name:   "override",
+			policy: MergeOverride,
+			other: dataTree{
+				"name": dataTree{"first": "f"},
+				"opts": "scalar",
+			},
+			want: dataTree{
+				"name":  dataTree{"first": "f"},
+				"empty": "",
+				"opts":  "scalar",
+				"tags":  []string{"a"},
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			dt := base()
+			err := dt.Merge(tt.other, tt.policy)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, dt)
+		})
+	}
+}
+
+func TestDataTreeMergeCopies(t *testing.T) {
+	dt := dataTree{}
+	other := dataTree{"opts": dataTree{"color": "red"}}
+
+	require.NoError(t, dt.Merge(other, MergeStrict))
+	other["opts"].(dataTree)["color"] = "blue"
+
+	assert.Equal(t, dataTree{"opts": dataTree{"color": "red"}}, dt)
+}
+
+func TestFileTreeMerge(t *testing.T) {
+	f1 := &FileUpload{Name: "f1"}
+	f2 := &FileUpload{Name: "f2"}
+
+	ft := fileTree{"docs": fileTree{"a": f1}}
+	require.NoError(t, ft.Merge(fileTree{"docs": fileTree{"b": f2}, "avatar": f2}, MergeStrict))
+	assert.Equal(t, fileTree{"docs": fileTree{"a": f1, "b": f2}, "avatar": f2}, ft)
+
+	assert.Error(t, ft.Merge(fileTree{"avatar": fileTree{"x": f1}}, MergeStrict))
+}
+
+func TestDataTreeFlatten(t *testing.T) {
+	dt := dataTree{
+		"name": "value",
+		"list": []string{"a", "b"},
+		"opts": dataTree{
+			"color": "red",
+			"sizes": []string{"m"},
+			"deep":  dataTree{"k": "v"},
+		},
+	}
+
+	assert.Equal(t, url.Values{
+		"name":          {"value"},
+		"list[]":        {"a", "b"},
+		"opts[color]":   {"red"},
+		"opts[sizes][]": {"m"},
+		"opts[deep][k]": {"v"},
+	}, dt.Flatten())
+}
+
+func TestDataTreeFlattenRoundTrip(t *testing.T) {
+	for _, values := range []url.Values{
+		{"key[options][id]": {"id1"}, "key[options][value]": {"value1"}},
+		{"key[]": {"a", "b"}, "other[x]": {""}},
+		{"key": {"v"}, "other[a][b][c]": {"deep"}, "other[a][d]": {"shallow"}},
+		{"list[0][name]": {"n0"}, "list[1][name]": {"n1"}, "list[1][tags][]": {"t1", "t2"}},
+		{"empty": {""}, "nested[empty]": {""}},
+	} {
+		dt := make(dataTree)
+		for k, v := range values {
+			require.NoError(t, dt.push(k, v))
+		}
+
+		restored := make(dataTree)
+		for k, v := range dt.Flatten() {
+			require.NoError(t, restored.push(k, v))
+		}
+
+		assert.Equal(t, dt, restored)
+	}
+}
+
+func TestDataTreeSetAtPath(t *testing.T) {
+	type pair struct {
+		key   string
+		value []string
+	}
+
+	// the same collision rules as push, the pairs are applied in order
+	for _, pairs := range [][]pair{
+		{{"key[options][id]", []string{"id1"}}, {"key[options][value]", []string{"value1"}}},
+		{{"key[a]", []string{""}}, {"key[a][b]", []string{"v"}}},
+		{{"key[a][b]", []string{"v"}}, {"key[a]", []string{""}}},
+		{{"key[]", []string{"a", "b"}}, {"key[]", []string{"c"}}},
+		{{"key", []string{"old"}}, {"key", []string{"new"}}},
+		{{"key[a]", []string{"v"}}, {"key[a][b]", []string{"w"}}},
+		{{"key[a][b]", []string{"w"}}, {"key[a]", []string{"v"}}},
+	} {
+		pushed := make(dataTree)
+		set := make(dataTree)
+
+		var errPush, errSet error
+		for _, p := range pairs {
+			errPush = pushed.push(p.key, p.value)
+			errSet = set.SetAtPath(splitKey(p.key, false), p.value)
+			if errPush != nil || errSet != nil {
+				break
+			}
+		}
+
+		assert.Equal(t, errPush, errSet)
+		assert.Equal(t, pushed, set)
+	}
+
+	dt := dataTree{}
+	require.NoError(t, dt.SetAtPath([]string{"variables", "input", "name"}, "n"))
+	require.NoError(t, dt.SetAtPath([]string{"variables", "tags", ""}, []string{"a", "b"}))
+	assert.Equal(t, dataTree{"variables": dataTree{"input": dataTree{"name": "n"}, "tags": []string{"a", "b"}}}, dt)
+
+	assert.Error(t, dt.SetAtPath(nil, "v"))
+	assert.Error(t, dt.SetAtPath([]string{"a"}, 1))
+	assert.Error(t, dt.SetAtPath(make([]string, MaxLevel+1), "v"))
+	assert.Error(t, dt.SetAtPath([]string{"variables", "input", "name", "x"}, "v"))
+}
+
+func TestFileTreeSetAtPath(t *testing.T) {
+	f1 := &FileUpload{Name: "f1"}
+	f2 := &FileUpload{Name: "f2"}
+
+	ft := fileTree{}
+	require.NoError(t, ft.SetAtPath([]string{"variables", "file"}, f1))
+	require.NoError(t, ft.SetAtPath([]string{"variables", "files", ""}, []*FileUpload{f1, f2}))
+	assert.Equal(t, fileTree{"variables": fileTree{"file": f1, "files": []*FileUpload{f1, f2}}}, ft)
+
+	// a non-empty leaf collides with a branch
+	assert.Error(t, ft.SetAtPath([]string{"variables", "file", "x"}, f2))
+	assert.Error(t, ft.SetAtPath([]string{"variables"}, "value"))
+}
+
+func TestFileTreeWalk(t *testing.T) {
+	avatar := &FileUpload{Name: "avatar.png"}
+	doc1 := &FileUpload{Name: "a.pdf"}
+	doc2 := &FileUpload{Name: "b.pdf"}
+
+	ft := fileTree{
+		"avatar": avatar,
+		"user":   fileTree{"docs": []*FileUpload{doc1, doc2}},
+	}
+
+	type visit struct {
+		path string
+		f    *FileUpload
+	}
+
+	var visited []visit
+	ft.Walk(func(path []string, f *FileUpload) bool {
+		visited = append(visited, visit{path: strings.Join(path, "."), f: f})
+		return true
+	})
+	assert.Equal(t, []visit{{"avatar", avatar}, {"user.docs.0", doc1}, {"user.docs.1", doc2}}, visited)
+
+	t.Run("early termination", func(t *testing.T) {
+		n := 0
+		ft.Walk(func(path []string, f *FileUpload) bool {
+			n++
+			return n < 2
+		})
+		assert.Equal(t, 2, n)
+	})
+
+	t.Run("view", func(t *testing.T) {
+		var names []string
+		FileView{tree: ft}.Walk(func(path []string, f FileUpload) bool {
+			names = append(names, f.Name)
+			return true
+		})
+		assert.Equal(t, []string{"avatar.png", "a.pdf", "b.pdf"}, names)
+	})
+}
+
+func TestDataTreeDelete(t *testing.T) {
+	dt := dataTree{"a": "1", "user": dataTree{"role": "admin", "tags": []string{"x"}}}
+
+	assert.True(t, dt.Delete([]string{"user", "role"}))
+	assert.False(t, dt.Delete([]string{"user", "role"}))
+	assert.False(t, dt.Delete([]string{"a", "b"}))
+	assert.False(t, dt.Delete(nil))
+	assert.Equal(t, dataTree{"a": "1", "user": dataTree{"tags": []string{"x"}}}, dt)
+
+	assert.True(t, dt.Delete([]string{"user"}))
+	assert.Equal(t, dataTree{"a": "1"}, dt)
+}
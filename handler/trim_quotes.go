@@ -0,0 +1,41 @@
+package handler
+
+// trimQuotes strips a single layer of the matching double quotes surrounding the values ("value" is value) of the
+// fields matched by the patterns, see config.Parse.TrimQuotes. The list values are matched by the name of the list,
+// the unmatched and the embedded quotes are kept.
+func (fp fieldPatterns) trimQuotes(dt dataTree, prefix []string) {
+	for k, v := range dt {
+		keys := append(prefix[:len(prefix):len(prefix)], k)
+
+		switch actual := v.(type) {
+		case dataTree:
+			fp.trimQuotes(actual, keys)
+		case string:
+			if fp.match(keys...) {
+				dt[k] = unquoteValue(actual)
+			}
+		case []string:
+			if fp.match(keys...) {
+				for i := range actual {
+					actual[i] = unquoteValue(actual[i])
+				}
+			}
+		case []any:
+			if fp.match(keys...) {
+				for i := range actual {
+					if s, ok := actual[i].(string); ok {
+						actual[i] = unquoteValue(s)
+					}
+				}
+			}
+		}
+	}
+}
+
+func unquoteValue(v string) string {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		return v[1 : len(v)-1]
+	}
+
+	return v
+}
@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isUpgrade reports whether the request is a protocol upgrade handshake (WebSocket and alike): the Connection header
+// has the upgrade token and the Upgrade header names the protocol. The handshake has no body to parse, the
+// connection is taken over by the upgraded protocol once it's accepted.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+
+	for _, v := range r.Header["Connection"] {
+		for token := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
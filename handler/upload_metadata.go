@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"net/http"
+)
+
+// UploadMetadataExtractor tags the uploads with the metadata the handler already knows about the request (the
+// authenticated user, the route), so the worker doesn't have to derive it again. It's called once per request with
+// uploads, the returned map is shared by all the uploads of the request and must not be modified afterward. The
+// empty map leaves the uploads untagged.
+type UploadMetadataExtractor interface {
+	UploadMetadata(r *http.Request) map[string]string
+}
+
+// UploadMetadataFunc is the function adapter of the UploadMetadataExtractor.
+type UploadMetadataFunc func(r *http.Request) map[string]string
+
+// UploadMetadata calls f(r).
+func (f UploadMetadataFunc) UploadMetadata(r *http.Request) map[string]string {
+	return f(r)
+}
+
+// tagUploads sets the metadata of the request uploads, if the extractor is set.
+func (h *Handler) tagUploads(r *http.Request, uploads *Uploads) {
+	if h.uploadMetadata == nil || uploads == nil || len(uploads.list) == 0 {
+		return
+	}
+
+	md := h.uploadMetadata.UploadMetadata(r)
+	if len(md) == 0 {
+		return
+	}
+
+	for _, f := range uploads.list {
+		f.Metadata = md
+	}
+}
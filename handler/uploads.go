@@ -1,29 +1,38 @@
 package handler
 
 import (
+	"bufio"
 	"encoding/json"
 	"io"
 	"mime/multipart"
+	"net/http"
+	"net/textproto"
 	"os"
 	"path"
 	"strings"
 	"sync"
 
+	"github.com/roadrunner-server/http/v5/config"
 	"go.uber.org/zap"
 )
 
 const (
 	// UploadErrorOK - no error, the file uploaded with success.
 	UploadErrorOK = 0
+	// UploadErrorIniSize - the file exceeds the max_file_size.
+	UploadErrorIniSize = 1
+	// UploadErrorFormSize - the file exceeds the MAX_FILE_SIZE field of the form.
+	UploadErrorFormSize = 2
+	// UploadErrorPartial - the body ended before the file was uploaded completely.
+	UploadErrorPartial = 3
 	// UploadErrorNoFile - no file was uploaded.
 	UploadErrorNoFile = 4
 	// UploadErrorNoTmpDir - missing a temporary folder.
 	UploadErrorNoTmpDir = 6
 	// UploadErrorCantWrite - failed to write file to disk.
 	UploadErrorCantWrite = 7
-	// UploadErrorExtension - forbidden file extension.
+	// UploadErrorExtension - forbidden file extension or media type.
 	UploadErrorExtension = 8
-	pattern              = "upload"
 )
 
 // Uploads tree manages uploaded files tree and temporary files.
@@ -43,19 +52,57 @@ func (u *Uploads) MarshalJSON() ([]byte, error) {
 // Open moves all uploaded files to temp directory, return error in case of issue with temp directory. File errors
 // will be handled individually.
 func (u *Uploads) Open(log *zap.Logger, dir string, forbid, allow map[string]struct{}) {
+	_ = u.open(log, dir, forbid, allow, nil, nil)
+}
+
+// open moves the files to the temp directory, at most the open files limit of them at the same time. The files
+// which didn't get the open file slot in time are left unopened and the error is returned. The files which can't be
+// stored because the temp disk is full or not writable keep their upload error code (UPLOAD_ERR_NO_TMP_DIR or
+// UPLOAD_ERR_CANT_WRITE), and the storage error is returned. The files are written within the temp space of the
+// request, the quota error is returned once it's reached.
+func (u *Uploads) open(log *zap.Logger, dir string, forbid, allow map[string]struct{}, of *openFiles, space *tempSpace) error {
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errL error
 	for i := range u.list {
 		wg.Add(1)
 		go func(f *FileUpload) {
 			defer wg.Done()
-			err := f.Open(dir, forbid, allow)
+			if f.Error != UploadErrorOK {
+				return
+			}
+
+			err := of.acquire()
+			if err != nil {
+				mu.Lock()
+				errL = err
+				mu.Unlock()
+				return
+			}
+
+			defer of.release()
+
+			f.space = space
+			err = f.Open(dir, forbid, allow)
 			if err != nil && log != nil {
 				log.Error("error opening the file", zap.Error(err))
 			}
+
+			switch {
+			case isTempQuotaErr(err):
+				mu.Lock()
+				errL = err
+				mu.Unlock()
+			case isStorageErr(err):
+				mu.Lock()
+				errL = storageErr(err)
+				mu.Unlock()
+			}
 		}(u.list[i])
 	}
 
 	wg.Wait()
+	return errL
 }
 
 // Clear deletes all temporary files.
@@ -74,29 +121,64 @@ func (u *Uploads) Clear(log *zap.Logger) {
 type FileUpload struct {
 	// ID contains filename specified by the client.
 	Name string `json:"name"`
-	// Mime contains mime-type provided by the client.
+	// Mime contains mime-type provided by the client, as it was declared. The parts without Content-Type are
+	// application/octet-stream, the same as in PHP.
 	Mime string `json:"mime"`
+	// SniffedMime is the media type detected from the file content (http.DetectContentType), empty if the detection
+	// is disabled, see config.Uploads.SniffMime. Unlike Mime, it's not under the client control.
+	SniffedMime string `json:"sniffedMime,omitempty"`
 	// Size of the uploaded file.
 	Size int64 `json:"size"`
 	// Error indicates file upload error (if any). See http://php.net/manual/en/features.file-upload.errors.php
 	Error int `json:"error"`
 	// TempFilename points to temporary file location.
 	TempFilename string `json:"tmpName"`
-	// associated file header
-	header *multipart.FileHeader
+	// Image contains the format and the dimensions of the uploaded image, nil if the file is not an image or the
+	// extraction is disabled.
+	Image *ImageInfo `json:"image,omitempty"`
+	// Metadata is the request-derived tags of the upload, see UploadMetadataExtractor.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// associated file content
+	source fileSource
 
 	// private
 	uid int
 	gid int
+	// extract the image header while the file is copied
+	imageInfo bool
+	// detect the media type while the file is copied
+	sniffMime bool
+	// temp file name pattern, empty means the default one
+	tempPattern string
+	// the temp space of the request the file is reserved in, nil means unlimited
+	space *tempSpace
+}
+
+// fileSource is the content of the uploaded file, either *multipart.FileHeader or the part read by the handler.
+type fileSource interface {
+	Open() (multipart.File, error)
 }
 
 // NewUpload wraps net/http upload into PRS-7 compatible structure.
 func NewUpload(f *multipart.FileHeader, uid, gid int) *FileUpload {
 	return &FileUpload{
 		Name:   f.Filename,
-		Mime:   f.Header.Get("Content-Type"),
+		Mime:   partMime(f.Header),
 		Error:  UploadErrorOK,
-		header: f,
+		source: f,
+		uid:    uid,
+		gid:    gid,
+	}
+}
+
+// newPartUpload wraps the file part read from the multipart body.
+func newPartUpload(f *filePart, uid, gid int) *FileUpload {
+	return &FileUpload{
+		Name:   f.filename,
+		Mime:   partMime(f.header),
+		Size:   f.size,
+		Error:  f.rejected,
+		source: f,
 		uid:    uid,
 		gid:    gid,
 	}
@@ -110,22 +192,17 @@ func NewUpload(f *multipart.FileHeader, uid, gid int) *FileUpload {
 // DEFER FILE CLOSE (2)
 // DEFER TMP CLOSE  (1)
 func (f *FileUpload) Open(dir string, forbid, allow map[string]struct{}) error {
-	ext := strings.ToLower(path.Ext(f.Name))
-
-	if _, ok := forbid[ext]; ok {
-		f.Error = UploadErrorExtension
+	// rejected before the content was read
+	if f.Error != UploadErrorOK {
 		return nil
 	}
 
-	// if allow is empty, all extensions (except forbidden) are allowed
-	if len(allow) > 0 {
-		if _, ok := allow[ext]; !ok {
-			f.Error = UploadErrorExtension
-			return nil
-		}
+	if !uploadAllowed(f.Name, forbid, allow) {
+		f.Error = UploadErrorExtension
+		return nil
 	}
 
-	file, err := f.header.Open()
+	file, err := f.source.Open()
 	if err != nil {
 		f.Error = UploadErrorNoFile
 		return err
@@ -136,7 +213,12 @@ func (f *FileUpload) Open(dir string, forbid, allow map[string]struct{}) error {
 		err = file.Close()
 	}()
 
-	tmp, err := os.CreateTemp(dir, pattern)
+	pattern := f.tempPattern
+	if pattern == "" {
+		pattern = config.DefaultTempPattern
+	}
+
+	tmp, err := createTempFile(dir, pattern)
 	if err != nil {
 		// most likely cause of this issue is missing tmp dir
 		f.Error = UploadErrorNoTmpDir
@@ -157,13 +239,87 @@ func (f *FileUpload) Open(dir string, forbid, allow map[string]struct{}) error {
 		err = tmp.Close()
 	}()
 
-	if f.Size, err = io.Copy(tmp, file); err != nil {
+	// each chunk is reserved in the temp quota before it's written
+	var dst io.Writer = tmp
+	if f.space != nil {
+		dst = &quotaWriter{w: tmp, space: f.space}
+	}
+
+	if !f.imageInfo && !f.sniffMime {
+		if f.Size, err = io.Copy(dst, file); err != nil {
+			f.Error = UploadErrorCantWrite
+		}
+
+		return writeErr(err)
+	}
+
+	br := bufio.NewReader(file)
+	if f.sniffMime {
+		head, _ := br.Peek(sniffSize)
+		f.SniffedMime = http.DetectContentType(head)
+	}
+
+	if f.imageInfo {
+		// the header is written into the temp file while being decoded
+		var written int64
+		f.Image, written, err = readImageInfo(br, dst)
+		if err != nil {
+			f.Error = UploadErrorCantWrite
+			return writeErr(err)
+		}
+
+		if f.Size, err = io.Copy(dst, br); err != nil {
+			f.Error = UploadErrorCantWrite
+		}
+
+		f.Size += written
+		return writeErr(err)
+	}
+
+	if f.Size, err = io.Copy(dst, br); err != nil {
 		f.Error = UploadErrorCantWrite
 	}
 
+	return writeErr(err)
+}
+
+// partMime is the declared content type of the multipart part, application/octet-stream if it has none.
+func partMime(header textproto.MIMEHeader) string {
+	if ct := header.Get("Content-Type"); ct != "" {
+		return ct
+	}
+
+	return "application/octet-stream"
+}
+
+// writeErr returns the temp file write failures of the storage and the temp quota, the upload keeps its error code for
+// the other ones.
+func writeErr(err error) error {
+	if isStorageErr(err) || isTempQuotaErr(err) {
+		return err
+	}
+
 	return nil
 }
 
+// uploadAllowed checks the file extension against the forbidden and allowed lists.
+func uploadAllowed(filename string, forbid, allow map[string]struct{}) bool {
+	ext := strings.ToLower(path.Ext(filename))
+
+	if _, ok := forbid[ext]; ok {
+		return false
+	}
+
+	// if allow is empty, all extensions (except forbidden) are allowed
+	if len(allow) > 0 {
+		if _, ok := allow[ext]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
 // exists if file exists.
 func exists(path string) bool {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"sort"
+	"unsafe"
+)
+
+// maxScanParams is the default net/http limit of the query parameters, the larger bodies are passed to net/url
+// which applies the configured limit.
+const maxScanParams = 10000
+
+// smallFormSize is the largest declared body size of the small forms fast path, see isSmallForm.
+const smallFormSize = 4 << 10
+
+// formPair is a key-value pair of the urlencoded form.
+type formPair struct {
+	key   string
+	value string
+	// position in the body
+	pos int
+}
+
+// formGroup is a range of the sorted pairs with the same key.
+type formGroup struct {
+	start, end int
+	// position of the first pair in the body
+	first int
+}
+
+// scanURLEncodedBody parses the urlencoded body into the data tree without copying the keys and values: they are
+// the strings backed by the body buffer, the escaped ones are decoded in place. The tree is the same as the one built
+// from url.ParseQuery, except the conflicting keys are always resolved in the body order. The invalid bodies are
+// passed to net/url to get the same error.
+func scanURLEncodedBody(r *http.Request, bm bodyMethods, phpKeys bool, maxSiblings int, np *namePattern, dl *parseDeadline) (dataTree, error) {
+	b, err := readURLEncodedBody(r, bm)
+	if err != nil {
+		return nil, err
+	}
+
+	if !validURLEncoded(b) {
+		values, errQ := url.ParseQuery(string(b))
+		if errQ != nil {
+			return nil, newParseError(ParseErrorMalformed, errQ).with(ParseErrorCodeInvalidEncoding, "")
+		}
+
+		return parsePostForm(values, phpKeys, maxSiblings, np, dl)
+	}
+
+	return pushFormPairs(scanURLEncoded(b), phpKeys, maxSiblings, np, dl)
+}
+
+// isSmallForm reports whether the urlencoded body is small enough for the fast path: the body is read into the
+// buffer of the declared size and parsed with the scanner, without building the url.Values.
+func isSmallForm(r *http.Request) bool {
+	return r.ContentLength > 0 && r.ContentLength <= smallFormSize
+}
+
+// validURLEncoded reports whether the body can be scanned, the same way url.ParseQuery validates it.
+func validURLEncoded(b []byte) bool {
+	if bytes.Count(b, []byte{'&'})+1 > maxScanParams || bytes.IndexByte(b, ';') != -1 {
+		return false
+	}
+
+	for i := 0; i < len(b); i++ {
+		if b[i] != '%' {
+			continue
+		}
+
+		if i+2 >= len(b) || !isHex(b[i+1]) || !isHex(b[i+2]) {
+			return false
+		}
+
+		i += 2
+	}
+
+	return true
+}
+
+// scanURLEncoded splits the valid body into the pairs, the body is decoded in place and must not be modified after.
+func scanURLEncoded(b []byte) []formPair {
+	pairs := make([]formPair, 0, bytes.Count(b, []byte{'&'})+1)
+
+	for len(b) > 0 {
+		var segment []byte
+		segment, b, _ = bytes.Cut(b, []byte{'&'})
+		if len(segment) == 0 {
+			continue
+		}
+
+		key, value, _ := bytes.Cut(segment, []byte{'='})
+		pairs = append(pairs, formPair{
+			key:   bytesString(unescapeInPlace(key)),
+			value: bytesString(unescapeInPlace(value)),
+			pos:   len(pairs),
+		})
+	}
+
+	return pairs
+}
+
+// pushFormPairs groups the values of the same keys, like url.Values does, and pushes them into the tree in the order
+// the keys first appear in the body. The keys not matching np are dropped or rejected.
+func pushFormPairs(pairs []formPair, phpKeys bool, maxSiblings int, np *namePattern, dl *parseDeadline) (dataTree, error) {
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].key < pairs[j].key
+	})
+
+	values := make([]string, len(pairs))
+	groups := make([]formGroup, 0, len(pairs))
+	for i := range pairs {
+		values[i] = pairs[i].value
+
+		if i > 0 && pairs[i].key == pairs[i-1].key {
+			groups[len(groups)-1].end++
+			continue
+		}
+
+		groups = append(groups, formGroup{start: i, end: i + 1, first: pairs[i].pos})
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].first < groups[j].first
+	})
+
+	data := make(dataTree, len(groups))
+	// the simple keys (most of the form fields) are mounted without splitting
+	simple := make([]string, 1)
+	for _, g := range groups {
+		err := dl.check()
+		if err != nil {
+			return nil, err
+		}
+
+		keep, err := np.keep(pairs[g.start].key)
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			continue
+		}
+
+		keys := simple
+		if k := pairs[g.start].key; isSimpleKey(k) {
+			simple[0] = k
+		} else {
+			keys = splitKey(k, phpKeys)
+		}
+
+		// limit the capacity, so the tree can't overwrite the next group
+		err = data.pushIndexes(keys, values[g.start:g.end:g.end], maxSiblings)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// unescapeInPlace decodes the validated query component into the same buffer, the decoded value is never longer.
+func unescapeInPlace(s []byte) []byte {
+	if bytes.IndexByte(s, '%') == -1 && bytes.IndexByte(s, '+') == -1 {
+		return s
+	}
+
+	j := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '%':
+			s[j] = unHex(s[i+1])<<4 | unHex(s[i+2])
+			i += 2
+		case '+':
+			s[j] = ' '
+		default:
+			s[j] = s[i]
+		}
+		j++
+	}
+
+	return s[:j]
+}
+
+// bytesString returns the string sharing the memory with the slice.
+func bytesString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+
+	return unsafe.String(unsafe.SliceData(b), len(b)) //nolint:gosec
+}
+
+func isHex(c byte) bool {
+	switch {
+	case '0' <= c && c <= '9', 'a' <= c && c <= 'f', 'A' <= c && c <= 'F':
+		return true
+	default:
+		return false
+	}
+}
+
+func unHex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
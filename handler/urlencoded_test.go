@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/roadrunner-server/http/v5/config"
+	"github.com/roadrunner-server/http/v5/handler/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestScanURLEncoded(t *testing.T) {
+	corpus := []string{
+		"",
+		"key=value",
+		"a=1&&b=2&",
+		"=value&key&empty=",
+		"arr[]=1&arr[]=2&arr[]=3",
+		"dup=1&dup=2",
+		"name=John+Doe&email=john%40example.com&pct=%25",
+		"%D0%BA%D0%BB%D1%8E%D1%87=%D0%B7%D0%BD%D0%B0%D1%87%D0%B5%D0%BD%D0%B8%D0%B5",
+		"key%5Bsub%5D=1&key[other]=2",
+		"options[0][id]=1&options[0][name]=n",
+		"a[b][c][d]=deep&a[b][e]=1",
+		"bad=%zz",
+		"short=%4",
+		"semi=1;other=2",
+		"ok=1&bad=%g1",
+	}
+
+	for i, body := range corpus {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			r := handlertest.NewRawRequest(http.MethodPost, "/", handlertest.ContentURLEncoded, []byte(body))
+			values, wantErr := readURLEncoded(r, nil)
+			var want dataTree
+			if wantErr == nil {
+				want, wantErr = parsePostForm(values, false, 0, nil, nil)
+			}
+
+			r = handlertest.NewRawRequest(http.MethodPost, "/", handlertest.ContentURLEncoded, []byte(body))
+			got, err := scanURLEncodedBody(r, nil, false, 0, nil, nil)
+			if wantErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, wantErr.Error(), err.Error())
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+// the push rules depend on the keys order, which net/url doesn't keep, so the scanner is compared with push directly
+func TestScanURLEncoded_PushCases(t *testing.T) {
+	for _, body := range []string{
+		"key[options][id]=id1&key[options][value]=value1",
+		"key[a]=&key[a][b]=v",
+		"key[a][b]=v&key[a]=",
+		"key[]=a&key[]=b&key[]=c",
+		"key=old&key=new",
+		"key=&key=new",
+		"key[a]=v&key[a][b]=w",
+		"key[a][b]=w&key[a]=v",
+	} {
+		// push gets all the values of the key at once, in the order of the keys first occurrence
+		var keys []string
+		values := make(map[string][]string)
+		for pair := range strings.SplitSeq(body, "&") {
+			k, v, _ := strings.Cut(pair, "=")
+			if _, ok := values[k]; !ok {
+				keys = append(keys, k)
+			}
+
+			values[k] = append(values[k], v)
+		}
+
+		want := make(dataTree)
+		var wantErr error
+		for _, k := range keys {
+			wantErr = want.push(k, values[k])
+			if wantErr != nil {
+				break
+			}
+		}
+
+		r := handlertest.NewRawRequest(http.MethodPost, "/", handlertest.ContentURLEncoded, []byte(body))
+		got, err := scanURLEncodedBody(r, nil, false, 0, nil, nil)
+		if wantErr != nil {
+			require.Error(t, err, body)
+			assert.Contains(t, err.Error(), wantErr.Error(), body)
+			continue
+		}
+
+		require.NoError(t, err, body)
+		assert.Equal(t, want, got, body)
+	}
+}
+
+func TestScanURLEncoded_Methods(t *testing.T) {
+	r := handlertest.NewRawRequest(http.MethodDelete, "/", handlertest.ContentURLEncoded, []byte("key=value"))
+	got, err := scanURLEncodedBody(r, nil, false, 0, nil, nil)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func BenchmarkURLEncoded(b *testing.B) {
+	form := url.Values{}
+	for i := range 200 {
+		form.Add(fmt.Sprintf("items[%d][name]", i), fmt.Sprintf("item name %d", i))
+		form.Add("tags[]", fmt.Sprintf("tag-%d", i))
+	}
+	body := []byte(form.Encode())
+
+	b.Run("net/url", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			r, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(body)) //nolint:noctx
+			values, err := readURLEncoded(r, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			_, err = parsePostForm(values, false, 0, nil, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("scanner", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			r, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(body)) //nolint:noctx
+			_, err := scanURLEncodedBody(r, nil, false, 0, nil, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRequest_ZeroCopyURLEncoded(t *testing.T) {
+	h, _ := newTestHandler(t, &config.Config{Parse: &config.Parse{ZeroCopyURLEncoded: true}})
+
+	r := handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"key": {"a b"}, "arr[]": {"1", "2"}})
+	req := newTestRequest(r)
+	require.NoError(t, h.request(r, req))
+
+	assert.True(t, req.Parsed)
+	assert.Equal(t, dataTree{"key": "a b", "arr": []string{"1", "2"}}, req.body)
+}
+
+func TestRequest_SmallURLEncoded(t *testing.T) {
+	h, _ := newTestHandler(t, &config.Config{})
+
+	for _, body := range []string{
+		"name=John+Doe&email=john%40example.com",
+		"a[b]=1&a[c][]=2&a[c][]=3&d=&d=4",
+		"a.b=1&a b=2&a]b=3",
+		"key=%zz",
+	} {
+		t.Run(body, func(t *testing.T) {
+			parse := func(contentLength int64) (any, error) {
+				r := handlertest.NewRawRequest(http.MethodPost, "/", handlertest.ContentURLEncoded, []byte(body))
+				r.ContentLength = contentLength
+				req := newTestRequest(r)
+				err := h.request(r, req)
+				return req.body, err
+			}
+
+			require.True(t, isSmallForm(handlertest.NewRawRequest(http.MethodPost, "/", handlertest.ContentURLEncoded, []byte(body))))
+			fast, errFast := parse(int64(len(body)))
+			generic, errGeneric := parse(-1)
+			assert.Equal(t, errGeneric, errFast)
+			if errFast == nil {
+				assert.Equal(t, generic, fast)
+			}
+		})
+	}
+}
+
+// the common case: a small form without files, the unknown length bodies take the generic path
+func BenchmarkRequest_SmallURLEncoded(b *testing.B) {
+	h, err := NewHandler(&config.Config{Uploads: &config.Uploads{}}, &testPool{}, zap.NewNop())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	body := []byte("name=John+Doe&email=john%40example.com&age=42&remember=1&redirect=%2Fhome")
+
+	for _, tt := range []struct {
+		name          string
+		contentLength int64
+	}{
+		{name: "fast path", contentLength: int64(len(body))},
+		{name: "generic", contentLength: -1},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				r, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(body)) //nolint:noctx
+				r.Header.Set("Content-Type", handlertest.ContentURLEncoded)
+				r.ContentLength = tt.contentLength
+
+				errR := h.request(r, newTestRequest(r))
+				if errR != nil {
+					b.Fatal(errR)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package handler
+
+import (
+	stderr "errors"
+	"net/http"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// BodyInspector is the native middleware inspecting the parsed body before it's sent to the worker. It gets the
+// read-only views of the trees, so it can't change what the worker sees. A non-nil error rejects the request, the
+// *ParseError keeps its status, any other error is rejected as the invalid fields (400).
+//
+// The inspectors run before the uploads are stored in the uploads dir, they see the declared names, types and the
+// sizes of the files, but no temp files yet. The uploads of the rejected request are never stored, and the parts
+// spilled to disk while the body was read are removed, so an inspector can accept or reject the whole form,
+// uploads included, without leaving orphan files.
+type BodyInspector interface {
+	InspectBody(r *http.Request, data DataView, files FileView) error
+}
+
+// DataView is the read-only view of the parsed data tree. The branches are DataView, the leaves are copied
+// (string, []string, or the typed JSON scalars with coerce_scalars), so the view can't be used to mutate the tree.
+type DataView struct {
+	tree dataTree
+	// the sources of the merged request params, nil when they aren't tracked
+	sources dataTree
+	// the warnings of the parse, the root view of the body only
+	warnings parseWarnings
+}
+
+// Len returns the number of the keys at this level.
+func (v DataView) Len() int {
+	return len(v.tree)
+}
+
+// Lookup returns the node at the path of the already split key ("user", "roles"), the empty path is the view itself.
+func (v DataView) Lookup(path ...string) (any, bool) {
+	node, ok := lookupNode(v.tree, path)
+	if !ok {
+		return nil, false
+	}
+
+	return v.node(path, node), true
+}
+
+// Range calls fn for each key at this level, in no particular order, until fn returns false.
+func (v DataView) Range(fn func(key string, value any) bool) {
+	for k, node := range v.tree {
+		if !fn(k, v.node([]string{k}, node)) {
+			return
+		}
+	}
+}
+
+// Source returns the source of the value at the path: the query, the body or the cookies. It's only known for the
+// leaves of the merged request params with track_sources, see ParamsInspector.
+func (v DataView) Source(path ...string) (Source, bool) {
+	tag, ok := lookupNode(v.sources, path)
+	if !ok {
+		return 0, false
+	}
+
+	s, ok := tag.(Source)
+	return s, ok
+}
+
+// node returns the view of the node at the path, the branches keep their part of the sources.
+func (v DataView) node(path []string, node any) any {
+	branch, ok := node.(dataTree)
+	if !ok || v.sources == nil {
+		return dataViewNode(node)
+	}
+
+	view := DataView{tree: branch}
+	if tags, _ := lookupNode(v.sources, path); tags != nil {
+		view.sources, _ = tags.(dataTree)
+	}
+
+	return view
+}
+
+// Warnings returns the non-fatal warnings of the parse (a skipped NDJSON line, a rewritten multipart framing), the
+// root view of the parsed body passed to the BodyInspector has them.
+func (v DataView) Warnings() []ParseWarning {
+	return append([]ParseWarning(nil), v.warnings...)
+}
+
+// Clone returns the writable deep copy of the tree, the changes of the copy are not seen by the worker.
+func (v DataView) Clone() map[string]any {
+	return cloneMap(v.tree)
+}
+
+func dataViewNode(node any) any {
+	switch actual := node.(type) {
+	case dataTree:
+		return DataView{tree: actual}
+	case []string:
+		return append([]string(nil), actual...)
+	case []any:
+		return append([]any(nil), actual...)
+	default:
+		return node
+	}
+}
+
+// FileView is the read-only view of the uploads tree. The branches are FileView, the leaves are the copies of the
+// uploads (FileUpload or []FileUpload).
+type FileView struct {
+	tree fileTree
+}
+
+// Len returns the number of the keys at this level.
+func (v FileView) Len() int {
+	return len(v.tree)
+}
+
+// Lookup returns the node at the path of the already split key, the empty path is the view itself.
+func (v FileView) Lookup(path ...string) (any, bool) {
+	node, ok := lookupNode(v.tree, path)
+	if !ok {
+		return nil, false
+	}
+
+	return fileViewNode(node), true
+}
+
+// Range calls fn for each key at this level, in no particular order, until fn returns false.
+func (v FileView) Range(fn func(key string, value any) bool) {
+	for k, node := range v.tree {
+		if !fn(k, fileViewNode(node)) {
+			return
+		}
+	}
+}
+
+// Walk calls fn for each upload of the tree with its full path, see fileTree.Walk. The uploads are the copies.
+func (v FileView) Walk(fn func(path []string, f FileUpload) bool) {
+	v.tree.Walk(func(path []string, f *FileUpload) bool {
+		return fn(path, *f)
+	})
+}
+
+// Clone returns the writable deep copy of the tree with the copies of the uploads.
+func (v FileView) Clone() map[string]any {
+	return cloneMap(v.tree)
+}
+
+func fileViewNode(node any) any {
+	switch actual := node.(type) {
+	case fileTree:
+		return FileView{tree: actual}
+	case *FileUpload:
+		return *actual
+	case []*FileUpload:
+		list := make([]FileUpload, len(actual))
+		for i := range actual {
+			list[i] = *actual[i]
+		}
+
+		return list
+	default:
+		return node
+	}
+}
+
+// cloneMap copies the tree into the plain maps, the branches become map[string]any and the leaves are copied the
+// same way the views copy them.
+func cloneMap[T dataTree | fileTree](tree T) map[string]any {
+	out := make(map[string]any, len(tree))
+	for k, node := range tree {
+		if branch, ok := node.(T); ok {
+			out[k] = cloneMap(branch)
+			continue
+		}
+
+		out[k] = dataViewNode(fileViewNode(node))
+	}
+
+	return out
+}
+
+// inspect runs the body inspectors on the parsed request.
+func (h *Handler) inspect(hr *http.Request, req *Request) error {
+	if len(h.inspectors) == 0 || !req.Parsed {
+		return nil
+	}
+
+	data, _ := req.body.(dataTree)
+	files := FileView{}
+	if req.Uploads != nil {
+		files.tree = req.Uploads.tree
+	}
+
+	for _, in := range h.inspectors {
+		err := in.InspectBody(hr, DataView{tree: data, warnings: req.warnings}, files)
+		if err != nil {
+			var pe *ParseError
+			if stderr.As(err, &pe) {
+				return err
+			}
+
+			return newParseError(ParseErrorInvalidFields, errors.E(errors.Op("inspect_body"), err))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,370 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/http/v5/config"
+	"github.com/roadrunner-server/http/v5/handler/handlertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type inspectorFunc func(r *http.Request, data DataView, files FileView) error
+
+func (f inspectorFunc) InspectBody(r *http.Request, data DataView, files FileView) error {
+	return f(r, data, files)
+}
+
+func TestHandler_BodyInspectors(t *testing.T) {
+	mp := func() *http.Request {
+		return handlertest.NewMultipart().
+			Field("name", "n").
+			Field("tags[]", "a").
+			Field("tags[]", "b").
+			Field("user[role]", "admin").
+			File("doc", "doc.txt", "text/plain", []byte("abc")).
+			Request(http.MethodPost, "/")
+	}
+
+	t.Run("read-only", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Uploads: &config.Uploads{Dir: t.TempDir()}})
+
+		var calls int
+		h.SetBodyInspectors(inspectorFunc(func(_ *http.Request, data DataView, files FileView) error {
+			calls++
+			assert.Equal(t, 3, data.Len())
+
+			role, ok := data.Lookup("user", "role")
+			require.True(t, ok)
+			assert.Equal(t, "admin", role)
+
+			_, ok = data.Lookup("user", "role", "deeper")
+			assert.False(t, ok)
+
+			user, ok := data.Lookup("user")
+			require.True(t, ok)
+			assert.IsType(t, DataView{}, user)
+
+			tags, _ := data.Lookup("tags")
+			tags.([]string)[0] = "changed"
+
+			clone := data.Clone()
+			clone["name"] = "changed"
+			clone["user"].(map[string]any)["role"] = "changed"
+
+			keys := 0
+			data.Range(func(string, any) bool {
+				keys++
+				return false
+			})
+			assert.Equal(t, 1, keys)
+
+			doc, ok := files.Lookup("doc")
+			require.True(t, ok)
+			upload := doc.(FileUpload)
+			assert.Equal(t, "doc.txt", upload.Name)
+			upload.Name = "changed.txt"
+
+			return nil
+		}), inspectorFunc(func(_ *http.Request, data DataView, _ FileView) error {
+			calls++
+			tags, _ := data.Lookup("tags")
+			assert.Equal(t, []string{"a", "b"}, tags)
+			return nil
+		}))
+
+		h.ServeHTTP(httptest.NewRecorder(), mp())
+		assert.Equal(t, 2, calls)
+		assert.JSONEq(t, `{"name":"n","tags":["a","b"],"user":{"role":"admin"}}`, string(p.pld.Body))
+		assert.Contains(t, string(p.request(t).Uploads), `"name":"doc.txt"`)
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Uploads: &config.Uploads{Dir: t.TempDir()}})
+		h.SetBodyInspectors(inspectorFunc(func(*http.Request, DataView, FileView) error {
+			return errors.Str("role is not allowed")
+		}))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, mp())
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "role is not allowed")
+		assert.Nil(t, p.pld)
+
+		h.SetBodyInspectors(inspectorFunc(func(*http.Request, DataView, FileView) error {
+			return newParseError(ParseErrorForbidden, errors.Str("forbidden"))
+		}))
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, mp())
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("rejected uploads are not stored", func(t *testing.T) {
+		// the parts over the memory limit are spilled to the system temp dir
+		spill := t.TempDir()
+		t.Setenv("TMPDIR", spill)
+
+		dir := t.TempDir()
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Uploads: &config.Uploads{Dir: dir}})
+		h.multipartOpts.maxMemory = 10
+
+		var size int64
+		h.SetBodyInspectors(inspectorFunc(func(_ *http.Request, data DataView, files FileView) error {
+			doc, ok := files.Lookup("doc")
+			require.True(t, ok)
+			upload := doc.(FileUpload)
+			assert.Empty(t, upload.TempFilename)
+			size = upload.Size
+
+			spilled, err := os.ReadDir(spill)
+			require.NoError(t, err)
+			assert.Len(t, spilled, 1)
+
+			if name, _ := data.Lookup("name"); name != "valid" {
+				return errors.Str("invalid name")
+			}
+
+			return nil
+		}))
+
+		form := func(name string) *http.Request {
+			return handlertest.NewMultipart().
+				Field("name", name).
+				File("doc", "doc.txt", "text/plain", bytes.Repeat([]byte("a"), 100)).
+				Request(http.MethodPost, "/")
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, form("invalid"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Nil(t, p.pld)
+		assert.Equal(t, int64(100), size)
+
+		for _, d := range []string{dir, spill} {
+			entries, err := os.ReadDir(d)
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+		}
+
+		h.ServeHTTP(httptest.NewRecorder(), form("valid"))
+		require.NotNil(t, p.pld)
+		assert.Contains(t, string(p.request(t).Uploads), `"size":100`)
+	})
+}
+
+type mutatorFunc func(r *http.Request, data DataEditor) error
+
+func (f mutatorFunc) MutateBody(r *http.Request, data DataEditor) error {
+	return f(r, data)
+}
+
+func TestHandler_BodyMutators(t *testing.T) {
+	form := func() *http.Request {
+		return handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"name": {"n"}, "secret": {"s"}, "user[role]": {"admin"}})
+	}
+
+	t.Run("set and delete", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true})
+		h.SetBodyMutators(mutatorFunc(func(r *http.Request, data DataEditor) error {
+			require.NoError(t, data.Set([]string{"tenant", "id"}, r.Header.Get("X-Tenant")))
+			require.NoError(t, data.Set([]string{"user", "groups", ""}, []string{"a", "b"}))
+			assert.True(t, data.Delete([]string{"secret"}))
+			assert.False(t, data.Delete([]string{"name", "deeper"}))
+
+			// the collision rules of the parsed fields
+			assert.Error(t, data.Set([]string{"name", "x"}, "v"))
+			assert.Error(t, data.Set(nil, "v"))
+			return nil
+		}), mutatorFunc(func(_ *http.Request, data DataEditor) error {
+			id, ok := data.View().Lookup("tenant", "id")
+			require.True(t, ok)
+			assert.Equal(t, "t1", id)
+			return nil
+		}))
+
+		r := form()
+		r.Header.Set("X-Tenant", "t1")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		assert.JSONEq(t, `{"name":"n","tenant":{"id":"t1"},"user":{"role":"admin","groups":["a","b"]}}`, string(p.pld.Body))
+	})
+
+	t.Run("after inspectors", func(t *testing.T) {
+		h, _ := newTestHandler(t, &config.Config{ParseErrorStatus: true})
+		h.SetBodyInspectors(inspectorFunc(func(_ *http.Request, data DataView, _ FileView) error {
+			_, ok := data.Lookup("tenant")
+			assert.False(t, ok)
+			return nil
+		}))
+		h.SetBodyMutators(mutatorFunc(func(_ *http.Request, data DataEditor) error {
+			return data.Set([]string{"tenant"}, "t1")
+		}))
+
+		h.ServeHTTP(httptest.NewRecorder(), form())
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true})
+		h.SetBodyMutators(mutatorFunc(func(*http.Request, DataEditor) error {
+			return errors.Str("unknown tenant")
+		}))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, form())
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "unknown tenant")
+		assert.Nil(t, p.pld)
+	})
+}
+
+type fieldInspectorFunc func(path []string, value string) error
+
+func (f fieldInspectorFunc) InspectField(path []string, value string) error {
+	return f(path, value)
+}
+
+func TestHandler_FieldInspectors(t *testing.T) {
+	// the encoded value is seen decoded
+	form := func() *http.Request {
+		return handlertest.NewRawRequest(http.MethodPost, "/", handlertest.ContentURLEncoded, []byte("name=n&tags[]=a&tags[]=%3Cscript%3E&user[bio]=b"))
+	}
+
+	t.Run("every value", func(t *testing.T) {
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true})
+		seen := make(map[string]string)
+		h.SetFieldInspectors(fieldInspectorFunc(func(path []string, value string) error {
+			seen[strings.Join(path, ".")] = value
+			return nil
+		}))
+		h.SetBodyMutators(mutatorFunc(func(_ *http.Request, data DataEditor) error {
+			return data.Set([]string{"tenant"}, "t1")
+		}))
+
+		h.ServeHTTP(httptest.NewRecorder(), form())
+		require.NotNil(t, p.pld)
+		assert.Equal(t, map[string]string{"name": "n", "tags.0": "a", "tags.1": "<script>", "user.bio": "b", "tenant": "t1"}, seen)
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		cfg := &config.Parse{FieldInspectStatus: http.StatusNotAcceptable}
+		require.NoError(t, cfg.InitDefaults())
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: cfg})
+		h.SetFieldInspectors(fieldInspectorFunc(func(_ []string, value string) error {
+			if strings.Contains(value, "<script") {
+				return errors.Str("xss payload")
+			}
+
+			return nil
+		}))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, form())
+		assert.Equal(t, http.StatusNotAcceptable, w.Code)
+		assert.Nil(t, p.pld)
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewURLEncodedRequest(http.MethodPost, "/", url.Values{"name": {"n"}}))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+
+	t.Run("lazy parse", func(t *testing.T) {
+		cfg := &config.Parse{
+			ContentTypes: []*config.ContentType{{Pattern: "application/json", Parser: config.ParserJSON}},
+			LazyParse:    &config.LazyParse{},
+		}
+		require.NoError(t, cfg.InitDefaults())
+		h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: cfg})
+		seen := make(map[string]string)
+		h.SetFieldInspectors(fieldInspectorFunc(func(path []string, value string) error {
+			seen[strings.Join(path, ".")] = value
+			if strings.Contains(value, "<script") {
+				return errors.Str("xss payload")
+			}
+
+			return nil
+		}))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, form())
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Nil(t, p.pld)
+		assert.Equal(t, "<script>", seen["tags.1"])
+
+		// the accepted body is still sent to the worker unparsed
+		h.ServeHTTP(httptest.NewRecorder(), handlertest.NewRawRequest(http.MethodPost, "/", "application/json", []byte(`{"a":{"b":"c"}}`)))
+		req := p.request(t)
+		assert.False(t, req.Parsed)
+		assert.Equal(t, `{"a":{"b":"c"}}`, string(p.pld.Body))
+		assert.Equal(t, "c", seen["a.b"])
+
+		// the body which can't be parsed can't be inspected
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, handlertest.NewRawRequest(http.MethodPost, "/", "application/json", []byte(`{"a":`)))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+type paramsInspectorFunc func(r *http.Request, params DataView) error
+
+func (f paramsInspectorFunc) InspectParams(r *http.Request, params DataView) error {
+	return f(r, params)
+}
+
+func TestHandler_ParamsInspectors(t *testing.T) {
+	cfg := &config.Parse{RequestOrder: "PG", TrackSources: true}
+	require.NoError(t, cfg.InitDefaults())
+	h, p := newTestHandler(t, &config.Config{ParseErrorStatus: true, Parse: cfg})
+
+	// the token must come from the body
+	h.SetParamsInspectors(paramsInspectorFunc(func(_ *http.Request, params DataView) error {
+		if _, ok := params.Lookup("token"); !ok {
+			return nil
+		}
+
+		if s, _ := params.Source("token"); s != SourceBody {
+			return errors.Errorf("token from %s", s)
+		}
+
+		return nil
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), handlertest.NewURLEncodedRequest(http.MethodPost, "/?user[id]=1", url.Values{"token": {"t"}, "user[name]": {"n"}}))
+	require.NotNil(t, p.pld)
+
+	var seen DataView
+	h.SetParamsInspectors(paramsInspectorFunc(func(_ *http.Request, params DataView) error {
+		seen = params
+		return nil
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), handlertest.NewURLEncodedRequest(http.MethodPost, "/?user[id]=1", url.Values{"user[name]": {"n"}}))
+	user, ok := seen.Lookup("user")
+	require.True(t, ok)
+	s, ok := user.(DataView).Source("id")
+	assert.True(t, ok)
+	assert.Equal(t, SourceQuery, s)
+	s, _ = seen.Source("user", "name")
+	assert.Equal(t, SourceBody, s)
+	_, ok = seen.Source("user")
+	assert.False(t, ok)
+
+	// the query (the later source) overrides the body token
+	p.pld = nil
+	h.SetParamsInspectors(paramsInspectorFunc(func(_ *http.Request, params DataView) error {
+		if s, _ := params.Source("token"); s != SourceBody {
+			return errors.Errorf("token from %s", s)
+		}
+
+		return nil
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, handlertest.NewURLEncodedRequest(http.MethodPost, "/?token=q", url.Values{"token": {"t"}}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Nil(t, p.pld)
+}
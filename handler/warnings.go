@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// ParseWarningsAttribute is the attribute with the JSON encoded list of the parse warnings, passed to the worker when
+// config.Parse.ParseWarnings is enabled and the parse produced any.
+const ParseWarningsAttribute string = "Parse-Warnings"
+
+// ParseWarningCode is the stable machine-readable code of the parse warning: the codes are never renamed or reused,
+// new codes may be added.
+type ParseWarningCode string
+
+const (
+	// ParseWarningNDJSONLineSkipped is the malformed NDJSON line skipped with ndjson_skip_malformed.
+	ParseWarningNDJSONLineSkipped ParseWarningCode = "ndjson_line_skipped"
+	// ParseWarningDuplicatePartHeader is the duplicate multipart framing header, only the first occurrence was kept
+	// with duplicate_part_headers: first.
+	ParseWarningDuplicatePartHeader ParseWarningCode = "duplicate_part_header"
+	// ParseWarningLFFraming is the multipart boundary or header line ending with LF, rewritten to CRLF with
+	// multipart_line_endings: lenient.
+	ParseWarningLFFraming ParseWarningCode = "lf_framing"
+	// ParseWarningMethodOverrideIgnored is the method override field with a method other than PUT, PATCH or DELETE.
+	ParseWarningMethodOverrideIgnored ParseWarningCode = "method_override_ignored"
+	// ParseWarningPartialUpload is the multipart body ended inside a file part, kept with partial_uploads.
+	ParseWarningPartialUpload ParseWarningCode = "partial_upload"
+	// ParseWarningCookiesTruncated is the cookies over max_cookie_count or max_cookie_bytes dropped with
+	// cookie_limit_action: truncate.
+	ParseWarningCookiesTruncated ParseWarningCode = "cookies_truncated"
+)
+
+// ParseWarning is the recoverable situation of the successful parse worth noting. Unlike the ParseError it never
+// rejects the request, the warnings are the diagnostics only.
+type ParseWarning struct {
+	Code    ParseWarningCode `json:"code"`
+	Message string           `json:"message"`
+}
+
+// parseWarnings collects the warnings along the parse path, the nil collector is empty.
+type parseWarnings []ParseWarning
+
+func (w *parseWarnings) add(code ParseWarningCode, format string, args ...any) {
+	*w = append(*w, ParseWarning{Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// setWarnings logs the warnings of the parsed request and passes them to the worker when enabled.
+func (h *Handler) setWarnings(req *Request) {
+	if req.form != nil {
+		req.warnings = append(req.warnings, req.form.warnings...)
+		req.form.warnings = nil
+	}
+
+	if len(req.warnings) == 0 {
+		return
+	}
+
+	h.logger(req).Debug("request parsed with warnings", zap.Any("warnings", []ParseWarning(req.warnings)))
+	if !h.parseWarnings {
+		return
+	}
+
+	b, err := json.Marshal(req.warnings)
+	if err != nil {
+		return
+	}
+
+	req.setAttribute(ParseWarningsAttribute, string(b))
+}
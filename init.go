@@ -96,6 +96,12 @@ func (p *Plugin) unmarshal(cfg common.Configurer) error {
 		return err
 	}
 
+	// unmarshal parse section
+	err = cfg.UnmarshalKey(sectionParse, &p.cfg.Parse)
+	if err != nil {
+		return err
+	}
+
 	// unmarshal fcgi section
 	err = cfg.UnmarshalKey(sectionFCGI, &p.cfg.FCGIConfig)
 	if err != nil {
@@ -13,7 +13,7 @@ type Informer interface {
 }
 
 func (p *Plugin) MetricsCollector() []prometheus.Collector {
-	return []prometheus.Collector{p.statsExporter}
+	return []prometheus.Collector{p.statsExporter, p.parseMetrics}
 }
 
 func newWorkersExporter(stats Informer) *StatsExporter {
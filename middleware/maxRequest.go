@@ -7,6 +7,12 @@ import (
 func MaxRequestSize(next http.Handler, maxReqSize uint64) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// validating request size
+		// the declared length is checked before the body is read, so the clients waiting for the 100 Continue
+		// (Expect: 100-continue) don't send the body at all. net/http sends 100 Continue on the first body read only.
+		if r.ContentLength > int64(maxReqSize) { //nolint:gosec
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
 
 		r2 := r.Clone(r.Context())
 		r2.Body = http.MaxBytesReader(w, r2.Body, int64(maxReqSize)) //nolint:gosec
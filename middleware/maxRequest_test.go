@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxRequestSize_ExpectContinue(t *testing.T) {
+	srv := httptest.NewServer(MaxRequestSize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		_, _ = w.Write(body)
+	}), 10))
+	defer srv.Close()
+
+	expect := func(t *testing.T, contentLength int) (*bufio.Reader, net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		require.NoError(t, err)
+
+		_, err = fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: %d\r\n\r\n", contentLength)
+		require.NoError(t, err)
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+
+		return br, conn, resp
+	}
+
+	t.Run("rejected before the body", func(t *testing.T) {
+		_, conn, resp := expect(t, 100)
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		_ = resp.Body.Close()
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		br, conn, resp := expect(t, 5)
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		require.Equal(t, http.StatusContinue, resp.StatusCode)
+
+		_, err := conn.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		resp, err = http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello", string(body))
+	})
+}
@@ -35,6 +35,7 @@ const (
 	sectionHTTP2   = "http.http2"
 	sectionFCGI    = "http.fcgi"
 	sectionUploads = "http.uploads"
+	sectionParse   = "http.parse"
 
 	// RrMode RR_HTTP env variable key (internal) if the HTTP presents
 	RrMode     = "RR_MODE"
@@ -64,8 +65,23 @@ type Plugin struct {
 	pool common.Pool
 	// servers RR handler
 	handler *handler.Handler
+	// the parse errors renderer collected from the other plugins
+	errorRenderer handler.ErrorRenderer
+	// native middleware inspecting the parsed bodies
+	bodyInspectors []handler.BodyInspector
+	// native middleware adding the derived fields to the parsed bodies
+	bodyMutators []handler.BodyMutator
+	// native middleware inspecting every parsed field value
+	fieldInspectors []handler.FieldInspector
+	// native middleware inspecting the merged request params
+	paramsInspectors []handler.ParamsInspector
+	// the uploads metadata extractor collected from the other plugins
+	uploadMetadata handler.UploadMetadataExtractor
+	// removes the orphaned upload temp files
+	tempSweeper *handler.TempSweeper
 	// metrics
 	statsExporter *StatsExporter
+	parseMetrics  *handler.Metrics
 	// servers
 	servers []servers.InternalServer[any]
 }
@@ -108,6 +124,7 @@ func (p *Plugin) Init(cfg common.Configurer, log common.Logger, srv common.Serve
 
 	// initialize statsExporter
 	p.statsExporter = newWorkersExporter(p)
+	p.parseMetrics = handler.NewMetrics(p.cfg.Parse)
 	p.server = srv
 	p.servers = make([]servers.InternalServer[any], 0, 4)
 	p.prop = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}, jprop.Jaeger{})
@@ -139,6 +156,17 @@ func (p *Plugin) Serve() chan error {
 		return errCh
 	}
 
+	p.handler.SetMetrics(p.parseMetrics)
+	p.handler.SetErrorRenderer(p.errorRenderer)
+	p.handler.SetBodyInspectors(p.bodyInspectors...)
+	p.handler.SetBodyMutators(p.bodyMutators...)
+	p.handler.SetFieldInspectors(p.fieldInspectors...)
+	p.handler.SetParamsInspectors(p.paramsInspectors...)
+	p.handler.SetUploadMetadataExtractor(p.uploadMetadata)
+
+	p.tempSweeper = handler.NewTempSweeper(p.cfg.Uploads, p.log)
+	p.tempSweeper.Start()
+
 	// initialize servers based on the configuration
 	err = p.initServers()
 	if err != nil {
@@ -171,6 +199,8 @@ func (p *Plugin) Stop(ctx context.Context) error {
 	doneCh := make(chan struct{}, 1)
 
 	go func() {
+		p.tempSweeper.Stop()
+
 		for i := range p.servers {
 			if p.servers[i] != nil {
 				p.servers[i].Stop()
@@ -272,7 +302,8 @@ func (p *Plugin) Reset() error {
 	return nil
 }
 
-// Collects collecting http middlewares
+// Collects collecting http middlewares, the parse errors renderer, the body inspectors and mutators and the uploads
+// metadata extractor
 func (p *Plugin) Collects() []*dep.In {
 	return []*dep.In{
 		dep.Fits(func(pp any) {
@@ -282,5 +313,35 @@ func (p *Plugin) Collects() []*dep.In {
 			p.mdwr[mdw.Name()] = mdw
 			p.mu.Unlock()
 		}, (*common.Middleware)(nil)),
+		dep.Fits(func(pp any) {
+			p.mu.Lock()
+			p.errorRenderer = pp.(handler.ErrorRenderer)
+			p.mu.Unlock()
+		}, (*handler.ErrorRenderer)(nil)),
+		dep.Fits(func(pp any) {
+			p.mu.Lock()
+			p.bodyInspectors = append(p.bodyInspectors, pp.(handler.BodyInspector))
+			p.mu.Unlock()
+		}, (*handler.BodyInspector)(nil)),
+		dep.Fits(func(pp any) {
+			p.mu.Lock()
+			p.bodyMutators = append(p.bodyMutators, pp.(handler.BodyMutator))
+			p.mu.Unlock()
+		}, (*handler.BodyMutator)(nil)),
+		dep.Fits(func(pp any) {
+			p.mu.Lock()
+			p.fieldInspectors = append(p.fieldInspectors, pp.(handler.FieldInspector))
+			p.mu.Unlock()
+		}, (*handler.FieldInspector)(nil)),
+		dep.Fits(func(pp any) {
+			p.mu.Lock()
+			p.paramsInspectors = append(p.paramsInspectors, pp.(handler.ParamsInspector))
+			p.mu.Unlock()
+		}, (*handler.ParamsInspector)(nil)),
+		dep.Fits(func(pp any) {
+			p.mu.Lock()
+			p.uploadMetadata = pp.(handler.UploadMetadataExtractor)
+			p.mu.Unlock()
+		}, (*handler.UploadMetadataExtractor)(nil)),
 	}
 }
@@ -13,6 +13,7 @@ import (
 
 	"github.com/roadrunner-server/errors"
 	"github.com/roadrunner-server/http/v5/config"
+	rrhandler "github.com/roadrunner-server/http/v5/handler"
 	"github.com/roadrunner-server/http/v5/middleware"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
@@ -52,6 +53,7 @@ func NewHTTPServer(handler http.Handler, cfg *config.Config, errLog *log.Logger,
 				IdleTimeout:       time.Hour,
 				ReadHeaderTimeout: time.Minute * 20,
 				ErrorLog:          errLog,
+				ConnContext:       rrhandler.ConnContext,
 			},
 		}
 	}
@@ -67,6 +69,7 @@ func NewHTTPServer(handler http.Handler, cfg *config.Config, errLog *log.Logger,
 			ReadHeaderTimeout: time.Minute * 20,
 			Handler:           handler,
 			ErrorLog:          errLog,
+			ConnContext:       rrhandler.ConnContext,
 		},
 	}
 }